@@ -0,0 +1,361 @@
+package dnsServer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/FidelityInternational/possum/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTTL       = 30
+	maxUDPMessage    = 512
+	tcpTimeout       = 10 * time.Second
+	typeA            = 1
+	typeCNAME        = 5
+	typeAAAA         = 28
+	typeANY          = 255
+	classIN          = 1
+	rcodeSuccess     = 0
+	rcodeFormatError = 1
+	rcodeServerFail  = 2
+	rcodeNotImpl     = 4
+	rcodeRefused     = 5
+)
+
+var errFormat = errors.New("malformed DNS message")
+
+// Target - the records served for a global name while a possum is alive
+type Target struct {
+	Possum string   `json:"possum"`
+	A      []string `json:"a"`
+	AAAA   []string `json:"aaaa"`
+	CNAME  string   `json:"cname"`
+}
+
+// Name - the targets for a global name, and what to answer when every possum is dead
+type Name struct {
+	Targets  []Target `json:"targets"`
+	Fallback []Target `json:"fallback"`
+}
+
+// Config - the global names possum is authoritative for
+type Config struct {
+	TTL   uint32          `json:"ttl"`
+	Names map[string]Name `json:"names"`
+}
+
+// StateSource - returns the state of every possum in the passel
+type StateSource func() (map[string]string, error)
+
+// Server - an authoritative DNS server for the configured global names
+type Server struct {
+	config Config
+	states StateSource
+}
+
+// LoadConfig - parses and validates a JSON DNS configuration
+func LoadConfig(data []byte) (Config, error) {
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Config{}, err
+	}
+	if config.TTL == 0 {
+		config.TTL = defaultTTL
+	}
+	names := make(map[string]Name)
+	for name, records := range config.Names {
+		if len(records.Targets) == 0 {
+			return Config{}, fmt.Errorf("%s has no targets", name)
+		}
+		for _, target := range append(append([]Target{}, records.Targets...), records.Fallback...) {
+			if err := validateTarget(target); err != nil {
+				return Config{}, fmt.Errorf("%s: %s", name, err)
+			}
+		}
+		names[canonicalName(name)] = records
+	}
+	config.Names = names
+	return config, nil
+}
+
+func validateTarget(target Target) error {
+	for _, address := range target.A {
+		if ip := net.ParseIP(address); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("%q is not an IPv4 address", address)
+		}
+	}
+	for _, address := range target.AAAA {
+		if ip := net.ParseIP(address); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("%q is not an IPv6 address", address)
+		}
+	}
+	if target.CNAME != "" && (len(target.A) > 0 || len(target.AAAA) > 0) {
+		return fmt.Errorf("target for %s cannot have a cname and addresses", target.Possum)
+	}
+	if target.CNAME == "" && len(target.A) == 0 && len(target.AAAA) == 0 {
+		return fmt.Errorf("target for %s has no a, aaaa or cname records", target.Possum)
+	}
+	if target.CNAME != "" {
+		if err := validateName(target.CNAME); err != nil {
+			return fmt.Errorf("cname of %s %s", target.Possum, err)
+		}
+	}
+	return nil
+}
+
+// validateName - checks a name can be encoded by encodeName, every label must have
+// between 1 and 63 bytes and the whole name at most 255
+func validateName(name string) error {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return fmt.Errorf("%q has a label that is empty or longer than 63 bytes", name)
+		}
+	}
+	if len(encodeName(name)) > 255 {
+		return fmt.Errorf("%q is longer than 255 bytes", name)
+	}
+	return nil
+}
+
+// NewServer - returns a DNS server answering from config with the states from states
+func NewServer(config Config, states StateSource) *Server {
+	return &Server{config: config, states: states}
+}
+
+// ServeUDP - answers DNS queries on conn until it is closed
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	buffer := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		response := s.Answer(buffer[:n])
+		if response == nil {
+			continue
+		}
+		if len(response) > maxUDPMessage {
+			response = truncate(response)
+		}
+		if _, err := conn.WriteTo(response, addr); err != nil {
+			log.WithFields(log.Fields{"package": "dnsServer", "function": "ServeUDP"}).Debugf("Can't reply to %s: %s", addr, err)
+		}
+	}
+}
+
+// ServeTCP - answers DNS queries on connections accepted from listener until it is closed
+func (s *Server) ServeTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveTCPConn(conn)
+	}
+}
+
+func (s *Server) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(tcpTimeout))
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		response := s.Answer(query)
+		if response == nil {
+			return
+		}
+		if err := binary.Write(conn, binary.BigEndian, uint16(len(response))); err != nil {
+			return
+		}
+		if _, err := conn.Write(response); err != nil {
+			return
+		}
+	}
+}
+
+type question struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	raw    []byte
+}
+
+// Answer - returns the response to a DNS query, or nil if the query should be ignored
+func (s *Server) Answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	id := binary.BigEndian.Uint16(query[0:2])
+	flags := binary.BigEndian.Uint16(query[2:4])
+	if flags&0x8000 != 0 {
+		// a response, not a query
+		return nil
+	}
+	opcode := (flags >> 11) & 0xF
+	if opcode != 0 {
+		return header(id, flags, rcodeNotImpl, nil, 0)
+	}
+	if binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return header(id, flags, rcodeFormatError, nil, 0)
+	}
+	q, err := parseQuestion(query[12:])
+	if err != nil {
+		return header(id, flags, rcodeFormatError, nil, 0)
+	}
+	records, ok := s.config.Names[q.name]
+	if !ok || q.qclass != classIN {
+		return header(id, flags, rcodeRefused, q.raw, 0)
+	}
+	states, err := s.states()
+	if err != nil {
+		log.WithFields(log.Fields{"package": "dnsServer", "function": "Answer", "name": q.name}).Debugf("Can't get passel state: %s", err)
+		return header(id, flags, rcodeServerFail, q.raw, 0)
+	}
+	answers := s.answers(q.qtype, aliveTargets(records, states))
+	response := header(id, flags, rcodeSuccess, q.raw, len(answers))
+	for _, answer := range answers {
+		response = append(response, answer...)
+	}
+	return response
+}
+
+// aliveTargets - the targets of the possums that are alive, matched by normalised URI as
+// the passel may name a possum differently from the DNS config
+func aliveTargets(records Name, states map[string]string) []Target {
+	alivePossums := make(map[string]bool, len(states))
+	for possum, state := range states {
+		if state == "alive" {
+			alivePossums[utils.NormalisePossumURI(possum)] = true
+		}
+	}
+	var alive []Target
+	for _, target := range records.Targets {
+		if alivePossums[utils.NormalisePossumURI(target.Possum)] {
+			alive = append(alive, target)
+		}
+	}
+	if len(alive) > 0 {
+		return alive
+	}
+	if len(records.Fallback) > 0 {
+		return records.Fallback
+	}
+	return records.Targets
+}
+
+func (s *Server) answers(qtype uint16, targets []Target) [][]byte {
+	var answers [][]byte
+	for _, target := range targets {
+		if qtype == typeA || qtype == typeANY {
+			for _, address := range target.A {
+				answers = append(answers, resourceRecord(typeA, s.config.TTL, net.ParseIP(address).To4()))
+			}
+		}
+		if qtype == typeAAAA || qtype == typeANY {
+			for _, address := range target.AAAA {
+				answers = append(answers, resourceRecord(typeAAAA, s.config.TTL, net.ParseIP(address).To16()))
+			}
+		}
+	}
+	if len(answers) > 0 || qtype == typeCNAME && len(targets) == 0 {
+		return answers
+	}
+	// a name can only have a single CNAME, so the first alive target with one wins
+	for _, target := range targets {
+		if target.CNAME != "" {
+			return [][]byte{resourceRecord(typeCNAME, s.config.TTL, encodeName(target.CNAME))}
+		}
+	}
+	return nil
+}
+
+func parseQuestion(data []byte) (question, error) {
+	var labels []string
+	offset := 0
+	for {
+		if offset >= len(data) {
+			return question{}, errFormat
+		}
+		length := int(data[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		if length > 63 || offset+length > len(data) {
+			return question{}, errFormat
+		}
+		labels = append(labels, string(data[offset:offset+length]))
+		offset += length
+	}
+	if offset+4 > len(data) {
+		return question{}, errFormat
+	}
+	return question{
+		name:   canonicalName(strings.Join(labels, ".")),
+		qtype:  binary.BigEndian.Uint16(data[offset : offset+2]),
+		qclass: binary.BigEndian.Uint16(data[offset+2 : offset+4]),
+		raw:    data[:offset+4],
+	}, nil
+}
+
+func header(id uint16, queryFlags uint16, rcode uint16, rawQuestion []byte, answers int) []byte {
+	// QR, AA, the query's opcode and RD, and the response code
+	flags := uint16(0x8000) | queryFlags&0x7900 | 0x0400 | rcode
+	message := make([]byte, 12, 12+len(rawQuestion))
+	binary.BigEndian.PutUint16(message[0:2], id)
+	binary.BigEndian.PutUint16(message[2:4], flags)
+	if rawQuestion != nil {
+		binary.BigEndian.PutUint16(message[4:6], 1)
+	}
+	binary.BigEndian.PutUint16(message[6:8], uint16(answers))
+	return append(message, rawQuestion...)
+}
+
+func resourceRecord(rrtype uint16, ttl uint32, data []byte) []byte {
+	// the owner name is always the question name, found at offset 12
+	record := []byte{0xC0, 0x0C, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(record[2:4], rrtype)
+	binary.BigEndian.PutUint16(record[4:6], classIN)
+	binary.BigEndian.PutUint32(record[6:10], ttl)
+	binary.BigEndian.PutUint16(record[10:12], uint16(len(data)))
+	return append(record, data...)
+}
+
+func encodeName(name string) []byte {
+	var encoded []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+	return append(encoded, 0)
+}
+
+// truncate - drops the answers from a response that is too large for UDP and sets TC
+func truncate(response []byte) []byte {
+	q, err := parseQuestion(response[12:])
+	if err != nil {
+		return response[:12]
+	}
+	truncated := append([]byte{}, response[:12+len(q.raw)]...)
+	truncated[2] |= 0x02
+	binary.BigEndian.PutUint16(truncated[6:8], 0)
+	return truncated
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,13 @@
+package dnsServer_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestDNSServer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "DNS Server test suite")
+}
@@ -0,0 +1,301 @@
+package dnsServer_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/FidelityInternational/possum/dns_server"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const testConfig = `{
+  "ttl": 5,
+  "names": {
+    "app.global.example.com.": {
+      "targets": [
+        {"possum": "possum1", "a": ["10.0.0.1"], "aaaa": ["fd00::1"]},
+        {"possum": "possum2", "a": ["10.0.0.2", "10.0.0.3"]}
+      ],
+      "fallback": [
+        {"possum": "maintenance", "a": ["10.9.9.9"]}
+      ]
+    },
+    "Alias.Global.Example.com": {
+      "targets": [
+        {"possum": "possum1", "cname": "lb.foundation1.example.com"},
+        {"possum": "possum2", "cname": "lb.foundation2.example.com"}
+      ]
+    }
+  }
+}`
+
+func lookupIPs(resolver *net.Resolver, name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addresses, err := resolver.LookupIPAddr(ctx, name)
+	var ips []string
+	for _, address := range addresses {
+		ips = append(ips, address.IP.String())
+	}
+	sort.Strings(ips)
+	return ips, err
+}
+
+var _ = Describe("#LoadConfig", func() {
+	It("defaults the ttl", func() {
+		config, err := LoadConfig([]byte(`{"names": {"a.example.com": {"targets": [{"possum": "p", "a": ["10.0.0.1"]}]}}}`))
+		Ω(err).Should(BeNil())
+		Ω(config.TTL).Should(Equal(uint32(30)))
+	})
+
+	It("canonicalises names", func() {
+		config, err := LoadConfig([]byte(testConfig))
+		Ω(err).Should(BeNil())
+		Ω(config.Names).Should(HaveKey("app.global.example.com"))
+		Ω(config.Names).Should(HaveKey("alias.global.example.com"))
+	})
+
+	Context("when the config is invalid", func() {
+		It("rejects invalid JSON", func() {
+			_, err := LoadConfig([]byte(`{`))
+			Ω(err).ShouldNot(BeNil())
+		})
+
+		It("rejects a name without targets", func() {
+			_, err := LoadConfig([]byte(`{"names": {"a.example.com": {}}}`))
+			Ω(err).Should(MatchError("a.example.com has no targets"))
+		})
+
+		It("rejects an IPv6 address in a", func() {
+			_, err := LoadConfig([]byte(`{"names": {"a.example.com": {"targets": [{"possum": "p", "a": ["fd00::1"]}]}}}`))
+			Ω(err).Should(MatchError(`a.example.com: "fd00::1" is not an IPv4 address`))
+		})
+
+		It("rejects an IPv4 address in aaaa", func() {
+			_, err := LoadConfig([]byte(`{"names": {"a.example.com": {"targets": [{"possum": "p", "aaaa": ["10.0.0.1"]}]}}}`))
+			Ω(err).Should(MatchError(`a.example.com: "10.0.0.1" is not an IPv6 address`))
+		})
+
+		It("rejects a target with a cname and addresses", func() {
+			_, err := LoadConfig([]byte(`{"names": {"a.example.com": {"targets": [{"possum": "p", "cname": "b.example.com", "a": ["10.0.0.1"]}]}}}`))
+			Ω(err).Should(MatchError("a.example.com: target for p cannot have a cname and addresses"))
+		})
+
+		It("rejects a target without records", func() {
+			_, err := LoadConfig([]byte(`{"names": {"a.example.com": {"targets": [{"possum": "p"}]}}}`))
+			Ω(err).Should(MatchError("a.example.com: target for p has no a, aaaa or cname records"))
+		})
+
+		It("rejects a fallback without records", func() {
+			_, err := LoadConfig([]byte(`{"names": {"a.example.com": {"targets": [{"possum": "p", "a": ["10.0.0.1"]}], "fallback": [{"possum": "maintenance"}]}}}`))
+			Ω(err).Should(MatchError("a.example.com: target for maintenance has no a, aaaa or cname records"))
+		})
+
+		It("rejects a cname with a label longer than 63 bytes", func() {
+			cname := strings.Repeat("x", 64) + ".example.com"
+			_, err := LoadConfig([]byte(fmt.Sprintf(`{"names": {"a.example.com": {"targets": [{"possum": "p", "cname": "%s"}]}}}`, cname)))
+			Ω(err).Should(MatchError(fmt.Sprintf(`a.example.com: cname of p "%s" has a label that is empty or longer than 63 bytes`, cname)))
+		})
+
+		It("rejects a cname with an empty label", func() {
+			_, err := LoadConfig([]byte(`{"names": {"a.example.com": {"targets": [{"possum": "p", "cname": "lb..example.com"}]}}}`))
+			Ω(err).Should(MatchError(`a.example.com: cname of p "lb..example.com" has a label that is empty or longer than 63 bytes`))
+		})
+
+		It("rejects a cname longer than 255 bytes", func() {
+			cname := strings.TrimSuffix(strings.Repeat(strings.Repeat("x", 63)+".", 4), ".")
+			_, err := LoadConfig([]byte(fmt.Sprintf(`{"names": {"a.example.com": {"targets": [{"possum": "p", "cname": "%s"}]}}}`, cname)))
+			Ω(err).Should(MatchError(fmt.Sprintf(`a.example.com: cname of p "%s" is longer than 255 bytes`, cname)))
+		})
+	})
+})
+
+var _ = Describe("Server", func() {
+	var (
+		states    map[string]string
+		statesErr error
+		conn      net.PacketConn
+		listener  net.Listener
+		resolver  *net.Resolver
+	)
+
+	BeforeEach(func() {
+		states = map[string]string{"possum1": "alive", "possum2": "alive"}
+		statesErr = nil
+		config, err := LoadConfig([]byte(testConfig))
+		Ω(err).Should(BeNil())
+		server := NewServer(config, func() (map[string]string, error) {
+			return states, statesErr
+		})
+
+		conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+		Ω(err).Should(BeNil())
+		listener, err = net.Listen("tcp", conn.LocalAddr().String())
+		Ω(err).Should(BeNil())
+		go server.ServeUDP(conn)
+		go server.ServeTCP(listener)
+
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, conn.LocalAddr().String())
+			},
+		}
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		listener.Close()
+	})
+
+	Context("when every possum is alive", func() {
+		It("answers with the addresses of every foundation", func() {
+			ips, err := lookupIPs(resolver, "app.global.example.com")
+			Ω(err).Should(BeNil())
+			Ω(ips).Should(Equal([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "fd00::1"}))
+		})
+
+		It("answers case insensitively", func() {
+			ips, err := lookupIPs(resolver, "APP.Global.example.com.")
+			Ω(err).Should(BeNil())
+			Ω(ips).Should(HaveLen(4))
+		})
+
+		It("answers with the cname of the first foundation", func() {
+			cname, err := resolver.LookupCNAME(context.Background(), "alias.global.example.com")
+			Ω(err).Should(BeNil())
+			Ω(cname).Should(Equal("lb.foundation1.example.com."))
+		})
+	})
+
+	Context("when a possum is dead", func() {
+		BeforeEach(func() {
+			states["possum1"] = "dead"
+		})
+
+		It("only answers with the addresses of the alive foundations", func() {
+			ips, err := lookupIPs(resolver, "app.global.example.com")
+			Ω(err).Should(BeNil())
+			Ω(ips).Should(Equal([]string{"10.0.0.2", "10.0.0.3"}))
+		})
+
+		It("answers with the cname of an alive foundation", func() {
+			cname, err := resolver.LookupCNAME(context.Background(), "alias.global.example.com")
+			Ω(err).Should(BeNil())
+			Ω(cname).Should(Equal("lb.foundation2.example.com."))
+		})
+	})
+
+	Context("when the passel names a possum differently from the config", func() {
+		BeforeEach(func() {
+			states = map[string]string{"POSSUM1.": "dead", "possum2/": "alive"}
+		})
+
+		It("matches the possums by normalised URI", func() {
+			ips, err := lookupIPs(resolver, "app.global.example.com")
+			Ω(err).Should(BeNil())
+			Ω(ips).Should(Equal([]string{"10.0.0.2", "10.0.0.3"}))
+		})
+	})
+
+	Context("when every possum is dead", func() {
+		BeforeEach(func() {
+			states = map[string]string{"possum1": "dead", "possum2": "dead"}
+		})
+
+		It("answers with the fallback addresses", func() {
+			ips, err := lookupIPs(resolver, "app.global.example.com")
+			Ω(err).Should(BeNil())
+			Ω(ips).Should(Equal([]string{"10.9.9.9"}))
+		})
+
+		It("answers with every target when there is no fallback", func() {
+			cname, err := resolver.LookupCNAME(context.Background(), "alias.global.example.com")
+			Ω(err).Should(BeNil())
+			Ω(cname).Should(Equal("lb.foundation1.example.com."))
+		})
+	})
+
+	Context("when the passel state cannot be read", func() {
+		BeforeEach(func() {
+			statesErr = errors.New("db is down")
+		})
+
+		It("fails the lookup", func() {
+			_, err := lookupIPs(resolver, "app.global.example.com")
+			Ω(err).ShouldNot(BeNil())
+		})
+	})
+
+	Context("when the name is not configured", func() {
+		It("fails the lookup", func() {
+			_, err := lookupIPs(resolver, "other.example.com")
+			Ω(err).ShouldNot(BeNil())
+		})
+	})
+
+	Context("when queried over TCP", func() {
+		BeforeEach(func() {
+			resolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "tcp", listener.Addr().String())
+			}
+		})
+
+		It("answers with the addresses of every foundation", func() {
+			ips, err := lookupIPs(resolver, "app.global.example.com")
+			Ω(err).Should(BeNil())
+			Ω(ips).Should(HaveLen(4))
+		})
+	})
+})
+
+var _ = Describe("#Answer", func() {
+	var server *Server
+
+	BeforeEach(func() {
+		config, err := LoadConfig([]byte(testConfig))
+		Ω(err).Should(BeNil())
+		server = NewServer(config, func() (map[string]string, error) {
+			return map[string]string{"possum1": "alive"}, nil
+		})
+	})
+
+	It("ignores messages too short to be queries", func() {
+		Ω(server.Answer([]byte{0, 1, 2})).Should(BeNil())
+	})
+
+	It("ignores responses", func() {
+		Ω(server.Answer([]byte{0, 1, 0x80, 0, 0, 1, 0, 0, 0, 0, 0, 0})).Should(BeNil())
+	})
+
+	It("answers a malformed question with FORMERR", func() {
+		response := server.Answer([]byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 5, 'a'})
+		Ω(response[3] & 0x0F).Should(Equal(byte(1)))
+	})
+
+	It("answers other opcodes with NOTIMP", func() {
+		response := server.Answer([]byte{0, 1, 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+		Ω(response[3] & 0x0F).Should(Equal(byte(4)))
+	})
+
+	It("answers authoritatively with the configured ttl", func() {
+		query := []byte{0xAB, 0xCD, 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+		query = append(query, 3, 'a', 'p', 'p', 6, 'g', 'l', 'o', 'b', 'a', 'l', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1)
+		response := server.Answer(query)
+		Ω(response[0:2]).Should(Equal([]byte{0xAB, 0xCD}))
+		Ω(response[2]).Should(Equal(byte(0x85)))
+		Ω(response[3] & 0x0F).Should(Equal(byte(0)))
+		Ω(response[6:8]).Should(Equal([]byte{0, 1}))
+		answer := response[len(query):]
+		Ω(answer[6:10]).Should(Equal([]byte{0, 0, 0, 5}))
+		Ω(answer[12:]).Should(Equal([]byte{10, 0, 0, 1}))
+	})
+})
@@ -1,13 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	dnss "github.com/FidelityInternational/possum/dns_server"
+	"github.com/FidelityInternational/possum/tracing"
+	"github.com/FidelityInternational/possum/utils"
 	webs "github.com/FidelityInternational/possum/web_server"
 )
 
@@ -15,13 +26,53 @@ func main() {
 	if os.Getenv("DEBUG") == "true" {
 		log.SetLevel(log.DebugLevel)
 	}
+	webs.ConfigureLogging()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		exportSnapshot(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		importSnapshot(os.Args[2:])
+		return
+	}
+	startTracing()
 	server, err := webs.CreateServer(dbConn, webs.CreateController)
 	if err != nil {
 		log.WithFields(log.Fields{"package": "main", "function": "main"}).Fatalf("Error creating server [%s]", err.Error())
 	}
 
+	if passelConfigFile := os.Getenv("PASSEL_CONFIG_FILE"); passelConfigFile != "" {
+		startReloader(server, passelConfigFile)
+	}
+
+	if discoveryConfig := os.Getenv("PASSEL_DISCOVERY"); discoveryConfig != "" {
+		if os.Getenv("PASSEL_CONFIG_FILE") != "" {
+			log.WithFields(log.Fields{"package": "main", "function": "main"}).Fatal("PASSEL_DISCOVERY and PASSEL_CONFIG_FILE cannot both be set")
+		}
+		startDiscovery(server, discoveryConfig)
+	}
+
+	if probeConfig := os.Getenv("PROBE_CONFIG"); probeConfig != "" {
+		startProbe(server, probeConfig)
+	}
+
+	go server.Controller.RunCatchUp(make(chan struct{}))
+
 	router := server.Start()
 	http.Handle("/", router)
+
+	if agentCheckPort := os.Getenv("AGENT_CHECK_PORT"); agentCheckPort != "" {
+		startAgentCheck(server, agentCheckPort)
+	}
+
+	if dnsPort := os.Getenv("DNS_PORT"); dnsPort != "" {
+		startDNS(server, dnsPort)
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		log.WithFields(log.Fields{"package": "main", "function": "main"}).Fatal("PORT not set. Exiting.")
@@ -38,3 +89,210 @@ func dbConn(driverName string, connectionString string) (*sql.DB, error) {
 	db, err := sql.Open(driverName, connectionString)
 	return db, err
 }
+
+// migrate - "possum migrate status" prints the schema version and pending migrations,
+// "possum migrate up" applies them without starting the server
+func migrate(args []string) {
+	if len(args) != 1 || (args[0] != "status" && args[0] != "up") {
+		fmt.Fprintln(os.Stderr, "usage: possum migrate status|up")
+		os.Exit(2)
+	}
+	db, err := webs.OpenDB(dbConn)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "migrate"}).Fatal(err)
+	}
+	defer db.Close()
+	var status utils.MigrationStatus
+	if args[0] == "up" {
+		status, err = utils.Migrate(db)
+	} else {
+		status, err = utils.GetMigrationStatus(db)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "migrate"}).Fatal(err)
+	}
+	fmt.Printf("Schema version: %d\n", status.CurrentVersion)
+	fmt.Printf("Latest version: %d\n", status.LatestVersion)
+	if status.CurrentVersion > status.LatestVersion {
+		fmt.Println("The database schema is newer than this possum understands")
+	}
+	for _, migration := range status.Pending {
+		fmt.Printf("Pending: %d %s\n", migration.Version, migration.Description)
+	}
+}
+
+// exportSnapshot - "possum export" saves a signed snapshot of the state of a possum to a file
+func exportSnapshot(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	url := flags.String("url", os.Getenv("POSSUM_URL"), "the possum to export from, defaults to POSSUM_URL")
+	output := flags.String("o", "", "the file to save the snapshot to, defaults to standard output")
+	flags.Parse(args)
+	if *url == "" || flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: possum export [-url URL] [-o FILE]")
+		os.Exit(2)
+	}
+	snapshot, err := possumRequest("GET", *url+"/v1/export", nil)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "exportSnapshot"}).Fatal(err)
+	}
+	if *output == "" {
+		fmt.Println(string(snapshot))
+		return
+	}
+	if err := ioutil.WriteFile(*output, snapshot, 0600); err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "exportSnapshot"}).Fatal(err)
+	}
+}
+
+// importSnapshot - "possum import" imports a snapshot saved by "possum export" into a possum
+func importSnapshot(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	url := flags.String("url", os.Getenv("POSSUM_URL"), "the possum to import into, defaults to POSSUM_URL")
+	dryRun := flags.Bool("dry-run", false, "check the snapshot and show what would change without importing it")
+	force := flags.Bool("force", false, "import even if the snapshot does not match the state of the other possums")
+	flags.Parse(args)
+	if *url == "" || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: possum import [-url URL] [-dry-run] [-force] FILE")
+		os.Exit(2)
+	}
+	snapshot, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "importSnapshot"}).Fatal(err)
+	}
+	body, err := json.Marshal(struct {
+		Snapshot json.RawMessage `json:"snapshot"`
+		DryRun   bool            `json:"dry_run,omitempty"`
+		Force    bool            `json:"force,omitempty"`
+	}{snapshot, *dryRun, *force})
+	if err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "importSnapshot"}).Fatalf("%s is not a snapshot: %s", flags.Arg(0), err)
+	}
+	result, err := possumRequest("POST", *url+"/v1/import", body)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "importSnapshot"}).Fatal(err)
+	}
+	fmt.Println(string(result))
+}
+
+// possumRequest - makes a request to a possum with the POSSUM_USERNAME and POSSUM_PASSWORD credentials,
+// returning the response body or an error with it if the possum did not accept the request
+func possumRequest(method string, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(os.Getenv("POSSUM_USERNAME"), os.Getenv("POSSUM_PASSWORD"))
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s %s failed: %d %s", method, url, resp.StatusCode, string(data))
+	}
+	return data, nil
+}
+
+func startTracing() {
+	tracer, err := tracing.FromEnv()
+	if err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "startTracing"}).Fatalf("Tracing is misconfigured: %s", err)
+	}
+	if tracer == nil {
+		return
+	}
+	tracing.SetTracer(tracer)
+	log.WithFields(log.Fields{"package": "main", "function": "startTracing"}).Infof("Exporting traces with the %s exporter", os.Getenv("TRACING_EXPORTER"))
+	go tracer.Run(make(chan struct{}))
+}
+
+func startAgentCheck(server *webs.Server, port string) {
+	config, err := webs.LoadAgentCheckConfig()
+	if err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "startAgentCheck"}).Fatal(err)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	if err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "startAgentCheck"}).Fatal(err)
+	}
+	log.WithFields(log.Fields{"package": "main", "function": "startAgentCheck"}).Infof("Answering HAProxy agent-checks on port: %s", port)
+	go func() {
+		err := server.Controller.ServeAgentCheck(listener, config)
+		log.WithFields(log.Fields{"package": "main", "function": "startAgentCheck"}).Fatal(err)
+	}()
+}
+
+func startDNS(server *webs.Server, port string) {
+	config, err := dnss.LoadConfig([]byte(os.Getenv("DNS_CONFIG")))
+	if err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "startDNS"}).Fatalf("DNS_CONFIG is invalid: %s", err)
+	}
+	dnsServer := dnss.NewServer(config, func() (map[string]string, error) {
+		passel, err := utils.GetPassel()
+		if err != nil {
+			return nil, err
+		}
+		return server.Controller.CachedPasselState(passel)
+	})
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%s", port))
+	if err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "startDNS"}).Fatal(err)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	if err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "startDNS"}).Fatal(err)
+	}
+	log.WithFields(log.Fields{"package": "main", "function": "startDNS"}).Infof("Answering DNS queries on port: %s", port)
+	go func() {
+		err := dnsServer.ServeUDP(conn)
+		log.WithFields(log.Fields{"package": "main", "function": "startDNS"}).Fatal(err)
+	}()
+	go func() {
+		err := dnsServer.ServeTCP(listener)
+		log.WithFields(log.Fields{"package": "main", "function": "startDNS"}).Fatal(err)
+	}()
+}
+
+func startProbe(server *webs.Server, probeConfig string) {
+	config, err := webs.LoadProbeConfig([]byte(probeConfig))
+	if err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "startProbe"}).Fatalf("PROBE_CONFIG is invalid: %s", err)
+	}
+	server.Controller.Prober = webs.NewProber(server.Controller, config)
+	log.WithFields(log.Fields{"package": "main", "function": "startProbe"}).Infof("Probing %d foundations every %d seconds", len(config.Foundations), config.IntervalSeconds)
+	go server.Controller.Prober.Run(make(chan struct{}))
+}
+
+func startDiscovery(server *webs.Server, discoveryConfig string) {
+	config, err := webs.LoadDiscoveryConfig([]byte(discoveryConfig))
+	if err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "startDiscovery"}).Fatalf("PASSEL_DISCOVERY is invalid: %s", err)
+	}
+	server.Controller.Discoverer = webs.NewDiscoverer(server.Controller.DB, config)
+	log.WithFields(log.Fields{"package": "main", "function": "startDiscovery"}).Infof("Discovering the passel with %s every %d seconds", config.Mode, config.IntervalSeconds)
+	go server.Controller.Discoverer.Run(make(chan struct{}))
+}
+
+func startReloader(server *webs.Server, path string) {
+	server.Controller.Reloader = webs.NewReloader(server.Controller.DB, path)
+	if _, err := server.Controller.Reloader.Reload(); err != nil {
+		log.WithFields(log.Fields{"package": "main", "function": "startReloader"}).Fatal(err)
+	}
+	log.WithFields(log.Fields{"package": "main", "function": "startReloader"}).Infof("Reloading the passel config from %s when it changes or on SIGHUP", path)
+	go server.Controller.Reloader.Watch(make(chan struct{}), 5*time.Second)
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			if _, err := server.Controller.Reloader.Reload(); err != nil {
+				log.WithFields(log.Fields{"package": "main", "function": "startReloader"}).Warnf("Keeping the current passel config: %s", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,273 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultServiceName  = "possum"
+	defaultOTLPEndpoint = "http://localhost:4318"
+	otlpTimeout         = 10 * time.Second
+)
+
+// WriterExporter - writes spans as JSON lines, one span per line
+type WriterExporter struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+// NewWriterExporter - creates an exporter writing spans to writer
+func NewWriterExporter(writer io.Writer) *WriterExporter {
+	return &WriterExporter{writer: writer}
+}
+
+// NewFileExporter - creates an exporter appending spans to the file at path
+func NewFileExporter(path string) (*WriterExporter, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterExporter(file), nil
+}
+
+// Export - writes the spans
+func (e *WriterExporter) Export(spans []SpanData) error {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, span := range spans {
+		if err := encoder.Encode(span); err != nil {
+			return err
+		}
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, err := e.writer.Write(buffer.Bytes())
+	return err
+}
+
+// OTLPExporter - sends spans to an OpenTelemetry collector with OTLP over HTTP, JSON encoded
+type OTLPExporter struct {
+	URL        string
+	Headers    map[string]string
+	HTTPClient *http.Client
+}
+
+// NewOTLPExporter - creates an exporter sending spans to the collector at url, the full URL of its traces endpoint
+func NewOTLPExporter(url string, headers map[string]string) *OTLPExporter {
+	return &OTLPExporter{
+		URL:        url,
+		Headers:    headers,
+		HTTPClient: &http.Client{Timeout: otlpTimeout},
+	}
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// OTLP span kinds and status codes
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpKindClient   = 3
+	otlpStatusError  = 2
+)
+
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		// 64 bit integers are strings in the JSON encoding of OTLP
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func otlpKind(kind string) int {
+	switch kind {
+	case KindServer:
+		return otlpKindServer
+	case KindClient:
+		return otlpKindClient
+	default:
+		return otlpKindInternal
+	}
+}
+
+// otlpEncode - groups the spans by service, as OTLP expects them
+func otlpEncode(spans []SpanData) otlpRequest {
+	var request otlpRequest
+	byService := make(map[string]int)
+	for _, span := range spans {
+		index, found := byService[span.Service]
+		if !found {
+			index = len(request.ResourceSpans)
+			byService[span.Service] = index
+			request.ResourceSpans = append(request.ResourceSpans, otlpResourceSpans{
+				Resource:   otlpResource{Attributes: []otlpAttribute{{Key: "service.name", Value: otlpValue(span.Service)}}},
+				ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "possum"}}},
+			})
+		}
+		encoded := otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentSpanID,
+			Name:              span.Name,
+			Kind:              otlpKind(span.Kind),
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+		}
+		for key, value := range span.Attributes {
+			encoded.Attributes = append(encoded.Attributes, otlpAttribute{Key: key, Value: otlpValue(value)})
+		}
+		if span.Error != "" {
+			encoded.Status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+		}
+		scope := &request.ResourceSpans[index].ScopeSpans[0]
+		scope.Spans = append(scope.Spans, encoded)
+	}
+	return request
+}
+
+// Export - sends the spans to the collector
+func (e *OTLPExporter) Export(spans []SpanData) error {
+	body, err := json.Marshal(otlpEncode(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := e.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("OTLP collector %s rejected %d spans: %d %s", e.URL, len(spans), resp.StatusCode, string(data))
+	}
+	return nil
+}
+
+// parseHeaders - parses OTEL_EXPORTER_OTLP_HEADERS style "key=value,key=value" headers
+func parseHeaders(value string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS has a header without a value: %q", pair)
+		}
+		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return headers, nil
+}
+
+// FromEnv - creates the tracer configured by TRACING_EXPORTER, which is "stdout",
+// "file", writing to TRACING_FILE, or "otlp", sending to the collector at
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT. It returns
+// nil if tracing is not configured.
+func FromEnv() (*Tracer, error) {
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = defaultServiceName
+	}
+	var exporter Exporter
+	switch os.Getenv("TRACING_EXPORTER") {
+	case "", "none":
+		return nil, nil
+	case "stdout":
+		exporter = NewWriterExporter(os.Stdout)
+	case "file":
+		path := os.Getenv("TRACING_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("TRACING_FILE must be set for the file exporter")
+		}
+		fileExporter, err := NewFileExporter(path)
+		if err != nil {
+			return nil, err
+		}
+		exporter = fileExporter
+	case "otlp":
+		url := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+		if url == "" {
+			endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+			if endpoint == "" {
+				endpoint = defaultOTLPEndpoint
+			}
+			url = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+		}
+		headers, err := parseHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+		if err != nil {
+			return nil, err
+		}
+		exporter = NewOTLPExporter(url, headers)
+	default:
+		return nil, fmt.Errorf("TRACING_EXPORTER %q is not one of stdout, file or otlp", os.Getenv("TRACING_EXPORTER"))
+	}
+	return NewTracer(service, exporter), nil
+}
@@ -0,0 +1,310 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// TraceParentHeader - the W3C trace-context header carrying the trace and parent span
+	TraceParentHeader = "traceparent"
+	// TraceStateHeader - the W3C trace-context header carrying vendor state, passed on untouched
+	TraceStateHeader = "tracestate"
+
+	defaultBatchSize     = 64
+	defaultFlushInterval = time.Second
+	// spans are dropped rather than queued without limit if the exporter can't keep up
+	maxPendingSpans = 2048
+)
+
+// Kinds of span, as in OpenTelemetry
+const (
+	KindInternal = "internal"
+	KindServer   = "server"
+	KindClient   = "client"
+)
+
+var traceParent = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})(-.*)?$`)
+
+// SpanContext - identifies a span, and the trace it belongs to, across possums
+type SpanContext struct {
+	TraceID    string
+	SpanID     string
+	Sampled    bool
+	TraceState string
+}
+
+// TraceParent - the span context as a traceparent header value
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceParent - parses a traceparent header value, returning false if it is invalid
+func ParseTraceParent(value string) (SpanContext, bool) {
+	match := traceParent.FindStringSubmatch(value)
+	if match == nil {
+		return SpanContext{}, false
+	}
+	version, traceID, spanID, flags := match[1], match[2], match[3], match[4]
+	// version 00 has no further fields, later versions may add them
+	if version == "ff" || (version == "00" && match[5] != "") {
+		return SpanContext{}, false
+	}
+	if traceID == "00000000000000000000000000000000" || spanID == "0000000000000000" {
+		return SpanContext{}, false
+	}
+	flagBits, _ := hex.DecodeString(flags)
+	return SpanContext{TraceID: traceID, SpanID: spanID, Sampled: flagBits[0]&1 == 1}, true
+}
+
+// SpanData - a finished span, as handed to an exporter
+type SpanData struct {
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         string                 `json:"kind"`
+	Service      string                 `json:"service"`
+	StartTime    time.Time              `json:"start_time"`
+	EndTime      time.Time              `json:"end_time"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// Span - an operation being traced. A nil span, or one started while tracing
+// is disabled, still carries trace context to peers but is not exported.
+type Span struct {
+	mutex   sync.Mutex
+	tracer  *Tracer
+	context SpanContext
+	data    SpanData
+	ended   bool
+}
+
+// Context - the span context, to be propagated to peers
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute - records a string, bool, integer or float attribute of the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]interface{})
+	}
+	s.data.Attributes[key] = value
+}
+
+// RecordError - marks the span as failed with err, if it is not nil
+func (s *Span) RecordError(err error) {
+	if s == nil || s.tracer == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End - finishes the span and queues it for export, only the first call has any effect
+func (s *Span) End() {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.EndTime = time.Now().UTC()
+	data := s.data
+	s.mutex.Unlock()
+	s.tracer.queue(data)
+}
+
+// Exporter - sends finished spans somewhere they can be looked at
+type Exporter interface {
+	Export(spans []SpanData) error
+}
+
+// Tracer - batches finished spans and hands them to an exporter
+type Tracer struct {
+	service  string
+	exporter Exporter
+	mutex    sync.Mutex
+	pending  []SpanData
+	dropped  int
+	// exporting serialises exports so spans reach the exporter in the order they ended
+	exporting sync.Mutex
+	flush     chan struct{}
+}
+
+// NewTracer - creates a tracer exporting the spans of service, call Run to export them in the background
+func NewTracer(service string, exporter Exporter) *Tracer {
+	return &Tracer{
+		service:  service,
+		exporter: exporter,
+		flush:    make(chan struct{}, 1),
+	}
+}
+
+func (t *Tracer) queue(data SpanData) {
+	t.mutex.Lock()
+	if len(t.pending) >= maxPendingSpans {
+		t.dropped++
+		t.mutex.Unlock()
+		return
+	}
+	t.pending = append(t.pending, data)
+	full := len(t.pending) >= defaultBatchSize
+	t.mutex.Unlock()
+	if full {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Flush - exports the spans that have ended so far
+func (t *Tracer) Flush() error {
+	t.exporting.Lock()
+	defer t.exporting.Unlock()
+	t.mutex.Lock()
+	spans := t.pending
+	dropped := t.dropped
+	t.pending = nil
+	t.dropped = 0
+	t.mutex.Unlock()
+	if dropped > 0 {
+		log.WithFields(log.Fields{"package": "tracing", "function": "Flush"}).Warnf("Dropped %d spans, the exporter is not keeping up", dropped)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	return t.exporter.Export(spans)
+}
+
+// Run - exports spans every second, or sooner when a batch fills, until stop is closed
+func (t *Tracer) Run(stop chan struct{}) {
+	ticker := time.NewTicker(defaultFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			t.logFlush()
+			return
+		case <-ticker.C:
+		case <-t.flush:
+		}
+		t.logFlush()
+	}
+}
+
+func (t *Tracer) logFlush() {
+	if err := t.Flush(); err != nil {
+		log.WithFields(log.Fields{"package": "tracing", "function": "Run"}).Warnf("Can't export spans: %s", err)
+	}
+}
+
+var global atomic.Pointer[Tracer]
+
+// SetTracer - sets the tracer spans are exported by, nil disables tracing
+func SetTracer(t *Tracer) {
+	global.Store(t)
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// FromContext - returns the span in the context, or nil
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start - starts a span, the child of the span or remote parent in ctx, returning a context carrying it
+func Start(ctx context.Context, name string, kind string) (context.Context, *Span) {
+	parent, hasParent := SpanContext{}, false
+	if span := FromContext(ctx); span != nil {
+		parent, hasParent = span.context, true
+	} else if remote, found := ctx.Value(remoteKey{}).(SpanContext); found {
+		parent, hasParent = remote, true
+	}
+	span := &Span{context: SpanContext{SpanID: newID(8), Sampled: true}}
+	if hasParent {
+		span.context.TraceID = parent.TraceID
+		span.context.Sampled = parent.Sampled
+		span.context.TraceState = parent.TraceState
+	} else {
+		span.context.TraceID = newID(16)
+	}
+	if tracer := global.Load(); tracer != nil && span.context.Sampled {
+		span.tracer = tracer
+		span.data = SpanData{
+			TraceID:   span.context.TraceID,
+			SpanID:    span.context.SpanID,
+			Name:      name,
+			Kind:      kind,
+			Service:   tracer.service,
+			StartTime: time.Now().UTC(),
+		}
+		if hasParent {
+			span.data.ParentSpanID = parent.SpanID
+		}
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Extract - returns a context carrying the remote parent span sent in the headers, if there is a valid one
+func Extract(ctx context.Context, header http.Header) context.Context {
+	remote, valid := ParseTraceParent(header.Get(TraceParentHeader))
+	if !valid {
+		return ctx
+	}
+	remote.TraceState = header.Get(TraceStateHeader)
+	return context.WithValue(ctx, remoteKey{}, remote)
+}
+
+// Inject - sets the trace-context headers for the span in ctx, if there is one
+func Inject(ctx context.Context, header http.Header) {
+	span := FromContext(ctx)
+	if span == nil {
+		return
+	}
+	header.Set(TraceParentHeader, span.context.TraceParent())
+	if span.context.TraceState != "" {
+		header.Set(TraceStateHeader, span.context.TraceState)
+	}
+}
+
+func newID(size int) string {
+	id := make([]byte, size)
+	// an all zero ID is invalid
+	for id[0] == 0 {
+		if _, err := rand.Read(id); err != nil {
+			id[0] = 1
+		}
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,272 @@
+package tracing_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	. "github.com/FidelityInternational/possum/tracing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type recordingExporter struct {
+	mutex sync.Mutex
+	spans []SpanData
+}
+
+func (e *recordingExporter) Export(spans []SpanData) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+var _ = Describe("Tracing", func() {
+	Describe("#ParseTraceParent", func() {
+		It("parses a sampled traceparent", func() {
+			spanContext, valid := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+			Ω(valid).Should(BeTrue())
+			Ω(spanContext.TraceID).Should(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+			Ω(spanContext.SpanID).Should(Equal("00f067aa0ba902b7"))
+			Ω(spanContext.Sampled).Should(BeTrue())
+			Ω(spanContext.TraceParent()).Should(Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+		})
+
+		It("parses an unsampled traceparent", func() {
+			spanContext, valid := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+			Ω(valid).Should(BeTrue())
+			Ω(spanContext.Sampled).Should(BeFalse())
+		})
+
+		It("accepts extra fields from later versions", func() {
+			_, valid := ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+			Ω(valid).Should(BeTrue())
+		})
+
+		It("rejects invalid traceparents", func() {
+			for _, value := range []string{
+				"",
+				"00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01",
+				"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+				"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+				"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+				"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+				"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+			} {
+				_, valid := ParseTraceParent(value)
+				Ω(valid).Should(BeFalse(), value)
+			}
+		})
+	})
+
+	Describe("#Start", func() {
+		var (
+			exporter *recordingExporter
+			tracer   *Tracer
+		)
+
+		BeforeEach(func() {
+			exporter = &recordingExporter{}
+			tracer = NewTracer("possum", exporter)
+			SetTracer(tracer)
+		})
+
+		AfterEach(func() {
+			SetTracer(nil)
+		})
+
+		It("starts a new trace without a parent", func() {
+			_, span := Start(context.Background(), "GET /v1/state", KindServer)
+			span.SetAttribute("http.status_code", 200)
+			span.End()
+			Ω(tracer.Flush()).Should(Succeed())
+			Ω(exporter.spans).Should(HaveLen(1))
+			Ω(exporter.spans[0].TraceID).Should(MatchRegexp(`^[0-9a-f]{32}$`))
+			Ω(exporter.spans[0].SpanID).Should(MatchRegexp(`^[0-9a-f]{16}$`))
+			Ω(exporter.spans[0].ParentSpanID).Should(BeEmpty())
+			Ω(exporter.spans[0].Name).Should(Equal("GET /v1/state"))
+			Ω(exporter.spans[0].Kind).Should(Equal(KindServer))
+			Ω(exporter.spans[0].Service).Should(Equal("possum"))
+			Ω(exporter.spans[0].Attributes).Should(Equal(map[string]interface{}{"http.status_code": 200}))
+		})
+
+		It("continues the trace of a remote parent and propagates it", func() {
+			incoming := http.Header{}
+			incoming.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+			incoming.Set(TraceStateHeader, "vendor=value")
+			ctx, server := Start(Extract(context.Background(), incoming), "POST /v1/passel_state", KindServer)
+			ctx, client := Start(ctx, "POST /v1/state", KindClient)
+			outgoing := http.Header{}
+			Inject(ctx, outgoing)
+			client.RecordError(errors.New("connection refused"))
+			client.End()
+			server.End()
+
+			Ω(outgoing.Get(TraceParentHeader)).Should(Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-" + client.Context().SpanID + "-01"))
+			Ω(outgoing.Get(TraceStateHeader)).Should(Equal("vendor=value"))
+			Ω(tracer.Flush()).Should(Succeed())
+			Ω(exporter.spans).Should(HaveLen(2))
+			Ω(exporter.spans[0].TraceID).Should(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+			Ω(exporter.spans[0].ParentSpanID).Should(Equal(server.Context().SpanID))
+			Ω(exporter.spans[0].Error).Should(Equal("connection refused"))
+			Ω(exporter.spans[1].TraceID).Should(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+			Ω(exporter.spans[1].ParentSpanID).Should(Equal("00f067aa0ba902b7"))
+		})
+
+		It("propagates but does not export an unsampled trace", func() {
+			incoming := http.Header{}
+			incoming.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+			ctx, span := Start(Extract(context.Background(), incoming), "GET /v1/state", KindServer)
+			outgoing := http.Header{}
+			Inject(ctx, outgoing)
+			span.End()
+			Ω(outgoing.Get(TraceParentHeader)).Should(HavePrefix("00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+			Ω(outgoing.Get(TraceParentHeader)).Should(HaveSuffix("-00"))
+			Ω(tracer.Flush()).Should(Succeed())
+			Ω(exporter.spans).Should(BeEmpty())
+		})
+
+		It("exports a span only once", func() {
+			_, span := Start(context.Background(), "GET /v1/state", KindServer)
+			span.End()
+			span.End()
+			Ω(tracer.Flush()).Should(Succeed())
+			Ω(exporter.spans).Should(HaveLen(1))
+		})
+
+		Context("when tracing is disabled", func() {
+			It("still propagates the trace", func() {
+				SetTracer(nil)
+				ctx, span := Start(context.Background(), "GET /v1/state", KindServer)
+				span.End()
+				outgoing := http.Header{}
+				Inject(ctx, outgoing)
+				Ω(outgoing.Get(TraceParentHeader)).Should(MatchRegexp(`^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`))
+				Ω(tracer.Flush()).Should(Succeed())
+				Ω(exporter.spans).Should(BeEmpty())
+			})
+		})
+	})
+
+	Describe("WriterExporter", func() {
+		It("writes a JSON line per span", func() {
+			var buffer bytes.Buffer
+			exporter := NewWriterExporter(&buffer)
+			Ω(exporter.Export([]SpanData{{TraceID: "a", SpanID: "b", Name: "first"}, {TraceID: "a", SpanID: "c", Name: "second"}})).Should(Succeed())
+			lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+			Ω(lines).Should(HaveLen(2))
+			var span SpanData
+			Ω(json.Unmarshal([]byte(lines[1]), &span)).Should(Succeed())
+			Ω(span.Name).Should(Equal("second"))
+		})
+	})
+
+	Describe("OTLPExporter", func() {
+		var (
+			collector *httptest.Server
+			body      []byte
+			headers   http.Header
+			status    int
+		)
+
+		BeforeEach(func() {
+			status = http.StatusOK
+			collector = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ = ioutil.ReadAll(r.Body)
+				headers = r.Header
+				w.WriteHeader(status)
+			}))
+		})
+
+		AfterEach(func() {
+			collector.Close()
+		})
+
+		It("sends the spans as OTLP JSON", func() {
+			exporter := NewOTLPExporter(collector.URL+"/v1/traces", map[string]string{"Authorization": "Bearer token"})
+			Ω(exporter.Export([]SpanData{{
+				TraceID:      "4bf92f3577b34da6a3ce929d0e0e4736",
+				SpanID:       "00f067aa0ba902b7",
+				ParentSpanID: "00f067aa0ba902b6",
+				Name:         "POST /v1/state",
+				Kind:         KindClient,
+				Service:      "possum",
+				Attributes:   map[string]interface{}{"http.status_code": 500},
+				Error:        "500 Internal Server Error",
+			}})).Should(Succeed())
+			Ω(headers.Get("Content-Type")).Should(Equal("application/json"))
+			Ω(headers.Get("Authorization")).Should(Equal("Bearer token"))
+			Ω(string(body)).Should(ContainSubstring(`"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"possum"}}]}`))
+			Ω(string(body)).Should(ContainSubstring(`"traceId":"4bf92f3577b34da6a3ce929d0e0e4736","spanId":"00f067aa0ba902b7","parentSpanId":"00f067aa0ba902b6","name":"POST /v1/state","kind":3`))
+			Ω(string(body)).Should(ContainSubstring(`{"key":"http.status_code","value":{"intValue":"500"}}`))
+			Ω(string(body)).Should(ContainSubstring(`"status":{"code":2,"message":"500 Internal Server Error"}`))
+		})
+
+		It("returns an error if the collector rejects the spans", func() {
+			status = http.StatusBadRequest
+			exporter := NewOTLPExporter(collector.URL+"/v1/traces", nil)
+			Ω(exporter.Export([]SpanData{{TraceID: "a", SpanID: "b"}})).Should(MatchError(ContainSubstring("rejected 1 spans: 400")))
+		})
+	})
+
+	Describe("#FromEnv", func() {
+		AfterEach(func() {
+			os.Unsetenv("TRACING_EXPORTER")
+			os.Unsetenv("TRACING_FILE")
+			os.Unsetenv("OTEL_EXPORTER_OTLP_HEADERS")
+		})
+
+		It("returns no tracer when tracing is not configured", func() {
+			tracer, err := FromEnv()
+			Ω(err).Should(BeNil())
+			Ω(tracer).Should(BeNil())
+		})
+
+		It("exports to a file", func() {
+			dir, err := ioutil.TempDir("", "possum-tracing")
+			Ω(err).Should(BeNil())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "spans.json")
+			os.Setenv("TRACING_EXPORTER", "file")
+			os.Setenv("TRACING_FILE", path)
+			tracer, err := FromEnv()
+			Ω(err).Should(BeNil())
+			SetTracer(tracer)
+			defer SetTracer(nil)
+			_, span := Start(context.Background(), "GET /v1/state", KindServer)
+			span.End()
+			Ω(tracer.Flush()).Should(Succeed())
+			data, err := ioutil.ReadFile(path)
+			Ω(err).Should(BeNil())
+			Ω(string(data)).Should(ContainSubstring(`"name":"GET /v1/state"`))
+		})
+
+		It("returns an error when the file exporter has no file", func() {
+			os.Setenv("TRACING_EXPORTER", "file")
+			_, err := FromEnv()
+			Ω(err).Should(MatchError("TRACING_FILE must be set for the file exporter"))
+		})
+
+		It("returns an error for invalid OTLP headers", func() {
+			os.Setenv("TRACING_EXPORTER", "otlp")
+			os.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization")
+			_, err := FromEnv()
+			Ω(err).Should(MatchError(ContainSubstring("OTEL_EXPORTER_OTLP_HEADERS")))
+		})
+
+		It("returns an error for an unknown exporter", func() {
+			os.Setenv("TRACING_EXPORTER", "jaeger")
+			_, err := FromEnv()
+			Ω(err).Should(MatchError(`TRACING_EXPORTER "jaeger" is not one of stdout, file or otlp`))
+		})
+	})
+})
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"database/sql"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Membership events, recorded when a discovered possum joins or leaves the passel
+const (
+	MemberJoined = "joined"
+	MemberLeft   = "left"
+)
+
+// MembershipChange - a possum joining or leaving a discovered passel
+type MembershipChange struct {
+	Possum    string    `json:"possum"`
+	Event     string    `json:"event"`
+	Source    string    `json:"source"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// RecordMembershipChange - records a possum joining or leaving the passel
+func RecordMembershipChange(db *sql.DB, change MembershipChange) error {
+	_, err := db.Exec("INSERT INTO membership_changes (possum, event, source, changed_at) VALUES (?, ?, ?, ?)",
+		change.Possum, change.Event, change.Source, change.ChangedAt.UTC())
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "RecordMembershipChange", "possum": change.Possum}).Debugf("Can't insert into DB: %s", err)
+		return err
+	}
+	return nil
+}
+
+// GetMembershipChanges - returns the most recent membership changes, newest first
+func GetMembershipChanges(db *sql.DB, limit int) ([]MembershipChange, error) {
+	rows, err := db.Query("SELECT possum, event, source, changed_at FROM membership_changes ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetMembershipChanges"}).Debugf("Can't get rows from DB: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []MembershipChange{}
+	for rows.Next() {
+		var change MembershipChange
+		if err := rows.Scan(&change.Possum, &change.Event, &change.Source, &change.ChangedAt); err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "GetMembershipChanges"}).Debugf("Can't scan row: %s", err)
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
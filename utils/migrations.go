@@ -0,0 +1,315 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	migrationLockName           = "possum_migrations"
+	migrationLockTimeoutSeconds = 60
+)
+
+// Migration - an ordered change to the state database schema
+type Migration struct {
+	Version     int
+	Description string
+	Statements  []MigrationStatement
+}
+
+// MigrationStatement - one statement of a migration. MySQL commits every schema change
+// as it is made, so a migration that fails part way is run again from its first statement.
+// Statements that can't be run twice, like adding a column, set Applied to a query counting
+// what they change in information_schema, and are skipped when it is already there.
+type MigrationStatement struct {
+	SQL     string
+	Applied string
+}
+
+// addColumn - a statement adding a column to a table, skipped if the column exists
+func addColumn(table string, column string, definition string) MigrationStatement {
+	return MigrationStatement{
+		SQL:     fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition),
+		Applied: fmt.Sprintf("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema=DATABASE() AND table_name='%s' AND column_name='%s'", table, column),
+	}
+}
+
+// Migrations - every migration, in the order they are applied. Migrations are
+// never edited once released, changes to the schema are made by appending one.
+//
+// The first migrations use CREATE TABLE IF NOT EXISTS so databases created
+// before schema versioning are adopted without changes.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create state table",
+		Statements: []MigrationStatement{{SQL: `CREATE TABLE IF NOT EXISTS state
+	(
+		possum varchar(255),
+		state varchar(255),
+		PRIMARY KEY(possum)
+	)`}},
+	},
+	{
+		Version:     2,
+		Description: "create state_history table",
+		Statements: []MigrationStatement{{SQL: `CREATE TABLE IF NOT EXISTS state_history
+	(
+		id int NOT NULL AUTO_INCREMENT,
+		possum varchar(255),
+		state varchar(255),
+		changed_at datetime,
+		changed_by varchar(255),
+		PRIMARY KEY(id)
+	)`}},
+	},
+	{
+		Version:     3,
+		Description: "create state_archive table",
+		Statements: []MigrationStatement{{SQL: `CREATE TABLE IF NOT EXISTS state_archive
+	(
+		id int NOT NULL AUTO_INCREMENT,
+		possum varchar(255),
+		state varchar(255),
+		archived_at datetime,
+		PRIMARY KEY(id)
+	)`}},
+	},
+	{
+		Version:     4,
+		Description: "create missed_writes table",
+		Statements: []MigrationStatement{{SQL: `CREATE TABLE IF NOT EXISTS missed_writes
+	(
+		possum varchar(255),
+		passel_state text,
+		missed_at datetime,
+		changed_by varchar(255),
+		PRIMARY KEY(possum)
+	)`}},
+	},
+	{
+		Version:     5,
+		Description: "record emergency changes in state_history",
+		Statements: []MigrationStatement{
+			addColumn("state_history", "emergency", "boolean NOT NULL DEFAULT false"),
+			addColumn("state_history", "reason", "varchar(1024) NOT NULL DEFAULT ''"),
+		},
+	},
+	{
+		Version:     6,
+		Description: "create proposals table",
+		Statements: []MigrationStatement{{SQL: `CREATE TABLE IF NOT EXISTS proposals
+	(
+		id varchar(64),
+		possum_states text,
+		force_update boolean NOT NULL DEFAULT false,
+		emergency boolean NOT NULL DEFAULT false,
+		reason varchar(1024) NOT NULL DEFAULT '',
+		proposed_by varchar(255),
+		proposed_at datetime,
+		expires_at datetime,
+		status varchar(16),
+		decided_by varchar(255) NOT NULL DEFAULT '',
+		decided_at datetime NULL,
+		error text,
+		PRIMARY KEY(id)
+	)`}},
+	},
+	{
+		Version:     7,
+		Description: "create membership_changes table",
+		Statements: []MigrationStatement{{SQL: `CREATE TABLE IF NOT EXISTS membership_changes
+	(
+		id int NOT NULL AUTO_INCREMENT,
+		possum varchar(255),
+		event varchar(16),
+		source varchar(255),
+		changed_at datetime,
+		PRIMARY KEY(id)
+	)`}},
+	},
+	{
+		Version:     8,
+		Description: "add version and update metadata to state",
+		Statements: []MigrationStatement{
+			addColumn("state", "version", "int NOT NULL DEFAULT 0"),
+			addColumn("state", "updated_at", "datetime NULL"),
+			addColumn("state", "updated_by", "varchar(255) NOT NULL DEFAULT ''"),
+		},
+	},
+	{
+		Version:     9,
+		Description: "add per-service states",
+		Statements: []MigrationStatement{
+			{SQL: `CREATE TABLE IF NOT EXISTS service_state
+	(
+		possum varchar(255),
+		service varchar(255),
+		state varchar(255),
+		version int NOT NULL DEFAULT 0,
+		updated_at datetime NULL,
+		updated_by varchar(255) NOT NULL DEFAULT '',
+		PRIMARY KEY(possum, service)
+	)`},
+			{SQL: `CREATE TABLE IF NOT EXISTS service_state_history
+	(
+		id int NOT NULL AUTO_INCREMENT,
+		possum varchar(255),
+		service varchar(255),
+		state varchar(255),
+		changed_at datetime,
+		changed_by varchar(255),
+		emergency boolean NOT NULL DEFAULT false,
+		reason varchar(1024) NOT NULL DEFAULT '',
+		PRIMARY KEY(id)
+	)`},
+			addColumn("missed_writes", "service", "varchar(255) NOT NULL DEFAULT ''"),
+			{
+				SQL:     "ALTER TABLE missed_writes DROP PRIMARY KEY, ADD PRIMARY KEY(possum, service)",
+				Applied: "SELECT COUNT(*) FROM information_schema.key_column_usage WHERE table_schema=DATABASE() AND table_name='missed_writes' AND constraint_name='PRIMARY' AND column_name='service'",
+			},
+			addColumn("proposals", "service", "varchar(255) NOT NULL DEFAULT ''"),
+		},
+	},
+	{
+		Version:     10,
+		Description: "create service_state_archive table",
+		Statements: []MigrationStatement{{SQL: `CREATE TABLE IF NOT EXISTS service_state_archive
+	(
+		id int NOT NULL AUTO_INCREMENT,
+		possum varchar(255),
+		service varchar(255),
+		state varchar(255),
+		archived_at datetime,
+		PRIMARY KEY(id)
+	)`}},
+	},
+}
+
+// MigrationStatus - the schema version of a database and the migrations it is missing
+type MigrationStatus struct {
+	CurrentVersion int
+	LatestVersion  int
+	Pending        []Migration
+}
+
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// LatestSchemaVersion - the newest schema version this possum understands
+func LatestSchemaVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// GetMigrationStatus - returns the schema version of the database and the migrations it is
+// missing, without changing the database; a database never migrated is at version 0
+func GetMigrationStatus(db *sql.DB) (MigrationStatus, error) {
+	ctx := context.Background()
+	var tables int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema=DATABASE() AND table_name='schema_version'").Scan(&tables)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetMigrationStatus"}).Debugf("Can't get rows from DB: %s", err)
+		return MigrationStatus{}, err
+	}
+	if tables == 0 {
+		return MigrationStatus{LatestVersion: LatestSchemaVersion(), Pending: Migrations}, nil
+	}
+	return migrationStatus(ctx, db)
+}
+
+func migrationStatus(ctx context.Context, db rowQueryer) (MigrationStatus, error) {
+	status := MigrationStatus{LatestVersion: LatestSchemaVersion()}
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&status.CurrentVersion)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "migrationStatus"}).Debugf("Can't get rows from DB: %s", err)
+		return MigrationStatus{}, err
+	}
+	for _, migration := range Migrations {
+		if migration.Version > status.CurrentVersion {
+			status.Pending = append(status.Pending, migration)
+		}
+	}
+	return status, nil
+}
+
+// Migrate - applies every pending migration while holding a database lock, so
+// instances starting together do not race, and refuses to touch a database
+// whose schema is newer than this possum understands
+func Migrate(db *sql.DB) (MigrationStatus, error) {
+	ctx := context.Background()
+	// GET_LOCK belongs to a connection, so the lock, the migrations and the
+	// release must all use the same one
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", migrationLockName, migrationLockTimeoutSeconds).Scan(&locked)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "Migrate"}).Debugf("Can't get migration lock: %s", err)
+		return MigrationStatus{}, err
+	}
+	if !locked.Valid || locked.Int64 != 1 {
+		return MigrationStatus{}, fmt.Errorf("Could not get the migration lock within %d seconds", migrationLockTimeoutSeconds)
+	}
+	defer func() {
+		var released sql.NullInt64
+		if err := conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", migrationLockName).Scan(&released); err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "Migrate"}).Debugf("Can't release migration lock: %s", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version
+	(
+		version int,
+		description varchar(255),
+		applied_at datetime,
+		PRIMARY KEY(version)
+	)`)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "Migrate"}).Debugf("Can't create table: %s", err)
+		return MigrationStatus{}, err
+	}
+	status, err := migrationStatus(ctx, conn)
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+	if status.CurrentVersion > status.LatestVersion {
+		return status, fmt.Errorf("The database schema is version %d but this possum only understands up to version %d", status.CurrentVersion, status.LatestVersion)
+	}
+	for _, migration := range status.Pending {
+		log.WithFields(log.Fields{"package": "utils", "function": "Migrate", "version": migration.Version}).Infof("Migrating: %s", migration.Description)
+		for _, statement := range migration.Statements {
+			if statement.Applied != "" {
+				var applied int
+				if err := conn.QueryRowContext(ctx, statement.Applied).Scan(&applied); err != nil {
+					log.WithFields(log.Fields{"package": "utils", "function": "Migrate", "version": migration.Version}).Debugf("Can't check migration: %s", err)
+					return status, err
+				}
+				if applied > 0 {
+					log.WithFields(log.Fields{"package": "utils", "function": "Migrate", "version": migration.Version}).Infof("Already applied: %s", statement.SQL)
+					continue
+				}
+			}
+			if _, err := conn.ExecContext(ctx, statement.SQL); err != nil {
+				log.WithFields(log.Fields{"package": "utils", "function": "Migrate", "version": migration.Version}).Debugf("Can't migrate: %s", err)
+				return status, err
+			}
+		}
+		_, err := conn.ExecContext(ctx, "INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)", migration.Version, migration.Description, time.Now().UTC())
+		if err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "Migrate", "version": migration.Version}).Debugf("Can't record migration: %s", err)
+			return status, err
+		}
+		status.CurrentVersion = migration.Version
+	}
+	status.Pending = nil
+	return status, nil
+}
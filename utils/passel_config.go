@@ -0,0 +1,274 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PasselConfig - passel membership and credentials that can be reloaded at runtime,
+// overriding the "possum" service
+type PasselConfig struct {
+	Passel   []string `json:"passel"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	// PeerSecret signs the writes possums make to each other, see GetPeerSecret
+	PeerSecret string `json:"peer_secret"`
+	// InitialState is the state of possums that join the passel, "alive" if empty
+	InitialState string `json:"initial_state"`
+	// EmergencyUsername and EmergencyPassword replace those of the possum service, see GetEmergencyCredentials
+	EmergencyUsername string `json:"emergency_username"`
+	EmergencyPassword string `json:"emergency_password"`
+	// Users replaces the named users of the possum service, see GetUsers
+	Users map[string]string `json:"users"`
+}
+
+var (
+	passelConfigMutex sync.RWMutex
+	passelConfig      *PasselConfig
+)
+
+// LoadPasselConfigFile - reads and validates a passel config file
+func LoadPasselConfigFile(path string) (PasselConfig, error) {
+	var config PasselConfig
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "LoadPasselConfigFile", "path": path}).Debugf("Can't read file: %s", err)
+		return PasselConfig{}, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "LoadPasselConfigFile", "path": path}).Debugf("Can't unmarshal JSON: %s", err)
+		return PasselConfig{}, err
+	}
+	if config.InitialState == "" {
+		config.InitialState = "alive"
+	}
+	if err := ValidatePasselConfig(config); err != nil {
+		return PasselConfig{}, err
+	}
+	return config, nil
+}
+
+// ValidatePasselConfig - checks a passel config is safe to swap in
+func ValidatePasselConfig(config PasselConfig) error {
+	if len(config.Passel) == 0 {
+		return fmt.Errorf("passel must have at least one possum")
+	}
+	seen := make(map[string]bool)
+	for _, possum := range config.Passel {
+		if u, err := url.Parse(possum); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("possum %q is not an http or https URL", possum)
+		}
+		if seen[possum] {
+			return fmt.Errorf("possum %s is in the passel more than once", possum)
+		}
+		seen[possum] = true
+	}
+	if (config.Username == "") != (config.Password == "") {
+		return fmt.Errorf("username and password must be set together")
+	}
+	if (config.EmergencyUsername == "") != (config.EmergencyPassword == "") {
+		return fmt.Errorf("emergency_username and emergency_password must be set together")
+	}
+	for username, password := range config.Users {
+		if username == "" || password == "" {
+			return fmt.Errorf("users must have a username and a password")
+		}
+	}
+	if config.InitialState != "alive" && config.InitialState != "dead" {
+		return fmt.Errorf(`initial_state should have been "alive" or "dead" not "%s"`, config.InitialState)
+	}
+	return nil
+}
+
+// SetPasselConfig - swaps in a reloaded passel config, nil reverts to the "possum" service
+func SetPasselConfig(config *PasselConfig) {
+	passelConfigMutex.Lock()
+	defer passelConfigMutex.Unlock()
+	passelConfig = config
+}
+
+func reloadedPasselConfig() *PasselConfig {
+	passelConfigMutex.RLock()
+	defer passelConfigMutex.RUnlock()
+	return passelConfig
+}
+
+// SyncPasselDB - inserts the possums that have joined the passel and archives the
+// possums that have left it, with the states of their services, returning both. A possum
+// that rejoins gets back the states it was archived with, a possum that never was in the
+// passel gets initialState. Possums are matched by normalised URI, and a possum the passel
+// names differently is renamed rather than archived. validate, if not nil, is called with
+// the states the passel will have before anything is committed; an error from validate
+// rolls the changes back.
+func SyncPasselDB(db *sql.DB, passel []string, initialState string, validate func(passelState map[string]string) error) ([]string, []string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "SyncPasselDB"}).Debugf("Can't begin transaction: %s", err)
+		return nil, nil, err
+	}
+	// a rollback after a commit does nothing
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT possum, state FROM state FOR UPDATE")
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "SyncPasselDB"}).Debugf("Can't get rows from DB: %s", err)
+		return nil, nil, err
+	}
+	existing := make(map[string]string)
+	// the row of each possum by normalised URI, a passel may name a possum differently
+	// from the row it already has
+	normalised := make(map[string]string)
+	var order []string
+	for rows.Next() {
+		var possum, state string
+		if err := rows.Scan(&possum, &state); err != nil {
+			rows.Close()
+			log.WithFields(log.Fields{"package": "utils", "function": "SyncPasselDB"}).Debugf("Can't scan row: %s", err)
+			return nil, nil, err
+		}
+		existing[possum] = state
+		if _, ok := normalised[NormalisePossumURI(possum)]; !ok {
+			normalised[NormalisePossumURI(possum)] = possum
+		}
+		order = append(order, possum)
+	}
+	rows.Close()
+
+	passelState := make(map[string]string, len(passel))
+	kept := make(map[string]bool, len(passel))
+	var added, archived []string
+	for _, possum := range passel {
+		if state, ok := existing[possum]; ok {
+			passelState[possum] = state
+			kept[possum] = true
+			continue
+		}
+		if row, ok := normalised[NormalisePossumURI(possum)]; ok && !kept[row] {
+			if err := renamePossum(tx, row, possum); err != nil {
+				return nil, nil, err
+			}
+			passelState[possum] = existing[row]
+			kept[row] = true
+			continue
+		}
+		state := initialState
+		err := tx.QueryRow("SELECT state FROM state_archive WHERE possum=? ORDER BY archived_at DESC, id DESC LIMIT 1", possum).Scan(&state)
+		if err != nil && err != sql.ErrNoRows {
+			log.WithFields(log.Fields{"package": "utils", "function": "SyncPasselDB", "possum": possum}).Debugf("Can't get archived state: %s", err)
+			return nil, nil, err
+		}
+		if _, err := tx.Exec("INSERT INTO state (possum, state) VALUES (?, ?)", possum, state); err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "SyncPasselDB", "possum": possum}).Debugf("Can't insert into DB: %s", err)
+			return nil, nil, err
+		}
+		if err := restoreServiceStates(tx, possum); err != nil {
+			return nil, nil, err
+		}
+		passelState[possum] = state
+		added = append(added, possum)
+	}
+	for _, possum := range order {
+		if kept[possum] {
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO state_archive (possum, state, archived_at) VALUES (?, ?, ?)", possum, existing[possum], time.Now().UTC()); err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "SyncPasselDB", "possum": possum}).Debugf("Can't archive possum: %s", err)
+			return nil, nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM state WHERE possum=?", possum); err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "SyncPasselDB", "possum": possum}).Debugf("Can't delete from DB: %s", err)
+			return nil, nil, err
+		}
+		if err := archiveServiceStates(tx, possum); err != nil {
+			return nil, nil, err
+		}
+		archived = append(archived, possum)
+	}
+	if validate != nil {
+		if err := validate(passelState); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "SyncPasselDB"}).Debugf("Can't commit: %s", err)
+		return nil, nil, err
+	}
+	return added, archived, nil
+}
+
+// renamePossum - renames the state and service states of a possum to the name the passel
+// gives it, so that they are read under that name
+func renamePossum(tx *sql.Tx, from string, to string) error {
+	if _, err := tx.Exec("UPDATE state SET possum=? WHERE possum=?", to, from); err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "renamePossum", "possum": from}).Debugf("Can't update DB: %s", err)
+		return err
+	}
+	if _, err := tx.Exec("UPDATE service_state SET possum=? WHERE possum=?", to, from); err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "renamePossum", "possum": from}).Debugf("Can't update DB: %s", err)
+		return err
+	}
+	log.WithFields(log.Fields{"package": "utils", "function": "renamePossum", "possum": from}).Infof("Renamed possum to %s as named by the passel", to)
+	return nil
+}
+
+// archiveServiceStates - moves the service states of a possum that left the passel to the
+// service_state_archive table
+func archiveServiceStates(tx *sql.Tx, possum string) error {
+	_, err := tx.Exec("INSERT INTO service_state_archive (possum, service, state, archived_at) SELECT possum, service, state, ? FROM service_state WHERE possum=?", time.Now().UTC(), possum)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "archiveServiceStates", "possum": possum}).Debugf("Can't archive service states: %s", err)
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM service_state WHERE possum=?", possum); err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "archiveServiceStates", "possum": possum}).Debugf("Can't delete from DB: %s", err)
+		return err
+	}
+	return nil
+}
+
+// restoreServiceStates - gives a possum that rejoined the passel the service states it was
+// last archived with
+func restoreServiceStates(tx *sql.Tx, possum string) error {
+	rows, err := tx.Query("SELECT service, state FROM service_state_archive WHERE possum=? ORDER BY archived_at, id", possum)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "restoreServiceStates", "possum": possum}).Debugf("Can't get archived service states: %s", err)
+		return err
+	}
+	// later archives replace earlier ones
+	states := make(map[string]string)
+	var services []string
+	for rows.Next() {
+		var service, state string
+		if err := rows.Scan(&service, &state); err != nil {
+			rows.Close()
+			log.WithFields(log.Fields{"package": "utils", "function": "restoreServiceStates", "possum": possum}).Debugf("Can't scan row: %s", err)
+			return err
+		}
+		if _, ok := states[service]; !ok {
+			services = append(services, service)
+		}
+		states[service] = state
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	restoredAt := time.Now().UTC()
+	for _, service := range services {
+		// rows left behind by possums that left before service states were archived are replaced
+		_, err := tx.Exec("INSERT INTO service_state (possum, service, state, version, updated_at, updated_by) VALUES (?, ?, ?, 1, ?, ?) ON DUPLICATE KEY UPDATE state=VALUES(state), version=version+1, updated_at=VALUES(updated_at), updated_by=VALUES(updated_by)",
+			possum, service, states[service], restoredAt, "passel membership")
+		if err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "restoreServiceStates", "possum": possum, "service": service}).Debugf("Can't insert into DB: %s", err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// PossumURI - the parts of a possum URI or application route that identify a possum
+type PossumURI struct {
+	Scheme string
+	Host   string
+	Port   string
+	Path   string
+}
+
+// ParsePossumURI - parses a possum URI, or an application route without a scheme, into
+// its normal form: scheme and host lower case, no trailing dot on the host, no default
+// port, and a clean path without a trailing slash. User info, queries and fragments are dropped.
+func ParsePossumURI(uri string) (PossumURI, error) {
+	raw := strings.TrimSpace(uri)
+	if !strings.Contains(raw, "://") {
+		raw = "//" + raw
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return PossumURI{}, err
+	}
+	if parsed.Hostname() == "" {
+		return PossumURI{}, fmt.Errorf("%s has no host", uri)
+	}
+	p := PossumURI{
+		Scheme: strings.ToLower(parsed.Scheme),
+		Host:   strings.TrimSuffix(strings.ToLower(parsed.Hostname()), "."),
+		Port:   parsed.Port(),
+	}
+	if p.Port == defaultPorts[p.Scheme] {
+		p.Port = ""
+	}
+	if parsed.Path != "" {
+		p.Path = strings.TrimSuffix(path.Clean("/"+parsed.Path), "/")
+	}
+	return p, nil
+}
+
+func (p PossumURI) String() string {
+	host := p.Host
+	if p.Port != "" {
+		host = fmt.Sprintf("%s:%s", host, p.Port)
+	}
+	if p.Scheme == "" {
+		return host + p.Path
+	}
+	return fmt.Sprintf("%s://%s%s", p.Scheme, host, p.Path)
+}
+
+// NormalisePossumURI - the normal form of a possum URI, or the URI unchanged if it can not be parsed
+func NormalisePossumURI(uri string) string {
+	p, err := ParsePossumURI(uri)
+	if err != nil {
+		return uri
+	}
+	return p.String()
+}
+
+// SamePossum - true if the two URIs name the same possum once normalised
+func SamePossum(a string, b string) bool {
+	if a == b {
+		return true
+	}
+	pa, errA := ParsePossumURI(a)
+	pb, errB := ParsePossumURI(b)
+	return errA == nil && errB == nil && pa == pb
+}
+
+// RouteMatchesPossum - true if an application route, which has no scheme, is the
+// possum URI over http or https
+func RouteMatchesPossum(route string, possum string) bool {
+	r, err := ParsePossumURI(route)
+	if err != nil {
+		return false
+	}
+	p, err := ParsePossumURI(possum)
+	if err != nil {
+		return false
+	}
+	if _, web := defaultPorts[p.Scheme]; !web || (r.Scheme != "" && r.Scheme != p.Scheme) {
+		return false
+	}
+	routePort := r.Port
+	if routePort == defaultPorts[p.Scheme] {
+		routePort = ""
+	}
+	return r.Host == p.Host && routePort == p.Port && r.Path == p.Path
+}
@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Proposal statuses, a pending proposal past its expiry is reported as expired
+const (
+	ProposalPending  = "pending"
+	ProposalApproved = "approved"
+	ProposalExecuted = "executed"
+	ProposalFailed   = "failed"
+	ProposalExpired  = "expired"
+)
+
+// Proposal - a passel state change waiting for a second person to approve it
+type Proposal struct {
+	ID           string            `json:"id"`
+	PossumStates map[string]string `json:"possum_states"`
+	// Service is empty for a change to the states of the possums themselves
+	Service    string     `json:"service,omitempty"`
+	Force      bool       `json:"force,omitempty"`
+	Emergency  bool       `json:"emergency,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	ProposedBy string     `json:"proposed_by"`
+	ProposedAt time.Time  `json:"proposed_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	Status     string     `json:"status"`
+	DecidedBy  string     `json:"decided_by,omitempty"`
+	DecidedAt  *time.Time `json:"decided_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+const proposalColumns = "id, possum_states, force_update, emergency, reason, proposed_by, proposed_at, expires_at, status, decided_by, decided_at, error, service"
+
+// SaveProposal - inserts or replaces a proposal
+func SaveProposal(db *sql.DB, proposal Proposal) error {
+	possumStates, err := json.Marshal(proposal.PossumStates)
+	if err != nil {
+		return err
+	}
+	var decidedAt interface{}
+	if proposal.DecidedAt != nil {
+		decidedAt = proposal.DecidedAt.UTC()
+	}
+	_, err = db.Exec("REPLACE INTO proposals ("+proposalColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		proposal.ID, string(possumStates), proposal.Force, proposal.Emergency, proposal.Reason, proposal.ProposedBy,
+		proposal.ProposedAt.UTC(), proposal.ExpiresAt.UTC(), proposal.Status, proposal.DecidedBy, decidedAt, proposal.Error, proposal.Service)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "SaveProposal", "id": proposal.ID}).Debugf("Can't insert into DB: %s", err)
+		return err
+	}
+	return nil
+}
+
+// GetProposal - returns a proposal, or sql.ErrNoRows if there is no proposal with the ID
+func GetProposal(db *sql.DB, id string) (Proposal, error) {
+	proposal, err := scanProposal(db.QueryRow("SELECT "+proposalColumns+" FROM proposals WHERE id=?", id))
+	if err != nil && err != sql.ErrNoRows {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetProposal", "id": id}).Debugf("Can't get rows from DB: %s", err)
+	}
+	return proposal, err
+}
+
+// GetProposals - returns every proposal, newest first
+func GetProposals(db *sql.DB) ([]Proposal, error) {
+	rows, err := db.Query("SELECT " + proposalColumns + " FROM proposals ORDER BY proposed_at DESC")
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetProposals"}).Debugf("Can't get rows from DB: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	proposals := []Proposal{}
+	for rows.Next() {
+		proposal, err := scanProposal(rows)
+		if err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "GetProposals"}).Debugf("Can't scan row: %s", err)
+			return nil, err
+		}
+		proposals = append(proposals, proposal)
+	}
+	return proposals, rows.Err()
+}
+
+// ClaimProposal - marks a pending, unexpired proposal as approved by approver,
+// returning false if it was not pending so that it is only ever executed once
+func ClaimProposal(db *sql.DB, id string, approver string, now time.Time) (bool, error) {
+	result, err := db.Exec("UPDATE proposals SET status=?, decided_by=?, decided_at=? WHERE id=? AND status=? AND expires_at>?",
+		ProposalApproved, approver, now.UTC(), id, ProposalPending, now.UTC())
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "ClaimProposal", "id": id}).Debugf("Can't update DB: %s", err)
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return claimed == 1, nil
+}
+
+// ReleaseProposal - moves a proposal claimed by approver back to pending, returning false
+// if approver no longer holds the claim
+func ReleaseProposal(db *sql.DB, id string, approver string) (bool, error) {
+	result, err := db.Exec("UPDATE proposals SET status=?, decided_by='', decided_at=NULL WHERE id=? AND status=? AND decided_by=?",
+		ProposalPending, id, ProposalApproved, approver)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "ReleaseProposal", "id": id}).Debugf("Can't update DB: %s", err)
+		return false, err
+	}
+	released, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return released == 1, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanProposal(row rowScanner) (Proposal, error) {
+	var proposal Proposal
+	var possumStates string
+	var decidedAt sql.NullTime
+	var proposalErr sql.NullString
+	err := row.Scan(&proposal.ID, &possumStates, &proposal.Force, &proposal.Emergency, &proposal.Reason, &proposal.ProposedBy,
+		&proposal.ProposedAt, &proposal.ExpiresAt, &proposal.Status, &proposal.DecidedBy, &decidedAt, &proposalErr, &proposal.Service)
+	if err != nil {
+		return Proposal{}, err
+	}
+	if err := json.Unmarshal([]byte(possumStates), &proposal.PossumStates); err != nil {
+		return Proposal{}, fmt.Errorf("proposal %s has invalid possum states: %s", proposal.ID, err)
+	}
+	if decidedAt.Valid {
+		proposal.DecidedAt = &decidedAt.Time
+	}
+	proposal.Error = proposalErr.String
+	return proposal, nil
+}
@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultServiceState - the state of a service that has never been changed, a service
+// follows the state of its possum until it is changed
+const DefaultServiceState = "alive"
+
+// ServiceStateReader - reads the state of a service of every possum in a passel
+type ServiceStateReader func(service string) (map[string]string, error)
+
+// txServiceStateReader - reads service states of the passel inside tx, locking them like a
+// service write would, so a check inside a write does not need a second connection
+func txServiceStateReader(tx *sql.Tx, passel []string) ServiceStateReader {
+	return func(service string) (map[string]string, error) {
+		return lockServiceState(tx, passel, service)
+	}
+}
+
+// GetServiceState - returns the current state of a service of the given possum
+func GetServiceState(db *sql.DB, possum string, service string) (string, error) {
+	stmt, err := prepared(db, "SELECT state FROM service_state WHERE possum=? AND service=?")
+	if err != nil {
+		return "", err
+	}
+	var state string
+	err = stmt.QueryRow(possum, service).Scan(&state)
+	if err == sql.ErrNoRows {
+		return DefaultServiceState, nil
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetServiceState", "possum": possum, "service": service}).Debugf("Can't get rows from DB: %s", err)
+		return "", err
+	}
+	return state, nil
+}
+
+// GetPasselServiceState - returns the current state of a service of every possum in the
+// passel, read in one query
+func GetPasselServiceState(db *sql.DB, passel []string, service string) (map[string]string, error) {
+	if len(passel) == 0 {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetPasselServiceState"}).Debugf("Passel had 0 members")
+		return nil, fmt.Errorf("Passel had 0 members")
+	}
+	placeholders, args := inPlaceholders(passel)
+	stmt, err := prepared(db, "SELECT possum, state FROM service_state WHERE service=? AND possum IN ("+placeholders+")")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(append([]interface{}{service}, args...)...)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetPasselServiceState", "service": service}).Debugf("Can't get rows from DB: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	return scanServiceState(rows, passel)
+}
+
+// WriteServiceStates - applies desired states of a service in a single transaction. The
+// state rows of the passel are locked first, so service writes are serialised with every
+// other write, then validate is called with the possum and service states before anything
+// is written; an error from validate rolls the transaction back, otherwise it returns the
+// emergency reason the changes are recorded with. Returns the service state of the passel
+// as it was before the write.
+func WriteServiceStates(db *sql.DB, passel []string, service string, desired map[string]string, actor string, validate func(passelState map[string]string, serviceState map[string]string) (string, error)) (map[string]string, error) {
+	for possum, state := range desired {
+		if state != "alive" && state != "dead" {
+			return nil, fmt.Errorf(`The state of %s should have been "alive" or "dead" not "%s"`, possum, state)
+		}
+	}
+	if len(passel) == 0 {
+		return nil, fmt.Errorf("Passel had 0 members")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "WriteServiceStates"}).Debugf("Can't begin transaction: %s", err)
+		return nil, err
+	}
+	// a rollback after a commit does nothing
+	defer tx.Rollback()
+
+	passelState, err := lockPasselState(tx, passel)
+	if err != nil {
+		return nil, err
+	}
+	serviceState, err := lockServiceState(tx, passel, service)
+	if err != nil {
+		return nil, err
+	}
+
+	emergencyReason, err := validate(passelState, serviceState)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := writeServiceStateChanges(tx, serviceState, service, desired, actor, emergencyReason); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "WriteServiceStates"}).Debugf("Can't commit: %s", err)
+		return nil, err
+	}
+	return serviceState, nil
+}
+
+// lockServiceState - locks and reads the state of a service of every possum in the passel
+func lockServiceState(tx *sql.Tx, passel []string, service string) (map[string]string, error) {
+	placeholders, args := inPlaceholders(passel)
+	rows, err := tx.Query("SELECT possum, state FROM service_state WHERE service=? AND possum IN ("+placeholders+") FOR UPDATE", append([]interface{}{service}, args...)...)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "lockServiceState", "service": service}).Debugf("Can't lock rows: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	return scanServiceState(rows, passel)
+}
+
+// writeServiceStateChanges - writes the desired states of a service that differ from
+// serviceState, recording each change in the service state history, and returns the
+// possums whose service state changed
+func writeServiceStateChanges(tx *sql.Tx, serviceState map[string]string, service string, desired map[string]string, actor string, emergencyReason string) ([]string, error) {
+	changedAt := time.Now().UTC()
+	possums := make([]string, 0, len(desired))
+	for possum := range desired {
+		possums = append(possums, possum)
+	}
+	sort.Strings(possums)
+	var changed []string
+	for _, possum := range possums {
+		state := desired[possum]
+		current, found := serviceState[possum]
+		if !found {
+			return nil, fmt.Errorf("Possum %s is not part of the passel", possum)
+		}
+		if current == state {
+			continue
+		}
+		_, err := tx.Exec("INSERT INTO service_state (possum, service, state, version, updated_at, updated_by) VALUES (?, ?, ?, 1, ?, ?) ON DUPLICATE KEY UPDATE state=VALUES(state), version=version+1, updated_at=VALUES(updated_at), updated_by=VALUES(updated_by)",
+			possum, service, state, changedAt, actor)
+		if err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "writeServiceStateChanges", "possum": possum, "service": service}).Debugf("Can't update DB: %s", err)
+			return nil, err
+		}
+		_, err = tx.Exec("INSERT INTO service_state_history (possum, service, state, changed_at, changed_by, emergency, reason) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			possum, service, state, changedAt, actor, emergencyReason != "", emergencyReason)
+		if err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "writeServiceStateChanges", "possum": possum, "service": service}).Debugf("Can't insert into DB: %s", err)
+			return nil, err
+		}
+		changed = append(changed, possum)
+	}
+	return changed, nil
+}
+
+// scanServiceState - the service state of every possum of the passel from rows of possum
+// and state, possums without a row have the default state
+func scanServiceState(rows *sql.Rows, passel []string) (map[string]string, error) {
+	serviceState := make(map[string]string, len(passel))
+	for _, possum := range passel {
+		serviceState[possum] = DefaultServiceState
+	}
+	for rows.Next() {
+		var possum, state string
+		if err := rows.Scan(&possum, &state); err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "scanServiceState"}).Debugf("Can't scan row: %s", err)
+			return nil, err
+		}
+		serviceState[possum] = state
+	}
+	return serviceState, rows.Err()
+}
@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SnapshotFormat - the version of the snapshot format written by ExportSnapshot
+const SnapshotFormat = 1
+
+// Snapshot - the full local state of a possum: the state of every possum and of their
+// services in its database and the history of how the possums changed
+type Snapshot struct {
+	FormatVersion int `json:"format_version"`
+	// SchemaVersion is the schema version of the database the snapshot was exported from
+	SchemaVersion int               `json:"schema_version"`
+	Possum        string            `json:"possum,omitempty"`
+	ExportedAt    time.Time         `json:"exported_at"`
+	States        map[string]string `json:"states"`
+	// ServiceStates are the states of each possum by service, only services that were
+	// ever changed are included
+	ServiceStates map[string]map[string]string `json:"service_states,omitempty"`
+	History       []StateChange                `json:"history"`
+	Signature     string                       `json:"signature,omitempty"`
+}
+
+// ImportResult - the possums whose state an import changed, and how much history it imported
+type ImportResult struct {
+	Changed []string `json:"changed"`
+	// ServicesChanged are the possums whose service states the import changed, by service
+	ServicesChanged map[string][]string `json:"services_changed,omitempty"`
+	HistoryImported int                 `json:"history_imported"`
+}
+
+// ExportSnapshot - reads the schema version, every state and service state row and the
+// whole state history in one transaction
+func ExportSnapshot(db *sql.DB) (Snapshot, error) {
+	snapshot := Snapshot{
+		FormatVersion: SnapshotFormat,
+		ExportedAt:    time.Now().UTC(),
+		States:        make(map[string]string),
+		History:       []StateChange{},
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "ExportSnapshot"}).Debugf("Can't begin transaction: %s", err)
+		return Snapshot{}, err
+	}
+	// the transaction only reads
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&snapshot.SchemaVersion)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "ExportSnapshot"}).Debugf("Can't get schema version: %s", err)
+		return Snapshot{}, err
+	}
+
+	rows, err := tx.Query("SELECT possum, state FROM state ORDER BY possum")
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "ExportSnapshot"}).Debugf("Can't get rows from DB: %s", err)
+		return Snapshot{}, err
+	}
+	for rows.Next() {
+		var possum, state string
+		if err := rows.Scan(&possum, &state); err != nil {
+			rows.Close()
+			return Snapshot{}, err
+		}
+		snapshot.States[possum] = state
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Snapshot{}, err
+	}
+
+	rows, err = tx.Query("SELECT possum, service, state FROM service_state ORDER BY service, possum")
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "ExportSnapshot"}).Debugf("Can't get rows from DB: %s", err)
+		return Snapshot{}, err
+	}
+	for rows.Next() {
+		var possum, service, state string
+		if err := rows.Scan(&possum, &service, &state); err != nil {
+			rows.Close()
+			return Snapshot{}, err
+		}
+		if snapshot.ServiceStates == nil {
+			snapshot.ServiceStates = make(map[string]map[string]string)
+		}
+		if snapshot.ServiceStates[service] == nil {
+			snapshot.ServiceStates[service] = make(map[string]string)
+		}
+		snapshot.ServiceStates[service][possum] = state
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Snapshot{}, err
+	}
+
+	rows, err = tx.Query("SELECT possum, state, changed_at, changed_by, emergency, reason FROM state_history ORDER BY id")
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "ExportSnapshot"}).Debugf("Can't get rows from DB: %s", err)
+		return Snapshot{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var change StateChange
+		if err := rows.Scan(&change.Possum, &change.State, &change.ChangedAt, &change.ChangedBy, &change.Emergency, &change.Reason); err != nil {
+			return Snapshot{}, err
+		}
+		change.ChangedAt = change.ChangedAt.UTC()
+		snapshot.History = append(snapshot.History, change)
+	}
+	return snapshot, rows.Err()
+}
+
+// Sign - returns the snapshot signed with key
+func (s Snapshot) Sign(key []byte) (Snapshot, error) {
+	signature, err := s.signature(key)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	s.Signature = signature
+	return s, nil
+}
+
+// Verify - true if the snapshot carries a signature made with key over its contents
+func (s Snapshot) Verify(key []byte) bool {
+	signature, err := s.signature(key)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(s.Signature))
+}
+
+// signature - the hex encoded HMAC-SHA256 of the JSON encoding of the snapshot
+// without its signature, map keys are encoded in order so it is stable
+func (s Snapshot) signature(key []byte) (string, error) {
+	s.Signature = ""
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// ImportSnapshot - writes the states and service states of a snapshot in a single
+// transaction. The rows of the passel are locked and read first, and validate is called
+// with them before anything is written, reading any service states it needs through the
+// transaction; an error from validate rolls the transaction back,
+// otherwise it returns the emergency reason the changes are recorded with. Each state the
+// import changes is recorded as changed by actor.
+//
+// The history of the snapshot is only imported if the state_history table is empty, as it
+// is after a database is rebuilt, so importing twice never duplicates it.
+func ImportSnapshot(db *sql.DB, passel []string, snapshot Snapshot, actor string, validate func(passelState map[string]string, serviceStates ServiceStateReader) (string, error)) (ImportResult, error) {
+	for possum, state := range snapshot.States {
+		if state != "alive" && state != "dead" {
+			return ImportResult{}, fmt.Errorf(`The state of %s should have been "alive" or "dead" not "%s"`, possum, state)
+		}
+	}
+	services := make([]string, 0, len(snapshot.ServiceStates))
+	for service, serviceStates := range snapshot.ServiceStates {
+		for possum, state := range serviceStates {
+			if state != "alive" && state != "dead" {
+				return ImportResult{}, fmt.Errorf(`The state of %s of %s should have been "alive" or "dead" not "%s"`, service, possum, state)
+			}
+		}
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	if len(passel) == 0 {
+		return ImportResult{}, fmt.Errorf("Passel had 0 members")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "ImportSnapshot"}).Debugf("Can't begin transaction: %s", err)
+		return ImportResult{}, err
+	}
+	// a rollback after a commit does nothing
+	defer tx.Rollback()
+
+	passelState, err := lockPasselState(tx, passel)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	emergencyReason, err := validate(passelState, txServiceStateReader(tx, passel))
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	var result ImportResult
+	var historyRows int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM state_history").Scan(&historyRows); err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "ImportSnapshot"}).Debugf("Can't count history: %s", err)
+		return ImportResult{}, err
+	}
+	if historyRows == 0 {
+		for _, change := range snapshot.History {
+			_, err := tx.Exec("INSERT INTO state_history (possum, state, changed_at, changed_by, emergency, reason) VALUES (?, ?, ?, ?, ?, ?)",
+				change.Possum, change.State, change.ChangedAt.UTC(), change.ChangedBy, change.Emergency, change.Reason)
+			if err != nil {
+				log.WithFields(log.Fields{"package": "utils", "function": "ImportSnapshot", "possum": change.Possum}).Debugf("Can't insert into DB: %s", err)
+				return ImportResult{}, err
+			}
+		}
+		result.HistoryImported = len(snapshot.History)
+	}
+
+	result.Changed, err = writeStateChanges(tx, passelState, snapshot.States, actor, emergencyReason)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	if result.Changed == nil {
+		result.Changed = []string{}
+	}
+	for _, service := range services {
+		serviceState, err := lockServiceState(tx, passel, service)
+		if err != nil {
+			return ImportResult{}, err
+		}
+		changed, err := writeServiceStateChanges(tx, serviceState, service, snapshot.ServiceStates[service], actor, emergencyReason)
+		if err != nil {
+			return ImportResult{}, err
+		}
+		if len(changed) > 0 {
+			if result.ServicesChanged == nil {
+				result.ServicesChanged = make(map[string][]string)
+			}
+			result.ServicesChanged[service] = changed
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "ImportSnapshot"}).Debugf("Can't commit: %s", err)
+		return ImportResult{}, err
+	}
+	return result, nil
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// prepared statements by database and query, possum opens one database so they
+// are kept for as long as it runs
+var (
+	statementsMutex sync.Mutex
+	statements      = make(map[*sql.DB]map[string]*sql.Stmt)
+)
+
+// prepared - returns query prepared on db, preparing it the first time it is used.
+// database/sql prepares it again on each connection that runs it.
+func prepared(db *sql.DB, query string) (*sql.Stmt, error) {
+	statementsMutex.Lock()
+	defer statementsMutex.Unlock()
+	if stmt, found := statements[db][query]; found {
+		return stmt, nil
+	}
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "prepared", "query": query}).Debugf("Can't prepare statement: %s", err)
+		return nil, err
+	}
+	if statements[db] == nil {
+		statements[db] = make(map[string]*sql.Stmt)
+	}
+	statements[db][query] = stmt
+	return stmt, nil
+}
+
+// inPlaceholders - the placeholders of an IN list of the values, and the values as arguments
+func inPlaceholders(values []string) (string, []interface{}) {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return "?" + strings.Repeat(", ?", len(values)-1), args
+}
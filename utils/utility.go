@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"reflect"
+	"sort"
+	"time"
 
 	"github.com/cloudfoundry-community/go-cfenv"
 	log "github.com/sirupsen/logrus"
@@ -32,7 +34,7 @@ func GetDBConnectionDetails() (string, error) {
 		database = service.Credentials["name"]
 	}
 
-	dbConnString := fmt.Sprintf("%s:%s@tcp(%s:%v)/%s",
+	dbConnString := fmt.Sprintf("%s:%s@tcp(%s:%v)/%s?parseTime=true",
 		service.Credentials["username"], service.Credentials["password"], hostname,
 		service.Credentials["port"], database)
 
@@ -50,54 +52,45 @@ func GetMyApplicationURIs() ([]string, error) {
 	return applicationURIs, nil
 }
 
-// SetupStateDB - creates the state DB if it does not exist
+// SetupStateDB - inserts an alive state for each possum in the passel that has no state,
+// the state table is created by Migrate
 func SetupStateDB(db *sql.DB) error {
-	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS state
-	(
-		possum varchar(255),
-		state varchar(255),
-		PRIMARY KEY(possum)
-	)`)
-
+	passel, err := GetPassel()
 	if err != nil {
-		log.WithFields(log.Fields{"package": "utils", "function": "SetupStateDB"}).Debugf("Can't create table: %s", err)
 		return err
 	}
+	if len(passel) == 0 {
+		return nil
+	}
 
-	passel, err := GetPassel()
+	existing, err := readPasselState(db, passel)
 	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "SetupStateDB"}).Debugf("Error getting rows from DB %s", err.Error())
 		return err
 	}
-
 	for _, possum := range passel {
-		var possumdb, state string
-		log.WithFields(log.Fields{"package": "utils", "function": "SetupStateDB", "possum": possum}).Debugf("Checking initail possum state")
-		row := db.QueryRow("SELECT * FROM state WHERE possum=?", possum)
-		err := row.Scan(&possumdb, &state)
-		if err != nil {
-			log.WithFields(log.Fields{"package": "utils", "function": "SetupStateDB"}).Debugf("Error getting row from DB %s", err.Error())
-			if err.Error() == "sql: no rows in result set" {
-				log.WithFields(log.Fields{"package": "utils", "function": "SetupStateDB", "possum": possum}).Debugf("Inserting alive state into DB")
-				_, insertErr := db.Exec("INSERT INTO state VALUES (?, ?)", possum, "alive")
-				if insertErr != nil {
-					log.WithFields(log.Fields{"package": "utils", "function": "SetupStateDB"}).Debugf("Error inserting into DB %s", insertErr.Error())
-					return insertErr
-				}
-			} else {
-				log.WithFields(log.Fields{"package": "utils", "function": "SetupStateDB"}).Debug(err.Error())
-				return err
-			}
-		} else {
-			log.WithFields(log.Fields{"package": "utils", "function": "SetupStateDB", "possum": possum, "state": state}).Debugf("Retrived state")
+		if possumState, found := existing[possum]; found {
+			log.WithFields(log.Fields{"package": "utils", "function": "SetupStateDB", "possum": possum, "state": possumState.State}).Debugf("Retrived state")
+			continue
+		}
+		log.WithFields(log.Fields{"package": "utils", "function": "SetupStateDB", "possum": possum}).Debugf("Inserting alive state into DB")
+		_, insertErr := db.Exec("INSERT INTO state (possum, state) VALUES (?, ?)", possum, "alive")
+		if insertErr != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "SetupStateDB"}).Debugf("Error inserting into DB %s", insertErr.Error())
+			return insertErr
 		}
 	}
 	return nil
 }
 
-// GetPassel - Returns the passel of possums
+// GetPassel - Returns the passel of possums, from the reloaded passel config if there is one
 func GetPassel() ([]string, error) {
 	var possums []string
 
+	if config := reloadedPasselConfig(); config != nil {
+		return append(possums, config.Passel...), nil
+	}
+
 	appEnv, err := cfenv.Current()
 	if err != nil {
 		log.WithFields(log.Fields{"package": "utils", "function": "GetPassel"}).Debugf("Can't get CF env variables: %s", err)
@@ -122,59 +115,250 @@ func GetPassel() ([]string, error) {
 	return possums, nil
 }
 
-// GetState - returns current state for the given possum
-func GetState(db *sql.DB, possum string) (string, error) {
-	var possumdb, state string
-	row := db.QueryRow("SELECT * FROM state WHERE possum=?", possum)
-	err := row.Scan(&possumdb, &state)
-	if err != nil {
-		log.WithFields(log.Fields{"package": "utils", "function": "GetState", "dbquery": "SELECT * FROM state WHERE possum=" + possum}).Debugf("Can't get rows from DB: %s", err)
-		if err.Error() == "sql: no rows in result set" {
-			return "", fmt.Errorf("Could not find possum %s in db", possum)
-		}
-		return "", err
-	}
-	return state, nil
+// PossumState - the state of a possum with its metadata
+type PossumState struct {
+	State string `json:"state"`
+	// Version counts the changes to the state, it is 0 until the state is first changed
+	Version   int64      `json:"version"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	UpdatedBy string     `json:"updated_by,omitempty"`
 }
 
-// GetPasselState - returns current state for the given passel
+const possumStateColumns = "possum, state, version, updated_at, updated_by"
+
+// GetPasselState - returns current state for the given passel, read in one query
 func GetPasselState(db *sql.DB, passel []string) (map[string]string, error) {
 	if len(passel) == 0 {
 		log.WithFields(log.Fields{"package": "utils", "function": "GetPasselState"}).Debugf("Passel had 0 members")
 		return nil, fmt.Errorf("Passel had 0 members")
 	}
+	placeholders, args := inPlaceholders(passel)
+	stmt, err := prepared(db, "SELECT possum, state FROM state WHERE possum IN ("+placeholders+")")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetPasselState"}).Debugf("Can't get rows from DB: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
 	passelState := make(map[string]string)
-	for _, possum := range passel {
-		var possumdb, state string
-		row := db.QueryRow("SELECT * FROM state WHERE possum=?", possum)
-		err := row.Scan(&possumdb, &state)
-		if err != nil {
-			log.WithFields(log.Fields{"package": "utils", "function": "GetPasselState", "dbquery": "SELECT * FROM state WHERE possum=" + possum}).Debugf("Can't get rows from DB: %s", err)
-			if err.Error() == "sql: no rows in result set" {
-				return nil, fmt.Errorf("Could not find possum %s in db", possum)
-			}
+	for rows.Next() {
+		var possum, state string
+		if err := rows.Scan(&possum, &state); err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "GetPasselState"}).Debugf("Can't scan row: %s", err)
 			return nil, err
 		}
 		passelState[possum] = state
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, possum := range passel {
+		if _, found := passelState[possum]; !found {
+			return nil, fmt.Errorf("Could not find possum %s in db", possum)
+		}
+	}
 	return passelState, nil
 }
 
-// WriteState - Updates the state of a possum
-func WriteState(db *sql.DB, desiredPossum string, desiredState string) error {
-	if desiredState != "alive" && desiredState != "dead" {
-		return fmt.Errorf(`The state should have been "alive" or "dead" not "%s"`, desiredState)
+// GetPasselStateMetadata - returns current state for the given passel with the version of
+// each state and when and by whom it was last changed, read in one query
+func GetPasselStateMetadata(db *sql.DB, passel []string) (map[string]PossumState, error) {
+	if len(passel) == 0 {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetPasselStateMetadata"}).Debugf("Passel had 0 members")
+		return nil, fmt.Errorf("Passel had 0 members")
 	}
-	_, err := db.Exec("UPDATE state SET state=? WHERE possum=?", desiredState, desiredPossum)
+	passelState, err := readPasselState(db, passel)
 	if err != nil {
-		log.WithFields(log.Fields{"package": "utils", "function": "WriteState", "dbquery": "UPDATE state SET state=" + desiredState + " WHERE possum=" + desiredPossum}).Debugf("Can't update DB: %s", err)
-		return err
+		return nil, err
 	}
-	return nil
+	for _, possum := range passel {
+		if _, found := passelState[possum]; !found {
+			return nil, fmt.Errorf("Could not find possum %s in db", possum)
+		}
+	}
+	return passelState, nil
+}
+
+// GetOrphanedStates - returns the state rows of possums that are not in the passel
+func GetOrphanedStates(db *sql.DB, passel []string) (map[string]string, error) {
+	if len(passel) == 0 {
+		return nil, fmt.Errorf("Passel had 0 members")
+	}
+	placeholders, args := inPlaceholders(passel)
+	stmt, err := prepared(db, "SELECT possum, state FROM state WHERE possum NOT IN ("+placeholders+")")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetOrphanedStates"}).Debugf("Can't get rows from DB: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	orphaned := make(map[string]string)
+	for rows.Next() {
+		var possum, state string
+		if err := rows.Scan(&possum, &state); err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "GetOrphanedStates"}).Debugf("Can't scan row: %s", err)
+			return nil, err
+		}
+		orphaned[possum] = state
+	}
+	return orphaned, rows.Err()
+}
+
+// readPasselState - reads the states and metadata of the possums of the passel that have a state row
+func readPasselState(db *sql.DB, passel []string) (map[string]PossumState, error) {
+	placeholders, args := inPlaceholders(passel)
+	stmt, err := prepared(db, "SELECT "+possumStateColumns+" FROM state WHERE possum IN ("+placeholders+")")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "readPasselState"}).Debugf("Can't get rows from DB: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	passelState := make(map[string]PossumState)
+	for rows.Next() {
+		var possum string
+		var possumState PossumState
+		var updatedAt sql.NullTime
+		if err := rows.Scan(&possum, &possumState.State, &possumState.Version, &updatedAt, &possumState.UpdatedBy); err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "readPasselState"}).Debugf("Can't scan row: %s", err)
+			return nil, err
+		}
+		if updatedAt.Valid {
+			updated := updatedAt.Time.UTC()
+			possumState.UpdatedAt = &updated
+		}
+		passelState[possum] = possumState
+	}
+	return passelState, rows.Err()
+}
+
+// updateStateQuery - changes the state of a possum, counting the change in its version
+const updateStateQuery = "UPDATE state SET state=?, version=version+1, updated_at=?, updated_by=? WHERE possum=?"
+
+// WriteStates - applies desired states in a single transaction. The rows of the
+// passel are locked and read first, and validate is called with them before
+// anything is written, reading any service states it needs through the transaction;
+// an error from validate rolls the transaction back, otherwise it returns the
+// emergency reason the changes are recorded with. Returns the passel state as it
+// was before the write.
+func WriteStates(db *sql.DB, passel []string, desired map[string]string, actor string, validate func(passelState map[string]string, serviceStates ServiceStateReader) (string, error)) (map[string]string, error) {
+	for possum, state := range desired {
+		if state != "alive" && state != "dead" {
+			return nil, fmt.Errorf(`The state of %s should have been "alive" or "dead" not "%s"`, possum, state)
+		}
+	}
+	if len(passel) == 0 {
+		return nil, fmt.Errorf("Passel had 0 members")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "WriteStates"}).Debugf("Can't begin transaction: %s", err)
+		return nil, err
+	}
+	// a rollback after a commit does nothing
+	defer tx.Rollback()
+
+	passelState, err := lockPasselState(tx, passel)
+	if err != nil {
+		return nil, err
+	}
+
+	emergencyReason, err := validate(passelState, txServiceStateReader(tx, passel))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := writeStateChanges(tx, passelState, desired, actor, emergencyReason); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "WriteStates"}).Debugf("Can't commit: %s", err)
+		return nil, err
+	}
+	return passelState, nil
+}
+
+// lockPasselState - locks and reads the state rows of the passel inside a transaction,
+// failing if any possum has no row
+func lockPasselState(tx *sql.Tx, passel []string) (map[string]string, error) {
+	// lock in a consistent order so concurrent writes cannot deadlock
+	possums := append([]string{}, passel...)
+	sort.Strings(possums)
+	placeholders, args := inPlaceholders(possums)
+	rows, err := tx.Query("SELECT possum, state FROM state WHERE possum IN ("+placeholders+") ORDER BY possum FOR UPDATE", args...)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "lockPasselState"}).Debugf("Can't lock rows: %s", err)
+		return nil, err
+	}
+	passelState := make(map[string]string)
+	for rows.Next() {
+		var possum, state string
+		if err := rows.Scan(&possum, &state); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		passelState[possum] = state
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, possum := range possums {
+		if _, found := passelState[possum]; !found {
+			return nil, fmt.Errorf("Could not find possum %s in db", possum)
+		}
+	}
+	return passelState, nil
+}
+
+// writeStateChanges - updates every possum whose desired state differs from its locked
+// state and records each change, returning the possums that changed
+func writeStateChanges(tx *sql.Tx, passelState map[string]string, desired map[string]string, actor string, emergencyReason string) ([]string, error) {
+	var changed []string
+	changedAt := time.Now().UTC()
+	desiredPossums := make([]string, 0, len(desired))
+	for possum := range desired {
+		desiredPossums = append(desiredPossums, possum)
+	}
+	sort.Strings(desiredPossums)
+	for _, possum := range desiredPossums {
+		state := desired[possum]
+		current, found := passelState[possum]
+		if !found {
+			return nil, fmt.Errorf("Possum %s is not part of the passel", possum)
+		}
+		if current == state {
+			continue
+		}
+		if _, err := tx.Exec(updateStateQuery, state, changedAt, actor, possum); err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "writeStateChanges", "possum": possum}).Debugf("Can't update DB: %s", err)
+			return nil, err
+		}
+		_, err := tx.Exec("INSERT INTO state_history (possum, state, changed_at, changed_by, emergency, reason) VALUES (?, ?, ?, ?, ?, ?)", possum, state, changedAt, actor, emergencyReason != "", emergencyReason)
+		if err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "writeStateChanges", "possum": possum}).Debugf("Can't insert into DB: %s", err)
+			return nil, err
+		}
+		changed = append(changed, possum)
+	}
+	return changed, nil
 }
 
 // GetUsername - Returns the basic auth username
 func GetUsername() (string, error) {
+	if config := reloadedPasselConfig(); config != nil && config.Username != "" {
+		return config.Username, nil
+	}
+
 	appEnv, err := cfenv.Current()
 	if err != nil {
 		log.WithFields(log.Fields{"package": "utils", "function": "GetUsername"}).Debugf("Can't get CF env variables: %s", err)
@@ -199,6 +383,10 @@ func GetUsername() (string, error) {
 
 // GetPassword - Returns the basic auth password
 func GetPassword() (string, error) {
+	if config := reloadedPasselConfig(); config != nil && config.Password != "" {
+		return config.Password, nil
+	}
+
 	appEnv, err := cfenv.Current()
 	if err != nil {
 		log.WithFields(log.Fields{"package": "utils", "function": "GetPassword"}).Debugf("Can't get CF env variables: %s", err)
@@ -220,3 +408,188 @@ func GetPassword() (string, error) {
 
 	return password.(string), nil
 }
+
+// GetPeerSecret - Returns the secret possums sign the writes they make to each other with,
+// empty if it is not configured. Unlike the username and password it is never given to
+// operators, so a signed write is known to come from a possum.
+func GetPeerSecret() (string, error) {
+	return GetPasselConfigPeerSecret(reloadedPasselConfig())
+}
+
+// GetPasselConfigPeerSecret - Returns the peer secret possums would use with config swapped in,
+// its own or that of the "possum" service; config may be nil
+func GetPasselConfigPeerSecret(config *PasselConfig) (string, error) {
+	if config != nil && config.PeerSecret != "" {
+		return config.PeerSecret, nil
+	}
+
+	appEnv, err := cfenv.Current()
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetPasselConfigPeerSecret"}).Debugf("Can't get CF env variables: %s", err)
+		return "", err
+	}
+
+	service, err := appEnv.Services.WithName("possum")
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetPasselConfigPeerSecret"}).Debugf("Can't get service with a name \"possum\": %s", err)
+		return "", err
+	}
+
+	secret, ok := service.Credentials["peer_secret"].(string)
+	if !ok {
+		return "", nil
+	}
+	return secret, nil
+}
+
+// GetEmergencyCredentials - Returns the basic auth username and password allowed to make
+// emergency changes during a freeze, both are empty if they are not configured
+func GetEmergencyCredentials() (string, string, error) {
+	if config := reloadedPasselConfig(); config != nil && config.EmergencyUsername != "" {
+		return config.EmergencyUsername, config.EmergencyPassword, nil
+	}
+
+	appEnv, err := cfenv.Current()
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetEmergencyCredentials"}).Debugf("Can't get CF env variables: %s", err)
+		return "", "", err
+	}
+
+	service, err := appEnv.Services.WithName("possum")
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetEmergencyCredentials"}).Debugf("Can't get service with a name \"possum\": %s", err)
+		return "", "", err
+	}
+
+	username, _ := service.Credentials["emergency_username"].(string)
+	password, _ := service.Credentials["emergency_password"].(string)
+	return username, password, nil
+}
+
+// GetUsers - Returns the basic auth passwords of the named users who can change state, by username
+func GetUsers() (map[string]string, error) {
+	if config := reloadedPasselConfig(); config != nil && config.Users != nil {
+		users := make(map[string]string)
+		for username, password := range config.Users {
+			users[username] = password
+		}
+		return users, nil
+	}
+
+	appEnv, err := cfenv.Current()
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetUsers"}).Debugf("Can't get CF env variables: %s", err)
+		return nil, err
+	}
+
+	service, err := appEnv.Services.WithName("possum")
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetUsers"}).Debugf("Can't get service with a name \"possum\": %s", err)
+		return nil, err
+	}
+
+	users := make(map[string]string)
+	configured, _ := service.Credentials["users"].(map[string]interface{})
+	for username, password := range configured {
+		if reflect.TypeOf(password) != reflect.TypeOf("") {
+			return nil, fmt.Errorf("the password of user %s was not a string", username)
+		}
+		users[username] = password.(string)
+	}
+	return users, nil
+}
+
+// StateChange - a recorded change to the state of a possum
+type StateChange struct {
+	Possum    string    `json:"possum"`
+	State     string    `json:"state"`
+	ChangedAt time.Time `json:"changed_at"`
+	ChangedBy string    `json:"changed_by"`
+	Emergency bool      `json:"emergency,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// GetLastStateChanges - returns the most recent recorded change for each possum in the passel,
+// read in one query, possums that have never been changed are omitted
+func GetLastStateChanges(db *sql.DB, passel []string) (map[string]StateChange, error) {
+	stateChanges := make(map[string]StateChange)
+	if len(passel) == 0 {
+		return stateChanges, nil
+	}
+	placeholders, args := inPlaceholders(passel)
+	stmt, err := prepared(db, "SELECT h.possum, h.state, h.changed_at, h.changed_by, h.emergency, h.reason FROM state_history h "+
+		"JOIN (SELECT MAX(id) AS id FROM state_history WHERE possum IN ("+placeholders+") GROUP BY possum) latest ON h.id = latest.id")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetLastStateChanges"}).Debugf("Can't get rows from DB: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var stateChange StateChange
+		if err := rows.Scan(&stateChange.Possum, &stateChange.State, &stateChange.ChangedAt, &stateChange.ChangedBy, &stateChange.Emergency, &stateChange.Reason); err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "GetLastStateChanges"}).Debugf("Can't scan row: %s", err)
+			return nil, err
+		}
+		stateChanges[stateChange.Possum] = stateChange
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return stateChanges, nil
+}
+
+// MissedWrite - a passel state write that a possum missed and must be caught up with
+type MissedWrite struct {
+	Possum string `json:"possum"`
+	// Service is empty for a write to the state of the possum itself
+	Service     string    `json:"service,omitempty"`
+	PasselState string    `json:"passel_state"`
+	MissedAt    time.Time `json:"missed_at"`
+	ChangedBy   string    `json:"changed_by"`
+}
+
+// RecordMissedWrite - records that a possum missed a passel state write of the possum, or of
+// one of its services, replacing any earlier missed write of the same
+func RecordMissedWrite(db *sql.DB, possum string, service string, passelState string, actor string) error {
+	_, err := db.Exec("REPLACE INTO missed_writes (possum, service, passel_state, missed_at, changed_by) VALUES (?, ?, ?, ?, ?)", possum, service, passelState, time.Now().UTC(), actor)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "RecordMissedWrite", "possum": possum}).Debugf("Can't insert into DB: %s", err)
+		return err
+	}
+	return nil
+}
+
+// GetMissedWrites - returns every recorded missed write
+func GetMissedWrites(db *sql.DB) ([]MissedWrite, error) {
+	rows, err := db.Query("SELECT possum, service, passel_state, missed_at, changed_by FROM missed_writes ORDER BY possum, service")
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "GetMissedWrites"}).Debugf("Can't get rows from DB: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var missedWrites []MissedWrite
+	for rows.Next() {
+		var missedWrite MissedWrite
+		err = rows.Scan(&missedWrite.Possum, &missedWrite.Service, &missedWrite.PasselState, &missedWrite.MissedAt, &missedWrite.ChangedBy)
+		if err != nil {
+			log.WithFields(log.Fields{"package": "utils", "function": "GetMissedWrites"}).Debugf("Can't scan row: %s", err)
+			return nil, err
+		}
+		missedWrites = append(missedWrites, missedWrite)
+	}
+	return missedWrites, rows.Err()
+}
+
+// ClearMissedWrite - removes a missed write of a possum once it has caught up
+func ClearMissedWrite(db *sql.DB, possum string, service string) error {
+	_, err := db.Exec("DELETE FROM missed_writes WHERE possum=? AND service=?", possum, service)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "utils", "function": "ClearMissedWrite", "possum": possum}).Debugf("Can't delete from DB: %s", err)
+		return err
+	}
+	return nil
+}
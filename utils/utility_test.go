@@ -1,8 +1,13 @@
 package utils_test
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/FidelityInternational/possum/utils"
@@ -150,7 +155,7 @@ var _ = Describe("GetDBConnectionDetails", func() {
 		It("Returns the database connection string", func() {
 			dbConnString, err := utils.GetDBConnectionDetails()
 			Ω(err).Should(BeNil())
-			Ω(dbConnString).Should(Equal("test_user:test_password@tcp(test_host:test_port)/test_database"))
+			Ω(dbConnString).Should(Equal("test_user:test_password@tcp(test_host:test_port)/test_database?parseTime=true"))
 		})
 
 		Context("When unmarshaling a managed database connection", func() {
@@ -184,7 +189,7 @@ var _ = Describe("GetDBConnectionDetails", func() {
 			It("returns the database connection string", func() {
 				dbConnString, err := utils.GetDBConnectionDetails()
 				Ω(err).Should(BeNil())
-				Ω(dbConnString).Should(Equal("test_user:test_password@tcp(test_host:3306)/test_database"))
+				Ω(dbConnString).Should(Equal("test_user:test_password@tcp(test_host:3306)/test_database?parseTime=true"))
 			})
 		})
 
@@ -229,7 +234,7 @@ var _ = Describe("#SetupStateDB", func() {
 		os.Unsetenv("VCAP_SERVICES")
 	})
 
-	Context("When the table exists", func() {
+	Context("When the state table has been migrated", func() {
 		Context("when getting passel returns an error", func() {
 			BeforeEach(func() {
 				vcapServicesJSON = `{
@@ -248,14 +253,13 @@ var _ = Describe("#SetupStateDB", func() {
 			})
 
 			It("does nothing and returns an error", func() {
-				db, mock, err := sqlmock.New()
+				db, _, err := sqlmock.New()
 				if err != nil {
 					fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
 					os.Exit(1)
 				}
 				defer db.Close()
 
-				mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(1, 1))
 				Ω(utils.SetupStateDB(db)).Should(MatchError("invalid character '\\n' in string literal"))
 			})
 		})
@@ -292,32 +296,27 @@ var _ = Describe("#SetupStateDB", func() {
 					mRows := sqlmock.NewRows([]string{"possum"}).
 						AddRow("mother")
 
-					mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(1, 1))
-					mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WillReturnRows(mRows)
-					Ω(utils.SetupStateDB(db)).Should(MatchError("sql: expected 1 destination arguments in Scan, not 2"))
+					mock.ExpectPrepare("SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WithArgs("mother", "father", "joey").WillReturnRows(mRows)
+					Ω(utils.SetupStateDB(db)).Should(MatchError("sql: expected 1 destination arguments in Scan, not 5"))
 				})
 			})
 
 			Context("when all possums are already in the db", func() {
-				It("does not create database or insert rows", func() {
+				It("does not insert rows", func() {
 					db, mock, err := sqlmock.New()
 					if err != nil {
 						fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
 						os.Exit(1)
 					}
 					defer db.Close()
-					mRows := sqlmock.NewRows([]string{"possum", "state"}).
-						AddRow("mother", "alive")
-					fRows := sqlmock.NewRows([]string{"possum", "state"}).
-						AddRow("father", "alive")
-					jRows := sqlmock.NewRows([]string{"possum", "state"}).
-						AddRow("joey", "alive")
-
-					mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(1, 1))
-					mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WillReturnRows(mRows)
-					mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WillReturnRows(fRows)
-					mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WillReturnRows(jRows)
+					rows := sqlmock.NewRows([]string{"possum", "state", "version", "updated_at", "updated_by"}).
+						AddRow("mother", "alive", 0, nil, "").
+						AddRow("father", "alive", 0, nil, "").
+						AddRow("joey", "alive", 0, nil, "")
+
+					mock.ExpectPrepare("SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WithArgs("mother", "father", "joey").WillReturnRows(rows)
 					Ω(utils.SetupStateDB(db)).Should(BeNil())
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
 				})
 			})
 
@@ -330,85 +329,186 @@ var _ = Describe("#SetupStateDB", func() {
 							os.Exit(1)
 						}
 						defer db.Close()
-						rows := sqlmock.NewRows([]string{"possum", "state"})
+						rows := sqlmock.NewRows([]string{"possum", "state", "version", "updated_at", "updated_by"})
 
-						mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(1, 1))
-						mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WillReturnRows(rows)
+						mock.ExpectPrepare("SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnRows(rows)
 						mock.ExpectExec("INSERT INTO state").WithArgs("mother").WillReturnResult(sqlmock.NewResult(1, 1))
-						Ω(utils.SetupStateDB(db)).Should(MatchError("ExecQuery 'INSERT INTO state VALUES (?, ?)', arguments do not match: expected 1, but got 2 arguments"))
+						Ω(utils.SetupStateDB(db)).Should(MatchError("ExecQuery 'INSERT INTO state (possum, state) VALUES (?, ?)', arguments do not match: expected 1, but got 2 arguments"))
 					})
 				})
 
 				Context("and inserting the records does not return an error", func() {
-					It("does not create database but does insert the possums with an alive state", func() {
+					It("inserts the possums with an alive state", func() {
 						db, mock, err := sqlmock.New()
 						if err != nil {
 							fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
 							os.Exit(1)
 						}
 						defer db.Close()
-						rows := sqlmock.NewRows([]string{"possum", "state"})
+						rows := sqlmock.NewRows([]string{"possum", "state", "version", "updated_at", "updated_by"}).
+							AddRow("father", "dead", 1, nil, "")
 
-						mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(1, 1))
-						mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WillReturnRows(rows)
+						mock.ExpectPrepare("SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnRows(rows)
 						mock.ExpectExec("INSERT INTO state").WithArgs("mother", "alive").WillReturnResult(sqlmock.NewResult(1, 1))
-						mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WillReturnRows(rows)
-						mock.ExpectExec("INSERT INTO state").WithArgs("father", "alive").WillReturnResult(sqlmock.NewResult(1, 1))
-						mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WillReturnRows(rows)
 						mock.ExpectExec("INSERT INTO state").WithArgs("joey", "alive").WillReturnResult(sqlmock.NewResult(1, 1))
 						Ω(utils.SetupStateDB(db)).Should(BeNil())
+						Ω(mock.ExpectationsWereMet()).Should(Succeed())
 					})
 				})
 			})
 		})
 	})
 
-	Context("When the table does not exist", func() {
-		BeforeEach(func() {
-			vcapServicesJSON = `{
-"user-provided": [
- {
-  "credentials": {
-    "passel": [
-      "mother",
-      "father",
-      "joey"
-    ]
-  },
-  "label": "user-provided",
-  "name": "possum",
-  "syslog_drain_url": "",
-  "tags": []
- }
-]
-}`
+})
+
+var _ = Describe("#Migrate", func() {
+	var (
+		db   *sql.DB
+		mock sqlmock.Sqlmock
+		err  error
+	)
+
+	BeforeEach(func() {
+		db, mock, err = sqlmock.New()
+		if err != nil {
+			fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+			os.Exit(1)
+		}
+	})
+
+	AfterEach(func() {
+		db.Close()
+	})
+
+	expectStatements := func(migration utils.Migration) {
+		for _, statement := range migration.Statements {
+			if statement.Applied != "" {
+				mock.ExpectQuery("information_schema").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			}
+			mock.ExpectExec(".+").WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+	}
+
+	expectVersion := func(version int) {
+		mock.ExpectQuery("SELECT GET_LOCK").WithArgs("possum_migrations", 60).WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_version").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT COALESCE").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(version))
+	}
+
+	Context("when the database has no schema version", func() {
+		It("applies every migration in order and releases the lock", func() {
+			expectVersion(0)
+			for _, migration := range utils.Migrations {
+				expectStatements(migration)
+				mock.ExpectExec("INSERT INTO schema_version").WithArgs(migration.Version, migration.Description, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			mock.ExpectQuery("SELECT RELEASE_LOCK").WithArgs("possum_migrations").WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+
+			status, err := utils.Migrate(db)
+			Ω(err).Should(BeNil())
+			Ω(status.CurrentVersion).Should(Equal(utils.LatestSchemaVersion()))
+			Ω(status.Pending).Should(BeEmpty())
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+	})
+
+	Context("when only the newest migration is pending", func() {
+		It("applies only that migration", func() {
+			latest := utils.Migrations[len(utils.Migrations)-1]
+			expectVersion(latest.Version - 1)
+			expectStatements(latest)
+			mock.ExpectExec("INSERT INTO schema_version").WithArgs(latest.Version, latest.Description, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery("SELECT RELEASE_LOCK").WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+
+			status, err := utils.Migrate(db)
+			Ω(err).Should(BeNil())
+			Ω(status.CurrentVersion).Should(Equal(latest.Version))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
 		})
+	})
 
-		It("creates the table", func() {
-			db, mock, err := sqlmock.New()
-			if err != nil {
-				fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
-				os.Exit(1)
+	Context("when a migration failed after some of its statements were applied", func() {
+		It("skips the statements that were applied", func() {
+			expectVersion(7)
+			mock.ExpectQuery("SELECT COUNT(.+) FROM information_schema.columns WHERE (.+) table_name='state' AND column_name='version'").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			mock.ExpectQuery("SELECT COUNT(.+) FROM information_schema.columns WHERE (.+) table_name='state' AND column_name='updated_at'").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			mock.ExpectExec("ALTER TABLE state ADD COLUMN updated_at datetime NULL").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery("SELECT COUNT(.+) FROM information_schema.columns WHERE (.+) table_name='state' AND column_name='updated_by'").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			mock.ExpectExec("ALTER TABLE state ADD COLUMN updated_by").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("INSERT INTO schema_version").WithArgs(8, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			for _, migration := range utils.Migrations[8:] {
+				expectStatements(migration)
+				mock.ExpectExec("INSERT INTO schema_version").WithArgs(migration.Version, migration.Description, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
 			}
-			defer db.Close()
-			mRows := sqlmock.NewRows([]string{"possum", "state"}).
-				AddRow("mother", "alive")
-			fRows := sqlmock.NewRows([]string{"possum", "state"}).
-				AddRow("father", "alive")
-			jRows := sqlmock.NewRows([]string{"possum", "state"}).
-				AddRow("joey", "alive")
+			mock.ExpectQuery("SELECT RELEASE_LOCK").WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
 
-			mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(1, 1))
-			mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WillReturnRows(mRows)
-			mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WillReturnRows(fRows)
-			mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WillReturnRows(jRows)
-			mock.ExpectExec("CREATE TABLE").WillReturnResult(sqlmock.NewResult(1, 1))
-			Ω(utils.SetupStateDB(db)).Should(BeNil())
+			status, err := utils.Migrate(db)
+			Ω(err).Should(BeNil())
+			Ω(status.CurrentVersion).Should(Equal(utils.LatestSchemaVersion()))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
 		})
 	})
 
-	Context("When the create command returns an error", func() {
-		It("Returns an error", func() {
+	Context("when the database schema is newer than this possum understands", func() {
+		It("refuses to migrate and returns an error", func() {
+			expectVersion(utils.LatestSchemaVersion() + 1)
+			mock.ExpectQuery("SELECT RELEASE_LOCK").WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+
+			_, err := utils.Migrate(db)
+			Ω(err).Should(MatchError(fmt.Sprintf("The database schema is version %d but this possum only understands up to version %d", utils.LatestSchemaVersion()+1, utils.LatestSchemaVersion())))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+	})
+
+	Context("when the lock is held by another possum", func() {
+		It("returns an error without migrating", func() {
+			mock.ExpectQuery("SELECT GET_LOCK").WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(0))
+
+			_, err := utils.Migrate(db)
+			Ω(err).Should(MatchError("Could not get the migration lock within 60 seconds"))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+	})
+
+	Context("when a migration raises an error", func() {
+		It("returns an error and does not record the migration", func() {
+			expectVersion(0)
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS state").WillReturnError(fmt.Errorf("An error has occurred: %s", "Database Create Error"))
+			mock.ExpectQuery("SELECT RELEASE_LOCK").WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+
+			status, err := utils.Migrate(db)
+			Ω(err).Should(MatchError("An error has occurred: Database Create Error"))
+			Ω(status.CurrentVersion).Should(Equal(0))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+	})
+})
+
+var _ = Describe("#GetMigrationStatus", func() {
+	It("returns the current version and the pending migrations", func() {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("SELECT COUNT(.+) FROM information_schema.tables WHERE (.+) table_name='schema_version'").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectQuery("SELECT COALESCE").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(2))
+		status, err := utils.GetMigrationStatus(db)
+		Ω(err).Should(BeNil())
+		Ω(status.CurrentVersion).Should(Equal(2))
+		Ω(status.LatestVersion).Should(Equal(utils.LatestSchemaVersion()))
+		Ω(status.Pending).Should(HaveLen(len(utils.Migrations) - 2))
+		Ω(status.Pending[0].Version).Should(Equal(3))
+		Ω(mock.ExpectationsWereMet()).Should(Succeed())
+	})
+
+	Context("when the database has never been migrated", func() {
+		It("reports version 0 without creating the schema_version table", func() {
 			db, mock, err := sqlmock.New()
 			if err != nil {
 				fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
@@ -416,10 +516,12 @@ var _ = Describe("#SetupStateDB", func() {
 			}
 			defer db.Close()
 
-			mock.ExpectExec("CREATE TABLE").WillReturnError(fmt.Errorf("An error has occurred: %s", "Database Create Error"))
-			err = utils.SetupStateDB(db)
-			Ω(err).ShouldNot(BeNil())
-			Ω(err.Error()).Should(Equal("An error has occurred: Database Create Error"))
+			mock.ExpectQuery("SELECT COUNT(.+) FROM information_schema.tables").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			status, err := utils.GetMigrationStatus(db)
+			Ω(err).Should(BeNil())
+			Ω(status.CurrentVersion).Should(Equal(0))
+			Ω(status.Pending).Should(Equal(utils.Migrations))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
 		})
 	})
 })
@@ -544,66 +646,6 @@ var _ = Describe("GetPassel", func() {
 	})
 })
 
-var _ = Describe("#GetState", func() {
-	Context("When the possum exists", func() {
-		It("Returns the state", func() {
-			db, mock, err := sqlmock.New()
-			if err != nil {
-				fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
-				os.Exit(1)
-			}
-			defer db.Close()
-
-			rows := sqlmock.NewRows([]string{"possum", "state"}).
-				AddRow("joey", "alive")
-
-			mock.ExpectQuery("^SELECT (.+) FROM state WHERE possum=").WillReturnRows(rows)
-
-			state, err := utils.GetState(db, "joey")
-			Ω(err).Should(BeNil())
-			Ω(state).Should(Equal("alive"))
-		})
-	})
-
-	Context("When the possum does not exist", func() {
-		It("Returns an error", func() {
-			db, mock, err := sqlmock.New()
-			if err != nil {
-				fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
-				os.Exit(1)
-			}
-			defer db.Close()
-
-			rows := sqlmock.NewRows([]string{"possum", "state"})
-			mock.ExpectQuery("^SELECT (.+) FROM state WHERE possum=").WillReturnRows(rows)
-
-			state, err := utils.GetState(db, "joey")
-			Ω(err).Should(MatchError("Could not find possum joey in db"))
-			Ω(state).Should(Equal(""))
-		})
-	})
-
-	Context("when a row cannot be scanned", func() {
-		It("returns an error", func() {
-			db, mock, err := sqlmock.New()
-			if err != nil {
-				fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
-				os.Exit(1)
-			}
-			defer db.Close()
-
-			rows := sqlmock.NewRows([]string{"possum"}).
-				AddRow("joey")
-
-			mock.ExpectQuery("^SELECT (.+) FROM state WHERE possum=").WillReturnRows(rows)
-
-			state, err := utils.GetState(db, "joey")
-			Ω(err).Should(MatchError("sql: expected 1 destination arguments in Scan, not 2"))
-			Ω(state).Should(Equal(""))
-		})
-	})
-})
-
 var _ = Describe("#GetPasselState", func() {
 	Context("When passel is empty", func() {
 		var passel = []string{}
@@ -632,16 +674,12 @@ var _ = Describe("#GetPasselState", func() {
 				}
 				defer db.Close()
 
-				mRows := sqlmock.NewRows([]string{"possum", "state"}).
+				rows := sqlmock.NewRows([]string{"possum", "state"}).
+					AddRow("father", "dead").
+					AddRow("joey", "alive").
 					AddRow("mother", "alive")
-				fRows := sqlmock.NewRows([]string{"possum", "state"}).
-					AddRow("father", "dead")
-				jRows := sqlmock.NewRows([]string{"possum", "state"}).
-					AddRow("joey", "alive")
 
-				mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WithArgs("father").WillReturnRows(fRows)
-				mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WithArgs("mother").WillReturnRows(mRows)
-				mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WithArgs("joey").WillReturnRows(jRows)
+				mock.ExpectPrepare(`^SELECT possum, state FROM state WHERE possum IN \(\?, \?, \?\)$`).ExpectQuery().WithArgs("father", "mother", "joey").WillReturnRows(rows)
 
 				passelState, err := utils.GetPasselState(db, passel)
 				Ω(err).Should(BeNil())
@@ -661,21 +699,34 @@ var _ = Describe("#GetPasselState", func() {
 				}
 				defer db.Close()
 
-				mRows := sqlmock.NewRows([]string{"possum", "state"})
-				fRows := sqlmock.NewRows([]string{"possum", "state"}).
-					AddRow("father", "dead")
-				jRows := sqlmock.NewRows([]string{"possum", "state"}).
+				rows := sqlmock.NewRows([]string{"possum", "state"}).
+					AddRow("father", "dead").
 					AddRow("joey", "alive")
 
-				mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WithArgs("father").WillReturnRows(fRows)
-				mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WithArgs("mother").WillReturnRows(mRows)
-				mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WithArgs("joey").WillReturnRows(jRows)
+				mock.ExpectPrepare("SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WithArgs("father", "mother", "joey").WillReturnRows(rows)
 				state, err := utils.GetPasselState(db, passel)
 				Ω(err).Should(MatchError("Could not find possum mother in db"))
 				Ω(state).Should(BeNil())
 			})
 		})
 
+		Context("when the query raises an error", func() {
+			It("returns the error", func() {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+					os.Exit(1)
+				}
+				defer db.Close()
+
+				mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnError(fmt.Errorf("An error has occurred: %s", "SELECT error"))
+
+				state, err := utils.GetPasselState(db, passel)
+				Ω(err).Should(MatchError("An error has occurred: SELECT error"))
+				Ω(state).Should(BeNil())
+			})
+		})
+
 		Context("when a row cannot be scanned", func() {
 			It("returns an error", func() {
 				db, mock, err := sqlmock.New()
@@ -688,7 +739,7 @@ var _ = Describe("#GetPasselState", func() {
 				rows := sqlmock.NewRows([]string{"possum"}).
 					AddRow("joey")
 
-				mock.ExpectQuery("^SELECT (.+) FROM state WHERE possum=").WillReturnRows(rows)
+				mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnRows(rows)
 
 				state, err := utils.GetPasselState(db, passel)
 				Ω(err).Should(MatchError("sql: expected 1 destination arguments in Scan, not 2"))
@@ -698,23 +749,55 @@ var _ = Describe("#GetPasselState", func() {
 	})
 })
 
-var _ = Describe("#WriteState", func() {
-	Context("when the state is 'alive'", func() {
-		It("Updates the possum state", func() {
-			db, mock, err := sqlmock.New()
-			if err != nil {
-				fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
-				os.Exit(1)
-			}
-			defer db.Close()
+var _ = Describe("#GetPasselStateMetadata", func() {
+	var passel = []string{"father", "mother", "joey"}
+
+	It("returns the state of each possum with its version and last update", func() {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		updatedAt := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+		rows := sqlmock.NewRows([]string{"possum", "state", "version", "updated_at", "updated_by"}).
+			AddRow("father", "dead", 2, updatedAt, "admin").
+			AddRow("joey", "alive", 0, nil, "").
+			AddRow("mother", "alive", 1, updatedAt, "alice")
+		mock.ExpectPrepare(`^SELECT possum, state, version, updated_at, updated_by FROM state WHERE possum IN \(\?, \?, \?\)$`).ExpectQuery().WithArgs("father", "mother", "joey").WillReturnRows(rows)
+
+		metadata, err := utils.GetPasselStateMetadata(db, passel)
+		Ω(err).Should(BeNil())
+		Ω(metadata).Should(Equal(map[string]utils.PossumState{
+			"father": {State: "dead", Version: 2, UpdatedAt: &updatedAt, UpdatedBy: "admin"},
+			"joey":   {State: "alive"},
+			"mother": {State: "alive", Version: 1, UpdatedAt: &updatedAt, UpdatedBy: "alice"},
+		}))
+	})
 
-			mock.ExpectExec("UPDATE state.*").WithArgs("alive", "joey").WillReturnResult(sqlmock.NewResult(1, 1))
-			Ω(utils.WriteState(db, "joey", "alive")).Should(BeNil())
-		})
+	It("prepares the query once", func() {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		columns := []string{"possum", "state", "version", "updated_at", "updated_by"}
+		prepared := mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN")
+		prepared.ExpectQuery().WillReturnRows(sqlmock.NewRows(columns).AddRow("father", "dead", 1, nil, "").AddRow("mother", "alive", 0, nil, "").AddRow("joey", "alive", 0, nil, ""))
+		prepared.ExpectQuery().WillReturnRows(sqlmock.NewRows(columns).AddRow("father", "dead", 1, nil, "").AddRow("mother", "alive", 0, nil, "").AddRow("joey", "alive", 0, nil, ""))
+
+		_, err = utils.GetPasselStateMetadata(db, passel)
+		Ω(err).Should(BeNil())
+		_, err = utils.GetPasselStateMetadata(db, passel)
+		Ω(err).Should(BeNil())
+		Ω(mock.ExpectationsWereMet()).Should(Succeed())
 	})
 
-	Context("when the state is 'dead'", func() {
-		It("Updates the possum state", func() {
+	Context("when a possum is not in the db", func() {
+		It("returns an error", func() {
 			db, mock, err := sqlmock.New()
 			if err != nil {
 				fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
@@ -722,12 +805,36 @@ var _ = Describe("#WriteState", func() {
 			}
 			defer db.Close()
 
-			mock.ExpectExec("UPDATE state.*").WithArgs("dead", "joey").WillReturnResult(sqlmock.NewResult(1, 1))
-			Ω(utils.WriteState(db, "joey", "dead")).Should(BeNil())
+			rows := sqlmock.NewRows([]string{"possum", "state", "version", "updated_at", "updated_by"}).
+				AddRow("father", "dead", 1, nil, "")
+			mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnRows(rows)
+
+			metadata, err := utils.GetPasselStateMetadata(db, passel)
+			Ω(err).Should(MatchError("Could not find possum mother in db"))
+			Ω(metadata).Should(BeNil())
 		})
 	})
+})
+
+var _ = Describe("#GetOrphanedStates", func() {
+	It("returns the states of possums that are not in the passel", func() {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		rows := sqlmock.NewRows([]string{"possum", "state"}).
+			AddRow("uncle", "dead")
+		mock.ExpectPrepare(`^SELECT possum, state FROM state WHERE possum NOT IN \(\?, \?\)$`).ExpectQuery().WithArgs("mother", "joey").WillReturnRows(rows)
+
+		orphaned, err := utils.GetOrphanedStates(db, []string{"mother", "joey"})
+		Ω(err).Should(BeNil())
+		Ω(orphaned).Should(Equal(map[string]string{"uncle": "dead"}))
+	})
 
-	Context("when the state is not 'alive' or 'dead", func() {
+	Context("when the passel is empty", func() {
 		It("returns an error", func() {
 			db, _, err := sqlmock.New()
 			if err != nil {
@@ -736,23 +843,292 @@ var _ = Describe("#WriteState", func() {
 			}
 			defer db.Close()
 
-			err = utils.WriteState(db, "joey", "undead")
-			Ω(err).Should(MatchError(`The state should have been "alive" or "dead" not "undead"`))
+			_, err = utils.GetOrphanedStates(db, []string{})
+			Ω(err).Should(MatchError("Passel had 0 members"))
+		})
+	})
+})
+
+var _ = Describe("service states", func() {
+	var (
+		db   *sql.DB
+		mock sqlmock.Sqlmock
+		err  error
+	)
+
+	BeforeEach(func() {
+		db, mock, err = sqlmock.New()
+		if err != nil {
+			fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+			os.Exit(1)
+		}
+	})
+
+	AfterEach(func() {
+		db.Close()
+	})
+
+	Describe("#GetServiceState", func() {
+		It("returns the state of the service", func() {
+			mock.ExpectPrepare("^SELECT state FROM service_state WHERE possum=(.+) AND service=").ExpectQuery().
+				WithArgs("joey", "payments").WillReturnRows(sqlmock.NewRows([]string{"state"}).AddRow("dead"))
+			Ω(utils.GetServiceState(db, "joey", "payments")).Should(Equal("dead"))
+		})
+
+		Context("when the service has never been changed", func() {
+			It("returns the default state", func() {
+				mock.ExpectPrepare("^SELECT state FROM service_state").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"state"}))
+				Ω(utils.GetServiceState(db, "joey", "payments")).Should(Equal(utils.DefaultServiceState))
+			})
+		})
+
+		Context("when the query raises an error", func() {
+			It("returns an error", func() {
+				mock.ExpectPrepare("^SELECT state FROM service_state").ExpectQuery().WillReturnError(fmt.Errorf("An error has occurred: %s", "SELECT error"))
+				_, err := utils.GetServiceState(db, "joey", "payments")
+				Ω(err).Should(MatchError("An error has occurred: SELECT error"))
+			})
 		})
 	})
 
-	Context("When the sql update command raises an error", func() {
-		It("returns an error", func() {
-			db, mock, err := sqlmock.New()
-			if err != nil {
-				fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
-				os.Exit(1)
-			}
-			defer db.Close()
+	Describe("#GetPasselServiceState", func() {
+		It("returns the state of the service of every possum in one query", func() {
+			mock.ExpectPrepare(`^SELECT possum, state FROM service_state WHERE service=\? AND possum IN \(\?, \?\)$`).ExpectQuery().
+				WithArgs("payments", "joey", "father").
+				WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow("father", "dead"))
+			Ω(utils.GetPasselServiceState(db, []string{"joey", "father"}, "payments")).Should(Equal(map[string]string{"joey": "alive", "father": "dead"}))
+		})
+
+		Context("when the passel is empty", func() {
+			It("returns an error", func() {
+				_, err := utils.GetPasselServiceState(db, []string{}, "payments")
+				Ω(err).Should(MatchError("Passel had 0 members"))
+			})
+		})
+	})
+
+	Describe("#WriteServiceStates", func() {
+		var validated map[string]string
+
+		validate := func(passelState map[string]string, serviceState map[string]string) (string, error) {
+			validated = serviceState
+			return "", nil
+		}
+
+		BeforeEach(func() {
+			validated = nil
+			mock.ExpectBegin()
+			mock.ExpectQuery("^SELECT possum, state FROM state WHERE possum IN (.+) FOR UPDATE$").
+				WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow("father", "alive").AddRow("joey", "alive"))
+		})
+
+		It("writes and records the changed states of the service", func() {
+			mock.ExpectQuery(`^SELECT possum, state FROM service_state WHERE service=\? AND possum IN \(\?, \?\) FOR UPDATE$`).
+				WithArgs("payments", "joey", "father").
+				WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow("father", "dead"))
+			mock.ExpectExec("^INSERT INTO service_state (.+) ON DUPLICATE KEY UPDATE").
+				WithArgs("joey", "payments", "dead", sqlmock.AnyArg(), "admin").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("^INSERT INTO service_state_history").
+				WithArgs("joey", "payments", "dead", sqlmock.AnyArg(), "admin", false, "").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			before, err := utils.WriteServiceStates(db, []string{"joey", "father"}, "payments", map[string]string{"joey": "dead", "father": "dead"}, "admin", validate)
+			Ω(err).Should(BeNil())
+			Ω(before).Should(Equal(map[string]string{"joey": "alive", "father": "dead"}))
+			Ω(validated).Should(Equal(before))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+
+		Context("when validate returns an error", func() {
+			It("rolls back without writing", func() {
+				mock.ExpectQuery("^SELECT possum, state FROM service_state").WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}))
+				mock.ExpectRollback()
+
+				_, err := utils.WriteServiceStates(db, []string{"joey", "father"}, "payments", map[string]string{"joey": "dead"}, "admin", func(map[string]string, map[string]string) (string, error) {
+					return "", fmt.Errorf("not allowed")
+				})
+				Ω(err).Should(MatchError("not allowed"))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+		})
+
+		Context("when a desired possum is not in the passel", func() {
+			It("rolls back without writing", func() {
+				mock.ExpectQuery("^SELECT possum, state FROM service_state").WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}))
+				mock.ExpectRollback()
+
+				_, err := utils.WriteServiceStates(db, []string{"joey", "father"}, "payments", map[string]string{"mother": "dead"}, "admin", validate)
+				Ω(err).Should(MatchError("Possum mother is not part of the passel"))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+		})
+	})
+
+	Context("when a desired state is not alive or dead", func() {
+		It("returns an error without starting a transaction", func() {
+			_, err := utils.WriteServiceStates(db, []string{"joey"}, "payments", map[string]string{"joey": "asleep"}, "admin", nil)
+			Ω(err).Should(MatchError(`The state of joey should have been "alive" or "dead" not "asleep"`))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+	})
+})
+
+var _ = Describe("#WriteStates", func() {
+	var (
+		db   *sql.DB
+		mock sqlmock.Sqlmock
+		err  error
+	)
+
+	allowAll := func(map[string]string, utils.ServiceStateReader) (string, error) {
+		return "", nil
+	}
+
+	BeforeEach(func() {
+		db, mock, err = sqlmock.New()
+		if err != nil {
+			fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+			os.Exit(1)
+		}
+	})
+
+	AfterEach(func() {
+		db.Close()
+	})
+
+	expectLock := func() {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`^SELECT possum, state FROM state WHERE possum IN \(\?, \?\) ORDER BY possum FOR UPDATE$`).
+			WithArgs("joey", "mother").
+			WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow("joey", "alive").AddRow("mother", "alive"))
+	}
+
+	It("locks the passel and writes and records every change in one transaction", func() {
+		expectLock()
+		mock.ExpectExec("UPDATE state.*").WithArgs("dead", sqlmock.AnyArg(), "admin", "joey").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO state_history.*").WithArgs("joey", "dead", sqlmock.AnyArg(), "admin", true, "datacentre fire").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		var validated map[string]string
+		passelState, err := utils.WriteStates(db, []string{"mother", "joey"}, map[string]string{"joey": "dead", "mother": "alive"}, "admin", func(passelState map[string]string, _ utils.ServiceStateReader) (string, error) {
+			validated = passelState
+			return "datacentre fire", nil
+		})
+		Ω(err).Should(BeNil())
+		Ω(passelState).Should(Equal(map[string]string{"joey": "alive", "mother": "alive"}))
+		Ω(validated).Should(Equal(passelState))
+		Ω(mock.ExpectationsWereMet()).Should(Succeed())
+	})
+
+	It("reads service states for validation inside the transaction", func() {
+		expectLock()
+		mock.ExpectQuery(`^SELECT possum, state FROM service_state WHERE service=\? AND possum IN \(\?, \?\) FOR UPDATE$`).
+			WithArgs("payments", "joey", "mother").
+			WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow("mother", "dead"))
+		mock.ExpectRollback()
+
+		var serviceState map[string]string
+		_, err := utils.WriteStates(db, []string{"joey", "mother"}, map[string]string{"joey": "dead"}, "admin", func(_ map[string]string, serviceStates utils.ServiceStateReader) (string, error) {
+			var err error
+			serviceState, err = serviceStates("payments")
+			Ω(err).Should(BeNil())
+			return "", fmt.Errorf("Would have killed payments on every possum")
+		})
+		Ω(err).Should(MatchError("Would have killed payments on every possum"))
+		Ω(serviceState).Should(Equal(map[string]string{"joey": "alive", "mother": "dead"}))
+		Ω(mock.ExpectationsWereMet()).Should(Succeed())
+	})
+
+	It("records a change that is not an emergency change without a reason", func() {
+		expectLock()
+		mock.ExpectExec("UPDATE state.*").WithArgs("dead", sqlmock.AnyArg(), "admin", "mother").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO state_history.*").WithArgs("mother", "dead", sqlmock.AnyArg(), "admin", false, "").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		_, err := utils.WriteStates(db, []string{"joey", "mother"}, map[string]string{"mother": "dead"}, "admin", allowAll)
+		Ω(err).Should(BeNil())
+		Ω(mock.ExpectationsWereMet()).Should(Succeed())
+	})
+
+	Context("when every possum already has its desired state", func() {
+		It("writes and records nothing", func() {
+			expectLock()
+			mock.ExpectCommit()
+
+			_, err := utils.WriteStates(db, []string{"joey", "mother"}, map[string]string{"joey": "alive", "mother": "alive"}, "admin", allowAll)
+			Ω(err).Should(BeNil())
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+	})
+
+	Context("when a change cannot be recorded in the state history", func() {
+		It("rolls back the state change", func() {
+			expectLock()
+			mock.ExpectExec("UPDATE state.*").WithArgs("dead", sqlmock.AnyArg(), "admin", "joey").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("INSERT INTO state_history.*").WillReturnError(fmt.Errorf("An error has occurred: %s", "INSERT error"))
+			mock.ExpectRollback()
+
+			_, err := utils.WriteStates(db, []string{"joey", "mother"}, map[string]string{"joey": "dead"}, "admin", allowAll)
+			Ω(err).Should(MatchError("An error has occurred: INSERT error"))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+	})
+
+	Context("when a desired possum is not part of the passel", func() {
+		It("writes nothing and rolls back", func() {
+			expectLock()
+			mock.ExpectRollback()
+
+			_, err := utils.WriteStates(db, []string{"joey", "mother"}, map[string]string{"father": "dead"}, "admin", allowAll)
+			Ω(err).Should(MatchError("Possum father is not part of the passel"))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+	})
+
+	Context("when validation fails", func() {
+		It("writes nothing and rolls back", func() {
+			expectLock()
+			mock.ExpectRollback()
+
+			_, err := utils.WriteStates(db, []string{"joey", "mother"}, map[string]string{"joey": "dead"}, "admin", func(map[string]string, utils.ServiceStateReader) (string, error) {
+				return "", fmt.Errorf("not allowed")
+			})
+			Ω(err).Should(MatchError("not allowed"))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+	})
+
+	Context("when a later write fails", func() {
+		It("rolls back the earlier writes", func() {
+			expectLock()
+			mock.ExpectExec("UPDATE state.*").WithArgs("dead", sqlmock.AnyArg(), "admin", "joey").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("INSERT INTO state_history.*").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("UPDATE state.*").WithArgs("dead", sqlmock.AnyArg(), "admin", "mother").WillReturnError(fmt.Errorf("An error has occurred: %s", "UPDATE error"))
+			mock.ExpectRollback()
 
-			mock.ExpectExec("UPDATE state.*").WithArgs("alive", "joey").WillReturnError(fmt.Errorf("An error has occurred: %s", "UPDATE error"))
-			err = utils.WriteState(db, "joey", "alive")
+			_, err := utils.WriteStates(db, []string{"joey", "mother"}, map[string]string{"joey": "dead", "mother": "dead"}, "admin", allowAll)
 			Ω(err).Should(MatchError("An error has occurred: UPDATE error"))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+	})
+
+	Context("when a possum of the passel is not in the db", func() {
+		It("returns an error", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery("^SELECT possum, state FROM state WHERE possum IN").
+				WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow("joey", "alive"))
+			mock.ExpectRollback()
+
+			_, err := utils.WriteStates(db, []string{"joey", "mother"}, map[string]string{"joey": "dead"}, "admin", allowAll)
+			Ω(err).Should(MatchError("Could not find possum mother in db"))
+		})
+	})
+
+	Context("when a desired state is not 'alive' or 'dead'", func() {
+		It("returns an error without starting a transaction", func() {
+			_, err := utils.WriteStates(db, []string{"joey"}, map[string]string{"joey": "undead"}, "admin", allowAll)
+			Ω(err).Should(MatchError(`The state of joey should have been "alive" or "dead" not "undead"`))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
 		})
 	})
 })
@@ -974,3 +1350,886 @@ var _ = Describe("GetPassword", func() {
 		})
 	})
 })
+
+var _ = Describe("GetEmergencyCredentials", func() {
+	var vcapServicesJSON string
+
+	JustBeforeEach(func() {
+		os.Setenv("VCAP_SERVICES", vcapServicesJSON)
+		os.Setenv("VCAP_APPLICATION", "{}")
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("VCAP_APPLICATION")
+		os.Unsetenv("VCAP_SERVICES")
+	})
+
+	Context("when emergency credentials are set", func() {
+		BeforeEach(func() {
+			vcapServicesJSON = `{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "username",
+    "password": "password",
+    "emergency_username": "oncall",
+    "emergency_password": "break-glass"
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`
+		})
+
+		It("returns them", func() {
+			username, password, err := utils.GetEmergencyCredentials()
+			Ω(err).Should(BeNil())
+			Ω(username).Should(Equal("oncall"))
+			Ω(password).Should(Equal("break-glass"))
+		})
+	})
+
+	Context("when emergency credentials are not set", func() {
+		BeforeEach(func() {
+			vcapServicesJSON = `{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "username",
+    "password": "password"
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`
+		})
+
+		It("returns empty credentials", func() {
+			username, password, err := utils.GetEmergencyCredentials()
+			Ω(err).Should(BeNil())
+			Ω(username).Should(BeEmpty())
+			Ω(password).Should(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("#GetLastStateChanges", func() {
+	It("returns the latest change for possums that have changed", func() {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		changedAt := time.Date(2019, 6, 1, 12, 30, 0, 0, time.UTC)
+		fRows := sqlmock.NewRows([]string{"possum", "state", "changed_at", "changed_by", "emergency", "reason"}).
+			AddRow("father", "dead", changedAt, "admin", true, "datacentre fire")
+
+		mock.ExpectPrepare(`SELECT (.+) FROM state_history h JOIN \(SELECT MAX\(id\) AS id FROM state_history WHERE possum IN \(\?, \?\) GROUP BY possum\) latest`).
+			ExpectQuery().WithArgs("father", "joey").WillReturnRows(fRows)
+
+		stateChanges, err := utils.GetLastStateChanges(db, []string{"father", "joey"})
+		Ω(err).Should(BeNil())
+		Ω(stateChanges).Should(HaveLen(1))
+		Ω(stateChanges["father"]).Should(Equal(utils.StateChange{Possum: "father", State: "dead", ChangedAt: changedAt, ChangedBy: "admin", Emergency: true, Reason: "datacentre fire"}))
+		Ω(mock.ExpectationsWereMet()).Should(Succeed())
+	})
+
+	It("reuses the prepared statement", func() {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		columns := []string{"possum", "state", "changed_at", "changed_by", "emergency", "reason"}
+		mock.ExpectPrepare("SELECT (.+) FROM state_history h JOIN").ExpectQuery().WithArgs("father").WillReturnRows(sqlmock.NewRows(columns))
+		mock.ExpectQuery("SELECT (.+) FROM state_history h JOIN").WithArgs("father").WillReturnRows(sqlmock.NewRows(columns))
+		for i := 0; i < 2; i++ {
+			_, err := utils.GetLastStateChanges(db, []string{"father"})
+			Ω(err).Should(BeNil())
+		}
+		Ω(mock.ExpectationsWereMet()).Should(Succeed())
+	})
+
+	Context("when the query raises an error", func() {
+		It("returns an error", func() {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+				os.Exit(1)
+			}
+			defer db.Close()
+
+			mock.ExpectPrepare("SELECT (.+) FROM state_history h JOIN").ExpectQuery().WillReturnError(fmt.Errorf("An error has occurred: %s", "SELECT error"))
+			stateChanges, err := utils.GetLastStateChanges(db, []string{"father"})
+			Ω(err).Should(MatchError("An error has occurred: SELECT error"))
+			Ω(stateChanges).Should(BeNil())
+		})
+	})
+})
+
+var _ = Describe("#RecordMissedWrite", func() {
+	It("replaces the missed write of the possum", func() {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		mock.ExpectExec("REPLACE INTO missed_writes").WithArgs("joey", "", `{"joey":"dead"}`, sqlmock.AnyArg(), "admin").WillReturnResult(sqlmock.NewResult(1, 1))
+		Ω(utils.RecordMissedWrite(db, "joey", "", `{"joey":"dead"}`, "admin")).Should(BeNil())
+		Ω(mock.ExpectationsWereMet()).Should(Succeed())
+	})
+
+	Context("when the replace raises an error", func() {
+		It("returns an error", func() {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+				os.Exit(1)
+			}
+			defer db.Close()
+
+			mock.ExpectExec("REPLACE INTO missed_writes").WillReturnError(fmt.Errorf("An error has occurred: %s", "REPLACE error"))
+			Ω(utils.RecordMissedWrite(db, "joey", "payments", `{"joey":"dead"}`, "admin")).Should(MatchError("An error has occurred: REPLACE error"))
+		})
+	})
+})
+
+var _ = Describe("#GetMissedWrites", func() {
+	It("returns every missed write", func() {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		missedAt := time.Date(2019, 6, 1, 12, 30, 0, 0, time.UTC)
+		rows := sqlmock.NewRows([]string{"possum", "service", "passel_state", "missed_at", "changed_by"}).
+			AddRow("joey", "", `{"joey":"dead"}`, missedAt, "admin").
+			AddRow("joey", "payments", `{"joey":"alive"}`, missedAt, "admin")
+		mock.ExpectQuery("SELECT (.+) FROM missed_writes").WillReturnRows(rows)
+
+		missedWrites, err := utils.GetMissedWrites(db)
+		Ω(err).Should(BeNil())
+		Ω(missedWrites).Should(Equal([]utils.MissedWrite{
+			{Possum: "joey", PasselState: `{"joey":"dead"}`, MissedAt: missedAt, ChangedBy: "admin"},
+			{Possum: "joey", Service: "payments", PasselState: `{"joey":"alive"}`, MissedAt: missedAt, ChangedBy: "admin"},
+		}))
+	})
+
+	Context("when the query raises an error", func() {
+		It("returns an error", func() {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+				os.Exit(1)
+			}
+			defer db.Close()
+
+			mock.ExpectQuery("SELECT (.+) FROM missed_writes").WillReturnError(fmt.Errorf("An error has occurred: %s", "SELECT error"))
+			missedWrites, err := utils.GetMissedWrites(db)
+			Ω(err).Should(MatchError("An error has occurred: SELECT error"))
+			Ω(missedWrites).Should(BeNil())
+		})
+	})
+})
+
+var _ = Describe("#ClearMissedWrite", func() {
+	It("deletes the missed write of the possum", func() {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		mock.ExpectExec("DELETE FROM missed_writes WHERE possum=(.+) AND service=").WithArgs("joey", "payments").WillReturnResult(sqlmock.NewResult(1, 1))
+		Ω(utils.ClearMissedWrite(db, "joey", "payments")).Should(BeNil())
+		Ω(mock.ExpectationsWereMet()).Should(Succeed())
+	})
+
+	Context("when the delete raises an error", func() {
+		It("returns an error", func() {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+				os.Exit(1)
+			}
+			defer db.Close()
+
+			mock.ExpectExec("DELETE FROM missed_writes WHERE possum=").WillReturnError(fmt.Errorf("An error has occurred: %s", "DELETE error"))
+			Ω(utils.ClearMissedWrite(db, "joey", "")).Should(MatchError("An error has occurred: DELETE error"))
+		})
+	})
+})
+
+var _ = Describe("#ValidatePasselConfig", func() {
+	var config utils.PasselConfig
+
+	BeforeEach(func() {
+		config = utils.PasselConfig{
+			Passel:       []string{"https://possum.example1.domain.com", "https://possum.example2.domain.com"},
+			Username:     "admin",
+			Password:     "admin",
+			InitialState: "dead",
+		}
+	})
+
+	It("accepts a valid config", func() {
+		Ω(utils.ValidatePasselConfig(config)).Should(Succeed())
+	})
+
+	It("rejects an empty passel", func() {
+		config.Passel = nil
+		Ω(utils.ValidatePasselConfig(config)).Should(MatchError("passel must have at least one possum"))
+	})
+
+	It("rejects a possum that is not a URL", func() {
+		config.Passel = []string{"possum.example1.domain.com"}
+		Ω(utils.ValidatePasselConfig(config)).Should(MatchError(`possum "possum.example1.domain.com" is not an http or https URL`))
+	})
+
+	It("rejects a duplicated possum", func() {
+		config.Passel = []string{"https://possum.example1.domain.com", "https://possum.example1.domain.com"}
+		Ω(utils.ValidatePasselConfig(config)).Should(MatchError("possum https://possum.example1.domain.com is in the passel more than once"))
+	})
+
+	It("rejects a username without a password", func() {
+		config.Password = ""
+		Ω(utils.ValidatePasselConfig(config)).Should(MatchError("username and password must be set together"))
+	})
+
+	It("rejects emergency credentials without both parts", func() {
+		config.EmergencyUsername = "oncall"
+		Ω(utils.ValidatePasselConfig(config)).Should(MatchError("emergency_username and emergency_password must be set together"))
+	})
+
+	It("rejects users without a password", func() {
+		config.Users = map[string]string{"alice": ""}
+		Ω(utils.ValidatePasselConfig(config)).Should(MatchError("users must have a username and a password"))
+	})
+
+	It("rejects an unknown initial state", func() {
+		config.InitialState = "undead"
+		Ω(utils.ValidatePasselConfig(config)).Should(MatchError(`initial_state should have been "alive" or "dead" not "undead"`))
+	})
+})
+
+var _ = Describe("#LoadPasselConfigFile", func() {
+	var dir, path string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "possum")
+		Ω(err).Should(BeNil())
+		path = filepath.Join(dir, "passel.json")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("loads the config and defaults the initial state", func() {
+		Ω(ioutil.WriteFile(path, []byte(`{"passel": ["https://possum.example1.domain.com"]}`), 0600)).Should(Succeed())
+		config, err := utils.LoadPasselConfigFile(path)
+		Ω(err).Should(BeNil())
+		Ω(config).Should(Equal(utils.PasselConfig{Passel: []string{"https://possum.example1.domain.com"}, InitialState: "alive"}))
+	})
+
+	It("returns an error when the file does not exist", func() {
+		_, err := utils.LoadPasselConfigFile(path)
+		Ω(err).ShouldNot(BeNil())
+	})
+
+	It("returns an error when the config is invalid", func() {
+		Ω(ioutil.WriteFile(path, []byte(`{"passel": []}`), 0600)).Should(Succeed())
+		_, err := utils.LoadPasselConfigFile(path)
+		Ω(err).Should(MatchError("passel must have at least one possum"))
+	})
+})
+
+var _ = Describe("#SetPasselConfig", func() {
+	BeforeEach(func() {
+		os.Setenv("VCAP_APPLICATION", "{}")
+		os.Setenv("VCAP_SERVICES", `{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "service-user",
+    "password": "service-password",
+    "emergency_username": "service-oncall",
+    "emergency_password": "service-oncall-password",
+    "users": {"alice": "service-alice-password"},
+    "passel": ["https://possum.example1.domain.com"]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`)
+	})
+
+	AfterEach(func() {
+		utils.SetPasselConfig(nil)
+		os.Unsetenv("VCAP_APPLICATION")
+		os.Unsetenv("VCAP_SERVICES")
+	})
+
+	It("overrides the passel and credentials of the possum service", func() {
+		utils.SetPasselConfig(&utils.PasselConfig{Passel: []string{"https://possum.example2.domain.com"}, Username: "file-user", Password: "file-password"})
+		Ω(utils.GetPassel()).Should(Equal([]string{"https://possum.example2.domain.com"}))
+		Ω(utils.GetUsername()).Should(Equal("file-user"))
+		Ω(utils.GetPassword()).Should(Equal("file-password"))
+	})
+
+	It("overrides the emergency credentials and users of the possum service", func() {
+		utils.SetPasselConfig(&utils.PasselConfig{
+			Passel:            []string{"https://possum.example2.domain.com"},
+			EmergencyUsername: "file-oncall",
+			EmergencyPassword: "file-oncall-password",
+			Users:             map[string]string{"carol": "carol-password"},
+		})
+		username, password, err := utils.GetEmergencyCredentials()
+		Ω(err).Should(BeNil())
+		Ω(username).Should(Equal("file-oncall"))
+		Ω(password).Should(Equal("file-oncall-password"))
+		Ω(utils.GetUsers()).Should(Equal(map[string]string{"carol": "carol-password"}))
+	})
+
+	It("keeps the service credentials when the config has none", func() {
+		utils.SetPasselConfig(&utils.PasselConfig{Passel: []string{"https://possum.example2.domain.com"}})
+		Ω(utils.GetUsername()).Should(Equal("service-user"))
+		Ω(utils.GetPassword()).Should(Equal("service-password"))
+		username, _, err := utils.GetEmergencyCredentials()
+		Ω(err).Should(BeNil())
+		Ω(username).Should(Equal("service-oncall"))
+		Ω(utils.GetUsers()).Should(Equal(map[string]string{"alice": "service-alice-password"}))
+	})
+
+	It("reverts to the possum service when cleared", func() {
+		utils.SetPasselConfig(&utils.PasselConfig{Passel: []string{"https://possum.example2.domain.com"}})
+		utils.SetPasselConfig(nil)
+		Ω(utils.GetPassel()).Should(Equal([]string{"https://possum.example1.domain.com"}))
+	})
+})
+
+var _ = Describe("#SyncPasselDB", func() {
+	var (
+		db   *sql.DB
+		mock sqlmock.Sqlmock
+	)
+
+	BeforeEach(func() {
+		var err error
+		db, mock, err = sqlmock.New()
+		if err != nil {
+			fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+			os.Exit(1)
+		}
+		rows := sqlmock.NewRows([]string{"possum", "state"}).
+			AddRow("mother", "alive").
+			AddRow("father", "dead")
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT possum, state FROM state FOR UPDATE").WillReturnRows(rows)
+	})
+
+	AfterEach(func() {
+		db.Close()
+	})
+
+	It("inserts joined possums and archives possums that left", func() {
+		mock.ExpectQuery("SELECT state FROM state_archive WHERE possum=").WithArgs("joey").WillReturnRows(sqlmock.NewRows([]string{"state"}))
+		mock.ExpectExec(`INSERT INTO state \(possum, state\) VALUES`).WithArgs("joey", "dead").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery("SELECT service, state FROM service_state_archive").WithArgs("joey").WillReturnRows(sqlmock.NewRows([]string{"service", "state"}))
+		mock.ExpectExec("INSERT INTO state_archive").WithArgs("father", "dead", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("DELETE FROM state WHERE possum=").WithArgs("father").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO service_state_archive").WithArgs(sqlmock.AnyArg(), "father").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DELETE FROM service_state WHERE possum=").WithArgs("father").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		added, archived, err := utils.SyncPasselDB(db, []string{"mother", "joey"}, "dead", nil)
+		Ω(err).Should(BeNil())
+		Ω(added).Should(Equal([]string{"joey"}))
+		Ω(archived).Should(Equal([]string{"father"}))
+		Ω(mock.ExpectationsWereMet()).Should(Succeed())
+	})
+
+	It("renames a possum the passel names differently rather than archiving it", func() {
+		mock.ExpectExec("UPDATE state SET possum=").WithArgs("Father.", "father").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE service_state SET possum=").WithArgs("Father.", "father").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		var validated map[string]string
+		added, archived, err := utils.SyncPasselDB(db, []string{"mother", "Father."}, "alive", func(passelState map[string]string) error {
+			validated = passelState
+			return nil
+		})
+		Ω(err).Should(BeNil())
+		Ω(added).Should(BeEmpty())
+		Ω(archived).Should(BeEmpty())
+		Ω(validated).Should(Equal(map[string]string{"mother": "alive", "Father.": "dead"}))
+		Ω(mock.ExpectationsWereMet()).Should(Succeed())
+	})
+
+	It("restores the archived state of a possum that rejoins", func() {
+		mock.ExpectQuery("SELECT state FROM state_archive WHERE possum=").WithArgs("joey").WillReturnRows(sqlmock.NewRows([]string{"state"}).AddRow("dead"))
+		mock.ExpectExec(`INSERT INTO state \(possum, state\) VALUES`).WithArgs("joey", "dead").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery("SELECT service, state FROM service_state_archive").WithArgs("joey").WillReturnRows(sqlmock.NewRows([]string{"service", "state"}))
+		mock.ExpectCommit()
+
+		var validated map[string]string
+		added, _, err := utils.SyncPasselDB(db, []string{"mother", "father", "joey"}, "alive", func(passelState map[string]string) error {
+			validated = passelState
+			return nil
+		})
+		Ω(err).Should(BeNil())
+		Ω(added).Should(Equal([]string{"joey"}))
+		Ω(validated).Should(Equal(map[string]string{"mother": "alive", "father": "dead", "joey": "dead"}))
+		Ω(mock.ExpectationsWereMet()).Should(Succeed())
+	})
+
+	It("restores the last archived service states of a possum that rejoins", func() {
+		mock.ExpectQuery("SELECT state FROM state_archive WHERE possum=").WithArgs("joey").WillReturnRows(sqlmock.NewRows([]string{"state"}).AddRow("alive"))
+		mock.ExpectExec(`INSERT INTO state \(possum, state\) VALUES`).WithArgs("joey", "alive").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery("SELECT service, state FROM service_state_archive WHERE possum=").WithArgs("joey").
+			WillReturnRows(sqlmock.NewRows([]string{"service", "state"}).AddRow("payments", "alive").AddRow("search", "alive").AddRow("payments", "dead"))
+		mock.ExpectExec("INSERT INTO service_state").WithArgs("joey", "payments", "dead", sqlmock.AnyArg(), "passel membership").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO service_state").WithArgs("joey", "search", "alive", sqlmock.AnyArg(), "passel membership").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		_, _, err := utils.SyncPasselDB(db, []string{"mother", "father", "joey"}, "dead", nil)
+		Ω(err).Should(BeNil())
+		Ω(mock.ExpectationsWereMet()).Should(Succeed())
+	})
+
+	Context("when validate returns an error", func() {
+		It("rolls back and returns the error", func() {
+			mock.ExpectExec("INSERT INTO state_archive").WithArgs("mother", "alive", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("DELETE FROM state WHERE possum=").WithArgs("mother").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("INSERT INTO service_state_archive").WithArgs(sqlmock.AnyArg(), "mother").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("DELETE FROM service_state WHERE possum=").WithArgs("mother").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectRollback()
+
+			_, _, err := utils.SyncPasselDB(db, []string{"father"}, "alive", func(passelState map[string]string) error {
+				return fmt.Errorf("no possum alive in %v", passelState)
+			})
+			Ω(err).Should(MatchError("no possum alive in map[father:dead]"))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+	})
+
+	Context("when archiving raises an error", func() {
+		It("rolls back and returns an error", func() {
+			mock.ExpectExec("INSERT INTO state_archive").WillReturnError(fmt.Errorf("An error has occurred: %s", "INSERT error"))
+			mock.ExpectRollback()
+
+			_, _, err := utils.SyncPasselDB(db, []string{"mother"}, "alive", nil)
+			Ω(err).Should(MatchError("An error has occurred: INSERT error"))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+	})
+})
+
+var _ = Describe("GetUsers", func() {
+	AfterEach(func() {
+		os.Unsetenv("VCAP_APPLICATION")
+		os.Unsetenv("VCAP_SERVICES")
+	})
+
+	It("returns the named users", func() {
+		os.Setenv("VCAP_APPLICATION", "{}")
+		os.Setenv("VCAP_SERVICES", `{
+"user-provided": [
+ {
+  "credentials": {
+    "users": {"alice": "alice-password", "bob": "bob-password"}
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`)
+		users, err := utils.GetUsers()
+		Ω(err).Should(BeNil())
+		Ω(users).Should(Equal(map[string]string{"alice": "alice-password", "bob": "bob-password"}))
+	})
+
+	Context("when a password is not a string", func() {
+		It("returns an error", func() {
+			os.Setenv("VCAP_APPLICATION", "{}")
+			os.Setenv("VCAP_SERVICES", `{
+"user-provided": [
+ {
+  "credentials": {
+    "users": {"alice": 1}
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`)
+			_, err := utils.GetUsers()
+			Ω(err).Should(MatchError("the password of user alice was not a string"))
+		})
+	})
+})
+
+var _ = Describe("proposals", func() {
+	var (
+		db         *sql.DB
+		mock       sqlmock.Sqlmock
+		err        error
+		proposedAt time.Time
+		proposal   utils.Proposal
+		columns    []string
+	)
+
+	BeforeEach(func() {
+		db, mock, err = sqlmock.New()
+		if err != nil {
+			fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
+			os.Exit(1)
+		}
+		proposedAt = time.Date(2019, 6, 1, 12, 30, 0, 0, time.UTC)
+		proposal = utils.Proposal{
+			ID:           "abc",
+			PossumStates: map[string]string{"joey": "dead"},
+			ProposedBy:   "alice",
+			ProposedAt:   proposedAt,
+			ExpiresAt:    proposedAt.Add(15 * time.Minute),
+			Status:       utils.ProposalPending,
+		}
+		columns = []string{"id", "possum_states", "force_update", "emergency", "reason", "proposed_by", "proposed_at", "expires_at", "status", "decided_by", "decided_at", "error", "service"}
+	})
+
+	AfterEach(func() {
+		db.Close()
+	})
+
+	Describe("#SaveProposal", func() {
+		It("replaces the proposal", func() {
+			mock.ExpectExec("REPLACE INTO proposals").
+				WithArgs("abc", `{"joey":"dead"}`, false, false, "", "alice", proposedAt, proposedAt.Add(15*time.Minute), "pending", "", nil, "", "").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			Ω(utils.SaveProposal(db, proposal)).Should(Succeed())
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+	})
+
+	Describe("#GetProposal", func() {
+		It("returns the proposal", func() {
+			mock.ExpectQuery("SELECT (.+) FROM proposals WHERE id=").WithArgs("abc").
+				WillReturnRows(sqlmock.NewRows(columns).AddRow("abc", `{"joey":"dead"}`, false, false, "", "alice", proposedAt, proposedAt.Add(15*time.Minute), "pending", "", nil, nil, ""))
+			Ω(utils.GetProposal(db, "abc")).Should(Equal(proposal))
+		})
+
+		Context("when there is no such proposal", func() {
+			It("returns sql.ErrNoRows", func() {
+				mock.ExpectQuery("SELECT (.+) FROM proposals WHERE id=").WillReturnRows(sqlmock.NewRows(columns))
+				_, err := utils.GetProposal(db, "abc")
+				Ω(err).Should(Equal(sql.ErrNoRows))
+			})
+		})
+	})
+
+	Describe("#GetProposals", func() {
+		It("returns every proposal", func() {
+			decidedAt := proposedAt.Add(time.Minute)
+			mock.ExpectQuery("SELECT (.+) FROM proposals ORDER BY proposed_at DESC").
+				WillReturnRows(sqlmock.NewRows(columns).
+					AddRow("def", `{"joey":"alive"}`, true, false, "", "bob", proposedAt, proposedAt.Add(15*time.Minute), "failed", "alice", decidedAt, "Would have killed all possums", "payments").
+					AddRow("abc", `{"joey":"dead"}`, false, false, "", "alice", proposedAt, proposedAt.Add(15*time.Minute), "pending", "", nil, nil, ""))
+			proposals, err := utils.GetProposals(db)
+			Ω(err).Should(BeNil())
+			Ω(proposals).Should(HaveLen(2))
+			Ω(proposals[0].Force).Should(BeTrue())
+			Ω(*proposals[0].DecidedAt).Should(Equal(decidedAt))
+			Ω(proposals[0].Error).Should(Equal("Would have killed all possums"))
+			Ω(proposals[0].Service).Should(Equal("payments"))
+			Ω(proposals[1]).Should(Equal(proposal))
+		})
+
+		Context("when there are no proposals", func() {
+			It("returns an empty list", func() {
+				mock.ExpectQuery("SELECT (.+) FROM proposals").WillReturnRows(sqlmock.NewRows(columns))
+				Ω(utils.GetProposals(db)).Should(Equal([]utils.Proposal{}))
+			})
+		})
+	})
+
+	Describe("#ClaimProposal", func() {
+		It("claims a pending proposal", func() {
+			now := proposedAt.Add(time.Minute)
+			mock.ExpectExec("UPDATE proposals SET status=(.+) WHERE id=(.+) AND status=(.+) AND expires_at>").
+				WithArgs("approved", "bob", now, "abc", "pending", now).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			Ω(utils.ClaimProposal(db, "abc", "bob", now)).Should(BeTrue())
+		})
+
+		Context("when the proposal is no longer pending", func() {
+			It("does not claim it", func() {
+				mock.ExpectExec("UPDATE proposals").WillReturnResult(sqlmock.NewResult(0, 0))
+				Ω(utils.ClaimProposal(db, "abc", "bob", proposedAt)).Should(BeFalse())
+			})
+		})
+	})
+
+	Describe("#ReleaseProposal", func() {
+		It("moves the proposal claimed by the approver back to pending", func() {
+			mock.ExpectExec("UPDATE proposals SET status=(.+), decided_by='', decided_at=NULL WHERE id=(.+) AND status=(.+) AND decided_by=").
+				WithArgs("pending", "abc", "approved", "bob").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			Ω(utils.ReleaseProposal(db, "abc", "bob")).Should(BeTrue())
+		})
+
+		Context("when someone else holds the claim", func() {
+			It("does not release it", func() {
+				mock.ExpectExec("UPDATE proposals").WillReturnResult(sqlmock.NewResult(0, 0))
+				Ω(utils.ReleaseProposal(db, "abc", "bob")).Should(BeFalse())
+			})
+		})
+	})
+})
+
+var _ = Describe("membership changes", func() {
+	var (
+		db   *sql.DB
+		mock sqlmock.Sqlmock
+	)
+
+	BeforeEach(func() {
+		db, mock, _ = sqlmock.New()
+	})
+
+	AfterEach(func() {
+		db.Close()
+	})
+
+	Describe("#RecordMembershipChange", func() {
+		It("inserts the change", func() {
+			changedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+			mock.ExpectExec("INSERT INTO membership_changes").WithArgs("https://possum1.example.com", "joined", "seeds", changedAt).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			err := utils.RecordMembershipChange(db, utils.MembershipChange{Possum: "https://possum1.example.com", Event: utils.MemberJoined, Source: "seeds", ChangedAt: changedAt})
+			Ω(err).Should(BeNil())
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+	})
+
+	Describe("#GetMembershipChanges", func() {
+		It("returns the most recent changes", func() {
+			changedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+			mock.ExpectQuery("SELECT possum, event, source, changed_at FROM membership_changes ORDER BY id DESC LIMIT").WithArgs(20).
+				WillReturnRows(sqlmock.NewRows([]string{"possum", "event", "source", "changed_at"}).
+					AddRow("https://possum2.example.com", "left", "dns", changedAt).
+					AddRow("https://possum1.example.com", "joined", "dns", changedAt))
+			changes, err := utils.GetMembershipChanges(db, 20)
+			Ω(err).Should(BeNil())
+			Ω(changes).Should(Equal([]utils.MembershipChange{
+				{Possum: "https://possum2.example.com", Event: utils.MemberLeft, Source: "dns", ChangedAt: changedAt},
+				{Possum: "https://possum1.example.com", Event: utils.MemberJoined, Source: "dns", ChangedAt: changedAt},
+			}))
+		})
+
+		It("returns an error if the query fails", func() {
+			mock.ExpectQuery("SELECT possum, event, source, changed_at FROM membership_changes").WillReturnError(fmt.Errorf("table is locked"))
+			_, err := utils.GetMembershipChanges(db, 20)
+			Ω(err).Should(MatchError("table is locked"))
+		})
+	})
+})
+
+var _ = Describe("snapshots", func() {
+	var (
+		db   *sql.DB
+		mock sqlmock.Sqlmock
+	)
+
+	changedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	BeforeEach(func() {
+		db, mock, _ = sqlmock.New()
+	})
+
+	AfterEach(func() {
+		db.Close()
+	})
+
+	Describe("#ExportSnapshot", func() {
+		It("reads the schema version, every state and service state and the whole history in one transaction", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT COALESCE\(MAX\(version\), 0\) FROM schema_version`).WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(7))
+			mock.ExpectQuery("SELECT possum, state FROM state ORDER BY possum").
+				WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow("joey", "dead").AddRow("mother", "alive"))
+			mock.ExpectQuery("SELECT possum, service, state FROM service_state ORDER BY service, possum").
+				WillReturnRows(sqlmock.NewRows([]string{"possum", "service", "state"}).AddRow("mother", "payments", "dead"))
+			mock.ExpectQuery("SELECT possum, state, changed_at, changed_by, emergency, reason FROM state_history ORDER BY id").
+				WillReturnRows(sqlmock.NewRows([]string{"possum", "state", "changed_at", "changed_by", "emergency", "reason"}).AddRow("joey", "dead", changedAt, "alice", true, "datacentre fire"))
+			mock.ExpectRollback()
+
+			snapshot, err := utils.ExportSnapshot(db)
+			Ω(err).Should(BeNil())
+			Ω(snapshot.FormatVersion).Should(Equal(utils.SnapshotFormat))
+			Ω(snapshot.SchemaVersion).Should(Equal(7))
+			Ω(snapshot.States).Should(Equal(map[string]string{"joey": "dead", "mother": "alive"}))
+			Ω(snapshot.ServiceStates).Should(Equal(map[string]map[string]string{"payments": {"mother": "dead"}}))
+			Ω(snapshot.History).Should(Equal([]utils.StateChange{{Possum: "joey", State: "dead", ChangedAt: changedAt, ChangedBy: "alice", Emergency: true, Reason: "datacentre fire"}}))
+			Ω(mock.ExpectationsWereMet()).Should(Succeed())
+		})
+
+		It("returns an error if the states cannot be read", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT COALESCE`).WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(7))
+			mock.ExpectQuery("SELECT possum, state FROM state").WillReturnError(fmt.Errorf("connection refused"))
+			mock.ExpectRollback()
+			_, err := utils.ExportSnapshot(db)
+			Ω(err).Should(MatchError("connection refused"))
+		})
+	})
+
+	Describe("#Sign", func() {
+		var snapshot utils.Snapshot
+
+		BeforeEach(func() {
+			var err error
+			snapshot, err = utils.Snapshot{
+				FormatVersion: utils.SnapshotFormat,
+				SchemaVersion: 7,
+				ExportedAt:    changedAt,
+				States:        map[string]string{"joey": "dead", "mother": "alive"},
+				History:       []utils.StateChange{},
+			}.Sign([]byte("key"))
+			Ω(err).Should(BeNil())
+		})
+
+		It("signs a snapshot so that it verifies after a JSON round trip", func() {
+			Ω(snapshot.Signature).Should(MatchRegexp(`^[0-9a-f]{64}$`))
+			data, err := json.Marshal(snapshot)
+			Ω(err).Should(BeNil())
+			var decoded utils.Snapshot
+			Ω(json.Unmarshal(data, &decoded)).Should(Succeed())
+			Ω(decoded.Verify([]byte("key"))).Should(BeTrue())
+		})
+
+		It("does not verify with another key", func() {
+			Ω(snapshot.Verify([]byte("other key"))).Should(BeFalse())
+		})
+
+		It("does not verify once the snapshot is changed", func() {
+			snapshot.States = map[string]string{"joey": "alive", "mother": "alive"}
+			Ω(snapshot.Verify([]byte("key"))).Should(BeFalse())
+		})
+	})
+
+	Describe("#ImportSnapshot", func() {
+		var snapshot utils.Snapshot
+
+		allowAll := func(map[string]string, utils.ServiceStateReader) (string, error) {
+			return "", nil
+		}
+
+		BeforeEach(func() {
+			snapshot = utils.Snapshot{
+				States:  map[string]string{"joey": "dead", "mother": "alive"},
+				History: []utils.StateChange{{Possum: "joey", State: "dead", ChangedAt: changedAt, ChangedBy: "alice"}},
+			}
+		})
+
+		expectLock := func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`^SELECT possum, state FROM state WHERE possum IN \(\?, \?\) ORDER BY possum FOR UPDATE$`).
+				WithArgs("joey", "mother").
+				WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow("joey", "alive").AddRow("mother", "alive"))
+		}
+
+		Context("when the possum has no history", func() {
+			It("imports the history and writes and records every change in one transaction", func() {
+				expectLock()
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM state_history`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectExec("INSERT INTO state_history").WithArgs("joey", "dead", changedAt, "alice", false, "").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("UPDATE state").WithArgs("dead", sqlmock.AnyArg(), "bob", "joey").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO state_history").WithArgs("joey", "dead", sqlmock.AnyArg(), "bob", false, "").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+
+				result, err := utils.ImportSnapshot(db, []string{"mother", "joey"}, snapshot, "bob", allowAll)
+				Ω(err).Should(BeNil())
+				Ω(result).Should(Equal(utils.ImportResult{Changed: []string{"joey"}, HistoryImported: 1}))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+		})
+
+		Context("when the possum already has history", func() {
+			It("keeps its history", func() {
+				expectLock()
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM state_history`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+				mock.ExpectExec("UPDATE state").WithArgs("dead", sqlmock.AnyArg(), "bob", "joey").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO state_history").WithArgs("joey", "dead", sqlmock.AnyArg(), "bob", false, "").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+
+				result, err := utils.ImportSnapshot(db, []string{"mother", "joey"}, snapshot, "bob", allowAll)
+				Ω(err).Should(BeNil())
+				Ω(result).Should(Equal(utils.ImportResult{Changed: []string{"joey"}, HistoryImported: 0}))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+		})
+
+		Context("when the snapshot has service states", func() {
+			It("writes and records the service states that changed", func() {
+				snapshot.ServiceStates = map[string]map[string]string{"payments": {"joey": "alive", "mother": "dead"}}
+				expectLock()
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM state_history`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+				mock.ExpectExec("UPDATE state").WithArgs("dead", sqlmock.AnyArg(), "bob", "joey").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO state_history").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery("SELECT possum, state FROM service_state WHERE service=(.+) FOR UPDATE").WithArgs("payments", "mother", "joey").
+					WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}))
+				mock.ExpectExec("INSERT INTO service_state ").WithArgs("mother", "payments", "dead", sqlmock.AnyArg(), "bob").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO service_state_history").WithArgs("mother", "payments", "dead", sqlmock.AnyArg(), "bob", false, "").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+
+				result, err := utils.ImportSnapshot(db, []string{"mother", "joey"}, snapshot, "bob", allowAll)
+				Ω(err).Should(BeNil())
+				Ω(result.ServicesChanged).Should(Equal(map[string][]string{"payments": {"mother"}}))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+		})
+
+		Context("when validation fails", func() {
+			It("rolls back without writing anything", func() {
+				expectLock()
+				mock.ExpectRollback()
+				_, err := utils.ImportSnapshot(db, []string{"mother", "joey"}, snapshot, "bob", func(map[string]string, utils.ServiceStateReader) (string, error) {
+					return "", fmt.Errorf("Would have killed all possums")
+				})
+				Ω(err).Should(MatchError("Would have killed all possums"))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+		})
+
+		Context("when a state is invalid", func() {
+			It("returns an error without touching the database", func() {
+				snapshot.States["joey"] = "sleeping"
+				_, err := utils.ImportSnapshot(db, []string{"mother", "joey"}, snapshot, "bob", allowAll)
+				Ω(err).Should(MatchError(`The state of joey should have been "alive" or "dead" not "sleeping"`))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+		})
+	})
+})
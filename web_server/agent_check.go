@@ -0,0 +1,99 @@
+package webServer
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAgentCheckAliveResponse = "up"
+	defaultAgentCheckDeadResponse  = "down"
+	agentCheckWriteTimeout         = 5 * time.Second
+)
+
+var agentCheckWord = regexp.MustCompile(`^(up|down|ready|drain|maint|stopped|fail|(100|[1-9]?[0-9])%)$`)
+
+// AgentCheckConfig - the replies sent to HAProxy agent-check probes for each state
+type AgentCheckConfig struct {
+	AliveResponse string
+	DeadResponse  string
+	// ErrorResponse is sent when the state cannot be read, when empty the
+	// connection is closed without a reply so HAProxy keeps the current state
+	ErrorResponse string
+}
+
+// LoadAgentCheckConfig - loads the agent-check replies from the environment
+func LoadAgentCheckConfig() (AgentCheckConfig, error) {
+	config := AgentCheckConfig{
+		AliveResponse: envOrDefault("AGENT_CHECK_ALIVE_RESPONSE", defaultAgentCheckAliveResponse),
+		DeadResponse:  envOrDefault("AGENT_CHECK_DEAD_RESPONSE", defaultAgentCheckDeadResponse),
+		ErrorResponse: envOrDefault("AGENT_CHECK_ERROR_RESPONSE", ""),
+	}
+	for name, response := range map[string]string{
+		"AGENT_CHECK_ALIVE_RESPONSE": config.AliveResponse,
+		"AGENT_CHECK_DEAD_RESPONSE":  config.DeadResponse,
+		"AGENT_CHECK_ERROR_RESPONSE": config.ErrorResponse,
+	} {
+		if err := validateAgentCheckResponse(response); err != nil {
+			return AgentCheckConfig{}, fmt.Errorf("%s is invalid: %s", name, err)
+		}
+	}
+	return config, nil
+}
+
+func validateAgentCheckResponse(response string) error {
+	for _, word := range strings.FieldsFunc(response, func(r rune) bool { return r == ' ' || r == ',' }) {
+		if !agentCheckWord.MatchString(word) {
+			return fmt.Errorf("%q is not an agent-check keyword or weight percentage", word)
+		}
+	}
+	return nil
+}
+
+// ServeAgentCheck - answers HAProxy agent-check probes with this possum's state until the listener is closed
+func (c *Controller) ServeAgentCheck(listener net.Listener, config AgentCheckConfig) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go c.answerAgentCheck(conn, config)
+	}
+}
+
+func (c *Controller) answerAgentCheck(conn net.Conn, config AgentCheckConfig) {
+	defer conn.Close()
+	response := c.agentCheckResponse(config)
+	if response == "" {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(agentCheckWriteTimeout))
+	if _, err := fmt.Fprintf(conn, "%s\n", response); err != nil {
+		log.WithFields(log.Fields{"package": "webServer", "function": "answerAgentCheck", "remote": conn.RemoteAddr().String()}).Debugf("Can't reply to agent-check: %s", err)
+	}
+}
+
+func (c *Controller) agentCheckResponse(config AgentCheckConfig) string {
+	possum, _, err := findMyPossum()
+	if err != nil {
+		log.WithFields(log.Fields{"package": "webServer", "function": "agentCheckResponse"}).Debugf("Can't find my possum: %s", err)
+		return config.ErrorResponse
+	}
+	state, _, err := c.readState(possum, readerAgentCheck)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "webServer", "function": "agentCheckResponse", "possum": possum}).Debugf("Can't get state: %s", err)
+		return config.ErrorResponse
+	}
+	switch state {
+	case "alive":
+		return config.AliveResponse
+	case "dead":
+		return config.DeadResponse
+	}
+	return config.ErrorResponse
+}
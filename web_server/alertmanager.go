@@ -0,0 +1,171 @@
+package webServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const alertmanagerActor = "alertmanager"
+
+// AlertRule - maps alerts whose labels include every label in Match to a possum
+type AlertRule struct {
+	Match  map[string]string `json:"match"`
+	Possum string            `json:"possum"`
+}
+
+// Alert - a single alert in an Alertmanager webhook payload
+type Alert struct {
+	Status string            `json:"status"`
+	Labels map[string]string `json:"labels"`
+}
+
+// AlertmanagerWebhook - the parts of an Alertmanager webhook payload used by possum
+type AlertmanagerWebhook struct {
+	Status string  `json:"status"`
+	Alerts []Alert `json:"alerts"`
+}
+
+// loadAlertRules - loads the alert to possum rules from ALERTMANAGER_RULES
+func loadAlertRules() ([]AlertRule, error) {
+	data := os.Getenv("ALERTMANAGER_RULES")
+	if data == "" {
+		return nil, newAPIError(CodeAlertmanagerDisabled, "Alertmanager rules are not configured")
+	}
+	var rules []AlertRule
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		return nil, newAPIError(CodeConfig, "ALERTMANAGER_RULES is invalid: %s", err)
+	}
+	for i, rule := range rules {
+		if len(rule.Match) == 0 || rule.Possum == "" {
+			return nil, newAPIError(CodeConfig, "ALERTMANAGER_RULES is invalid: rule %d needs match labels and a possum", i)
+		}
+	}
+	return rules, nil
+}
+
+func (rule AlertRule) matches(alert Alert) bool {
+	for label, value := range rule.Match {
+		if alert.Labels[label] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// AlertTracker - the alerts firing for each possum, kept across webhooks because
+// Alertmanager sends each alert group in its own webhook
+type AlertTracker struct {
+	mutex  sync.Mutex
+	firing map[string]map[string]bool
+}
+
+// NewAlertTracker - creates an AlertTracker with no firing alerts
+func NewAlertTracker() *AlertTracker {
+	return &AlertTracker{firing: make(map[string]map[string]bool)}
+}
+
+// alertKey - identifies an alert by its labels, as Alertmanager does
+func alertKey(alert Alert) string {
+	labels := make([]string, 0, len(alert.Labels))
+	for label, value := range alert.Labels {
+		labels = append(labels, fmt.Sprintf("%s=%q", label, value))
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+// states - records the alerts and returns the desired state of every possum they match, a
+// possum is killed if any of its alerts are firing, in this or an earlier webhook, and
+// revived once all have resolved
+func (t *AlertTracker) states(rules []AlertRule, alerts []Alert) map[string]string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	desiredPasselState := make(map[string]string)
+	for _, alert := range alerts {
+		for _, rule := range rules {
+			if !rule.matches(alert) {
+				continue
+			}
+			firing := t.firing[rule.Possum]
+			if alert.Status == "firing" {
+				if firing == nil {
+					firing = make(map[string]bool)
+					t.firing[rule.Possum] = firing
+				}
+				firing[alertKey(alert)] = true
+			} else {
+				delete(firing, alertKey(alert))
+			}
+			desiredPasselState[rule.Possum] = ""
+		}
+	}
+	for possum := range desiredPasselState {
+		if len(t.firing[possum]) > 0 {
+			desiredPasselState[possum] = "dead"
+		} else {
+			desiredPasselState[possum] = "alive"
+			delete(t.firing, possum)
+		}
+	}
+	return desiredPasselState
+}
+
+// ReceiveAlerts - Kill or revive the possums matched by Alertmanager webhook alerts, or propose
+// the change when approval is required
+func (c *Controller) ReceiveAlerts(w http.ResponseWriter, r *http.Request) {
+	if !c.authorize(w, r, checkAuth) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	rules, err := loadAlertRules()
+	if standardError(err, w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "ReceiveAlerts"}).Debug(err.Error())
+		return
+	}
+	passel, err := getPassel()
+	if standardError(err, w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "ReceiveAlerts"}).Debugf("Can't get passel: %s", err.Error())
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if standardError(wrapError(CodeInvalidRequest, err), w) {
+		return
+	}
+	if standardError(validateRequestBody(data, "AlertmanagerWebhook"), w) {
+		return
+	}
+	var webhook AlertmanagerWebhook
+	if standardError(wrapError(CodeInvalidRequest, json.Unmarshal(data, &webhook)), w) {
+		return
+	}
+	tracker := c.AlertTracker
+	if tracker == nil {
+		tracker = NewAlertTracker()
+	}
+	desiredPasselState := tracker.states(rules, webhook.Alerts)
+	if len(desiredPasselState) == 0 {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "ReceiveAlerts"}).Debugf("No rule matched any of %d alerts", len(webhook.Alerts))
+		writeJSON(w, http.StatusOK, PossumStates{PossumStates: desiredPasselState})
+		return
+	}
+	desiredPasselState, desiredPossumFound, desiredPossum := desiredPossumInPassel(desiredPasselState, passel)
+	if !desiredPossumFound {
+		customError(w, CodePossumNotInPassel, fmt.Sprintf("Possum %s is not part of my passel", desiredPossum))
+		return
+	}
+	c = c.forRequest(r)
+	// a webhook carries no second person, so with approval required it can only propose the change
+	if approvalRequired() {
+		c.propose(w, r, passel, PossumStates{PossumStates: desiredPasselState})
+		return
+	}
+	c.changePasselState(w, passel, PossumStates{PossumStates: desiredPasselState}, alertmanagerActor, false)
+}
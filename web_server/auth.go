@@ -0,0 +1,402 @@
+package webServer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FidelityInternational/possum/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAuthLockoutThreshold   = 5
+	defaultAuthLockoutBaseSeconds = 30
+	defaultAuthLockoutMaxSeconds  = 3600
+	// failures are pruned once this many sources and usernames are tracked
+	authFailurePruneSize = 1024
+	// signed peer writes are only accepted this long either side of when they were signed
+	peerSignatureMaxAge = 5 * time.Minute
+	peerTimeHeader      = "X-Possum-Peer-Time"
+	peerSignatureHeader = "X-Possum-Peer-Signature"
+)
+
+// Reasons a request to a write endpoint is rejected, reported in logs and metrics
+const (
+	rejectBadCredentials   = "bad_credentials"
+	rejectLockedOut        = "locked_out"
+	rejectSourceNotAllowed = "source_not_allowed"
+)
+
+// AuthGuard - tracks failed authentication attempts by source IP and by
+// username at that source, locking either out for exponentially longer after
+// too many. Usernames are only locked out at the source guessing at them, so
+// guesses from anywhere cannot lock a user out everywhere.
+type AuthGuard struct {
+	mutex      sync.Mutex
+	failures   map[string]*authFailures
+	rejections map[string]int
+	lockouts   int
+}
+
+type authFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// NewAuthGuard - creates an AuthGuard with no failed attempts
+func NewAuthGuard() *AuthGuard {
+	return &AuthGuard{
+		failures:   make(map[string]*authFailures),
+		rejections: make(map[string]int),
+	}
+}
+
+// authLockout - the failures allowed before a lockout, from AUTH_LOCKOUT_THRESHOLD,
+// and the first and longest lockouts, from AUTH_LOCKOUT_BASE_SECONDS and AUTH_LOCKOUT_MAX_SECONDS
+func authLockout() (int, time.Duration, time.Duration) {
+	threshold := envInt("AUTH_LOCKOUT_THRESHOLD", defaultAuthLockoutThreshold)
+	base := time.Duration(envInt("AUTH_LOCKOUT_BASE_SECONDS", defaultAuthLockoutBaseSeconds)) * time.Second
+	max := time.Duration(envInt("AUTH_LOCKOUT_MAX_SECONDS", defaultAuthLockoutMaxSeconds)) * time.Second
+	return threshold, base, max
+}
+
+func envInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+func authKeys(ip string, username string) []string {
+	keys := []string{"ip:" + ip}
+	if username != "" {
+		// a success by one user of a shared source, such as a NAT, clears the
+		// failures of the source but not those of the other usernames at it
+		keys = append(keys, "user:"+username+"@"+ip)
+	}
+	return keys
+}
+
+// lockedUntil - returns when the lockout of the source or of the username at the source
+// ends, if either is locked out at now
+func (g *AuthGuard) lockedUntil(ip string, username string, now time.Time) (time.Time, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	var until time.Time
+	for _, key := range authKeys(ip, username) {
+		if failures, found := g.failures[key]; found && failures.lockedUntil.After(until) {
+			until = failures.lockedUntil
+		}
+	}
+	return until, now.Before(until)
+}
+
+// fail - records a failed attempt, locking out the source or the username at it once
+// they reach the threshold and doubling the lockout with each further failure
+func (g *AuthGuard) fail(ip string, username string, now time.Time) {
+	threshold, base, max := authLockout()
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if len(g.failures) >= authFailurePruneSize {
+		g.prune(now, max)
+	}
+	for _, key := range authKeys(ip, username) {
+		failures, found := g.failures[key]
+		// failures are forgotten after a quiet period as long as the longest lockout
+		if !found || now.Sub(failures.lastFailure) > max {
+			failures = &authFailures{}
+			g.failures[key] = failures
+		}
+		failures.count++
+		failures.lastFailure = now
+		if failures.count < threshold {
+			continue
+		}
+		lockout := max
+		if doublings := failures.count - threshold; doublings < 32 && base<<uint(doublings) < max {
+			lockout = base << uint(doublings)
+		}
+		failures.lockedUntil = now.Add(lockout)
+		g.lockouts++
+		log.WithFields(log.Fields{"package": "webServer", "function": "fail", "key": key, "failures": failures.count}).Warnf("Locked out for %s", lockout)
+	}
+}
+
+// succeed - forgets the failed attempts of the source and of the username at it
+func (g *AuthGuard) succeed(ip string, username string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, key := range authKeys(ip, username) {
+		delete(g.failures, key)
+	}
+}
+
+func (g *AuthGuard) reject(reason string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.rejections[reason]++
+}
+
+func (g *AuthGuard) prune(now time.Time, max time.Duration) {
+	for key, failures := range g.failures {
+		if now.Sub(failures.lastFailure) > max && !now.Before(failures.lockedUntil) {
+			delete(g.failures, key)
+		}
+	}
+}
+
+// parseCIDRs - parses a comma or space separated list of CIDRs or IP addresses
+func parseCIDRs(key string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range strings.FieldsFunc(os.Getenv(key), func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, newAPIError(CodeConfig, "%s is invalid: %s", key, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP - returns the address a request came from. X-Forwarded-For is only
+// believed when the request came through a TRUSTED_PROXY_CIDRS proxy, such as
+// a gorouter, and then the client is the last address not added by a trusted
+// proxy. It returns nil if the remote address is not an IP address.
+func clientIP(r *http.Request) (net.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, nil
+	}
+	proxies, err := parseCIDRs("TRUSTED_PROXY_CIDRS")
+	if err != nil {
+		return nil, err
+	}
+	if !containsIP(proxies, ip) {
+		return ip, nil
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			break
+		}
+		ip = forwardedIP
+		if !containsIP(proxies, ip) {
+			break
+		}
+	}
+	return ip, nil
+}
+
+// credentialsMatch - compares credentials in constant time, hashing them
+// first so that the time taken does not reveal their lengths either
+func credentialsMatch(username string, password string, wantUsername string, wantPassword string) bool {
+	usernameHash := sha256.Sum256([]byte(username))
+	wantUsernameHash := sha256.Sum256([]byte(wantUsername))
+	passwordHash := sha256.Sum256([]byte(password))
+	wantPasswordHash := sha256.Sum256([]byte(wantPassword))
+	usernameMatch := subtle.ConstantTimeCompare(usernameHash[:], wantUsernameHash[:])
+	passwordMatch := subtle.ConstantTimeCompare(passwordHash[:], wantPasswordHash[:])
+	return usernameMatch&passwordMatch == 1
+}
+
+// peerSignature - the HMAC-SHA256 with the peer secret of everything a signed peer write
+// depends on, so a signature cannot be moved to another write
+func peerSignature(secret string, method string, path string, timestamp string, actor string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n", method, path, timestamp, actor)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signPeerRequest - signs a write one possum makes to another with the peer secret, so the
+// other possum can tell it apart from a write made with the shared possum credentials.
+// Writes are left unsigned if no peer secret is configured.
+func signPeerRequest(req *http.Request, body []byte) error {
+	secret, err := utils.GetPeerSecret()
+	if err != nil {
+		return wrapError(CodeConfig, err)
+	}
+	if secret == "" {
+		return nil
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(peerTimeHeader, timestamp)
+	req.Header.Set(peerSignatureHeader, peerSignature(secret, req.Method, req.URL.Path, timestamp, req.Header.Get(actorHeader), body))
+	return nil
+}
+
+// checkPeerSignature - true if the request is a write another possum signed with the peer
+// secret within peerSignatureMaxAge. The body is read to check the signature and put back
+// for the handler.
+func checkPeerSignature(r *http.Request) bool {
+	signature := r.Header.Get(peerSignatureHeader)
+	if signature == "" {
+		return false
+	}
+	secret, err := utils.GetPeerSecret()
+	if err != nil || secret == "" {
+		return false
+	}
+	timestamp := r.Header.Get(peerTimeHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > peerSignatureMaxAge || age < -peerSignatureMaxAge {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "checkPeerSignature"}).Warn("Rejected a peer signature outside the allowed clock skew")
+		return false
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	want := peerSignature(secret, r.Method, r.URL.Path, timestamp, r.Header.Get(actorHeader), body)
+	return hmac.Equal([]byte(signature), []byte(want))
+}
+
+// authorize - checks a request to a write endpoint comes from a WRITE_ALLOWED_CIDRS
+// source that is not locked out and carries credentials accepted by check,
+// writing the error response if it does not. Writes signed with the peer secret are
+// neither locked out nor counted, so guessing the shared possum credentials cannot
+// stop passel wide writes.
+func (c *Controller) authorize(w http.ResponseWriter, r *http.Request, check func(*http.Request) bool) bool {
+	guard := c.AuthGuard
+	if guard == nil {
+		guard = NewAuthGuard()
+	}
+	ip, err := clientIP(r)
+	if standardError(err, w) {
+		return false
+	}
+	source := "unknown"
+	if ip != nil {
+		source = ip.String()
+	}
+	username, _, supplied := r.BasicAuth()
+	fields := log.Fields{"package": "webServer", "function": "authorize", "ip": source, "username": username, "path": r.URL.Path}
+
+	allowed, err := parseCIDRs("WRITE_ALLOWED_CIDRS")
+	if standardError(err, w) {
+		return false
+	}
+	if len(allowed) > 0 && !containsIP(allowed, ip) {
+		guard.reject(rejectSourceNotAllowed)
+		requestLog(r).WithFields(fields).Warn("Rejected a write from a source that is not allowed")
+		writeError(w, newAPIError(CodeSourceNotAllowed, "Writes are not allowed from %s", source))
+		return false
+	}
+
+	now := time.Now()
+	signed := checkPeerSignature(r)
+	if until, locked := guard.lockedUntil(source, username, now); locked && !signed {
+		guard.reject(rejectLockedOut)
+		requestLog(r).WithFields(fields).Warn("Rejected a write while locked out")
+		retryAfter := int((until.Sub(now) + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, newAPIError(CodeAuthLockedOut, "Too many failed attempts, try again in %d seconds", retryAfter))
+		return false
+	}
+
+	if !check(r) {
+		// requests without credentials are not guesses
+		if supplied && !signed {
+			guard.fail(source, username, now)
+			guard.reject(rejectBadCredentials)
+			requestLog(r).WithFields(fields).Warn("Rejected a write with bad credentials")
+		}
+		unauthorizedError(w)
+		return false
+	}
+	// signed writes do not clear the failures of the shared username, so
+	// possums writing to each other do not reset a lockout of guesses at it
+	if !signed {
+		guard.succeed(source, username)
+	}
+	return true
+}
+
+// GetMetrics - Get authentication and state cache metrics in the Prometheus text format
+func (c *Controller) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	guard := c.AuthGuard
+	if guard == nil {
+		guard = NewAuthGuard()
+	}
+	now := time.Now()
+	guard.mutex.Lock()
+	rejections := make(map[string]int, len(guard.rejections))
+	for reason, count := range guard.rejections {
+		rejections[reason] = count
+	}
+	lockouts := guard.lockouts
+	locked := 0
+	for _, failures := range guard.failures {
+		if now.Before(failures.lockedUntil) {
+			locked++
+		}
+	}
+	guard.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP possum_auth_rejections_total Requests to write endpoints rejected, by reason.")
+	fmt.Fprintln(w, "# TYPE possum_auth_rejections_total counter")
+	for _, reason := range []string{rejectBadCredentials, rejectLockedOut, rejectSourceNotAllowed} {
+		fmt.Fprintf(w, "possum_auth_rejections_total{reason=%q} %d\n", reason, rejections[reason])
+	}
+	fmt.Fprintln(w, "# HELP possum_auth_lockouts_total Source IPs, and usernames at a source IP, locked out after failed attempts.")
+	fmt.Fprintln(w, "# TYPE possum_auth_lockouts_total counter")
+	fmt.Fprintf(w, "possum_auth_lockouts_total %d\n", lockouts)
+	fmt.Fprintln(w, "# HELP possum_auth_locked_out Source IPs, and usernames at a source IP, currently locked out.")
+	fmt.Fprintln(w, "# TYPE possum_auth_locked_out gauge")
+	fmt.Fprintf(w, "possum_auth_locked_out %d\n", locked)
+
+	cache := c.StateCache
+	if cache == nil {
+		cache = NewStateCache("")
+	}
+	served, age := cache.metrics(now)
+	fmt.Fprintln(w, "# HELP possum_state_cache_served_total Reads answered from the state cache because the database was unavailable, by reader.")
+	fmt.Fprintln(w, "# TYPE possum_state_cache_served_total counter")
+	for _, reader := range []string{readerState, readerPasselState, readerAgentCheck, readerDNS, readerServiceState, readerPasselServiceState} {
+		fmt.Fprintf(w, "possum_state_cache_served_total{reader=%q} %d\n", reader, served[reader])
+	}
+	fmt.Fprintln(w, "# HELP possum_state_cache_age_seconds Seconds since the state cache was last read from the database.")
+	fmt.Fprintln(w, "# TYPE possum_state_cache_age_seconds gauge")
+	fmt.Fprintf(w, "possum_state_cache_age_seconds %g\n", age)
+}
@@ -2,6 +2,7 @@ package webServer
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
@@ -9,11 +10,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"reflect"
-	"regexp"
 	"strings"
+	"time"
 
 	"github.com/FidelityInternational/possum/utils"
 	log "github.com/sirupsen/logrus"
@@ -21,290 +23,457 @@ import (
 
 const (
 	defaultPollingIntervalSeconds = 10
+	defaultPeerTimeoutSeconds     = 10
+	actorHeader                   = "X-Possum-Actor"
 )
 
 // Controller struct
 type Controller struct {
 	DB         *sql.DB
 	HTTPClient *http.Client
+	// Prober is nil unless foundation probing is configured
+	Prober *Prober
+	// Reloader is nil unless a passel config file is configured
+	Reloader *Reloader
+	// Discoverer is nil unless peer discovery is configured
+	Discoverer *Discoverer
+	// AuthGuard is nil if failed authentication attempts are not tracked
+	AuthGuard *AuthGuard
+	// StateCache is nil if reads are not answered from the cache when the database is unavailable
+	StateCache *StateCache
+	// AlertTracker is nil if firing alerts are only known for the webhook they came in
+	AlertTracker *AlertTracker
+	// Consistency is nil if when the passel was last consistent is not tracked
+	Consistency *ConsistencyTracker
+	// ctx is the context of the request being handled, set by forRequest
+	ctx context.Context
 }
 
 // PossumStates struct
 type PossumStates struct {
 	PossumStates map[string]string `json:"possum_states"`
-	Error        string            `json:"error"`
-	Force        bool              `json:"force"`
+	// Service is set when the states are of a service of each possum
+	Service   string     `json:"service,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Code      ErrorCode  `json:"code,omitempty"`
+	Force     bool       `json:"force,omitempty"`
+	DryRun    bool       `json:"dry_run,omitempty"`
+	Emergency bool       `json:"emergency,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Propose   bool       `json:"propose,omitempty"`
+	Stale     bool       `json:"stale,omitempty"`
+	CachedAt  *time.Time `json:"cached_at,omitempty"`
+	// Metadata is the version of each state and when and by whom it was last changed
+	Metadata map[string]utils.PossumState `json:"metadata,omitempty"`
+}
+
+// StateChanges struct
+type StateChanges struct {
+	StateChanges map[string]utils.StateChange `json:"state_changes"`
 }
 
 // CreateController - returns a populated controller object
 func CreateController(db *sql.DB) *Controller {
 	return &Controller{
-		DB:         db,
-		HTTPClient: createHTTPClient(),
+		DB:           db,
+		HTTPClient:   createHTTPClient(),
+		AuthGuard:    NewAuthGuard(),
+		StateCache:   NewStateCache(os.Getenv("STATE_CACHE_FILE")),
+		Consistency:  &ConsistencyTracker{},
+		AlertTracker: NewAlertTracker(),
 	}
 }
 
 // GetState - Get state of a single possum
 func (c *Controller) GetState(w http.ResponseWriter, r *http.Request) {
+	c = c.forRequest(r)
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", loadCORSAllowed())
-	myURIs, err := utils.GetMyApplicationURIs()
+	possum, _, err := findMyPossum()
 	if standardError(err, w) {
-		log.WithFields(log.Fields{"package": "webServer", "function": "GetState"}).Debugf("Can't get application URIs: %s", err.Error())
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetState"}).Debugf("Can't find my possum: %s", err.Error())
 		return
 	}
-	if len(myURIs) == 0 {
-		customError(w, http.StatusGone, "No uris were configured")
-		log.WithFields(log.Fields{"package": "webServer", "function": "GetState"}).Debugf("No uris were configured: %v", myURIs)
+	state, cachedAt, err := c.readState(possum, readerState)
+	if standardError(wrapError(CodeDatabase, err), w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetState"}).Debugf("%v", err)
 		return
 	}
-	passel, err := utils.GetPassel()
-	if standardError(err, w) {
-		log.WithFields(log.Fields{"package": "webServer", "function": "GetState"}).Debugf("Can't get passel: %s", err.Error())
+	if !cachedAt.IsZero() {
+		setStaleWarning(w)
+		writeJSON(w, http.StatusOK, StateResponse{State: state, Stale: true, CachedAt: &cachedAt})
 		return
 	}
-	if len(passel) == 0 {
-		log.WithFields(log.Fields{"package": "webServer", "function": "GetState"}).Debugln("Passel had 0 members")
-		customError(w, http.StatusGone, "Passel had 0 members")
-		return
-	}
-	for _, uri := range myURIs {
-		for _, possum := range passel {
-			if uriPossumMatch(uri, possum) {
-				state, err := utils.GetState(c.DB, possum)
-				if standardError(err, w) {
-					log.WithFields(log.Fields{"package": "webServer", "function": "GetState"}).Debugf("%v", err)
-					return
-				}
-				w.WriteHeader(http.StatusOK)
-				fmt.Fprintf(w, fmt.Sprintf(`{"state": "%s"}`, state))
-				return
-			}
-		}
-	}
-	log.WithFields(log.Fields{"package": "webServer", "function": "GetState"}).Debugln("Could not match any possum in db")
-	w.WriteHeader(http.StatusGone)
-	fmt.Fprintf(w, `{"error": "Could not match any possum in db"}`)
+	writeJSON(w, http.StatusOK, StateResponse{State: state})
 }
 
 // GetPasselState - Get state of the entire passel
 func (c *Controller) GetPasselState(w http.ResponseWriter, r *http.Request) {
+	c = c.forRequest(r)
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", loadCORSAllowed())
 
-	passel, err := utils.GetPassel()
+	passel, err := getPassel()
 	if standardError(err, w) {
-		log.WithFields(log.Fields{"package": "webServer", "function": "GetPassel"}).Debugf("Can't get passel: %s", err.Error())
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetPassel"}).Debugf("Can't get passel: %s", err.Error())
 		return
 	}
-	possumStates, err := utils.GetPasselState(c.DB, passel)
-	if standardError(err, w) {
-		log.WithFields(log.Fields{"package": "webServer", "function": "GetPassel"}).Debug(err.Error())
+	if r.URL.Query().Get("metadata") == "true" {
+		c.getPasselStateMetadata(w, r, passel)
+		return
+	}
+	possumStates, cachedAt, err := c.readPasselState(passel, readerPasselState)
+	if standardError(wrapError(CodeDatabase, err), w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetPassel"}).Debug(err.Error())
+		return
+	}
+	if !cachedAt.IsZero() {
+		setStaleWarning(w)
+		writeJSON(w, http.StatusOK, PossumStates{PossumStates: possumStates, Stale: true, CachedAt: &cachedAt})
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	possumStatesBytes, _ := json.Marshal(possumStates)
-	fmt.Fprintf(w, fmt.Sprintf(`{"possum_states": %s}`, string(possumStatesBytes)))
+	writeJSON(w, http.StatusOK, PossumStates{PossumStates: possumStates})
 }
 
-// GetPasselStateConsistency - Get the state conistency of the passel
+// getPasselStateMetadata - writes the passel state with its metadata, the cache does not
+// hold metadata so it is always read from the database
+func (c *Controller) getPasselStateMetadata(w http.ResponseWriter, r *http.Request, passel []string) {
+	span := c.storeSpan("GetPasselStateMetadata")
+	metadata, err := utils.GetPasselStateMetadata(c.DB, passel)
+	endStoreSpan(span, err)
+	if standardError(wrapError(CodeDatabase, err), w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetPassel"}).Debug(err.Error())
+		return
+	}
+	possumStates := make(map[string]string, len(metadata))
+	for possum, possumState := range metadata {
+		possumStates[possum] = possumState.State
+	}
+	if c.StateCache != nil {
+		c.StateCache.update("", possumStates, time.Now().UTC())
+	}
+	writeJSON(w, http.StatusOK, PossumStates{PossumStates: possumStates, Metadata: metadata})
+}
+
+// GetPasselStateConsistency - Get the state conistency of the passel. Once a quorum of
+// possums answer, the states they returned are sent with the possums that did not answer
+// in missed, so the dashboard can still be used while a foundation is down.
 func (c *Controller) GetPasselStateConsistency(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", loadCORSAllowed())
 
 	passel, err := getPassel()
 	if standardError(err, w) {
-		log.WithFields(log.Fields{"package": "webServer", "function": "GetPasselStateConsistency"}).Debugf("Can't get passel: %s", err.Error())
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetPasselStateConsistency"}).Debugf("Can't get passel: %s", err.Error())
 		return
 	}
-	passelStates, err := gatherStates(c.HTTPClient, passel)
+	c = c.forRequest(r)
+	reachable, err := gatherQuorumStates(c.HTTPClient, passel, "")
 	if standardError(err, w) {
-		log.WithFields(log.Fields{"package": "webServer", "function": "GetPasselStateConsistency"}).Debug(err.Error())
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetPasselStateConsistency"}).Debug(err.Error())
+		return
+	}
+	consistent := len(reachable.Missed) == 0 && arePasselStatesConsistent(reachable.PasselStates)
+	c.Consistency.record(consistent, time.Now())
+	response := PasselStatesResponse{Consistent: true, Passel: reachable.Passel, Missed: reachable.Missed, PasselStates: reachable.PasselStates, Membership: c.checkMembership(passel)}
+	if len(reachable.Missed) > 0 {
+		writeStateInconsistent(w, response, fmt.Sprintf("Possums %s did not answer", strings.Join(reachable.Missed, ", ")))
 		return
 	}
-	consistent := arePasselStatesConsistent(passelStates)
-	if stateInconsistentError(w, passelStates, consistent, "") {
+	if !consistent {
+		writeStateInconsistent(w, response, "")
 		return
 	}
-	passelStatesBytes, _ := json.Marshal(passelStates)
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, fmt.Sprintf(`{"consistent": true, "passel_states": %s}`, string(passelStatesBytes)))
+	writeJSON(w, http.StatusOK, response)
+}
+
+// GetStateChanges - Get the most recent recorded state change of each possum in the passel
+func (c *Controller) GetStateChanges(w http.ResponseWriter, r *http.Request) {
+	c = c.forRequest(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	passel, err := getPassel()
+	if standardError(err, w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetStateChanges"}).Debugf("Can't get passel: %s", err.Error())
+		return
+	}
+	span := c.storeSpan("GetLastStateChanges")
+	stateChanges, err := utils.GetLastStateChanges(c.DB, passel)
+	endStoreSpan(span, err)
+	if standardError(wrapError(CodeDatabase, err), w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetStateChanges"}).Debug(err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, StateChanges{StateChanges: stateChanges})
 }
 
 // SetState - set the possum state
 func (c *Controller) SetState(w http.ResponseWriter, r *http.Request) {
-	if !checkAuth(w, r) {
-		w.WriteHeader(401)
-		fmt.Fprintf(w, "401 Unauthorized")
+	if !c.authorize(w, r, checkAuth) {
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	myURIs, err := utils.GetMyApplicationURIs()
-	if standardError(err, w) {
-		log.WithFields(log.Fields{"package": "webServer", "function": "SetState"}).Debugf("Can't get application URIs: %s, Request: ", err.Error())
+	c.setState(w, r, "")
+}
+
+// setState - writes the desired states of the possums, or of a service of each
+// possum when service is not empty, to this possum's database
+func (c *Controller) setState(w http.ResponseWriter, r *http.Request, service string) {
+	c = c.forRequest(r)
+	signed := checkPeerSignature(r)
+	// only writes fanned out by a possum, which signs them with the peer secret, or
+	// emergency writes skip approval; the shared possum credentials are not enough
+	if approvalRequired() && !signed && !checkEmergencyAuth(r) {
+		writeError(w, newAPIError(CodeApprovalRequired, "Changes need approval, propose them with POST %s", statePath(service, "passel_state")))
 		return
 	}
-	if len(myURIs) == 0 {
-		customError(w, http.StatusGone, "No uris were configured")
+	w.Header().Set("Content-Type", "application/json")
+	possum, passel, err := findMyPossum()
+	if standardError(err, w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "SetState"}).Debugf("Can't find my possum: %s", err.Error())
 		return
 	}
-	passel, err := utils.GetPassel()
+	desiredPasselState, err := getDesiredPasselState(r)
 	if standardError(err, w) {
-		log.WithFields(log.Fields{"package": "webServer", "function": "SetState"}).Debugf("Can't get passel: %s", err.Error())
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "SetState"}).Debug(err.Error())
 		return
 	}
-	if len(passel) == 0 {
-		customError(w, http.StatusGone, "Passel had 0 members")
+	desiredPasselState, desiredPossumFound, desiredPossum := desiredPossumInPassel(desiredPasselState, passel)
+	if !desiredPossumFound {
+		customError(w, CodePossumNotInPassel, fmt.Sprintf("Possum %s is not part of my passel", desiredPossum))
 		return
 	}
-	for _, uri := range myURIs {
-		for _, possum := range passel {
-			if uriPossumMatch(uri, possum) {
-				desiredPasselState, err := getDesiredPasselState(r)
-				if standardError(err, w) {
-					log.WithFields(log.Fields{"package": "webServer", "function": "SetState"}).Debug(err.Error())
-					return
-				}
-				desiredPossumFound, desiredPossum := desiredPossumInPassel(desiredPasselState, passel)
-				if !desiredPossumFound {
-					customError(w, http.StatusInternalServerError, fmt.Sprintf("Possum %s is not part of my passel", desiredPossum))
-					return
-				}
-				passelState, err := getPasselState(c.HTTPClient, possum)
-				if standardError(err, w) {
-					log.WithFields(log.Fields{"package": "webServer", "function": "SetState"}).Debugf("Can't get passel: %s", err.Error())
-					return
-				}
-				if !isAtLeastOnePossumAlive(desiredPasselState, passelState) {
-					customError(w, http.StatusInternalServerError, "Would have killed all possums")
-					return
-				}
-				for desiredPossum, desiredState := range desiredPasselState {
-					err = utils.WriteState(c.DB, desiredPossum, desiredState)
-					if standardError(err, w) {
-						return
-					}
-				}
-				afterWritePasselState, err := getPasselState(c.HTTPClient, possum)
-				if standardError(err, w) {
-					log.WithFields(log.Fields{"package": "webServer", "function": "SetState"}).Debug(err.Error())
-					return
-				}
-				completeDesiredState := updateStateToDesired(desiredPasselState, afterWritePasselState)
-				configuredCorrectly := reflect.DeepEqual(completeDesiredState, afterWritePasselState)
-				afterWritePasselStateBytes, _ := json.Marshal(afterWritePasselState)
-				if !configuredCorrectly {
-					completeDesiredStateBytes, _ := json.Marshal(completeDesiredState)
-					customError(w, http.StatusInternalServerError, fmt.Sprintf("State should have been: %s but was %s", string(completeDesiredStateBytes), string(afterWritePasselStateBytes)))
-					log.WithFields(log.Fields{"package": "webServer", "function": "SetState"}).Debugf("State should have been: %s but was %s", string(completeDesiredStateBytes), string(afterWritePasselStateBytes))
-					return
-				}
-				w.WriteHeader(http.StatusAccepted)
-				fmt.Fprintf(w, fmt.Sprintf(`{"possum_states": %s}`, string(afterWritePasselStateBytes)))
-				return
-			}
+	actor := requestActor(r, signed)
+	checkChange := func(passelState map[string]string) (string, error) {
+		if !changesState(desiredPasselState, passelState) {
+			return "", nil
+		}
+		// a signed catch-up write only replays a change the passel already allowed
+		if signed && actor == catchUpActor {
+			return "", nil
 		}
+		emergency, reason := emergencyRequest(r)
+		return checkFreeze(emergency, reason, checkEmergencyAuth(r), actor)
+	}
+	// the checks run against the passel state locked by the write, so
+	// concurrent writes cannot each pass them and together kill every possum
+	var passelState map[string]string
+	if service == "" {
+		span := c.storeSpan("WriteStates")
+		passelState, err = utils.WriteStates(c.DB, passel, desiredPasselState, actor, func(passelState map[string]string, serviceStates utils.ServiceStateReader) (string, error) {
+			if !isAtLeastOnePossumAlive(desiredPasselState, passelState) {
+				return "", newAPIError(CodeWouldKillAll, "Would have killed all possums")
+			}
+			// service writes lock the possum states too, so the service states cannot change under this check
+			if err := checkServicesStayAlive(desiredPasselState, passelState, nil, serviceStates); err != nil {
+				return "", err
+			}
+			return checkChange(passelState)
+		})
+		endStoreSpan(span, err)
+	} else {
+		span := c.storeSpan("WriteServiceStates")
+		passelState, err = utils.WriteServiceStates(c.DB, passel, service, desiredPasselState, actor, func(possumStates map[string]string, serviceStates map[string]string) (string, error) {
+			if !isServiceAliveSomewhere(desiredPasselState, serviceStates, possumStates) {
+				return "", newAPIError(CodeWouldKillAll, "Would have killed %s on every possum", service)
+			}
+			return checkChange(serviceStates)
+		})
+		endStoreSpan(span, err)
+	}
+	if standardError(wrapError(CodeDatabase, err), w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "SetState", "possum": possum, "service": service}).Debug(err.Error())
+		return
 	}
-	w.WriteHeader(http.StatusGone)
-	fmt.Fprintf(w, `{"error": "Could not match any possum in db"}`)
+	// verify against the committed data
+	var afterWritePasselState map[string]string
+	if service == "" {
+		span := c.storeSpan("GetPasselState")
+		afterWritePasselState, err = utils.GetPasselState(c.DB, passel)
+		endStoreSpan(span, err)
+	} else {
+		span := c.storeSpan("GetPasselServiceState")
+		afterWritePasselState, err = utils.GetPasselServiceState(c.DB, passel, service)
+		endStoreSpan(span, err)
+	}
+	if standardError(wrapError(CodeDatabase, err), w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "SetState"}).Debug(err.Error())
+		return
+	}
+	if c.StateCache != nil {
+		c.StateCache.update(service, afterWritePasselState, time.Now().UTC())
+	}
+	completeDesiredState := updateStateToDesired(desiredPasselState, passelState)
+	configuredCorrectly := reflect.DeepEqual(completeDesiredState, afterWritePasselState)
+	if !configuredCorrectly {
+		afterWritePasselStateBytes, _ := json.Marshal(afterWritePasselState)
+		completeDesiredStateBytes, _ := json.Marshal(completeDesiredState)
+		customError(w, CodeStateMismatch, fmt.Sprintf("State should have been: %s but was %s", string(completeDesiredStateBytes), string(afterWritePasselStateBytes)))
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "SetState"}).Debugf("State should have been: %s but was %s", string(completeDesiredStateBytes), string(afterWritePasselStateBytes))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, PossumStates{PossumStates: afterWritePasselState, Service: service})
 }
 
 // SetPasselState - Set the state of the entire passel
 func (c *Controller) SetPasselState(w http.ResponseWriter, r *http.Request) {
-	if !checkAuth(w, r) {
-		w.WriteHeader(401)
-		fmt.Fprintf(w, "401 Unauthorized")
+	if !c.authorize(w, r, checkAuth) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
+	c.setPasselStates(w, r, "")
+}
+
+// setPasselStates - changes the states of the possums, or of a service of each possum
+// when service is not empty, on every possum in the passel
+func (c *Controller) setPasselStates(w http.ResponseWriter, r *http.Request, service string) {
+	signed := checkPeerSignature(r)
 	passel, err := getPassel()
 	if standardError(err, w) {
-		log.WithFields(log.Fields{"package": "webServer", "function": "SetPasselState"}).Debugf("Can't get passel: %s", err.Error())
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "SetPasselState"}).Debugf("Can't get passel: %s", err.Error())
 		return
 	}
 	desiredPossumStates, err := getDesiredPossumStates(r)
 	if standardError(err, w) {
-		log.WithFields(log.Fields{"package": "webServer", "function": "SetPasselState"}).Debug(err.Error())
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "SetPasselState"}).Debug(err.Error())
+		return
+	}
+	desiredPossumStates.Service = service
+	c = c.forRequest(r)
+	// the emergency credentials bypass approval, as they do for a single possum
+	elevated := checkEmergencyAuth(r)
+	if (desiredPossumStates.Propose || (approvalRequired() && !elevated)) && !desiredPossumStates.DryRun {
+		c.propose(w, r, passel, desiredPossumStates)
 		return
 	}
-	desiredPasselState := desiredPossumStates.PossumStates
-	passelStates, err := gatherStates(c.HTTPClient, passel)
+	c.changePasselState(w, passel, desiredPossumStates, requestActor(r, signed), elevated)
+}
+
+// changePasselState - checks a passel state change is safe and allowed, then applies it to every
+// possum in the passel, elevated is true if the change was made with the emergency credentials.
+// The change is to a service of each possum when desiredPossumStates.Service is set.
+func (c *Controller) changePasselState(w http.ResponseWriter, passel []string, desiredPossumStates PossumStates, actor string, elevated bool) {
+	service := desiredPossumStates.Service
+	// possums named differently to the passel are renamed, the others are rejected by each possum
+	desiredPasselState := inPasselNames(desiredPossumStates.PossumStates, passel)
+	desiredPossumStates.PossumStates = desiredPasselState
+	reachable, err := gatherQuorumStates(c.HTTPClient, passel, service)
 	if standardError(err, w) {
-		log.WithFields(log.Fields{"package": "webServer", "function": "SetPasselState"}).Debug(err.Error())
+		responseLog(w).WithFields(log.Fields{"package": "webServer", "function": "changePasselState"}).Debug(err.Error())
 		return
 	}
+	passelStates := reachable.PasselStates
 	if !desiredPossumStates.Force {
-		consistent := arePasselStatesConsistent(passelStates)
-		if stateInconsistentError(w, passelStates, consistent, "State was inconsistent before update") {
+		consistent := statesAgree(passelStates)
+		if service == "" {
+			c.Consistency.record(consistent, time.Now())
+		}
+		if stateInconsistentError(w, reachable.Passel, passelStates, consistent, "State was inconsistent before update") {
 			return
 		}
 	}
-	if !isAtLeastOnePossumAlive(desiredPasselState, passelStates[0]) {
-		customError(w, http.StatusInternalServerError, "Would have killed all possums")
+	if service == "" && !isAtLeastOnePossumAlive(desiredPasselState, passelStates[0]) {
+		customError(w, CodeWouldKillAll, "Would have killed all possums")
+		return
+	}
+	if service == "" {
+		if err := checkServicesStayAlive(desiredPasselState, passelStates[0], nil, c.serviceStateReader(passel)); standardError(err, w) {
+			return
+		}
+	}
+	if service != "" {
+		// a service is only up where its possum is alive too
+		possumStates, _, err := c.readPasselState(passel, readerPasselState)
+		if standardError(wrapError(CodeDatabase, err), w) {
+			responseLog(w).WithFields(log.Fields{"package": "webServer", "function": "changePasselState"}).Debug(err.Error())
+			return
+		}
+		if !isServiceAliveSomewhere(desiredPasselState, passelStates[0], possumStates) {
+			customError(w, CodeWouldKillAll, fmt.Sprintf("Would have killed %s on every possum", service))
+			return
+		}
+	}
+	var emergencyReason string
+	if changesState(desiredPasselState, passelStates[0]) {
+		emergencyReason, err = checkFreeze(desiredPossumStates.Emergency, desiredPossumStates.Reason, elevated, actor)
+		if standardError(err, w) {
+			return
+		}
+	}
+	if desiredPossumStates.DryRun {
+		writeJSON(w, http.StatusOK, PasselStatesResponse{
+			Consistent:    statesAgree(passelStates),
+			DryRun:        true,
+			Service:       service,
+			Passel:        reachable.Passel,
+			Missed:        reachable.Missed,
+			PasselStates:  passelStates,
+			ProposedState: updateStateToDesired(desiredPasselState, passelStates[0]),
+		})
 		return
 	}
 	desiredPasselStateBytes, _ := json.Marshal(desiredPasselState)
-	afterWritePasselStates, err := setStates(c.HTTPClient, passel, desiredPasselStateBytes)
+	written, err := c.setQuorumStates(reachable, desiredPasselStateBytes, actor, emergencyReason)
 	if standardError(err, w) {
-		log.WithFields(log.Fields{"package": "webServer", "function": "SetPasselState"}).Debug(err.Error())
+		responseLog(w).WithFields(log.Fields{"package": "webServer", "function": "changePasselState"}).Debug(err.Error())
 		return
 	}
-	afterWriteConsistent := arePasselStatesConsistent(afterWritePasselStates)
-	if stateInconsistentError(w, afterWritePasselStates, afterWriteConsistent, "State was inconsistent after update") {
+	afterWriteConsistent := statesAgree(written.PasselStates)
+	if service == "" {
+		c.Consistency.record(afterWriteConsistent, time.Now())
+	}
+	if stateInconsistentError(w, written.Passel, written.PasselStates, afterWriteConsistent, "State was inconsistent after update") {
 		return
 	}
-	afterWritePasselStatesBytes, _ := json.Marshal(afterWritePasselStates)
-	w.WriteHeader(http.StatusAccepted)
-	fmt.Fprintf(w, fmt.Sprintf(`{"consistent": true, "passel_states": %s}`, string(afterWritePasselStatesBytes)))
+	writeJSON(w, http.StatusAccepted, PasselStatesResponse{Consistent: true, Service: service, Passel: written.Passel, Missed: written.Missed, PasselStates: written.PasselStates})
 }
 
 func standardError(err error, w http.ResponseWriter) bool {
 	if err != nil {
-		fmt.Println("An error occurred:")
-		fmt.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()))
+		writeError(w, toAPIError(err))
 		return true
 	}
 	return false
 }
 
-func customError(w http.ResponseWriter, statusCode int, err string) {
-	fmt.Println("An error occurred:")
-	fmt.Println(err)
-	w.WriteHeader(statusCode)
-	fmt.Fprintf(w, fmt.Sprintf(`{"error": "%s"}`, err))
+func customError(w http.ResponseWriter, code ErrorCode, err string) {
+	writeError(w, newAPIError(code, "%s", err))
 }
 
-func stateInconsistentError(w http.ResponseWriter, passelStates []map[string]string, consistent bool, customError string) bool {
+func stateInconsistentError(w http.ResponseWriter, passel []string, passelStates []map[string]string, consistent bool, customError string) bool {
 	if !consistent {
-		passelStatesBytes, _ := json.Marshal(passelStates)
-		passelStatesString := string(passelStatesBytes)
-		fmt.Println("An error occurred:")
-		w.WriteHeader(http.StatusInternalServerError)
-		if customError == "" {
-			fmt.Printf("State was inconsistent: \n%s\n", passelStatesString)
-			fmt.Fprintf(w, fmt.Sprintf(`{"consistent": false, "error": "State was inconsistent", "passel_states": %s}`, passelStatesString))
-			return true
-		}
-		fmt.Printf("%s: \n%s\n", customError, passelStatesString)
-		fmt.Fprintf(w, fmt.Sprintf(`{"consistent": false, "error": "%s", "passel_states": %s}`, customError, passelStatesString))
+		writeStateInconsistent(w, PasselStatesResponse{Passel: passel, PasselStates: passelStates}, customError)
 		return true
 	}
 	return false
 }
 
+// writeStateInconsistent - writes response as a STATE_INCONSISTENT error
+func writeStateInconsistent(w http.ResponseWriter, response PasselStatesResponse, customError string) {
+	if customError == "" {
+		customError = "State was inconsistent"
+	}
+	passelStatesBytes, _ := json.Marshal(response.PasselStates)
+	responseLog(w).WithFields(log.Fields{"package": "webServer", "function": "writeStateInconsistent", "code": CodeStateInconsistent}).Warnf("%s: %s", customError, string(passelStatesBytes))
+	response.Consistent = false
+	response.Error = customError
+	response.Code = CodeStateInconsistent
+	response.RequestID = w.Header().Get(RequestIDHeader)
+	writeJSON(w, CodeStateInconsistent.Status(), response)
+}
+
 func getDesiredPasselState(r *http.Request) (map[string]string, error) {
 	var desiredPasselState map[string]string
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.WithFields(log.Fields{"package": "webServer", "function": "getDesiredPasselState"}).Debugf("Couldn't read body of request :%s", err)
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "getDesiredPasselState"}).Debugf("Couldn't read body of request :%s", err)
+		return nil, wrapError(CodeInvalidRequest, err)
+	}
+	err = validateRequestBody(data, "SetStateRequest")
+	if err != nil {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "getDesiredPasselState"}).Debugf("Invalid request :%s", err)
 		return nil, err
 	}
 	err = json.Unmarshal(data, &desiredPasselState)
 	if err != nil {
-		log.WithFields(log.Fields{"package": "webServer", "function": "getDesiredPasselState"}).Debugf("Couldn't unmarshal JSON :%s", err)
-		return nil, err
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "getDesiredPasselState"}).Debugf("Couldn't unmarshal JSON :%s", err)
+		return nil, wrapError(CodeInvalidRequest, err)
 	}
 	return desiredPasselState, nil
 }
@@ -313,22 +482,22 @@ func getDesiredPossumStates(r *http.Request) (PossumStates, error) {
 	var desiredPossumStates PossumStates
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.WithFields(log.Fields{"package": "webServer", "function": "getDesiredPossumStates"}).Debugf("Couldn't read body of request :%s", err)
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "getDesiredPossumStates"}).Debugf("Couldn't read body of request :%s", err)
+		return PossumStates{}, wrapError(CodeInvalidRequest, err)
+	}
+	err = validateRequestBody(data, "SetPasselStateRequest")
+	if err != nil {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "getDesiredPossumStates"}).Debugf("Invalid request :%s", err)
 		return PossumStates{}, err
 	}
 	err = json.Unmarshal(data, &desiredPossumStates)
 	if err != nil {
-		log.WithFields(log.Fields{"package": "webServer", "function": "getDesiredPossumStates"}).Debugf("Couldn't unmarshal JSON :%s", err)
-		return PossumStates{}, err
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "getDesiredPossumStates"}).Debugf("Couldn't unmarshal JSON :%s", err)
+		return PossumStates{}, wrapError(CodeInvalidRequest, err)
 	}
 	return desiredPossumStates, nil
 }
 
-func uriPossumMatch(uri string, possum string) bool {
-	match, _ := regexp.MatchString(fmt.Sprintf("^http.?://%s$", uri), possum)
-	return match
-}
-
 func isAtLeastOnePossumAlive(desiredPasselStates map[string]string, passelStates map[string]string) bool {
 	for _, state := range updateStateToDesired(desiredPasselStates, passelStates) {
 		if state == "alive" {
@@ -338,6 +507,14 @@ func isAtLeastOnePossumAlive(desiredPasselStates map[string]string, passelStates
 	return false
 }
 
+// keepsAPossumAlive - refuses a passel that would have no possum alive once it is swapped in
+func keepsAPossumAlive(passelState map[string]string) error {
+	if !isAtLeastOnePossumAlive(nil, passelState) {
+		return newAPIError(CodeWouldKillAll, "Would have left no possum alive in the passel")
+	}
+	return nil
+}
+
 func updateStateToDesired(desiredPasselStates map[string]string, passelStates map[string]string) map[string]string {
 	newPasselStates := make(map[string]string)
 	for possum, state := range passelStates {
@@ -349,18 +526,6 @@ func updateStateToDesired(desiredPasselStates map[string]string, passelStates ma
 	return newPasselStates
 }
 
-func gatherStates(httpClient *http.Client, passel []string) ([]map[string]string, error) {
-	var passelStates []map[string]string
-	for _, possum := range passel {
-		possumStates, err := getPasselState(httpClient, possum)
-		if err != nil {
-			return nil, err
-		}
-		passelStates = append(passelStates, possumStates)
-	}
-	return passelStates, nil
-}
-
 func arePasselStatesConsistent(passelStates []map[string]string) bool {
 	var count int
 	consistent := make(map[bool]struct{})
@@ -378,114 +543,159 @@ func arePasselStatesConsistent(passelStates []map[string]string) bool {
 	return false
 }
 
-func getPasselState(httpClient *http.Client, possum string) (map[string]string, error) {
+// getPasselState - asks a possum for the passel state, or the state of a service of
+// each possum when service is not empty. A stale answer is an error.
+func getPasselState(httpClient *http.Client, possum string, service string) (map[string]string, error) {
 	var possumStates PossumStates
-	resp, err := httpClient.Get(fmt.Sprintf("%s/v1/passel_state", possum))
+	uri := possum + statePath(service, "passel_state")
+	resp, err := httpClient.Get(uri)
 	if err != nil {
-		log.WithFields(log.Fields{"package": "webServer", "function": "getPasselState", "URI": fmt.Sprintf("%s/v1/passel_state", possum)}).Debugf("Couldn't complete API request :%s", err)
-		return nil, err
+		log.WithFields(log.Fields{"package": "webServer", "function": "getPasselState", "URI": uri}).Debugf("Couldn't complete API request :%s", err)
+		return nil, peerRequestError(err)
 	}
 	defer resp.Body.Close()
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.WithFields(log.Fields{"package": "webServer", "function": "getPasselState"}).Debugf("Couldn't read body of request :%s", err)
-		return nil, err
+		return nil, peerRequestError(err)
 	}
 	err = json.Unmarshal(data, &possumStates)
 	if err != nil {
 		log.WithFields(log.Fields{"package": "webServer", "function": "getPasselState"}).Debugf("Couldn't unmarshal JSON :%s", err)
-		return nil, err
+		return nil, wrapError(CodePeerInvalidResponse, err)
 	}
 	if possumStates.Error != "" {
 		log.WithFields(log.Fields{"package": "webServer", "function": "getPasselState"}).Debug(possumStates.Error)
-		return nil, fmt.Errorf(possumStates.Error)
+		return nil, newAPIError(CodePeerError, "%s", possumStates.Error)
+	}
+	// a possum answering from its cache cannot vote on or verify a write
+	if possumStates.Stale {
+		log.WithFields(log.Fields{"package": "webServer", "function": "getPasselState", "URI": uri}).Debug("Possum answered from its cache")
+		return nil, newAPIError(CodePeerError, "Possum %s answered from its cache, its database is unavailable", possum)
+	}
+	return peerPasselStates(possumStates.PossumStates), nil
+}
+
+// findMyPossum - returns the possum in the passel that this application is serving, and the passel
+func findMyPossum() (string, []string, error) {
+	if self := os.Getenv("POSSUM_SELF"); self != "" {
+		passel, err := getPassel()
+		if err != nil {
+			return "", nil, err
+		}
+		if possum, found := inPassel(self, passel); found {
+			return possum, passel, nil
+		}
+		return "", nil, newAPIError(CodePossumNotMatched, "POSSUM_SELF %s is not in the passel", self)
+	}
+	myURIs, err := selfRoutes()
+	if err != nil {
+		return "", nil, wrapError(CodeConfig, err)
+	}
+	if len(myURIs) == 0 {
+		return "", nil, newAPIError(CodeNoURIs, "No uris were configured")
+	}
+	passel, err := getPassel()
+	if err != nil {
+		return "", nil, err
+	}
+	matched := matchSelf(myURIs, passel)
+	switch len(matched) {
+	case 0:
+		return "", nil, newAPIError(CodePossumNotMatched, "Could not match any possum in db")
+	case 1:
+		return matched[0], passel, nil
 	}
-	return possumStates.PossumStates, nil
+	return "", nil, newAPIError(CodePossumNotMatched, "Routes %s match more than one possum %s, set POSSUM_SELF", strings.Join(myURIs, ", "), strings.Join(matched, ", "))
 }
 
 func getPassel() ([]string, error) {
 	passel, err := utils.GetPassel()
 	if err != nil {
-		return nil, err
+		return nil, wrapError(CodeConfig, err)
 	}
 	if len(passel) == 0 {
-		return nil, fmt.Errorf("Passel had 0 members")
+		return nil, newAPIError(CodePasselEmpty, "Passel had 0 members")
 	}
 	return passel, nil
 }
 
-func setStates(httpClient *http.Client, passel []string, passelState []byte) ([]map[string]string, error) {
-	var passelStates []map[string]string
-	for _, possum := range passel {
-		possumStates, err := setPasselState(httpClient, possum, passelState)
-		if err != nil {
-			return nil, err
-		}
-		passelStates = append(passelStates, possumStates)
-	}
-	return passelStates, nil
-}
-
-func setPasselState(httpClient *http.Client, possum string, passelState []byte) (map[string]string, error) {
+// setPasselState - writes the passel state, or the state of a service of each possum when
+// service is not empty, to a possum. A non-empty emergencyReason makes it an emergency change
+// made with the emergency credentials
+func setPasselState(httpClient *http.Client, possum string, service string, passelState []byte, actor string, emergencyReason string) (map[string]string, error) {
 	var possumStates PossumStates
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/state", possum), bytes.NewReader(passelState))
+	req, err := http.NewRequest("POST", possum+statePath(service, "state"), bytes.NewReader(passelState))
 	if err != nil {
 		log.WithFields(log.Fields{"package": "webServer", "function": "setPasselState", "URI": fmt.Sprintf("%s/v1/passel_state", possum)}).Debugf("Couldn't set possum state :%s", err)
 		return nil, err
 	}
 	username, err := utils.GetUsername()
 	if err != nil {
-		return nil, err
+		return nil, wrapError(CodeConfig, err)
 	}
 
 	password, err := utils.GetPassword()
 	if err != nil {
-		return nil, err
+		return nil, wrapError(CodeConfig, err)
+	}
+	if emergencyReason != "" {
+		username, password, err = utils.GetEmergencyCredentials()
+		if err != nil {
+			return nil, wrapError(CodeConfig, err)
+		}
+		req.Header.Set(emergencyHeader, "true")
+		req.Header.Set(emergencyReasonHeader, emergencyReason)
 	}
 	req.SetBasicAuth(username, password)
+	if actor != "" {
+		req.Header.Set(actorHeader, actor)
+	}
+	if err := signPeerRequest(req, passelState); err != nil {
+		return nil, err
+	}
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.WithFields(log.Fields{"package": "webServer", "function": "setPasselState"}).Debugf("Couldn't authenticate :%s", err)
-		return nil, err
+		log.WithFields(log.Fields{"package": "webServer", "function": "setPasselState"}).Debugf("Couldn't complete API request :%s", err)
+		return nil, peerRequestError(err)
 	}
 
 	defer resp.Body.Close()
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.WithFields(log.Fields{"package": "webServer", "function": "setPasselState"}).Debugf("Couldn't read body of request :%s", err)
-		return nil, err
+		return nil, peerRequestError(err)
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		log.WithFields(log.Fields{"package": "webServer", "function": "setPasselState", "response_code": resp.StatusCode}).Debugf("Couldn't authenticate :%s", err)
-		return nil, fmt.Errorf("Couldn't authenticate: %d %s", resp.StatusCode, string(data))
+		log.WithFields(log.Fields{"package": "webServer", "function": "setPasselState", "response_code": resp.StatusCode}).Debugf("Possum %s rejected the update", possum)
+		if json.Unmarshal(data, &possumStates) == nil && possumStates.Error != "" {
+			return nil, newAPIError(CodePeerError, "Possum %s rejected the update: %d %s", possum, resp.StatusCode, possumStates.Error)
+		}
+		return nil, newAPIError(CodePeerError, "Possum %s rejected the update: %d %s", possum, resp.StatusCode, string(data))
 	}
 
 	err = json.Unmarshal(data, &possumStates)
 	if err != nil {
 		log.WithFields(log.Fields{"package": "webServer", "function": "setPasselState", "data": string(data)}).Debugf("Couldn't unmarshal JSON :%s", err)
-		return nil, err
+		return nil, wrapError(CodePeerInvalidResponse, err)
 	}
 	if possumStates.Error != "" {
 		log.WithFields(log.Fields{"package": "webServer", "function": "setPasselState"}).Debug(possumStates.Error)
-		return nil, fmt.Errorf(possumStates.Error)
+		return nil, newAPIError(CodePeerError, "%s", possumStates.Error)
 	}
-	return possumStates.PossumStates, nil
+	return peerPasselStates(possumStates.PossumStates), nil
 }
 
-func desiredPossumInPassel(desiredPasselState map[string]string, passel []string) (bool, string) {
-	for desiredPossum := range desiredPasselState {
-		var found bool
-		for _, possum := range passel {
-			if desiredPossum == possum {
-				found = true
-			}
-		}
-		if !found {
-			return false, desiredPossum
+// desiredPossumInPassel - the desired states keyed by the passel entry of each possum, or
+// false and the first possum that is not in the passel
+func desiredPossumInPassel(desiredPasselState map[string]string, passel []string) (map[string]string, bool, string) {
+	for _, desiredPossum := range sortedKeys(desiredPasselState) {
+		if _, found := inPassel(desiredPossum, passel); !found {
+			return nil, false, desiredPossum
 		}
 	}
-	return true, ""
+	return inPasselNames(desiredPasselState, passel), true, ""
 }
 
 func createHTTPClient() *http.Client {
@@ -497,47 +707,62 @@ func createHTTPClient() *http.Client {
 	transport := &http.Transport{
 		TLSClientConfig: tlsConfig,
 	}
-	return &http.Client{Transport: transport}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   defaultPeerTimeoutSeconds * time.Second,
+	}
+}
+
+func peerRequestError(err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return wrapError(CodePeerTimeout, err)
+	}
+	return wrapError(CodePeerUnreachable, err)
 }
 
-func checkAuth(w http.ResponseWriter, r *http.Request) bool {
+// checkAuth - true if the request carries the credentials of the "possum" service, the emergency credentials or those of a named user
+func checkAuth(r *http.Request) bool {
 	s := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
 	if len(s) != 2 {
-		log.WithFields(log.Fields{"package": "webServer", "function": "checkAuth"}).Debugf("No authorisation header found ")
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "checkAuth"}).Debugf("No authorisation header found ")
 		return false
 	}
 
 	b, err := base64.StdEncoding.DecodeString(s[1])
 	if err != nil {
-		log.WithFields(log.Fields{"package": "webServer", "function": "checkAuth"}).Debugf("Cannot decode string :%s ", err)
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "checkAuth"}).Debugf("Cannot decode string :%s ", err)
 		return false
 	}
 
 	pair := strings.SplitN(string(b), ":", 2)
 	if len(pair) != 2 {
-		fmt.Println(err)
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "checkAuth"}).Debug("Authorisation header has no password")
 		return false
 	}
 
 	username, err := utils.GetUsername()
 	if err != nil {
-		fmt.Println(err)
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "checkAuth"}).Debugf("Can't get username: %s", err)
 		return false
 	}
 
 	password, err := utils.GetPassword()
 	if err != nil {
-		fmt.Println(err)
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "checkAuth"}).Debugf("Can't get password: %s", err)
 		return false
 	}
 
-	return pair[0] == username && pair[1] == password
+	return credentialsMatch(pair[0], pair[1], username, password) || checkEmergencyAuth(r) || checkUserAuth(r)
 }
 
-func loadCORSAllowed() string {
-	corsAllowed := os.Getenv("CORS_ALLOWED")
-	if corsAllowed == "" {
-		corsAllowed = "*"
+// requestActor - returns who is making an authenticated request, preferring the
+// actor forwarded by a peer possum fanning out a passel wide update. The forwarded
+// actor is only trusted when the request is signed with the peer secret, which
+// callers check with checkPeerSignature before they read the body.
+func requestActor(r *http.Request, signed bool) string {
+	if actor := r.Header.Get(actorHeader); actor != "" && signed {
+		return actor
 	}
-	return corsAllowed
+	username, _, _ := r.BasicAuth()
+	return username
 }
@@ -0,0 +1,132 @@
+package webServer
+
+import (
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCORSAllowedMethods = "GET, POST, OPTIONS"
+	defaultCORSAllowedHeaders = "Authorization, Content-Type"
+	defaultCORSMaxAgeSeconds  = 600
+)
+
+// CORSConfig - which cross origin requests are allowed and how
+type CORSConfig struct {
+	AllowAny         bool
+	Origins          []string
+	Patterns         []*regexp.Regexp
+	AllowedMethods   string
+	AllowedHeaders   string
+	AllowCredentials bool
+	MaxAgeSeconds    int
+}
+
+// LoadCORSConfig - loads the CORS configuration from the environment
+//
+// CORS_ALLOWED is a comma or space separated list of origins, which may use
+// "*" as a wildcard (e.g. "https://*.example.com"), or "*" to allow any origin.
+// Any origin is never allowed to send credentials, so "*" with
+// CORS_ALLOW_CREDENTIALS still answers with a literal "*" and no credentials.
+func LoadCORSConfig() CORSConfig {
+	config := CORSConfig{
+		AllowedMethods: envOrDefault("CORS_ALLOWED_METHODS", defaultCORSAllowedMethods),
+		AllowedHeaders: envOrDefault("CORS_ALLOWED_HEADERS", defaultCORSAllowedHeaders),
+		MaxAgeSeconds:  defaultCORSMaxAgeSeconds,
+	}
+	config.AllowCredentials, _ = strconv.ParseBool(os.Getenv("CORS_ALLOW_CREDENTIALS"))
+	if maxAge, err := strconv.Atoi(os.Getenv("CORS_MAX_AGE")); err == nil {
+		config.MaxAgeSeconds = maxAge
+	}
+
+	allowed := strings.FieldsFunc(envOrDefault("CORS_ALLOWED", "*"), func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	for _, origin := range allowed {
+		switch {
+		case origin == "*":
+			config.AllowAny = true
+		case strings.Contains(origin, "*"):
+			pattern := strings.Replace(regexp.QuoteMeta(strings.ToLower(origin)), `\*`, `[a-z0-9.-]+`, -1)
+			config.Patterns = append(config.Patterns, regexp.MustCompile("^"+pattern+"$"))
+		default:
+			config.Origins = append(config.Origins, strings.ToLower(strings.TrimSuffix(origin, "/")))
+		}
+	}
+	if config.AllowAny && config.AllowCredentials {
+		log.WithFields(log.Fields{"package": "webServer", "function": "LoadCORSConfig"}).Warn("CORS_ALLOW_CREDENTIALS is ignored for any origin, list the allowed origins in CORS_ALLOWED to allow credentials")
+	}
+	return config
+}
+
+// allowedOrigin - returns the value for Access-Control-Allow-Origin, or "" if the origin is not allowed
+func (c CORSConfig) allowedOrigin(origin string) string {
+	if c.AllowAny {
+		return "*"
+	}
+	if origin == "" {
+		return ""
+	}
+	lowerOrigin := strings.ToLower(origin)
+	for _, allowed := range c.Origins {
+		if lowerOrigin == allowed {
+			return origin
+		}
+	}
+	for _, pattern := range c.Patterns {
+		if pattern.MatchString(lowerOrigin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// CORSMiddleware - sets CORS headers on every response and answers preflight requests
+func CORSMiddleware(config CORSConfig) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			allowedOrigin := config.allowedOrigin(origin)
+			if allowedOrigin != "*" {
+				w.Header().Add("Vary", "Origin")
+			}
+			if allowedOrigin != "" {
+				w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+				// credentials are only allowed for origins that are listed
+				if config.AllowCredentials && allowedOrigin != "*" {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+			}
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				if allowedOrigin == "" {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.Header().Set("Access-Control-Allow-Methods", config.AllowedMethods)
+				w.Header().Set("Access-Control-Allow-Headers", config.AllowedHeaders)
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(config.MaxAgeSeconds))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func preflight(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func envOrDefault(key string, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
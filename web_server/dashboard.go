@@ -0,0 +1,204 @@
+package webServer
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// GetDashboard - Get the passel dashboard web page
+func (c *Controller) GetDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, dashboardHTML)
+}
+
+// dashboardHTML is kept in Go source rather than an embedded .html file as
+// .cfignore excludes *.html from the application pushed to Cloud Foundry
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>possum dashboard</title>
+<style>
+  body { font-family: sans-serif; margin: 2em; color: #222; }
+  table { border-collapse: collapse; margin-top: 1em; }
+  th, td { border: 1px solid #ccc; padding: 0.4em 0.8em; text-align: left; }
+  .alive { background: #d4f7d4; }
+  .dead { background: #f7d4d4; }
+  .unknown { background: #eee; }
+  .banner { padding: 0.6em; margin-top: 1em; }
+  .ok { background: #d4f7d4; }
+  .problem { background: #f7e3b5; }
+  #confirm { display: none; border: 2px solid #c60; padding: 1em; margin-top: 1em; }
+  #result { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>possum dashboard</h1>
+<form id="credentials" onsubmit="return false">
+  <label>Username <input id="username" autocomplete="username"></label>
+  <label>Password <input id="password" type="password" autocomplete="current-password"></label>
+</form>
+<div id="consistency" class="banner"></div>
+<table>
+  <thead id="head"></thead>
+  <tbody id="body"></tbody>
+</table>
+<div id="confirm">
+  <h2>Confirm change</h2>
+  <p id="confirm-summary"></p>
+  <table>
+    <thead><tr><th>Possum</th><th>Current</th><th>Proposed</th></tr></thead>
+    <tbody id="confirm-body"></tbody>
+  </table>
+  <p>
+    <button id="confirm-apply">Apply</button>
+    <button id="confirm-cancel">Cancel</button>
+  </p>
+</div>
+<p id="result"></p>
+<script>
+(function () {
+  "use strict";
+  var pending = null;
+
+  function el(tag, text, className) {
+    var node = document.createElement(tag);
+    if (text !== undefined) { node.textContent = text; }
+    if (className) { node.className = className; }
+    return node;
+  }
+
+  function authHeaders() {
+    var user = document.getElementById("username").value;
+    var pass = document.getElementById("password").value;
+    return {
+      "Content-Type": "application/json",
+      "Authorization": "Basic " + btoa(user + ":" + pass)
+    };
+  }
+
+  function getJSON(url) {
+    return fetch(url, { cache: "no-store" }).then(function (resp) { return resp.json(); });
+  }
+
+  function postPasselState(states, dryRun) {
+    return fetch("/v1/passel_state", {
+      method: "POST",
+      headers: authHeaders(),
+      body: JSON.stringify({ possum_states: states, dry_run: dryRun })
+    }).then(function (resp) { return resp.json(); });
+  }
+
+  function describeError(data) {
+    return data.code ? data.code + ": " + data.error : data.error;
+  }
+
+  function render(consistency, changes) {
+    var banner = document.getElementById("consistency");
+    var head = document.getElementById("head");
+    var body = document.getElementById("body");
+    head.textContent = "";
+    body.textContent = "";
+    if (!consistency.passel_states) {
+      banner.className = "banner problem";
+      banner.textContent = describeError(consistency);
+      return;
+    }
+    banner.className = consistency.consistent ? "banner ok" : "banner problem";
+    banner.textContent = consistency.consistent ? "All possums agree on the passel state" : describeError(consistency);
+
+    // peers are the possums that answered, in the order of passel_states, missed did not answer
+    var peers = consistency.passel || [];
+    var missed = consistency.missed || [];
+    var header = el("tr");
+    header.appendChild(el("th", "Possum"));
+    peers.forEach(function (peer) { header.appendChild(el("th", "Seen by " + peer)); });
+    missed.forEach(function (peer) { header.appendChild(el("th", "Seen by " + peer + " (not answering)")); });
+    ["Last change", "Changed by", ""].forEach(function (title) { header.appendChild(el("th", title)); });
+    head.appendChild(header);
+
+    var stateChanges = (changes && changes.state_changes) || {};
+    peers.concat(missed).sort().forEach(function (possum) {
+      var row = el("tr");
+      row.appendChild(el("th", missed.indexOf(possum) < 0 ? possum : possum + " (not answering)"));
+      consistency.passel_states.forEach(function (states) {
+        var state = states[possum] || "unknown";
+        row.appendChild(el("td", state, state));
+      });
+      missed.forEach(function () { row.appendChild(el("td", "unreachable", "unknown")); });
+      var change = stateChanges[possum];
+      row.appendChild(el("td", change ? new Date(change.changed_at).toLocaleString() : "never"));
+      row.appendChild(el("td", change ? change.changed_by : ""));
+      var actions = el("td");
+      ["dead", "alive"].forEach(function (state) {
+        var button = el("button", state === "dead" ? "Kill" : "Revive");
+        button.onclick = function () { propose(possum, state); };
+        actions.appendChild(button);
+      });
+      row.appendChild(actions);
+      body.appendChild(row);
+    });
+  }
+
+  function refresh() {
+    Promise.all([getJSON("/v1/passel_state_consistency"), getJSON("/v1/state_changes")])
+      .then(function (results) { render(results[0], results[1]); })
+      .catch(function (err) { document.getElementById("result").textContent = String(err); });
+  }
+
+  function propose(possum, state) {
+    var states = {};
+    states[possum] = state;
+    document.getElementById("result").textContent = "";
+    postPasselState(states, true).then(function (data) {
+      if (!data.dry_run) {
+        document.getElementById("result").textContent = "Dry run rejected: " + describeError(data);
+        return;
+      }
+      pending = states;
+      var current = data.passel_states[0] || {};
+      var confirmBody = document.getElementById("confirm-body");
+      confirmBody.textContent = "";
+      Object.keys(data.proposed_state).sort().forEach(function (name) {
+        var row = el("tr");
+        row.appendChild(el("td", name));
+        row.appendChild(el("td", current[name], current[name]));
+        row.appendChild(el("td", data.proposed_state[name], data.proposed_state[name]));
+        confirmBody.appendChild(row);
+      });
+      document.getElementById("confirm-summary").textContent =
+        (state === "dead" ? "Kill " : "Revive ") + possum + "?" +
+        (data.consistent ? "" : " Warning: the passel state is currently inconsistent.");
+      document.getElementById("confirm").style.display = "block";
+    });
+  }
+
+  document.getElementById("confirm-cancel").onclick = function () {
+    pending = null;
+    document.getElementById("confirm").style.display = "none";
+  };
+
+  document.getElementById("confirm-apply").onclick = function () {
+    var states = pending;
+    pending = null;
+    document.getElementById("confirm").style.display = "none";
+    if (!states) { return; }
+    postPasselState(states, false).then(function (data) {
+      if (data.status === "pending") {
+        document.getElementById("result").textContent = "Proposed as " + data.id + ", waiting for someone else to approve it";
+      } else {
+        document.getElementById("result").textContent = data.error ? "Update failed: " + describeError(data) : "Update applied";
+      }
+      refresh();
+    });
+  };
+
+  refresh();
+  setInterval(refresh, 10000);
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,202 @@
+package webServer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/FidelityInternational/possum/utils"
+)
+
+const readyDBTimeout = 2 * time.Second
+
+// Version - the version of possum, set at build time with
+// -ldflags "-X github.com/FidelityInternational/possum/web_server.Version=1.2.3"
+var Version = "dev"
+
+// ReadyCheck - the result of one readiness check
+type ReadyCheck struct {
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+	Possum string `json:"possum,omitempty"`
+}
+
+// ReadyResponse - whether this possum instance can serve requests, and the checks that decided it
+type ReadyResponse struct {
+	Ready  bool                  `json:"ready"`
+	Checks map[string]ReadyCheck `json:"checks"`
+}
+
+// DBPoolStats - the connection pool statistics of the state database
+type DBPoolStats struct {
+	MaxOpenConnections int     `json:"max_open_connections"`
+	OpenConnections    int     `json:"open_connections"`
+	InUse              int     `json:"in_use"`
+	Idle               int     `json:"idle"`
+	WaitCount          int64   `json:"wait_count"`
+	WaitSeconds        float64 `json:"wait_seconds"`
+	MaxIdleClosed      int64   `json:"max_idle_closed"`
+	MaxIdleTimeClosed  int64   `json:"max_idle_time_closed"`
+	MaxLifetimeClosed  int64   `json:"max_lifetime_closed"`
+}
+
+// PeerDiagnostics - whether a possum in the passel answered, and how quickly
+type PeerDiagnostics struct {
+	Possum           string  `json:"possum"`
+	Reachable        bool    `json:"reachable"`
+	Ready            bool    `json:"ready"`
+	StatusCode       int     `json:"status_code,omitempty"`
+	RoundTripSeconds float64 `json:"round_trip_seconds"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// DiagnosticsResponse - how this possum instance is configured and how it sees the passel
+type DiagnosticsResponse struct {
+	Version      string            `json:"version"`
+	ConfigSource string            `json:"config_source"`
+	Possum       string            `json:"possum,omitempty"`
+	DBDriver     string            `json:"db_driver"`
+	DBPool       DBPoolStats       `json:"db_pool"`
+	Peers        []PeerDiagnostics `json:"peers"`
+	// LastConsistentAt is nil if the passel has not been seen to be consistent since this instance started
+	LastConsistentAt            *time.Time `json:"last_consistent_at"`
+	SecondsSinceLastConsistency *float64   `json:"seconds_since_last_consistency"`
+}
+
+// ConsistencyTracker - remembers when the possums were last seen to agree on the passel state
+type ConsistencyTracker struct {
+	mutex            sync.Mutex
+	lastConsistentAt time.Time
+}
+
+// record - notes the result of a consistency check
+func (t *ConsistencyTracker) record(consistent bool, now time.Time) {
+	if t == nil || !consistent {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.lastConsistentAt = now
+}
+
+// last - when the possums were last seen to agree, zero if never
+func (t *ConsistencyTracker) last() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.lastConsistentAt
+}
+
+func readyCheck(err error) ReadyCheck {
+	if err != nil {
+		return ReadyCheck{OK: false, Error: err.Error()}
+	}
+	return ReadyCheck{OK: true}
+}
+
+// GetReady - Get whether this possum can reach its database, has a valid passel config and is in the passel
+func (c *Controller) GetReady(w http.ResponseWriter, r *http.Request) {
+	var dbErr error
+	if c.DB == nil {
+		dbErr = fmt.Errorf("No database is configured")
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), readyDBTimeout)
+		defer cancel()
+		dbErr = c.DB.PingContext(ctx)
+	}
+	_, passelErr := getPassel()
+	possum, _, possumErr := findMyPossum()
+	possumCheck := readyCheck(possumErr)
+	possumCheck.Possum = possum
+
+	response := ReadyResponse{
+		Ready: dbErr == nil && passelErr == nil && possumErr == nil,
+		Checks: map[string]ReadyCheck{
+			"database":      readyCheck(dbErr),
+			"passel_config": readyCheck(passelErr),
+			"possum":        possumCheck,
+		},
+	}
+	if !response.Ready {
+		writeJSON(w, http.StatusServiceUnavailable, response)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// GetDiagnostics - Get the version, configuration, database pool and view of the passel of this possum
+func (c *Controller) GetDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if !c.authorize(w, r, checkAuth) {
+		return
+	}
+	c = c.forRequest(r)
+	response := DiagnosticsResponse{
+		Version:      Version,
+		ConfigSource: "VCAP_SERVICES",
+		DBDriver:     "mysql",
+		Peers:        []PeerDiagnostics{},
+	}
+	if c.Reloader != nil {
+		response.ConfigSource = "file:" + c.Reloader.path
+	}
+	if c.DB != nil {
+		stats := c.DB.Stats()
+		response.DBPool = DBPoolStats{
+			MaxOpenConnections: stats.MaxOpenConnections,
+			OpenConnections:    stats.OpenConnections,
+			InUse:              stats.InUse,
+			Idle:               stats.Idle,
+			WaitCount:          stats.WaitCount,
+			WaitSeconds:        stats.WaitDuration.Seconds(),
+			MaxIdleClosed:      stats.MaxIdleClosed,
+			MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+			MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+		}
+	}
+	if possum, _, err := findMyPossum(); err == nil {
+		response.Possum = possum
+	}
+	if passel, err := utils.GetPassel(); err == nil {
+		response.Peers = c.checkPeers(passel)
+	}
+	if last := c.Consistency.last(); !last.IsZero() {
+		since := time.Since(last).Seconds()
+		response.LastConsistentAt = &last
+		response.SecondsSinceLastConsistency = &since
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// checkPeers - asks every possum in the passel whether it is ready, at the same time
+func (c *Controller) checkPeers(passel []string) []PeerDiagnostics {
+	peers := make([]PeerDiagnostics, len(passel))
+	var wg sync.WaitGroup
+	for i, possum := range passel {
+		wg.Add(1)
+		go func(i int, possum string) {
+			defer wg.Done()
+			peer := PeerDiagnostics{Possum: possum}
+			start := time.Now()
+			resp, err := c.HTTPClient.Get(fmt.Sprintf("%s/v1/ready", possum))
+			peer.RoundTripSeconds = time.Since(start).Seconds()
+			if err != nil {
+				peer.Error = err.Error()
+				peers[i] = peer
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			peer.Reachable = true
+			peer.StatusCode = resp.StatusCode
+			peer.Ready = resp.StatusCode == http.StatusOK
+			peers[i] = peer
+		}(i, possum)
+	}
+	wg.Wait()
+	return peers
+}
@@ -0,0 +1,494 @@
+package webServer
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FidelityInternational/possum/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDiscoveryIntervalSeconds = 30
+	defaultDiscoveryMissedRounds    = 10
+	membershipChangesShown          = 20
+)
+
+// Discovery modes, a passel without discovery is "static"
+const (
+	discoveryStatic = "static"
+	discoverySeeds  = "seeds"
+	discoveryDNS    = "dns"
+)
+
+// DiscoveryConfig - how a possum finds the other possums in its passel
+type DiscoveryConfig struct {
+	// Mode is "seeds" to register with Seeds and learn the rest of the passel from them,
+	// or "dns" to take the passel from the SRV records of SRVName
+	Mode    string   `json:"mode"`
+	Self    string   `json:"self"`
+	Seeds   []string `json:"seeds"`
+	SRVName string   `json:"srv_name"`
+	// Scheme is used for possums found in DNS, "https" if empty
+	Scheme          string `json:"scheme"`
+	IntervalSeconds int    `json:"interval_seconds"`
+	// MissedRounds is how many rounds in a row a possum can fail to answer before it leaves the passel
+	MissedRounds int    `json:"missed_rounds"`
+	InitialState string `json:"initial_state"`
+}
+
+// RegisterMemberRequest - a possum announcing itself to a seed
+type RegisterMemberRequest struct {
+	Possum string `json:"possum"`
+}
+
+// MembersResponse - the passel as this possum sees it, and whether the other possums see the same
+type MembersResponse struct {
+	Discovery string   `json:"discovery"`
+	Members   []string `json:"members"`
+	// Self is the member that is this possum, empty if it can not find itself in its passel
+	Self string `json:"self,omitempty"`
+	// Consistent is nil until a discovery round has checked the other possums
+	Consistent  *bool                    `json:"consistent,omitempty"`
+	CheckedAt   *time.Time               `json:"checked_at,omitempty"`
+	Disagreeing []string                 `json:"disagreeing,omitempty"`
+	Unreachable []string                 `json:"unreachable,omitempty"`
+	Changes     []utils.MembershipChange `json:"changes,omitempty"`
+}
+
+// Discoverer - keeps the passel in line with the possums found by registering with seeds or in DNS
+type Discoverer struct {
+	db         *sql.DB
+	config     DiscoveryConfig
+	httpClient *http.Client
+	// LookupSRV finds the SRV records of a name, net.LookupSRV unless replaced
+	LookupSRV func(service string, proto string, name string) (string, []*net.SRV, error)
+
+	mutex sync.Mutex
+	// missed is how many rounds in a row each known possum has failed to answer
+	missed      map[string]int
+	passel      []string
+	checkedAt   time.Time
+	disagreeing []string
+	unreachable []string
+}
+
+// validPossumURI - checks a possum is an http or https URL, as in a passel config
+func validPossumURI(possum string) error {
+	if u, err := url.Parse(possum); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("possum %q is not an http or https URL", possum)
+	}
+	return nil
+}
+
+// LoadDiscoveryConfig - parses and validates a JSON discovery configuration, taking
+// self from the first application URI if it is not set
+func LoadDiscoveryConfig(data []byte) (DiscoveryConfig, error) {
+	var config DiscoveryConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return DiscoveryConfig{}, err
+	}
+	if config.IntervalSeconds == 0 {
+		config.IntervalSeconds = defaultDiscoveryIntervalSeconds
+	}
+	if config.MissedRounds == 0 {
+		config.MissedRounds = defaultDiscoveryMissedRounds
+	}
+	if config.Scheme == "" {
+		config.Scheme = "https"
+	}
+	if config.InitialState == "" {
+		config.InitialState = "alive"
+	}
+	if config.IntervalSeconds < 0 || config.MissedRounds < 0 {
+		return DiscoveryConfig{}, fmt.Errorf("interval_seconds and missed_rounds cannot be negative")
+	}
+	if config.InitialState != "alive" && config.InitialState != "dead" {
+		return DiscoveryConfig{}, fmt.Errorf(`initial_state should have been "alive" or "dead" not "%s"`, config.InitialState)
+	}
+	if config.Scheme != "http" && config.Scheme != "https" {
+		return DiscoveryConfig{}, fmt.Errorf(`scheme should have been "http" or "https" not "%s"`, config.Scheme)
+	}
+	switch config.Mode {
+	case discoverySeeds:
+		if len(config.Seeds) == 0 {
+			return DiscoveryConfig{}, fmt.Errorf("no seeds were configured")
+		}
+		for _, seed := range config.Seeds {
+			if err := validPossumURI(seed); err != nil {
+				return DiscoveryConfig{}, err
+			}
+		}
+		// seeds only take registrations signed with the peer secret
+		secret, err := utils.GetPeerSecret()
+		if err != nil {
+			return DiscoveryConfig{}, err
+		}
+		if secret == "" {
+			return DiscoveryConfig{}, fmt.Errorf("seeds mode needs a peer_secret to sign registrations")
+		}
+	case discoveryDNS:
+		if config.SRVName == "" {
+			return DiscoveryConfig{}, fmt.Errorf("no srv_name was configured")
+		}
+	default:
+		return DiscoveryConfig{}, fmt.Errorf(`mode should have been "seeds" or "dns" not "%s"`, config.Mode)
+	}
+	if config.Self == "" {
+		config.Self = os.Getenv("POSSUM_SELF")
+	}
+	if config.Self == "" {
+		uris, err := selfRoutes()
+		if err != nil {
+			return DiscoveryConfig{}, err
+		}
+		if len(uris) == 0 {
+			return DiscoveryConfig{}, fmt.Errorf("self is not set and no application uris outside GLOBAL_DOMAIN were configured")
+		}
+		config.Self = fmt.Sprintf("%s://%s", config.Scheme, uris[0])
+	}
+	config.Self = utils.NormalisePossumURI(config.Self)
+	if err := validPossumURI(config.Self); err != nil {
+		return DiscoveryConfig{}, err
+	}
+	return config, nil
+}
+
+// NewDiscoverer - returns a discoverer that keeps the passel in db in line with the possums it finds
+func NewDiscoverer(db *sql.DB, config DiscoveryConfig) *Discoverer {
+	return &Discoverer{
+		db:         db,
+		config:     config,
+		httpClient: createHTTPClient(),
+		LookupSRV:  net.LookupSRV,
+		missed:     make(map[string]int),
+	}
+}
+
+// Run - discovers the passel every interval until stop is closed
+func (d *Discoverer) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(d.config.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		if err := d.Discover(); err != nil {
+			log.WithFields(log.Fields{"package": "webServer", "function": "Run"}).Warnf("Keeping the current passel: %s", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Discover - contacts every known possum, swaps in the passel they make up and
+// records whether they all see the same passel
+func (d *Discoverer) Discover() error {
+	candidates, err := d.candidates()
+	if err != nil {
+		return err
+	}
+	views := make(map[string][]string)
+	var unreachable []string
+	for _, possum := range candidates {
+		if utils.SamePossum(possum, d.config.Self) {
+			continue
+		}
+		members, err := d.contact(possum)
+		if err != nil {
+			log.WithFields(log.Fields{"package": "webServer", "function": "Discover", "possum": possum}).Debugf("Possum did not answer: %s", err)
+			unreachable = append(unreachable, possum)
+			// seeds that have never answered are not members, so are not counted
+			d.mutex.Lock()
+			if _, known := d.missed[possum]; known {
+				d.missed[possum]++
+			}
+			d.mutex.Unlock()
+			continue
+		}
+		views[possum] = members
+		d.mutex.Lock()
+		d.missed[possum] = 0
+		// possums are learned from seeds, then contacted directly from the next round
+		if d.config.Mode == discoverySeeds {
+			for _, member := range members {
+				if _, known := d.missed[member]; !known && !utils.SamePossum(member, d.config.Self) && validPossumURI(member) == nil {
+					d.missed[member] = 0
+				}
+			}
+		}
+		d.mutex.Unlock()
+	}
+
+	passel := candidates
+	if d.config.Mode == discoverySeeds {
+		passel = d.members()
+	}
+	if err := d.apply(passel); err != nil {
+		return err
+	}
+
+	var disagreeing []string
+	for possum, members := range views {
+		if !reflect.DeepEqual(sortedPossums(members), passel) {
+			disagreeing = append(disagreeing, possum)
+		}
+	}
+	sort.Strings(disagreeing)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.checkedAt = time.Now().UTC()
+	d.disagreeing = disagreeing
+	d.unreachable = unreachable
+	if len(disagreeing) > 0 {
+		log.WithFields(log.Fields{"package": "webServer", "function": "Discover", "disagreeing": disagreeing}).Warn("Possums disagree on the members of the passel")
+	}
+	return nil
+}
+
+// candidates - the possums to contact: in seeds mode the seeds and every possum
+// known so far, in dns mode the possums in the SRV records
+func (d *Discoverer) candidates() ([]string, error) {
+	if d.config.Mode == discoveryDNS {
+		_, records, err := d.LookupSRV("", "", d.config.SRVName)
+		if err != nil {
+			return nil, wrapError(CodeConfig, err)
+		}
+		possums := []string{d.config.Self}
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			if (d.config.Scheme == "https" && record.Port != 443) || (d.config.Scheme == "http" && record.Port != 80) {
+				host = net.JoinHostPort(host, strconv.Itoa(int(record.Port)))
+			}
+			possums = append(possums, fmt.Sprintf("%s://%s", d.config.Scheme, host))
+		}
+		return sortedPossums(possums), nil
+	}
+	possums := append([]string{d.config.Self}, d.config.Seeds...)
+	d.mutex.Lock()
+	for possum := range d.missed {
+		possums = append(possums, possum)
+	}
+	d.mutex.Unlock()
+	return sortedPossums(possums), nil
+}
+
+// members - this possum and every possum that has not missed too many rounds, forgetting the rest
+func (d *Discoverer) members() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	possums := []string{d.config.Self}
+	for possum, missed := range d.missed {
+		if missed >= d.config.MissedRounds {
+			delete(d.missed, possum)
+			continue
+		}
+		possums = append(possums, possum)
+	}
+	return sortedPossums(possums)
+}
+
+// register - records a possum that announced itself
+func (d *Discoverer) register(possum string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !utils.SamePossum(possum, d.config.Self) {
+		d.missed[possum] = 0
+	}
+}
+
+// contact - registers with a possum in seeds mode, or asks for its members in
+// dns mode, returning the members it knows
+func (d *Discoverer) contact(possum string) ([]string, error) {
+	var req *http.Request
+	var err error
+	if d.config.Mode == discoverySeeds {
+		body, _ := json.Marshal(RegisterMemberRequest{Possum: d.config.Self})
+		req, err = http.NewRequest("POST", fmt.Sprintf("%s/v1/members", possum), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		username, err := utils.GetUsername()
+		if err != nil {
+			return nil, wrapError(CodeConfig, err)
+		}
+		password, err := utils.GetPassword()
+		if err != nil {
+			return nil, wrapError(CodeConfig, err)
+		}
+		req.SetBasicAuth(username, password)
+		req.Header.Set("Content-Type", "application/json")
+		if err := signPeerRequest(req, body); err != nil {
+			return nil, err
+		}
+	} else {
+		req, err = http.NewRequest("GET", fmt.Sprintf("%s/v1/members", possum), nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, peerRequestError(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, peerRequestError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(CodePeerError, "Possum %s returned %d %s", possum, resp.StatusCode, string(data))
+	}
+	var members MembersResponse
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, wrapError(CodePeerInvalidResponse, err)
+	}
+	return members.Members, nil
+}
+
+// apply - brings the state table in line with the passel, records who joined
+// and left, then swaps the passel in
+func (d *Discoverer) apply(passel []string) error {
+	d.mutex.Lock()
+	unchanged := reflect.DeepEqual(passel, d.passel)
+	d.mutex.Unlock()
+	if unchanged {
+		return nil
+	}
+	config := utils.PasselConfig{Passel: passel, InitialState: d.config.InitialState}
+	if err := utils.ValidatePasselConfig(config); err != nil {
+		return wrapError(CodeConfig, err)
+	}
+	// possums that rejoin keep the state they left with, and a passel without
+	// a possum alive is never swapped in
+	added, archived, err := utils.SyncPasselDB(d.db, passel, d.config.InitialState, keepsAPossumAlive)
+	if err != nil {
+		return wrapError(CodeDatabase, err)
+	}
+	now := time.Now().UTC()
+	for _, change := range []struct {
+		event   string
+		possums []string
+	}{{utils.MemberJoined, added}, {utils.MemberLeft, archived}} {
+		for _, possum := range change.possums {
+			err := utils.RecordMembershipChange(d.db, utils.MembershipChange{Possum: possum, Event: change.event, Source: d.config.Mode, ChangedAt: now})
+			if err != nil {
+				log.WithFields(log.Fields{"package": "webServer", "function": "apply", "possum": possum}).Warnf("Can't record membership change: %s", err)
+			}
+		}
+	}
+	utils.SetPasselConfig(&config)
+	d.mutex.Lock()
+	d.passel = passel
+	d.mutex.Unlock()
+	log.WithFields(log.Fields{"package": "webServer", "function": "apply", "passel": passel, "joined": added, "left": archived}).Info("Discovered passel")
+	return nil
+}
+
+// status - the passel swapped in and the result of the last consistency check
+func (d *Discoverer) status() MembersResponse {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	response := MembersResponse{Discovery: d.config.Mode, Members: append([]string{}, d.passel...)}
+	if !d.checkedAt.IsZero() {
+		consistent := len(d.disagreeing) == 0 && len(d.unreachable) == 0
+		checkedAt := d.checkedAt
+		response.Consistent = &consistent
+		response.CheckedAt = &checkedAt
+		response.Disagreeing = append([]string{}, d.disagreeing...)
+		response.Unreachable = append([]string{}, d.unreachable...)
+	}
+	return response
+}
+
+// sortedPossums - the possums in normal form, sorted and without duplicates
+func sortedPossums(possums []string) []string {
+	seen := make(map[string]bool)
+	sorted := []string{}
+	for _, possum := range possums {
+		possum = utils.NormalisePossumURI(possum)
+		if !seen[possum] {
+			seen[possum] = true
+			sorted = append(sorted, possum)
+		}
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// GetMembers - Get the members of the passel, how they were found and whether every possum sees the same members
+func (c *Controller) GetMembers(w http.ResponseWriter, r *http.Request) {
+	self, _, _ := findMyPossum()
+	if c.Discoverer == nil {
+		passel, err := getPassel()
+		if standardError(err, w) {
+			return
+		}
+		writeJSON(w, http.StatusOK, MembersResponse{Discovery: discoveryStatic, Members: passel, Self: self})
+		return
+	}
+	c = c.forRequest(r)
+	response := c.Discoverer.status()
+	response.Self = self
+	span := c.storeSpan("GetMembershipChanges")
+	changes, err := utils.GetMembershipChanges(c.DB, membershipChangesShown)
+	endStoreSpan(span, err)
+	if err != nil {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetMembers"}).Warnf("Can't get membership changes: %s", err)
+	}
+	response.Changes = changes
+	writeJSON(w, http.StatusOK, response)
+}
+
+// RegisterMember - Register a possum with this seed, returning every possum this seed knows.
+// Only possums holding the peer secret can register, and only once they answer
+// /v1/members, so a possum that is not running is never counted as alive.
+func (c *Controller) RegisterMember(w http.ResponseWriter, r *http.Request) {
+	if !c.authorize(w, r, checkPeerAuth) {
+		return
+	}
+	if c.Discoverer == nil || c.Discoverer.config.Mode != discoverySeeds {
+		writeError(w, newAPIError(CodeDiscoveryDisabled, "Seed discovery is not configured"))
+		return
+	}
+	if !checkPeerSignature(r) {
+		writeError(w, newAPIError(CodeUnauthorized, "Registrations must be signed with the peer secret"))
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if standardError(wrapError(CodeInvalidRequest, err), w) {
+		return
+	}
+	if standardError(validateRequestBody(data, "RegisterMemberRequest"), w) {
+		return
+	}
+	var request RegisterMemberRequest
+	if standardError(wrapError(CodeInvalidRequest, json.Unmarshal(data, &request)), w) {
+		return
+	}
+	if err := validPossumURI(request.Possum); err != nil {
+		writeError(w, newAPIError(CodeInvalidRequest, "%s", err))
+		return
+	}
+	if _, err := getMembers(c.Discoverer.httpClient, request.Possum); err != nil {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "RegisterMember", "possum": request.Possum}).Warnf("Not registering a possum that does not answer: %s", err)
+		writeError(w, newAPIError(CodeInvalidRequest, "Possum %s does not answer /v1/members: %s", request.Possum, err))
+		return
+	}
+	c.Discoverer.register(request.Possum)
+	requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "RegisterMember", "possum": request.Possum}).Debug("Possum registered")
+	writeJSON(w, http.StatusOK, MembersResponse{Discovery: discoverySeeds, Members: c.Discoverer.members()})
+}
@@ -0,0 +1,193 @@
+package webServer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrorCode - a stable, machine readable identifier returned with every error response
+type ErrorCode string
+
+// Error codes returned in the "code" field of error responses
+const (
+	CodeInternal              ErrorCode = "INTERNAL_ERROR"
+	CodeConfig                ErrorCode = "CONFIG_ERROR"
+	CodeDatabase              ErrorCode = "DATABASE_ERROR"
+	CodeInvalidRequest        ErrorCode = "INVALID_REQUEST"
+	CodeUnauthorized          ErrorCode = "UNAUTHORIZED"
+	CodeNoURIs                ErrorCode = "NO_URIS_CONFIGURED"
+	CodePasselEmpty           ErrorCode = "PASSEL_EMPTY"
+	CodePossumNotMatched      ErrorCode = "POSSUM_NOT_MATCHED"
+	CodePossumNotInPassel     ErrorCode = "POSSUM_NOT_IN_PASSEL"
+	CodeWouldKillAll          ErrorCode = "WOULD_KILL_ALL"
+	CodeStateInconsistent     ErrorCode = "STATE_INCONSISTENT"
+	CodeStateMismatch         ErrorCode = "STATE_MISMATCH"
+	CodePeerUnreachable       ErrorCode = "PEER_UNREACHABLE"
+	CodePeerTimeout           ErrorCode = "PEER_TIMEOUT"
+	CodePeerError             ErrorCode = "PEER_ERROR"
+	CodePeerInvalidResponse   ErrorCode = "PEER_INVALID_RESPONSE"
+	CodeProbeDisabled         ErrorCode = "PROBE_DISABLED"
+	CodeAlertmanagerDisabled  ErrorCode = "ALERTMANAGER_DISABLED"
+	CodeReloadDisabled        ErrorCode = "RELOAD_DISABLED"
+	CodeDiscoveryDisabled     ErrorCode = "DISCOVERY_DISABLED"
+	CodeSnapshotInvalid       ErrorCode = "SNAPSHOT_INVALID"
+	CodeChangeFrozen          ErrorCode = "CHANGE_FROZEN"
+	CodeEmergencyRoleRequired ErrorCode = "EMERGENCY_ROLE_REQUIRED"
+	CodeApprovalRequired      ErrorCode = "APPROVAL_REQUIRED"
+	CodeApprovalForbidden     ErrorCode = "APPROVAL_FORBIDDEN"
+	CodeProposalNotFound      ErrorCode = "PROPOSAL_NOT_FOUND"
+	CodeProposalNotPending    ErrorCode = "PROPOSAL_NOT_PENDING"
+	CodeProposalExpired       ErrorCode = "PROPOSAL_EXPIRED"
+	CodeProposalConflict      ErrorCode = "PROPOSAL_CONFLICT"
+	CodeSourceNotAllowed      ErrorCode = "SOURCE_NOT_ALLOWED"
+	CodeAuthLockedOut         ErrorCode = "AUTH_LOCKED_OUT"
+	CodeServiceNotFound       ErrorCode = "SERVICE_NOT_FOUND"
+	CodeNotFound              ErrorCode = "NOT_FOUND"
+	CodeMethodNotAllowed      ErrorCode = "METHOD_NOT_ALLOWED"
+)
+
+var errorCodeStatus = map[ErrorCode]int{
+	CodeInternal:              http.StatusInternalServerError,
+	CodeConfig:                http.StatusInternalServerError,
+	CodeDatabase:              http.StatusInternalServerError,
+	CodeInvalidRequest:        http.StatusBadRequest,
+	CodeUnauthorized:          http.StatusUnauthorized,
+	CodeNoURIs:                http.StatusGone,
+	CodePasselEmpty:           http.StatusGone,
+	CodePossumNotMatched:      http.StatusGone,
+	CodePossumNotInPassel:     http.StatusBadRequest,
+	CodeWouldKillAll:          http.StatusConflict,
+	CodeStateInconsistent:     http.StatusConflict,
+	CodeStateMismatch:         http.StatusInternalServerError,
+	CodePeerUnreachable:       http.StatusBadGateway,
+	CodePeerTimeout:           http.StatusGatewayTimeout,
+	CodePeerError:             http.StatusBadGateway,
+	CodePeerInvalidResponse:   http.StatusBadGateway,
+	CodeProbeDisabled:         http.StatusNotFound,
+	CodeAlertmanagerDisabled:  http.StatusNotFound,
+	CodeReloadDisabled:        http.StatusNotFound,
+	CodeDiscoveryDisabled:     http.StatusNotFound,
+	CodeSnapshotInvalid:       http.StatusBadRequest,
+	CodeChangeFrozen:          http.StatusLocked,
+	CodeEmergencyRoleRequired: http.StatusForbidden,
+	CodeApprovalRequired:      http.StatusForbidden,
+	CodeApprovalForbidden:     http.StatusForbidden,
+	CodeProposalNotFound:      http.StatusNotFound,
+	CodeProposalNotPending:    http.StatusConflict,
+	CodeProposalExpired:       http.StatusGone,
+	CodeProposalConflict:      http.StatusConflict,
+	CodeSourceNotAllowed:      http.StatusForbidden,
+	CodeAuthLockedOut:         http.StatusTooManyRequests,
+	CodeServiceNotFound:       http.StatusNotFound,
+	CodeNotFound:              http.StatusNotFound,
+	CodeMethodNotAllowed:      http.StatusMethodNotAllowed,
+}
+
+// Status - returns the HTTP status code used when responding with the error code
+func (c ErrorCode) Status() int {
+	if status, ok := errorCodeStatus[c]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// APIError - an error carrying the code it should be reported to clients with
+type APIError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// ErrorResponse - the body of every error response
+type ErrorResponse struct {
+	Error     string    `json:"error"`
+	Code      ErrorCode `json:"code"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// StateResponse - the body of a successful GET /v1/state
+type StateResponse struct {
+	State string `json:"state"`
+	// Stale is true when the state was served from the cache because the database is unavailable
+	Stale    bool       `json:"stale,omitempty"`
+	CachedAt *time.Time `json:"cached_at,omitempty"`
+}
+
+// PasselStatesResponse - the body of passel wide consistency checks and updates
+type PasselStatesResponse struct {
+	Consistent bool      `json:"consistent"`
+	Error      string    `json:"error,omitempty"`
+	Code       ErrorCode `json:"code,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	DryRun     bool      `json:"dry_run,omitempty"`
+	// Service is set when the states are of a service of each possum
+	Service       string              `json:"service,omitempty"`
+	Passel        []string            `json:"passel,omitempty"`
+	Missed        []string            `json:"missed,omitempty"`
+	PasselStates  []map[string]string `json:"passel_states"`
+	ProposedState map[string]string   `json:"proposed_state,omitempty"`
+	// Membership is only checked by GET /v1/passel_state_consistency
+	Membership *MembershipConsistency `json:"membership,omitempty"`
+}
+
+func newAPIError(code ErrorCode, format string, a ...interface{}) *APIError {
+	return &APIError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// wrapError - attaches a code to err unless it already carries one
+func wrapError(code ErrorCode, err error) error {
+	if err == nil {
+		return nil
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return err
+	}
+	return &APIError{Code: code, Message: err.Error()}
+}
+
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return &APIError{Code: CodeInternal, Message: err.Error()}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		data, _ = json.Marshal(ErrorResponse{Error: err.Error(), Code: CodeInternal})
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, apiErr *APIError) {
+	status := apiErr.Code.Status()
+	entry := responseLog(w).WithFields(log.Fields{"package": "webServer", "function": "writeError", "code": apiErr.Code, "status": status})
+	if status >= http.StatusInternalServerError {
+		entry.Error(apiErr.Message)
+	} else {
+		entry.Info(apiErr.Message)
+	}
+	writeJSON(w, status, ErrorResponse{Error: apiErr.Message, Code: apiErr.Code, RequestID: w.Header().Get(RequestIDHeader)})
+}
+
+func unauthorizedError(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="possum"`)
+	writeError(w, newAPIError(CodeUnauthorized, "Unauthorized"))
+}
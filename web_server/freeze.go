@@ -0,0 +1,275 @@
+package webServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	// freeze window timezones must load on stacks without tzdata
+	_ "time/tzdata"
+
+	"github.com/FidelityInternational/possum/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	freezeTimeLayout         = "2006-01-02T15:04"
+	emergencyHeader          = "X-Possum-Emergency"
+	emergencyReasonHeader    = "X-Possum-Emergency-Reason"
+	maxEmergencyReasonLength = 1024
+)
+
+// FreezeWindow - a period during which the passel state cannot be changed
+// except in a declared emergency. A window either recurs, starting on a
+// cron schedule and lasting DurationMinutes, or runs from Start to End.
+type FreezeWindow struct {
+	Name            string `json:"name"`
+	Cron            string `json:"cron"`
+	DurationMinutes int    `json:"duration_minutes"`
+	Start           string `json:"start"`
+	End             string `json:"end"`
+	// Timezone is an IANA timezone name, UTC if empty
+	Timezone string `json:"timezone"`
+
+	location *time.Location
+	schedule *cronSchedule
+	start    time.Time
+	end      time.Time
+}
+
+// cronSchedule - the minutes, hours, days of the month, months and days of the week a cron expression matches
+type cronSchedule struct {
+	minutes, hours, daysOfMonth, months, daysOfWeek uint64
+	anyDayOfMonth, anyDayOfWeek                     bool
+}
+
+// loadFreezeWindows - loads the freeze windows from FREEZE_WINDOWS, there are none if it is not set
+func loadFreezeWindows() ([]FreezeWindow, error) {
+	data := os.Getenv("FREEZE_WINDOWS")
+	if data == "" {
+		return nil, nil
+	}
+	var windows []FreezeWindow
+	if err := json.Unmarshal([]byte(data), &windows); err != nil {
+		return nil, newAPIError(CodeConfig, "FREEZE_WINDOWS is invalid: %s", err)
+	}
+	for i := range windows {
+		if err := windows[i].parse(); err != nil {
+			return nil, newAPIError(CodeConfig, "FREEZE_WINDOWS is invalid: window %d: %s", i, err)
+		}
+		if windows[i].Name == "" {
+			windows[i].Name = fmt.Sprintf("freeze window %d", i)
+		}
+	}
+	return windows, nil
+}
+
+func (window *FreezeWindow) parse() error {
+	var err error
+	window.location = time.UTC
+	if window.Timezone != "" {
+		if window.location, err = time.LoadLocation(window.Timezone); err != nil {
+			return err
+		}
+	}
+	recurring := window.Cron != "" || window.DurationMinutes != 0
+	dated := window.Start != "" || window.End != ""
+	switch {
+	case recurring && dated:
+		return fmt.Errorf("set either cron and duration_minutes or start and end, not both")
+	case recurring:
+		if window.DurationMinutes <= 0 {
+			return fmt.Errorf("duration_minutes must be positive")
+		}
+		window.schedule, err = parseCron(window.Cron)
+		return err
+	case dated:
+		if window.start, err = time.ParseInLocation(freezeTimeLayout, window.Start, window.location); err != nil {
+			return fmt.Errorf("start should look like %s", freezeTimeLayout)
+		}
+		if window.end, err = time.ParseInLocation(freezeTimeLayout, window.End, window.location); err != nil {
+			return fmt.Errorf("end should look like %s", freezeTimeLayout)
+		}
+		if !window.end.After(window.start) {
+			return fmt.Errorf("end must be after start")
+		}
+		return nil
+	}
+	return fmt.Errorf("set either cron and duration_minutes or start and end")
+}
+
+// activeUntil - returns when the window ends if it is active at now
+func (window FreezeWindow) activeUntil(now time.Time) (time.Time, bool) {
+	now = now.In(window.location)
+	if window.schedule == nil {
+		return window.end, !now.Before(window.start) && now.Before(window.end)
+	}
+	minute := now.Truncate(time.Minute)
+	for i := 0; i < window.DurationMinutes; i++ {
+		start := minute.Add(-time.Duration(i) * time.Minute)
+		if window.schedule.matches(start) {
+			return start.Add(time.Duration(window.DurationMinutes) * time.Minute), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// activeFreeze - returns the freeze window in force at now, and when it ends
+func activeFreeze(now time.Time) (*FreezeWindow, time.Time, error) {
+	windows, err := loadFreezeWindows()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	for i := range windows {
+		if until, active := windows[i].activeUntil(now); active {
+			return &windows[i], until, nil
+		}
+	}
+	return nil, time.Time{}, nil
+}
+
+// parseCron - parses a five field "minute hour day-of-month month day-of-week"
+// cron expression, each field may be *, a number, a range or a list with steps
+func parseCron(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q should have 5 fields", expression)
+	}
+	var schedule cronSchedule
+	var err error
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if schedule.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if schedule.daysOfMonth, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if schedule.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if schedule.daysOfWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// 7 is also Sunday
+	if schedule.daysOfWeek&(1<<7) != 0 {
+		schedule.daysOfWeek |= 1
+	}
+	schedule.anyDayOfMonth = fields[2] == "*"
+	schedule.anyDayOfWeek = fields[4] == "*"
+	return &schedule, nil
+}
+
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("cron field %q has an invalid step", field)
+			}
+			part = part[:i]
+		}
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("cron field %q is invalid", field)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("cron field %q is invalid", field)
+				}
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("cron field %q should be between %d and %d", field, min, max)
+		}
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func (schedule *cronSchedule) matches(t time.Time) bool {
+	if schedule.minutes&(1<<uint(t.Minute())) == 0 || schedule.hours&(1<<uint(t.Hour())) == 0 || schedule.months&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dayOfMonth := schedule.daysOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := schedule.daysOfWeek&(1<<uint(t.Weekday())) != 0
+	// like cron, a day matches either restricted day field
+	if !schedule.anyDayOfMonth && !schedule.anyDayOfWeek {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
+
+// emergencyRequest - returns the emergency flag and reason sent in the headers of a request
+func emergencyRequest(r *http.Request) (bool, string) {
+	return r.Header.Get(emergencyHeader) == "true", r.Header.Get(emergencyReasonHeader)
+}
+
+// checkEmergencyAuth - true if the request carries the emergency credentials
+func checkEmergencyAuth(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	emergencyUsername, emergencyPassword, err := utils.GetEmergencyCredentials()
+	if err != nil || emergencyUsername == "" {
+		return false
+	}
+	return credentialsMatch(username, password, emergencyUsername, emergencyPassword)
+}
+
+// checkFreeze - rejects a change made during a freeze window unless it is an
+// emergency change with a reason made with the emergency credentials, and
+// returns the reason to record with an emergency change
+func checkFreeze(emergency bool, reason string, elevated bool, actor string) (string, error) {
+	if emergency {
+		if strings.TrimSpace(reason) == "" {
+			return "", newAPIError(CodeInvalidRequest, "An emergency change needs a reason")
+		}
+		if len(reason) > maxEmergencyReasonLength {
+			return "", newAPIError(CodeInvalidRequest, "An emergency reason cannot be longer than %d characters", maxEmergencyReasonLength)
+		}
+		if !elevated {
+			return "", newAPIError(CodeEmergencyRoleRequired, "Emergency changes need the emergency credentials")
+		}
+	}
+	window, until, err := activeFreeze(time.Now())
+	if err != nil {
+		return "", err
+	}
+	if window == nil {
+		if emergency {
+			return reason, nil
+		}
+		return "", nil
+	}
+	if !emergency {
+		log.WithFields(log.Fields{"package": "webServer", "function": "checkFreeze", "actor": actor, "window": window.Name}).Warn("Rejected a change during a freeze")
+		return "", newAPIError(CodeChangeFrozen, "Changes are frozen by %s until %s", window.Name, until.Format(time.RFC3339))
+	}
+	log.WithFields(log.Fields{"package": "webServer", "function": "checkFreeze", "actor": actor, "window": window.Name, "reason": reason}).Warn("Allowed an emergency change during a freeze")
+	return reason, nil
+}
+
+// changesState - true if applying desiredPasselState to passelState would change the state of any possum
+func changesState(desiredPasselState map[string]string, passelState map[string]string) bool {
+	for possum, state := range desiredPasselState {
+		if passelState[possum] != state {
+			return true
+		}
+	}
+	return false
+}
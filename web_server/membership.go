@@ -0,0 +1,99 @@
+package webServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"github.com/FidelityInternational/possum/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// MembershipConsistency - whether every possum has the same passel and can find itself in it
+type MembershipConsistency struct {
+	Consistent bool     `json:"consistent"`
+	Members    []string `json:"members"`
+	// SelfInPassel is false when none of the uris of this possum match a possum in its passel
+	SelfInPassel bool `json:"self_in_passel"`
+	// PasselMembers are the members of the passel of each possum that answered
+	PasselMembers map[string][]string `json:"passel_members"`
+	// Disagreeing are the possums whose passel is not the passel of this possum
+	Disagreeing []string `json:"disagreeing,omitempty"`
+	// Stranded are the possums that can not find themselves in their own passel
+	Stranded    []string `json:"stranded,omitempty"`
+	Unreachable []string `json:"unreachable,omitempty"`
+	// Orphaned are the state rows of possums that are not in the passel
+	Orphaned map[string]string `json:"orphaned,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// checkMembership - compares the passel of every possum with the passel of this possum,
+// and looks for state rows of possums that are no longer in the passel
+func (c *Controller) checkMembership(passel []string) *MembershipConsistency {
+	members := sortedPossums(passel)
+	membership := &MembershipConsistency{Members: members, PasselMembers: make(map[string][]string)}
+	if _, _, err := findMyPossum(); err == nil {
+		membership.SelfInPassel = true
+	}
+	for _, possum := range passel {
+		response, err := getMembers(c.HTTPClient, possum)
+		if err != nil {
+			log.WithFields(log.Fields{"package": "webServer", "function": "checkMembership", "possum": possum}).Debugf("Can't get members: %s", err)
+			membership.Unreachable = append(membership.Unreachable, possum)
+			continue
+		}
+		possumMembers := sortedPossums(response.Members)
+		membership.PasselMembers[possum] = possumMembers
+		if !reflect.DeepEqual(possumMembers, members) {
+			membership.Disagreeing = append(membership.Disagreeing, possum)
+		}
+		if response.Self == "" {
+			membership.Stranded = append(membership.Stranded, possum)
+		}
+	}
+	sort.Strings(membership.Unreachable)
+	sort.Strings(membership.Disagreeing)
+	sort.Strings(membership.Stranded)
+
+	span := c.storeSpan("GetOrphanedStates")
+	orphaned, err := utils.GetOrphanedStates(c.DB, passel)
+	endStoreSpan(span, err)
+	if err != nil {
+		log.WithFields(log.Fields{"package": "webServer", "function": "checkMembership"}).Warnf("Can't look for orphaned states: %s", err)
+		membership.Error = fmt.Sprintf("Can't look for orphaned states: %s", err)
+	} else if len(orphaned) > 0 {
+		membership.Orphaned = orphaned
+	}
+
+	membership.Consistent = membership.SelfInPassel && membership.Error == "" &&
+		len(membership.Unreachable) == 0 && len(membership.Disagreeing) == 0 &&
+		len(membership.Stranded) == 0 && len(membership.Orphaned) == 0
+	if !membership.Consistent {
+		log.WithFields(log.Fields{"package": "webServer", "function": "checkMembership", "self_in_passel": membership.SelfInPassel, "disagreeing": membership.Disagreeing, "stranded": membership.Stranded, "unreachable": membership.Unreachable, "orphaned": sortedKeys(membership.Orphaned)}).Warn("Passel membership is inconsistent")
+	}
+	return membership
+}
+
+// getMembers - asks a possum for the members of its passel
+func getMembers(httpClient *http.Client, possum string) (MembersResponse, error) {
+	var members MembersResponse
+	resp, err := httpClient.Get(fmt.Sprintf("%s/v1/members", possum))
+	if err != nil {
+		return members, peerRequestError(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return members, peerRequestError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return members, newAPIError(CodePeerError, "Possum %s returned %d %s", possum, resp.StatusCode, string(data))
+	}
+	if err := json.Unmarshal(data, &members); err != nil {
+		return members, wrapError(CodePeerInvalidResponse, err)
+	}
+	return members, nil
+}
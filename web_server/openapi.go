@@ -0,0 +1,732 @@
+package webServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type schema map[string]interface{}
+
+func ref(name string) schema {
+	return schema{"$ref": "#/components/schemas/" + name}
+}
+
+func jsonContent(s schema) schema {
+	return schema{"application/json": schema{"schema": s}}
+}
+
+func jsonResponse(description string, s schema) schema {
+	return schema{"description": description, "content": jsonContent(s)}
+}
+
+func errorResponses(statuses ...int) schema {
+	responses := schema{}
+	for _, status := range statuses {
+		responses[fmt.Sprintf("%d", status)] = jsonResponse(http.StatusText(status), ref("ErrorResponse"))
+	}
+	return responses
+}
+
+func withResponses(responses schema, status int, description string, s schema) schema {
+	responses[fmt.Sprintf("%d", status)] = jsonResponse(description, s)
+	return responses
+}
+
+var basicAuth = []schema{{"basicAuth": []string{}}}
+
+// openAPISpec - the OpenAPI 3 description of every route registered by Server.Start
+var openAPISpec = schema{
+	"openapi": "3.0.3",
+	"info": schema{
+		"title":       "possum",
+		"description": "Health monitor endpoint used to fake the death of Cloud Foundry foundations behind a load balancer",
+		"version":     "1.0.0",
+	},
+	"paths": schema{
+		"/v1/state": schema{
+			"get": schema{
+				"operationId": "getState",
+				"summary":     "Returns the state of this possum",
+				"responses":   withResponses(errorResponses(410, 500), 200, "The state of this possum", ref("StateResponse")),
+			},
+			"post": schema{
+				"operationId": "setState",
+				"summary":     "Sets the state of one or more possums in this possum's database",
+				"security":    basicAuth,
+				"parameters": []schema{
+					{"name": "X-Possum-Emergency", "in": "header", "schema": schema{"type": "boolean"}, "description": "Make an emergency change, allowed during a freeze window"},
+					{"name": "X-Possum-Emergency-Reason", "in": "header", "schema": schema{"type": "string"}, "description": "Why the emergency change is being made"},
+				},
+				"requestBody": schema{"required": true, "content": jsonContent(ref("SetStateRequest"))},
+				"responses":   withResponses(errorResponses(400, 401, 403, 409, 410, 423, 429, 500, 502, 504), 202, "The passel state after the update", ref("PossumStatesResponse")),
+			},
+		},
+		"/v1/passel_state": schema{
+			"get": schema{
+				"operationId": "getPasselState",
+				"summary":     "Returns the state of every possum in the passel as seen by this possum",
+				"parameters": []schema{
+					{"name": "metadata", "in": "query", "description": "true to include the version of each state and when and by whom it was last changed", "schema": schema{"type": "boolean"}},
+				},
+				"responses": withResponses(errorResponses(410, 500), 200, "The passel state", ref("PossumStatesResponse")),
+			},
+			"post": schema{
+				"operationId": "setPasselState",
+				"summary":     "Sets the state of the passel on every possum in the passel",
+				"security":    basicAuth,
+				"requestBody": schema{"required": true, "content": jsonContent(ref("SetPasselStateRequest"))},
+				"responses": withResponses(
+					withResponses(errorResponses(400, 401, 403, 409, 410, 423, 429, 500, 502, 504), 200, "The result of a dry run", ref("PasselStatesResponse")),
+					202, "The passel state seen by every possum after the update, or the proposal when approval is needed", schema{"oneOf": []schema{ref("PasselStatesResponse"), ref("Proposal")}}),
+			},
+		},
+		"/v1/services/{service}/state": schema{
+			"parameters": []schema{{"name": "service", "in": "path", "required": true, "schema": schema{"type": "string"}, "description": "A service named in POSSUM_SERVICES"}},
+			"get": schema{
+				"operationId": "getServiceState",
+				"summary":     "Returns the health of a service of this possum, dead if either the service or the possum is dead",
+				"responses":   withResponses(errorResponses(404, 410, 500), 200, "The health of the service", ref("ServiceStateResponse")),
+			},
+			"post": schema{
+				"operationId": "setServiceState",
+				"summary":     "Sets the state of a service of one or more possums in this possum's database",
+				"security":    basicAuth,
+				"parameters": []schema{
+					{"name": "X-Possum-Emergency", "in": "header", "schema": schema{"type": "boolean"}, "description": "Make an emergency change, allowed during a freeze window"},
+					{"name": "X-Possum-Emergency-Reason", "in": "header", "schema": schema{"type": "string"}, "description": "Why the emergency change is being made"},
+				},
+				"requestBody": schema{"required": true, "content": jsonContent(ref("SetStateRequest"))},
+				"responses":   withResponses(errorResponses(400, 401, 403, 404, 409, 410, 423, 429, 500, 502, 504), 202, "The state of the service of the passel after the update", ref("PossumStatesResponse")),
+			},
+		},
+		"/v1/services/{service}/passel_state": schema{
+			"parameters": []schema{{"name": "service", "in": "path", "required": true, "schema": schema{"type": "string"}, "description": "A service named in POSSUM_SERVICES"}},
+			"get": schema{
+				"operationId": "getPasselServiceState",
+				"summary":     "Returns the state of a service of every possum in the passel as seen by this possum",
+				"responses":   withResponses(errorResponses(404, 410, 500), 200, "The state of the service of the passel", ref("PossumStatesResponse")),
+			},
+			"post": schema{
+				"operationId": "setPasselServiceState",
+				"summary":     "Sets the state of a service of the passel on every possum in the passel",
+				"security":    basicAuth,
+				"requestBody": schema{"required": true, "content": jsonContent(ref("SetPasselStateRequest"))},
+				"responses": withResponses(
+					withResponses(errorResponses(400, 401, 403, 404, 409, 410, 423, 429, 500, 502, 504), 200, "The result of a dry run", ref("PasselStatesResponse")),
+					202, "The state of the service seen by every possum after the update, or the proposal when approval is needed", schema{"oneOf": []schema{ref("PasselStatesResponse"), ref("Proposal")}}),
+			},
+		},
+		"/v1/proposals": schema{
+			"get": schema{
+				"operationId": "getProposals",
+				"summary":     "Returns every proposed passel state change, newest first",
+				"responses":   withResponses(errorResponses(500), 200, "The proposals", ref("ProposalsResponse")),
+			},
+		},
+		"/v1/proposals/{id}": schema{
+			"parameters": []schema{{"name": "id", "in": "path", "required": true, "schema": schema{"type": "string"}}},
+			"get": schema{
+				"operationId": "getProposal",
+				"summary":     "Returns a proposed passel state change",
+				"responses":   withResponses(errorResponses(404, 500), 200, "The proposal", ref("Proposal")),
+			},
+			"put": schema{
+				"operationId": "putProposal",
+				"summary":     "Stores a proposal replicated from another possum, only possums use this",
+				"security":    basicAuth,
+				"requestBody": schema{"required": true, "content": jsonContent(ref("Proposal"))},
+				"responses":   withResponses(errorResponses(400, 401, 403, 429, 500), 200, "The stored proposal", ref("Proposal")),
+			},
+		},
+		"/v1/proposals/{id}/approve": schema{
+			"parameters": []schema{{"name": "id", "in": "path", "required": true, "schema": schema{"type": "string"}}},
+			"post": schema{
+				"operationId": "approveProposal",
+				"summary":     "Approves a passel state change proposed by someone else, then applies it to every possum in the passel",
+				"security":    basicAuth,
+				"responses":   withResponses(errorResponses(400, 401, 403, 404, 409, 410, 423, 429, 500, 502, 504), 202, "The passel state seen by every possum after the update", ref("PasselStatesResponse")),
+			},
+		},
+		"/v1/alertmanager": schema{
+			"post": schema{
+				"operationId": "receiveAlerts",
+				"summary":     "Kills or revives the possums matched by Alertmanager webhook alerts",
+				"security":    basicAuth,
+				"requestBody": schema{"required": true, "content": jsonContent(ref("AlertmanagerWebhook"))},
+				"responses": withResponses(
+					withResponses(errorResponses(400, 401, 403, 404, 409, 410, 423, 429, 500, 502, 504), 200, "No rule matched any alert", ref("PossumStatesResponse")),
+					202, "The passel state seen by every possum after the update", ref("PasselStatesResponse")),
+			},
+		},
+		"/v1/reload": schema{
+			"post": schema{
+				"operationId": "reload",
+				"summary":     "Reloads passel membership and credentials from the passel config file",
+				"security":    basicAuth,
+				"responses":   withResponses(errorResponses(401, 403, 404, 429, 500), 200, "The reloaded passel", ref("ReloadResponse")),
+			},
+		},
+		"/v1/members": schema{
+			"get": schema{
+				"operationId": "getMembers",
+				"summary":     "Returns the members of the passel, how they were found and whether every possum sees the same members",
+				"responses":   withResponses(errorResponses(410, 500), 200, "The members of the passel", ref("MembersResponse")),
+			},
+			"post": schema{
+				"operationId": "registerMember",
+				"summary":     "Registers a possum with this seed, only possums use this",
+				"security":    basicAuth,
+				"requestBody": schema{"required": true, "content": jsonContent(ref("RegisterMemberRequest"))},
+				"responses":   withResponses(errorResponses(400, 401, 403, 404, 429), 200, "Every possum this seed knows", ref("MembersResponse")),
+			},
+		},
+		"/v1/passel_state_consistency": schema{
+			"get": schema{
+				"operationId": "getPasselStateConsistency",
+				"summary":     "Returns the passel state seen by every possum and whether they agree",
+				"responses": withResponses(
+					withResponses(errorResponses(410, 500, 502, 504), 409, "The possums do not agree on the passel state", ref("PasselStatesResponse")),
+					200, "The passel state seen by every possum", ref("PasselStatesResponse")),
+			},
+		},
+		"/v1/state_changes": schema{
+			"get": schema{
+				"operationId": "getStateChanges",
+				"summary":     "Returns the most recent recorded state change of each possum in the passel",
+				"responses":   withResponses(errorResponses(410, 500), 200, "The most recent state changes", ref("StateChangesResponse")),
+			},
+		},
+		"/v1/export": schema{
+			"get": schema{
+				"operationId": "exportState",
+				"summary":     "Exports the state and state history of this possum as a signed snapshot",
+				"security":    basicAuth,
+				"responses":   withResponses(errorResponses(401, 403, 429, 500), 200, "The signed snapshot", ref("Snapshot")),
+			},
+		},
+		"/v1/import": schema{
+			"post": schema{
+				"operationId": "importState",
+				"summary":     "Imports a signed snapshot into this possum, once it has been checked against the passel and the other possums",
+				"security":    basicAuth,
+				"parameters": []schema{
+					{"name": "X-Possum-Emergency", "in": "header", "schema": schema{"type": "boolean"}, "description": "Make an emergency import, allowed during a freeze window"},
+					{"name": "X-Possum-Emergency-Reason", "in": "header", "schema": schema{"type": "string"}, "description": "Why the emergency import is being made"},
+				},
+				"requestBody": schema{"required": true, "content": jsonContent(ref("ImportRequest"))},
+				"responses": withResponses(
+					withResponses(
+						withResponses(errorResponses(400, 401, 403, 410, 423, 429, 500, 502, 504), 409, "The other possums do not agree with each other or with the snapshot", ref("PasselStatesResponse")),
+						200, "The result of a dry run", ref("ImportResponse")),
+					202, "The result of the import", ref("ImportResponse")),
+			},
+		},
+		"/v1/probe_status": schema{
+			"get": schema{
+				"operationId": "getProbeStatus",
+				"summary":     "Returns the latest foundation probe results and any passel state change they propose",
+				"responses":   withResponses(errorResponses(404), 200, "The probe results", ref("ProbeStatusResponse")),
+			},
+		},
+		"/v1/ready": schema{
+			"get": schema{
+				"operationId": "getReady",
+				"summary":     "Returns whether this possum can reach its database, has a valid passel config and is in the passel",
+				"responses": withResponses(
+					withResponses(schema{}, 503, "This possum is not ready", ref("ReadyResponse")),
+					200, "This possum is ready", ref("ReadyResponse")),
+			},
+		},
+		"/v1/diagnostics": schema{
+			"get": schema{
+				"operationId": "getDiagnostics",
+				"summary":     "Returns the version, configuration, database pool and view of the passel of this possum",
+				"security":    basicAuth,
+				"responses":   withResponses(errorResponses(401, 403, 429, 500), 200, "The diagnostics", ref("DiagnosticsResponse")),
+			},
+		},
+		"/metrics": schema{
+			"get": schema{
+				"operationId": "getMetrics",
+				"summary":     "Returns authentication and state cache metrics in the Prometheus text format",
+				"responses":   schema{"200": schema{"description": "The metrics", "content": schema{"text/plain": schema{"schema": schema{"type": "string"}}}}},
+			},
+		},
+		"/dashboard": schema{
+			"get": schema{
+				"operationId": "getDashboard",
+				"summary":     "Returns the passel dashboard web page",
+				"responses":   schema{"200": schema{"description": "The dashboard", "content": schema{"text/html": schema{"schema": schema{"type": "string"}}}}},
+			},
+		},
+		"/v1/openapi.json": schema{
+			"get": schema{
+				"operationId": "getOpenAPI",
+				"summary":     "Returns this document",
+				"responses":   schema{"200": jsonResponse("The OpenAPI document", schema{"type": "object"})},
+			},
+		},
+	},
+	"components": schema{
+		"securitySchemes": schema{
+			"basicAuth": schema{"type": "http", "scheme": "basic"},
+		},
+		"schemas": schema{
+			"State": schema{
+				"type": "string",
+				"enum": []interface{}{"alive", "dead"},
+			},
+			"PossumStates": schema{
+				"type":                 "object",
+				"description":          "A map of possum URI to state",
+				"additionalProperties": ref("State"),
+			},
+			"SetStateRequest": ref("PossumStates"),
+			"SetPasselStateRequest": schema{
+				"type":                 "object",
+				"required":             []interface{}{"possum_states"},
+				"additionalProperties": false,
+				"properties": schema{
+					"possum_states": ref("PossumStates"),
+					"force":         schema{"type": "boolean", "description": "Skip the consistency check before the update"},
+					"dry_run":       schema{"type": "boolean", "description": "Run every check and return the proposed state without updating any possum"},
+					"emergency":     schema{"type": "boolean", "description": "Make an emergency change, allowed during a freeze window"},
+					"reason":        schema{"type": "string", "description": "Why the emergency change is being made"},
+					"propose":       schema{"type": "boolean", "description": "Propose the change for someone else to approve instead of making it"},
+				},
+			},
+			"Proposal": schema{
+				"type":     "object",
+				"required": []interface{}{"id", "possum_states", "proposed_by", "proposed_at", "expires_at", "status"},
+				"properties": schema{
+					"id":            schema{"type": "string"},
+					"possum_states": ref("PossumStates"),
+					"service":       schema{"type": "string", "description": "The service the states are of, absent for the states of the possums"},
+					"force":         schema{"type": "boolean"},
+					"emergency":     schema{"type": "boolean"},
+					"reason":        schema{"type": "string"},
+					"proposed_by":   schema{"type": "string"},
+					"proposed_at":   schema{"type": "string", "format": "date-time"},
+					"expires_at":    schema{"type": "string", "format": "date-time"},
+					"status":        schema{"type": "string", "enum": []interface{}{"pending", "approved", "executed", "failed", "expired"}},
+					"decided_by":    schema{"type": "string"},
+					"decided_at":    schema{"type": "string", "format": "date-time"},
+					"error":         schema{"type": "string"},
+				},
+			},
+			"ProposalsResponse": schema{
+				"type":     "object",
+				"required": []interface{}{"proposals"},
+				"properties": schema{
+					"proposals": schema{"type": "array", "items": ref("Proposal")},
+				},
+			},
+			"AlertmanagerWebhook": schema{
+				"type":     "object",
+				"required": []interface{}{"alerts"},
+				"properties": schema{
+					"alerts": schema{"type": "array", "items": ref("Alert")},
+				},
+			},
+			"Alert": schema{
+				"type":     "object",
+				"required": []interface{}{"status", "labels"},
+				"properties": schema{
+					"status": schema{"type": "string", "enum": []interface{}{"firing", "resolved"}},
+					"labels": schema{"type": "object", "additionalProperties": schema{"type": "string"}},
+				},
+			},
+			"ReadyCheck": schema{
+				"type":     "object",
+				"required": []interface{}{"ok"},
+				"properties": schema{
+					"ok":     schema{"type": "boolean"},
+					"error":  schema{"type": "string"},
+					"possum": schema{"type": "string", "description": "The possum this instance serves, for the possum check"},
+				},
+			},
+			"ReadyResponse": schema{
+				"type":     "object",
+				"required": []interface{}{"ready", "checks"},
+				"properties": schema{
+					"ready": schema{"type": "boolean"},
+					"checks": schema{
+						"type":     "object",
+						"required": []interface{}{"database", "passel_config", "possum"},
+						"properties": schema{
+							"database":      ref("ReadyCheck"),
+							"passel_config": ref("ReadyCheck"),
+							"possum":        ref("ReadyCheck"),
+						},
+					},
+				},
+			},
+			"DiagnosticsResponse": schema{
+				"type":     "object",
+				"required": []interface{}{"version", "config_source", "db_driver", "db_pool", "peers", "last_consistent_at", "seconds_since_last_consistency"},
+				"properties": schema{
+					"version":       schema{"type": "string"},
+					"config_source": schema{"type": "string", "description": "VCAP_SERVICES, or file: and the path of the passel config file"},
+					"possum":        schema{"type": "string"},
+					"db_driver":     schema{"type": "string"},
+					"db_pool": schema{
+						"type": "object",
+						"properties": schema{
+							"max_open_connections": schema{"type": "integer"},
+							"open_connections":     schema{"type": "integer"},
+							"in_use":               schema{"type": "integer"},
+							"idle":                 schema{"type": "integer"},
+							"wait_count":           schema{"type": "integer"},
+							"wait_seconds":         schema{"type": "number"},
+							"max_idle_closed":      schema{"type": "integer"},
+							"max_idle_time_closed": schema{"type": "integer"},
+							"max_lifetime_closed":  schema{"type": "integer"},
+						},
+					},
+					"peers": schema{
+						"type": "array",
+						"items": schema{
+							"type":     "object",
+							"required": []interface{}{"possum", "reachable", "ready", "round_trip_seconds"},
+							"properties": schema{
+								"possum":             schema{"type": "string"},
+								"reachable":          schema{"type": "boolean"},
+								"ready":              schema{"type": "boolean"},
+								"status_code":        schema{"type": "integer"},
+								"round_trip_seconds": schema{"type": "number"},
+								"error":              schema{"type": "string"},
+							},
+						},
+					},
+					"last_consistent_at":             schema{"type": "string", "format": "date-time", "nullable": true, "description": "When the possums last agreed on the passel state, null if not since this instance started"},
+					"seconds_since_last_consistency": schema{"type": "number", "nullable": true},
+				},
+			},
+			"RegisterMemberRequest": schema{
+				"type":                 "object",
+				"required":             []interface{}{"possum"},
+				"additionalProperties": false,
+				"properties": schema{
+					"possum": schema{"type": "string", "description": "The URI of the registering possum"},
+				},
+			},
+			"MembersResponse": schema{
+				"type":     "object",
+				"required": []interface{}{"discovery", "members"},
+				"properties": schema{
+					"discovery":   schema{"type": "string", "enum": []interface{}{"static", "seeds", "dns"}},
+					"members":     schema{"type": "array", "items": schema{"type": "string"}},
+					"self":        schema{"type": "string", "description": "The member that is this possum, absent if it can not find itself in its passel"},
+					"consistent":  schema{"type": "boolean", "description": "Whether every other possum answered the last discovery round with the same members, absent until a round has run"},
+					"checked_at":  schema{"type": "string", "format": "date-time"},
+					"disagreeing": schema{"type": "array", "items": schema{"type": "string"}, "description": "Possums that answered with different members"},
+					"unreachable": schema{"type": "array", "items": schema{"type": "string"}, "description": "Possums that did not answer"},
+					"changes": schema{
+						"type":        "array",
+						"description": "The most recent possums to join or leave the passel, newest first",
+						"items": schema{
+							"type":     "object",
+							"required": []interface{}{"possum", "event", "source", "changed_at"},
+							"properties": schema{
+								"possum":     schema{"type": "string"},
+								"event":      schema{"type": "string", "enum": []interface{}{"joined", "left"}},
+								"source":     schema{"type": "string"},
+								"changed_at": schema{"type": "string", "format": "date-time"},
+							},
+						},
+					},
+				},
+			},
+			"ReloadResponse": schema{
+				"type":     "object",
+				"required": []interface{}{"passel", "added", "archived"},
+				"properties": schema{
+					"passel":   schema{"type": "array", "items": schema{"type": "string"}},
+					"added":    schema{"type": "array", "items": schema{"type": "string"}, "description": "Possums that joined the passel"},
+					"archived": schema{"type": "array", "items": schema{"type": "string"}, "description": "Possums that left the passel, their states were archived"},
+				},
+			},
+			"StateResponse": schema{
+				"type":     "object",
+				"required": []interface{}{"state"},
+				"properties": schema{
+					"state":     ref("State"),
+					"stale":     schema{"type": "boolean", "description": "True when the database is unavailable and the state was served from the cache"},
+					"cached_at": schema{"type": "string", "format": "date-time"},
+				},
+			},
+			"ServiceStateResponse": schema{
+				"type":     "object",
+				"required": []interface{}{"service", "state", "service_state", "possum_state"},
+				"properties": schema{
+					"service":       schema{"type": "string"},
+					"state":         ref("State"),
+					"service_state": ref("State"),
+					"possum_state":  ref("State"),
+					"stale":         schema{"type": "boolean", "description": "True when the database is unavailable and the possum state was served from the cache"},
+				},
+			},
+			"PossumStatesResponse": schema{
+				"type":     "object",
+				"required": []interface{}{"possum_states"},
+				"properties": schema{
+					"possum_states": ref("PossumStates"),
+					"service":       schema{"type": "string", "description": "The service the states are of, absent for the states of the possums"},
+					"stale":         schema{"type": "boolean", "description": "True when the database is unavailable and the states were served from the cache"},
+					"cached_at":     schema{"type": "string", "format": "date-time"},
+					"metadata":      schema{"type": "object", "additionalProperties": ref("PossumStateMetadata"), "description": "Only with ?metadata=true"},
+				},
+			},
+			"PossumStateMetadata": schema{
+				"type":     "object",
+				"required": []interface{}{"state", "version"},
+				"properties": schema{
+					"state":      schema{"type": "string", "enum": []interface{}{"alive", "dead"}},
+					"version":    schema{"type": "integer", "description": "The number of times the state has changed"},
+					"updated_at": schema{"type": "string", "format": "date-time"},
+					"updated_by": schema{"type": "string"},
+				},
+			},
+			"PasselStatesResponse": schema{
+				"type":     "object",
+				"required": []interface{}{"consistent", "passel_states"},
+				"properties": schema{
+					"consistent":     schema{"type": "boolean"},
+					"error":          schema{"type": "string"},
+					"code":           ref("ErrorCode"),
+					"request_id":     schema{"type": "string"},
+					"dry_run":        schema{"type": "boolean"},
+					"service":        schema{"type": "string", "description": "The service the states are of, absent for the states of the possums"},
+					"passel":         schema{"type": "array", "items": schema{"type": "string"}, "description": "The possums, in the same order as passel_states"},
+					"missed":         schema{"type": "array", "items": schema{"type": "string"}, "description": "The possums that did not respond, they are caught up once they return"},
+					"passel_states":  schema{"type": "array", "items": ref("PossumStates")},
+					"proposed_state": ref("PossumStates"),
+					"membership":     ref("MembershipConsistency"),
+				},
+			},
+			"MembershipConsistency": schema{
+				"type":     "object",
+				"required": []interface{}{"consistent", "members", "self_in_passel", "passel_members"},
+				"properties": schema{
+					"consistent":     schema{"type": "boolean"},
+					"members":        schema{"type": "array", "items": schema{"type": "string"}, "description": "The passel of this possum"},
+					"self_in_passel": schema{"type": "boolean", "description": "False when none of the uris of this possum match a possum in its passel"},
+					"passel_members": schema{"type": "object", "additionalProperties": schema{"type": "array", "items": schema{"type": "string"}}, "description": "The passel of each possum that answered"},
+					"disagreeing":    schema{"type": "array", "items": schema{"type": "string"}, "description": "Possums whose passel is not the passel of this possum"},
+					"stranded":       schema{"type": "array", "items": schema{"type": "string"}, "description": "Possums that can not find themselves in their own passel"},
+					"unreachable":    schema{"type": "array", "items": schema{"type": "string"}, "description": "Possums that did not answer with their members"},
+					"orphaned":       schema{"type": "object", "additionalProperties": schema{"type": "string"}, "description": "State rows of possums that are not in the passel"},
+					"error":          schema{"type": "string"},
+				},
+			},
+			"StateChange": schema{
+				"type": "object",
+				"properties": schema{
+					"possum":     schema{"type": "string"},
+					"state":      ref("State"),
+					"changed_at": schema{"type": "string", "format": "date-time"},
+					"changed_by": schema{"type": "string"},
+					"emergency":  schema{"type": "boolean"},
+					"reason":     schema{"type": "string"},
+				},
+			},
+			"Snapshot": schema{
+				"type":     "object",
+				"required": []interface{}{"format_version", "schema_version", "exported_at", "states", "history", "signature"},
+				"properties": schema{
+					"format_version": schema{"type": "integer"},
+					"schema_version": schema{"type": "integer", "description": "The schema version of the database the snapshot was exported from"},
+					"possum":         schema{"type": "string", "description": "The possum the snapshot was exported from"},
+					"exported_at":    schema{"type": "string", "format": "date-time"},
+					"states":         ref("PossumStates"),
+					"service_states": schema{"type": "object", "additionalProperties": ref("PossumStates"), "description": "The states of each possum by service"},
+					"history":        schema{"type": "array", "items": ref("StateChange")},
+					"signature":      schema{"type": "string", "description": "The hex encoded HMAC-SHA256 of the snapshot without its signature"},
+				},
+			},
+			"ImportRequest": schema{
+				"type":                 "object",
+				"required":             []interface{}{"snapshot"},
+				"additionalProperties": false,
+				"properties": schema{
+					"snapshot": ref("Snapshot"),
+					"dry_run":  schema{"type": "boolean", "description": "Run every check and return what would change without importing anything"},
+					"force":    schema{"type": "boolean", "description": "Skip the check that the snapshot matches the state of the other possums"},
+				},
+			},
+			"ImportResponse": schema{
+				"type":     "object",
+				"required": []interface{}{"possum", "changed", "history_imported", "possum_states"},
+				"properties": schema{
+					"dry_run":          schema{"type": "boolean"},
+					"possum":           schema{"type": "string", "description": "The possum the snapshot was imported into"},
+					"changed":          schema{"type": "array", "items": schema{"type": "string"}, "description": "The possums whose state the import changed"},
+					"history_imported": schema{"type": "integer", "description": "The state changes imported, history is only imported into a possum without any"},
+					"services_changed": schema{"type": "object", "additionalProperties": schema{"type": "array", "items": schema{"type": "string"}}, "description": "The possums whose service states the import changed, by service"},
+					"possum_states":    ref("PossumStates"),
+					"passel":           schema{"type": "array", "items": schema{"type": "string"}, "description": "The other possums the snapshot was checked against"},
+					"passel_states":    schema{"type": "array", "items": ref("PossumStates")},
+				},
+			},
+			"StateChangesResponse": schema{
+				"type":     "object",
+				"required": []interface{}{"state_changes"},
+				"properties": schema{
+					"state_changes": schema{"type": "object", "additionalProperties": ref("StateChange")},
+				},
+			},
+			"FoundationProbeStatus": schema{
+				"type": "object",
+				"properties": schema{
+					"healthy":              schema{"type": "boolean"},
+					"consecutive_failures": schema{"type": "integer"},
+					"last_error":           schema{"type": "string"},
+					"last_probed_at":       schema{"type": "string", "format": "date-time"},
+				},
+			},
+			"ProbeStatusResponse": schema{
+				"type":     "object",
+				"required": []interface{}{"auto_apply", "foundations"},
+				"properties": schema{
+					"auto_apply":     schema{"type": "boolean"},
+					"foundations":    schema{"type": "object", "additionalProperties": ref("FoundationProbeStatus")},
+					"proposed_state": ref("PossumStates"),
+					"last_action":    schema{"type": "string"},
+				},
+			},
+			"ErrorResponse": schema{
+				"type":     "object",
+				"required": []interface{}{"error", "code"},
+				"properties": schema{
+					"error":      schema{"type": "string"},
+					"code":       ref("ErrorCode"),
+					"request_id": schema{"type": "string", "description": "The X-Request-ID of the request, to find it in the logs"},
+				},
+			},
+			"ErrorCode": schema{
+				"type": "string",
+				"enum": errorCodeEnum(),
+			},
+		},
+	},
+}
+
+func errorCodeEnum() []interface{} {
+	var codes []string
+	for code := range errorCodeStatus {
+		codes = append(codes, string(code))
+	}
+	sort.Strings(codes)
+	enum := make([]interface{}, len(codes))
+	for i, code := range codes {
+		enum[i] = code
+	}
+	return enum
+}
+
+// GetOpenAPI - Get the OpenAPI document describing the API
+func (c *Controller) GetOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPISpec)
+}
+
+// validateRequestBody - checks a request body against a named schema in the OpenAPI document
+func validateRequestBody(data []byte, schemaName string) error {
+	var body interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return wrapError(CodeInvalidRequest, err)
+	}
+	if err := validateSchema(body, ref(schemaName), "body"); err != nil {
+		return newAPIError(CodeInvalidRequest, "Request body is invalid: %s", err.Error())
+	}
+	return nil
+}
+
+func resolveSchema(s schema) schema {
+	for {
+		target, ok := s["$ref"].(string)
+		if !ok {
+			return s
+		}
+		s = openAPISpec["components"].(schema)["schemas"].(schema)[strings.TrimPrefix(target, "#/components/schemas/")].(schema)
+	}
+}
+
+func validateSchema(value interface{}, s schema, path string) error {
+	s = resolveSchema(s)
+	switch s["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s should be an object", path)
+		}
+		return validateObject(object, s, path)
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s should be an array", path)
+		}
+		if items, ok := s["items"].(schema); ok {
+			for i, item := range array {
+				if err := validateSchema(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s should be a string", path)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s should be a boolean", path)
+		}
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		for _, allowed := range enum {
+			if value == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s should be one of %v not %v", path, enum, value)
+	}
+	return nil
+}
+
+func validateObject(object map[string]interface{}, s schema, path string) error {
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				return fmt.Errorf("%s.%s is required", path, name)
+			}
+		}
+	}
+	properties, _ := s["properties"].(schema)
+	var names []string
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fieldPath := fmt.Sprintf("%s.%s", path, name)
+		if property, ok := properties[name].(schema); ok {
+			if err := validateSchema(object[name], property, fieldPath); err != nil {
+				return err
+			}
+			continue
+		}
+		switch additional := s["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s is not a known field", fieldPath)
+			}
+		case schema:
+			if err := validateSchema(object[name], additional, fieldPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
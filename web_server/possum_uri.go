@@ -0,0 +1,87 @@
+package webServer
+
+import (
+	"os"
+	"strings"
+
+	"github.com/FidelityInternational/possum/utils"
+)
+
+// onGlobalDomain - true if the route is on GLOBAL_DOMAIN, a domain whose routes are
+// mapped to the possum of every foundation so can not identify any one of them
+func onGlobalDomain(route string) bool {
+	domain := strings.TrimSuffix(strings.ToLower(os.Getenv("GLOBAL_DOMAIN")), ".")
+	if domain == "" {
+		return false
+	}
+	r, err := utils.ParsePossumURI(route)
+	if err != nil {
+		return false
+	}
+	return r.Host == domain || strings.HasSuffix(r.Host, "."+domain)
+}
+
+// selfRoutes - the application routes that can identify this possum, those not on GLOBAL_DOMAIN
+func selfRoutes() ([]string, error) {
+	uris, err := utils.GetMyApplicationURIs()
+	if err != nil {
+		return nil, err
+	}
+	var routes []string
+	for _, uri := range uris {
+		if !onGlobalDomain(uri) {
+			routes = append(routes, uri)
+		}
+	}
+	return routes, nil
+}
+
+// matchSelf - the possums of the passel that the routes of this possum match
+func matchSelf(routes []string, passel []string) []string {
+	var matched []string
+	for _, possum := range passel {
+		for _, route := range routes {
+			if utils.RouteMatchesPossum(route, possum) {
+				matched = append(matched, possum)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// inPassel - the entry of the passel that is possum, and whether there is one
+func inPassel(possum string, passel []string) (string, bool) {
+	for _, member := range passel {
+		if utils.SamePossum(possum, member) {
+			return member, true
+		}
+	}
+	return "", false
+}
+
+// inPasselNames - states keyed by the passel entry of each possum, so states named by
+// another possum or in a request match the passel. Possums not in the passel keep their name.
+func inPasselNames(states map[string]string, passel []string) map[string]string {
+	if states == nil {
+		return nil
+	}
+	named := make(map[string]string, len(states))
+	for possum, state := range states {
+		if member, found := inPassel(possum, passel); found {
+			possum = member
+		}
+		named[possum] = state
+	}
+	return named
+}
+
+// peerPasselStates - the passel state another possum answered with, keyed by the entries
+// of the passel of this possum, as the passel of the other possum may name them differently
+func peerPasselStates(states map[string]string) map[string]string {
+	passel, err := utils.GetPassel()
+	if err != nil {
+		return states
+	}
+	return inPasselNames(states, passel)
+}
@@ -0,0 +1,357 @@
+package webServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultProbeIntervalSeconds  = 30
+	defaultProbeTimeoutSeconds   = 5
+	defaultProbeFailureThreshold = 3
+	defaultProbeMinAlive         = 1
+	probeActor                   = "probe"
+)
+
+// ProbeTargets - the signals probed for the foundation of a possum, any may be empty
+type ProbeTargets struct {
+	// CFAPI is the CF API root, /v2/info is probed falling back to /v3
+	CFAPI string `json:"cf_api"`
+	// UAA is the UAA or login server root, /healthz is probed
+	UAA string `json:"uaa"`
+	// Canary is the URL of an application on the foundation
+	Canary string `json:"canary"`
+}
+
+// ProbeConfig - how foundations are probed and what is done when they fail
+type ProbeConfig struct {
+	IntervalSeconds  int                     `json:"interval_seconds"`
+	TimeoutSeconds   int                     `json:"timeout_seconds"`
+	FailureThreshold int                     `json:"failure_threshold"`
+	MinAlive         int                     `json:"min_alive"`
+	AutoApply        bool                    `json:"auto_apply"`
+	Foundations      map[string]ProbeTargets `json:"foundations"`
+}
+
+// FoundationProbeStatus - the result of probing the foundation of a possum
+type FoundationProbeStatus struct {
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastProbedAt        time.Time `json:"last_probed_at"`
+}
+
+// ProbeStatusResponse - the probe results and the passel state change they propose
+type ProbeStatusResponse struct {
+	AutoApply     bool                             `json:"auto_apply"`
+	Foundations   map[string]FoundationProbeStatus `json:"foundations"`
+	ProposedState map[string]string                `json:"proposed_state,omitempty"`
+	LastAction    string                           `json:"last_action,omitempty"`
+}
+
+// Prober - periodically probes each foundation and proposes, or applies, killing the possums of failed foundations
+type Prober struct {
+	controller *Controller
+	config     ProbeConfig
+	httpClient *http.Client
+	mutex      sync.Mutex
+	status     ProbeStatusResponse
+}
+
+// LoadProbeConfig - parses and validates a JSON probe configuration
+func LoadProbeConfig(data []byte) (ProbeConfig, error) {
+	var config ProbeConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return ProbeConfig{}, err
+	}
+	if config.IntervalSeconds == 0 {
+		config.IntervalSeconds = defaultProbeIntervalSeconds
+	}
+	if config.TimeoutSeconds == 0 {
+		config.TimeoutSeconds = defaultProbeTimeoutSeconds
+	}
+	if config.FailureThreshold == 0 {
+		config.FailureThreshold = defaultProbeFailureThreshold
+	}
+	if config.MinAlive == 0 {
+		config.MinAlive = defaultProbeMinAlive
+	}
+	if config.IntervalSeconds < 0 || config.TimeoutSeconds < 0 || config.FailureThreshold < 0 || config.MinAlive < 0 {
+		return ProbeConfig{}, fmt.Errorf("interval_seconds, timeout_seconds, failure_threshold and min_alive cannot be negative")
+	}
+	if len(config.Foundations) == 0 {
+		return ProbeConfig{}, fmt.Errorf("no foundations were configured")
+	}
+	if config.AutoApply && approvalRequired() {
+		return ProbeConfig{}, fmt.Errorf("auto_apply cannot be used with REQUIRE_APPROVAL, changes need a second person")
+	}
+	for possum, targets := range config.Foundations {
+		if targets.CFAPI == "" && targets.UAA == "" && targets.Canary == "" {
+			return ProbeConfig{}, fmt.Errorf("%s has nothing to probe", possum)
+		}
+		for _, target := range []string{targets.CFAPI, targets.UAA, targets.Canary} {
+			if target == "" {
+				continue
+			}
+			if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return ProbeConfig{}, fmt.Errorf("%s: %q is not an http or https URL", possum, target)
+			}
+		}
+	}
+	return config, nil
+}
+
+// NewProber - returns a prober for the foundations in config, changing state through controller
+func NewProber(controller *Controller, config ProbeConfig) *Prober {
+	httpClient := createHTTPClient()
+	httpClient.Timeout = time.Duration(config.TimeoutSeconds) * time.Second
+	return &Prober{
+		controller: controller,
+		config:     config,
+		httpClient: httpClient,
+		status: ProbeStatusResponse{
+			AutoApply:   config.AutoApply,
+			Foundations: make(map[string]FoundationProbeStatus),
+		},
+	}
+}
+
+// Run - probes every interval until stop is closed
+func (p *Prober) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(p.config.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		if err := p.ProbeOnce(); err != nil {
+			log.WithFields(log.Fields{"package": "webServer", "function": "Run"}).Warn(err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status - returns a copy of the latest probe results
+func (p *Prober) Status() ProbeStatusResponse {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	status := p.status
+	status.Foundations = make(map[string]FoundationProbeStatus)
+	for possum, foundation := range p.status.Foundations {
+		status.Foundations[possum] = foundation
+	}
+	return status
+}
+
+// ProbeOnce - probes every foundation, then proposes or applies killing the possums of failed foundations
+func (p *Prober) ProbeOnce() error {
+	for possum, targets := range p.config.Foundations {
+		p.record(possum, p.probeFoundation(targets))
+	}
+	return p.evaluate()
+}
+
+func (p *Prober) record(possum string, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	status := p.status.Foundations[possum]
+	status.LastProbedAt = time.Now().UTC()
+	if err != nil {
+		log.WithFields(log.Fields{"package": "webServer", "function": "record", "possum": possum}).Debugf("Probe failed: %s", err)
+		status.Healthy = false
+		status.ConsecutiveFailures++
+		status.LastError = err.Error()
+	} else {
+		status.Healthy = true
+		status.ConsecutiveFailures = 0
+		status.LastError = ""
+	}
+	p.status.Foundations[possum] = status
+}
+
+func (p *Prober) setOutcome(proposedState map[string]string, action string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.status.ProposedState = proposedState
+	if action != "" {
+		p.status.LastAction = action
+	}
+}
+
+func (p *Prober) probeFoundation(targets ProbeTargets) error {
+	if targets.CFAPI != "" {
+		if err := p.probeURL(targets.CFAPI, "/v2/info"); err != nil {
+			if v3Err := p.probeURL(targets.CFAPI, "/v3"); v3Err != nil {
+				return fmt.Errorf("cf_api: %s", err)
+			}
+		}
+	}
+	if targets.UAA != "" {
+		if err := p.probeURL(targets.UAA, "/healthz"); err != nil {
+			return fmt.Errorf("uaa: %s", err)
+		}
+	}
+	if targets.Canary != "" {
+		if err := p.probeURL(targets.Canary, ""); err != nil {
+			return fmt.Errorf("canary: %s", err)
+		}
+	}
+	return nil
+}
+
+func (p *Prober) probeURL(root string, path string) error {
+	target := strings.TrimSuffix(root, "/") + path
+	if path == "" {
+		target = root
+	}
+	resp, err := p.httpClient.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %d", target, resp.StatusCode)
+	}
+	return nil
+}
+
+// failedPossums - the possums whose foundations have reached the failure threshold
+func (p *Prober) failedPossums() map[string]bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	failed := make(map[string]bool)
+	for possum, status := range p.status.Foundations {
+		if status.ConsecutiveFailures >= p.config.FailureThreshold {
+			failed[possum] = true
+		}
+	}
+	return failed
+}
+
+func (p *Prober) evaluate() error {
+	failed := p.failedPossums()
+	if len(failed) == 0 {
+		p.setOutcome(nil, "")
+		return nil
+	}
+	passel, err := getPassel()
+	if err != nil {
+		return err
+	}
+	reachable, err := gatherQuorumStates(p.controller.HTTPClient, passel, "")
+	if err != nil {
+		return err
+	}
+	passelStates := reachable.PasselStates
+	desiredPasselState := make(map[string]string)
+	for possum := range failed {
+		if passelStates[0][possum] == "alive" {
+			desiredPasselState[possum] = "dead"
+		}
+	}
+	if len(desiredPasselState) == 0 {
+		p.setOutcome(nil, "")
+		return nil
+	}
+	killing := strings.Join(sortedKeys(desiredPasselState), ", ")
+	if countAlive(updateStateToDesired(desiredPasselState, passelStates[0])) < p.config.MinAlive {
+		err := newAPIError(CodeWouldKillAll, "Killing %s would leave fewer than %d possums alive", killing, p.config.MinAlive)
+		p.setOutcome(nil, err.Error())
+		return err
+	}
+	if !p.config.AutoApply {
+		log.WithFields(log.Fields{"package": "webServer", "function": "evaluate"}).Warnf("Probes propose killing %s", killing)
+		p.setOutcome(desiredPasselState, fmt.Sprintf("Proposed killing %s", killing))
+		return nil
+	}
+	// REQUIRE_APPROVAL can be set after the config was loaded, probes are not a second person
+	if approvalRequired() {
+		log.WithFields(log.Fields{"package": "webServer", "function": "evaluate"}).Warnf("Probes propose killing %s, which needs approval", killing)
+		p.setOutcome(desiredPasselState, fmt.Sprintf("Left killing %s, changes need approval, propose them with POST /v1/passel_state", killing))
+		return nil
+	}
+
+	// every possum probes, only the first possum in the passel whose own foundation
+	// has not failed applies the change so that they do not race each other
+	myPossum, _, err := findMyPossum()
+	if err != nil {
+		return err
+	}
+	for _, possum := range passel {
+		if failed[possum] {
+			continue
+		}
+		if possum != myPossum {
+			p.setOutcome(desiredPasselState, fmt.Sprintf("Left killing %s to %s", killing, possum))
+			return nil
+		}
+		break
+	}
+	window, until, err := activeFreeze(time.Now())
+	if err != nil {
+		return err
+	}
+	if window != nil {
+		p.setOutcome(desiredPasselState, fmt.Sprintf("Left killing %s, changes are frozen by %s until %s", killing, window.Name, until.Format(time.RFC3339)))
+		return nil
+	}
+	if !statesAgree(passelStates) {
+		err := newAPIError(CodeStateInconsistent, "State was inconsistent before killing %s", killing)
+		p.setOutcome(desiredPasselState, err.Error())
+		return err
+	}
+	desiredPasselStateBytes, _ := json.Marshal(desiredPasselState)
+	written, err := p.controller.setQuorumStates(reachable, desiredPasselStateBytes, probeActor, "")
+	if err != nil {
+		p.setOutcome(desiredPasselState, fmt.Sprintf("Failed to kill %s: %s", killing, err))
+		return err
+	}
+	if !statesAgree(written.PasselStates) {
+		err := newAPIError(CodeStateInconsistent, "State was inconsistent after killing %s", killing)
+		p.setOutcome(nil, err.Error())
+		return err
+	}
+	log.WithFields(log.Fields{"package": "webServer", "function": "evaluate"}).Warnf("Probes killed %s", killing)
+	p.setOutcome(nil, fmt.Sprintf("Killed %s", killing))
+	return nil
+}
+
+func countAlive(passelState map[string]string) int {
+	var alive int
+	for _, state := range passelState {
+		if state == "alive" {
+			alive++
+		}
+	}
+	return alive
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// GetProbeStatus - Get the latest foundation probe results and any state change they propose
+func (c *Controller) GetProbeStatus(w http.ResponseWriter, r *http.Request) {
+	if c.Prober == nil {
+		writeError(w, newAPIError(CodeProbeDisabled, "Foundation probing is not configured"))
+		return
+	}
+	writeJSON(w, http.StatusOK, c.Prober.Status())
+}
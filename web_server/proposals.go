@@ -0,0 +1,470 @@
+package webServer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/FidelityInternational/possum/utils"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultProposalTTLSeconds = 900
+
+// ProposalsResponse - the body of GET /v1/proposals
+type ProposalsResponse struct {
+	Proposals []utils.Proposal `json:"proposals"`
+}
+
+// approvalRequired - true if REQUIRE_APPROVAL forces every passel state change to be proposed
+func approvalRequired() bool {
+	return os.Getenv("REQUIRE_APPROVAL") == "true"
+}
+
+// checkApprovalConfig - approved changes only reach the other possums signed with the
+// peer secret, so with REQUIRE_APPROVAL a passel config without one is refused; config
+// is the passel config about to be swapped in, nil for the "possum" service
+func checkApprovalConfig(config *utils.PasselConfig) error {
+	if !approvalRequired() {
+		return nil
+	}
+	secret, err := utils.GetPasselConfigPeerSecret(config)
+	if err != nil {
+		return err
+	}
+	if secret == "" {
+		return fmt.Errorf("REQUIRE_APPROVAL needs a peer_secret to sign the writes possums make to each other")
+	}
+	return nil
+}
+
+// proposalTTL - how long a proposal can be approved for, from PROPOSAL_TTL_SECONDS
+func proposalTTL() time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv("PROPOSAL_TTL_SECONDS")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultProposalTTLSeconds * time.Second
+}
+
+func newProposalID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// withExpiry - reports a pending proposal past its expiry as expired
+func withExpiry(proposal utils.Proposal, now time.Time) utils.Proposal {
+	if proposal.Status == utils.ProposalPending && !now.Before(proposal.ExpiresAt) {
+		proposal.Status = utils.ProposalExpired
+	}
+	return proposal
+}
+
+// checkPeerAuth - true if the request carries the credentials of the "possum" service that possums use with each other
+func checkPeerAuth(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	peerUsername, err := utils.GetUsername()
+	if err != nil {
+		return false
+	}
+	peerPassword, err := utils.GetPassword()
+	if err != nil {
+		return false
+	}
+	return credentialsMatch(username, password, peerUsername, peerPassword)
+}
+
+// checkUserAuth - true if the request carries the credentials of a named user
+func checkUserAuth(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	users, err := utils.GetUsers()
+	if err != nil {
+		return false
+	}
+	userPassword, found := users[username]
+	// compare unknown usernames too, so the time taken does not reveal which exist
+	return credentialsMatch(username, password, username, userPassword) && found
+}
+
+// propose - stores a passel state change as a pending proposal on every possum in the passel
+func (c *Controller) propose(w http.ResponseWriter, r *http.Request, passel []string, desiredPossumStates PossumStates) {
+	desiredPasselState, desiredPossumFound, desiredPossum := desiredPossumInPassel(desiredPossumStates.PossumStates, passel)
+	if !desiredPossumFound {
+		customError(w, CodePossumNotInPassel, fmt.Sprintf("Possum %s is not part of my passel", desiredPossum))
+		return
+	}
+	desiredPossumStates.PossumStates = desiredPasselState
+	// the emergency credentials bypass approval, a proposal made with them could be
+	// approved by whoever holds them without a second person
+	if checkEmergencyAuth(r) {
+		writeError(w, newAPIError(CodeApprovalForbidden, "The emergency credentials bypass approval, apply the change without proposing it"))
+		return
+	}
+	id, err := newProposalID()
+	if standardError(err, w) {
+		return
+	}
+	proposedBy, _, _ := r.BasicAuth()
+	// proposals are stored to the second, so replicas can be compared with the original
+	now := time.Now().UTC().Truncate(time.Second)
+	proposal := utils.Proposal{
+		ID:           id,
+		PossumStates: desiredPossumStates.PossumStates,
+		Service:      desiredPossumStates.Service,
+		Force:        desiredPossumStates.Force,
+		Emergency:    desiredPossumStates.Emergency,
+		Reason:       desiredPossumStates.Reason,
+		ProposedBy:   proposedBy,
+		ProposedAt:   now,
+		ExpiresAt:    now.Add(proposalTTL()),
+		Status:       utils.ProposalPending,
+	}
+	span := c.storeSpan("SaveProposal")
+	err = utils.SaveProposal(c.DB, proposal)
+	endStoreSpan(span, err)
+	if standardError(wrapError(CodeDatabase, err), w) {
+		return
+	}
+	c.replicateProposal(passel, proposal)
+	requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "propose", "id": id, "proposed_by": proposedBy}).Info("Proposed a passel state change")
+	writeJSON(w, http.StatusAccepted, proposal)
+}
+
+// replicateProposal - stores the proposal on every possum in the passel, possums
+// that cannot be reached do not see the proposal until it is next replicated.
+// Returns how many possums stored it.
+func (c *Controller) replicateProposal(passel []string, proposal utils.Proposal) int {
+	body, _ := json.Marshal(proposal)
+	username, err := utils.GetUsername()
+	if err != nil {
+		log.WithFields(log.Fields{"package": "webServer", "function": "replicateProposal"}).Warnf("Can't replicate proposal: %s", err)
+		return 0
+	}
+	password, err := utils.GetPassword()
+	if err != nil {
+		log.WithFields(log.Fields{"package": "webServer", "function": "replicateProposal"}).Warnf("Can't replicate proposal: %s", err)
+		return 0
+	}
+	stored := 0
+	for _, possum := range passel {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("%s/v1/proposals/%s", possum, proposal.ID), bytes.NewReader(body))
+		if err != nil {
+			log.WithFields(log.Fields{"package": "webServer", "function": "replicateProposal", "possum": possum}).Warnf("Can't replicate proposal: %s", err)
+			continue
+		}
+		req.SetBasicAuth(username, password)
+		if err := signPeerRequest(req, body); err != nil {
+			log.WithFields(log.Fields{"package": "webServer", "function": "replicateProposal", "possum": possum}).Warnf("Can't replicate proposal: %s", err)
+			continue
+		}
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			log.WithFields(log.Fields{"package": "webServer", "function": "replicateProposal", "possum": possum}).Warnf("Can't replicate proposal: %s", err)
+			continue
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			log.WithFields(log.Fields{"package": "webServer", "function": "replicateProposal", "possum": possum, "response_code": resp.StatusCode}).Warn("Possum rejected the proposal")
+			continue
+		}
+		stored++
+	}
+	return stored
+}
+
+// GetProposals - Get every proposed passel state change known to this possum
+func (c *Controller) GetProposals(w http.ResponseWriter, r *http.Request) {
+	c = c.forRequest(r)
+	span := c.storeSpan("GetProposals")
+	proposals, err := utils.GetProposals(c.DB)
+	endStoreSpan(span, err)
+	if standardError(wrapError(CodeDatabase, err), w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetProposals"}).Debug(err.Error())
+		return
+	}
+	now := time.Now()
+	for i := range proposals {
+		proposals[i] = withExpiry(proposals[i], now)
+	}
+	writeJSON(w, http.StatusOK, ProposalsResponse{Proposals: proposals})
+}
+
+// GetProposal - Get a proposed passel state change
+func (c *Controller) GetProposal(w http.ResponseWriter, r *http.Request) {
+	c = c.forRequest(r)
+	proposal, err := c.findProposal(mux.Vars(r)["id"])
+	if standardError(err, w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, withExpiry(proposal, time.Now()))
+}
+
+// sameSecond - true if two times stored in the database to the second are the same
+func sameSecond(a time.Time, b time.Time) bool {
+	difference := a.Sub(b)
+	return difference > -time.Second && difference < time.Second
+}
+
+// sameProposal - true if two copies of a proposal propose the same change
+func sameProposal(a utils.Proposal, b utils.Proposal) bool {
+	if len(a.PossumStates) != len(b.PossumStates) {
+		return false
+	}
+	for possum, state := range a.PossumStates {
+		if b.PossumStates[possum] != state {
+			return false
+		}
+	}
+	return a.Service == b.Service && a.Force == b.Force && a.Emergency == b.Emergency && a.Reason == b.Reason &&
+		a.ProposedBy == b.ProposedBy && sameSecond(a.ProposedAt, b.ProposedAt) && sameSecond(a.ExpiresAt, b.ExpiresAt)
+}
+
+// checkProposalUpdate - checks a proposal replicated from another possum against the copy
+// stored here, if there is one. A new proposal must be pending. A stored proposal keeps what
+// it proposes and its status only moves on from pending, to approved, executed or failed by
+// someone other than the proposer, or from approved to executed or failed by the approver.
+func checkProposalUpdate(stored *utils.Proposal, proposal utils.Proposal, now time.Time) error {
+	if stored == nil {
+		if proposal.Status != utils.ProposalPending || proposal.DecidedBy != "" || proposal.DecidedAt != nil || proposal.Error != "" {
+			return newAPIError(CodeProposalConflict, "Proposal %s is not stored here so it must be pending", proposal.ID)
+		}
+		if proposal.ProposedBy == "" || !proposal.ExpiresAt.After(proposal.ProposedAt) || proposal.ExpiresAt.After(now.Add(proposalTTL()+time.Minute)) {
+			return newAPIError(CodeProposalConflict, "Proposal %s has an invalid proposer or expiry", proposal.ID)
+		}
+		return nil
+	}
+	if !sameProposal(*stored, proposal) {
+		return newAPIError(CodeProposalConflict, "Proposal %s does not match the proposal stored here", proposal.ID)
+	}
+	if proposal.Status == stored.Status && proposal.DecidedBy == stored.DecidedBy {
+		return nil
+	}
+	decided := proposal.Status == utils.ProposalExecuted || proposal.Status == utils.ProposalFailed
+	switch stored.Status {
+	case utils.ProposalPending:
+		if (proposal.Status == utils.ProposalApproved || decided) && proposal.DecidedBy != "" && proposal.DecidedBy != proposal.ProposedBy {
+			return nil
+		}
+	case utils.ProposalApproved:
+		if decided && proposal.DecidedBy == stored.DecidedBy {
+			return nil
+		}
+		// the approver releasing a claim that did not reach a majority
+		if proposal.Status == utils.ProposalPending && proposal.DecidedBy == stored.DecidedBy {
+			return nil
+		}
+	}
+	return newAPIError(CodeProposalConflict, "Proposal %s can't move from %s to %s by %s", proposal.ID, stored.Status, proposal.Status, proposal.DecidedBy)
+}
+
+// PutProposal - Store a proposal replicated from another possum, once it has been checked
+// against the copy stored here
+func (c *Controller) PutProposal(w http.ResponseWriter, r *http.Request) {
+	if !c.authorize(w, r, checkPeerAuth) {
+		return
+	}
+	c = c.forRequest(r)
+	// with approval required, approvals are only taken from possums and not from anyone
+	// holding the shared possum credentials
+	if approvalRequired() && !checkPeerSignature(r) {
+		writeError(w, newAPIError(CodeApprovalRequired, "Replicated proposals must be signed with the peer secret"))
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if standardError(wrapError(CodeInvalidRequest, err), w) {
+		return
+	}
+	if standardError(validateRequestBody(data, "Proposal"), w) {
+		return
+	}
+	var proposal utils.Proposal
+	if standardError(wrapError(CodeInvalidRequest, json.Unmarshal(data, &proposal)), w) {
+		return
+	}
+	if proposal.ID != mux.Vars(r)["id"] {
+		writeError(w, newAPIError(CodeInvalidRequest, "Proposal %s does not match the path", proposal.ID))
+		return
+	}
+	var stored *utils.Proposal
+	existing, err := c.findProposal(proposal.ID)
+	if err == nil {
+		stored = &existing
+	} else if toAPIError(err).Code != CodeProposalNotFound {
+		standardError(err, w)
+		return
+	}
+	now := time.Now().UTC()
+	if standardError(checkProposalUpdate(stored, proposal, now), w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "PutProposal", "id": proposal.ID, "status": proposal.Status}).Warn("Rejected a replicated proposal")
+		return
+	}
+	if stored != nil && stored.Status == utils.ProposalApproved && proposal.Status == utils.ProposalPending {
+		span := c.storeSpan("ReleaseProposal")
+		released, err := utils.ReleaseProposal(c.DB, proposal.ID, proposal.DecidedBy)
+		endStoreSpan(span, err)
+		if standardError(wrapError(CodeDatabase, err), w) {
+			return
+		}
+		if !released {
+			writeError(w, newAPIError(CodeProposalConflict, "Proposal %s is no longer claimed by %s", proposal.ID, proposal.DecidedBy))
+			return
+		}
+		writeJSON(w, http.StatusOK, proposal)
+		return
+	}
+	if stored != nil && stored.Status == utils.ProposalPending && proposal.Status == utils.ProposalApproved {
+		// a claim from the approving possum, which only one approver can win
+		span := c.storeSpan("ClaimProposal")
+		claimed, err := utils.ClaimProposal(c.DB, proposal.ID, proposal.DecidedBy, now)
+		endStoreSpan(span, err)
+		if standardError(wrapError(CodeDatabase, err), w) {
+			return
+		}
+		if !claimed {
+			writeError(w, newAPIError(CodeProposalNotPending, "Proposal %s is no longer pending", proposal.ID))
+			return
+		}
+		writeJSON(w, http.StatusOK, proposal)
+		return
+	}
+	span := c.storeSpan("SaveProposal")
+	err = utils.SaveProposal(c.DB, proposal)
+	endStoreSpan(span, err)
+	if standardError(wrapError(CodeDatabase, err), w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, proposal)
+}
+
+// ApproveProposal - Approve a proposed passel state change made by someone else, then apply it
+func (c *Controller) ApproveProposal(w http.ResponseWriter, r *http.Request) {
+	if !c.authorize(w, r, checkAuth) {
+		return
+	}
+	c = c.forRequest(r)
+	w.Header().Set("Content-Type", "application/json")
+	proposal, err := c.findProposal(mux.Vars(r)["id"])
+	if standardError(err, w) {
+		return
+	}
+	approver, _, _ := r.BasicAuth()
+	if !checkUserAuth(r) {
+		writeError(w, newAPIError(CodeApprovalForbidden, "Proposals must be approved by a named user"))
+		return
+	}
+	if approver == proposal.ProposedBy {
+		writeError(w, newAPIError(CodeApprovalForbidden, "Proposal %s must be approved by someone other than %s", proposal.ID, proposal.ProposedBy))
+		return
+	}
+	now := time.Now().UTC()
+	proposal = withExpiry(proposal, now)
+	if proposal.Status == utils.ProposalExpired {
+		writeError(w, newAPIError(CodeProposalExpired, "Proposal %s expired at %s", proposal.ID, proposal.ExpiresAt.Format(time.RFC3339)))
+		return
+	}
+	span := c.storeSpan("ClaimProposal")
+	claimed, err := utils.ClaimProposal(c.DB, proposal.ID, approver, now)
+	endStoreSpan(span, err)
+	if standardError(wrapError(CodeDatabase, err), w) {
+		return
+	}
+	if !claimed {
+		writeError(w, newAPIError(CodeProposalNotPending, "Proposal %s is %s", proposal.ID, proposal.Status))
+		return
+	}
+	passel, err := getPassel()
+	if standardError(err, w) {
+		return
+	}
+	proposal.Status = utils.ProposalApproved
+	proposal.DecidedBy = approver
+	proposal.DecidedAt = &now
+	// the claim only counts once a majority of the passel has it, so two people
+	// approving on different possums cannot both apply the change
+	if claims := c.replicateProposal(passel, proposal); claims <= len(passel)/2 {
+		// the claim is released everywhere it was taken, so every possum reports the
+		// proposal as pending or as decided by whoever did reach a majority
+		span = c.storeSpan("ReleaseProposal")
+		_, err = utils.ReleaseProposal(c.DB, proposal.ID, approver)
+		endStoreSpan(span, err)
+		if err != nil {
+			requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "ApproveProposal", "id": proposal.ID}).Warnf("Can't release the claim on the proposal: %s", err)
+		}
+		proposal.Status = utils.ProposalPending
+		proposal.DecidedAt = nil
+		c.replicateProposal(passel, proposal)
+		writeError(w, newAPIError(CodeProposalConflict, "Proposal %s could only be claimed on %d of %d possums, it may have been approved on another possum", proposal.ID, claims, len(passel)))
+		return
+	}
+
+	requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "ApproveProposal", "id": proposal.ID, "approved_by": approver}).Info("Approved a passel state change")
+	capture := &responseCapture{ResponseWriter: w, status: http.StatusOK}
+	desiredPossumStates := PossumStates{
+		PossumStates: proposal.PossumStates,
+		Service:      proposal.Service,
+		Force:        proposal.Force,
+		Emergency:    proposal.Emergency,
+		Reason:       proposal.Reason,
+	}
+	c.changePasselState(capture, passel, desiredPossumStates, fmt.Sprintf("%s, approved by %s", proposal.ProposedBy, approver), false)
+
+	proposal.Status = utils.ProposalExecuted
+	if capture.status < 200 || capture.status > 299 {
+		var failure ErrorResponse
+		json.Unmarshal(capture.body.Bytes(), &failure)
+		proposal.Status = utils.ProposalFailed
+		proposal.Error = failure.Error
+	}
+	span = c.storeSpan("SaveProposal")
+	err = utils.SaveProposal(c.DB, proposal)
+	endStoreSpan(span, err)
+	if err != nil {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "ApproveProposal", "id": proposal.ID}).Warnf("Can't record the outcome of the proposal: %s", err)
+	}
+	c.replicateProposal(passel, proposal)
+}
+
+func (c *Controller) findProposal(id string) (utils.Proposal, error) {
+	span := c.storeSpan("GetProposal")
+	proposal, err := utils.GetProposal(c.DB, id)
+	endStoreSpan(span, err)
+	if err == sql.ErrNoRows {
+		return utils.Proposal{}, newAPIError(CodeProposalNotFound, "Could not find proposal %s", id)
+	}
+	return proposal, wrapError(CodeDatabase, err)
+}
+
+// responseCapture - passes a response through while keeping its status and body
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rc *responseCapture) WriteHeader(status int) {
+	rc.status = status
+	rc.ResponseWriter.WriteHeader(status)
+}
+
+func (rc *responseCapture) Write(data []byte) (int, error) {
+	rc.body.Write(data)
+	return rc.ResponseWriter.Write(data)
+}
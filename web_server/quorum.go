@@ -0,0 +1,219 @@
+package webServer
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/FidelityInternational/possum/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCatchUpIntervalSeconds = 30
+	catchUpActor                  = "catch-up"
+)
+
+// quorumStates - the passel states of the possums that responded, and the possums that did not
+type quorumStates struct {
+	// Service is set when the states are of a service of each possum
+	Service      string
+	Passel       []string
+	PasselStates []map[string]string
+	Missed       []string
+}
+
+// quorumSize - how many possums must respond for a passel write to go ahead,
+// PASSEL_QUORUM if it is set to a valid size otherwise a majority of the passel
+func quorumSize(passelSize int) int {
+	if quorum, err := strconv.Atoi(os.Getenv("PASSEL_QUORUM")); err == nil && quorum > 0 && quorum <= passelSize {
+		return quorum
+	}
+	return passelSize/2 + 1
+}
+
+// gatherQuorumStates - gets the passel state, or the state of a service of each possum when
+// service is not empty, from every possum, failing with the first error seen unless a quorum
+// of possums responded
+func gatherQuorumStates(httpClient *http.Client, passel []string, service string) (quorumStates, error) {
+	states := quorumStates{Service: service}
+	var firstErr error
+	for _, possum := range passel {
+		possumStates, err := getPasselState(httpClient, possum, service)
+		if err != nil {
+			log.WithFields(log.Fields{"package": "webServer", "function": "gatherQuorumStates", "possum": possum}).Debugf("Possum missed: %s", err)
+			states.Missed = append(states.Missed, possum)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		states.Passel = append(states.Passel, possum)
+		states.PasselStates = append(states.PasselStates, possumStates)
+	}
+	if len(states.Passel) < quorumSize(len(passel)) {
+		return states, firstErr
+	}
+	return states, nil
+}
+
+// setQuorumStates - writes the passel state to every possum that responded to
+// gatherQuorumStates, then records the possums that missed the write. Unless a quorum
+// of the passel was written, the possums that were written are rolled back and it
+// fails with the first error seen.
+func (c *Controller) setQuorumStates(reachable quorumStates, passelState []byte, actor string, emergencyReason string) (quorumStates, error) {
+	written := quorumStates{Service: reachable.Service, Missed: reachable.Missed}
+	var firstErr error
+	for _, possum := range reachable.Passel {
+		possumStates, err := setPasselState(c.HTTPClient, possum, reachable.Service, passelState, actor, emergencyReason)
+		if err != nil {
+			log.WithFields(log.Fields{"package": "webServer", "function": "setQuorumStates", "possum": possum}).Debugf("Possum missed: %s", err)
+			written.Missed = append(written.Missed, possum)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		written.Passel = append(written.Passel, possum)
+		written.PasselStates = append(written.PasselStates, possumStates)
+	}
+	if len(written.Passel) < quorumSize(len(reachable.Passel)+len(reachable.Missed)) {
+		c.rollBack(reachable, written, passelState, actor, emergencyReason)
+		return written, firstErr
+	}
+	for _, possum := range written.Missed {
+		span := c.storeSpan("RecordMissedWrite")
+		err := utils.RecordMissedWrite(c.DB, possum, written.Service, string(passelState), actor)
+		endStoreSpan(span, err)
+		if err != nil {
+			log.WithFields(log.Fields{"package": "webServer", "function": "setQuorumStates", "possum": possum}).Warnf("Can't record missed write: %s", err)
+		}
+	}
+	return written, nil
+}
+
+// rollBack - writes back the states the possums written by a passel write had before it,
+// once the write has failed to reach a quorum. Possums that cannot be rolled back are
+// recorded as missing a write, so they are caught up with the rest of the passel.
+func (c *Controller) rollBack(reachable quorumStates, written quorumStates, passelState []byte, actor string, emergencyReason string) {
+	var desiredPasselState map[string]string
+	json.Unmarshal(passelState, &desiredPasselState)
+	for _, possum := range written.Passel {
+		previousPasselState := make(map[string]string)
+		for i, reachablePossum := range reachable.Passel {
+			if reachablePossum != possum {
+				continue
+			}
+			for changed := range desiredPasselState {
+				if state, found := reachable.PasselStates[i][changed]; found {
+					previousPasselState[changed] = state
+				}
+			}
+		}
+		previousPasselStateBytes, _ := json.Marshal(previousPasselState)
+		_, err := setPasselState(c.HTTPClient, possum, written.Service, previousPasselStateBytes, actor, emergencyReason)
+		if err == nil {
+			log.WithFields(log.Fields{"package": "webServer", "function": "rollBack", "possum": possum}).Info("Rolled back a write that did not reach a quorum")
+			continue
+		}
+		log.WithFields(log.Fields{"package": "webServer", "function": "rollBack", "possum": possum}).Warnf("Can't roll back: %s", err)
+		span := c.storeSpan("RecordMissedWrite")
+		err = utils.RecordMissedWrite(c.DB, possum, written.Service, string(previousPasselStateBytes), actor)
+		endStoreSpan(span, err)
+		if err != nil {
+			log.WithFields(log.Fields{"package": "webServer", "function": "rollBack", "possum": possum}).Warnf("Can't record missed write: %s", err)
+		}
+	}
+}
+
+// statesAgree - true if there is at least one passel state and they are all the same
+func statesAgree(passelStates []map[string]string) bool {
+	for _, passelState := range passelStates {
+		if !reflect.DeepEqual(passelState, passelStates[0]) {
+			return false
+		}
+	}
+	return len(passelStates) > 0
+}
+
+// RunCatchUp - catches up possums that missed passel writes every interval until stop is closed
+func (c *Controller) RunCatchUp(stop <-chan struct{}) {
+	interval := defaultCatchUpIntervalSeconds
+	if seconds, err := strconv.Atoi(os.Getenv("CATCH_UP_INTERVAL_SECONDS")); err == nil && seconds > 0 {
+		interval = seconds
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := c.CatchUpMissedWrites(); err != nil {
+				log.WithFields(log.Fields{"package": "webServer", "function": "RunCatchUp"}).Warn(err)
+			}
+		}
+	}
+}
+
+// CatchUpMissedWrites - writes the state the rest of the passel agrees on to
+// every possum that missed a write and is reachable again
+//
+// The agreed state is written rather than the missed write itself, so a
+// possum is never rolled back by a write that has since been superseded.
+func (c *Controller) CatchUpMissedWrites() error {
+	missedWrites, err := utils.GetMissedWrites(c.DB)
+	if err != nil {
+		return wrapError(CodeDatabase, err)
+	}
+	if len(missedWrites) == 0 {
+		return nil
+	}
+	passel, err := getPassel()
+	if err != nil {
+		return err
+	}
+	for _, missedWrite := range missedWrites {
+		possum, service := missedWrite.Possum, missedWrite.Service
+		member, found := inPassel(possum, passel)
+		if !found {
+			log.WithFields(log.Fields{"package": "webServer", "function": "CatchUpMissedWrites", "possum": possum}).Info("Possum has left the passel")
+			if err := utils.ClearMissedWrite(c.DB, possum, service); err != nil {
+				return wrapError(CodeDatabase, err)
+			}
+			continue
+		}
+		possumState, err := getPasselState(c.HTTPClient, member, service)
+		if err != nil {
+			log.WithFields(log.Fields{"package": "webServer", "function": "CatchUpMissedWrites", "possum": possum}).Debugf("Possum is still unreachable: %s", err)
+			continue
+		}
+		var peers []string
+		for _, peer := range passel {
+			if !utils.SamePossum(peer, possum) {
+				peers = append(peers, peer)
+			}
+		}
+		peerStates, _ := gatherQuorumStates(c.HTTPClient, peers, service)
+		if len(peerStates.Passel)+1 < quorumSize(len(passel)) || !statesAgree(peerStates.PasselStates) {
+			log.WithFields(log.Fields{"package": "webServer", "function": "CatchUpMissedWrites", "possum": possum}).Debug("The rest of the passel does not agree on a state to catch up with")
+			continue
+		}
+		agreedState := peerStates.PasselStates[0]
+		if !reflect.DeepEqual(possumState, agreedState) {
+			agreedStateBytes, _ := json.Marshal(agreedState)
+			if _, err := setPasselState(c.HTTPClient, member, service, agreedStateBytes, catchUpActor, ""); err != nil {
+				log.WithFields(log.Fields{"package": "webServer", "function": "CatchUpMissedWrites", "possum": possum}).Debugf("Can't catch up: %s", err)
+				continue
+			}
+		}
+		log.WithFields(log.Fields{"package": "webServer", "function": "CatchUpMissedWrites", "possum": possum, "service": service}).Infof("Caught up with the write missed at %s", missedWrite.MissedAt)
+		if err := utils.ClearMissedWrite(c.DB, possum, service); err != nil {
+			return wrapError(CodeDatabase, err)
+		}
+	}
+	return nil
+}
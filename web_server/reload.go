@@ -0,0 +1,109 @@
+package webServer
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/FidelityInternational/possum/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReloadResponse - the passel swapped in by a reload and how the state table changed
+type ReloadResponse struct {
+	Passel   []string `json:"passel"`
+	Added    []string `json:"added"`
+	Archived []string `json:"archived"`
+}
+
+// Reloader - reloads passel membership and credentials from a file
+type Reloader struct {
+	db      *sql.DB
+	path    string
+	mutex   sync.Mutex
+	modTime time.Time
+}
+
+// NewReloader - returns a reloader for the passel config file at path
+func NewReloader(db *sql.DB, path string) *Reloader {
+	return &Reloader{db: db, path: path}
+}
+
+// Reload - validates the passel config file, brings the state table in line
+// with it, then swaps it in; on any error the current config is kept
+func (r *Reloader) Reload() (ReloadResponse, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return ReloadResponse{}, wrapError(CodeConfig, err)
+	}
+	config, err := utils.LoadPasselConfigFile(r.path)
+	if err != nil {
+		return ReloadResponse{}, newAPIError(CodeConfig, "%s is invalid: %s", r.path, err)
+	}
+	if err := checkApprovalConfig(&config); err != nil {
+		return ReloadResponse{}, newAPIError(CodeConfig, "%s is invalid: %s", r.path, err)
+	}
+	// a config that would leave no possum alive, even one that only adds dead
+	// possums, is refused
+	added, archived, err := utils.SyncPasselDB(r.db, config.Passel, config.InitialState, keepsAPossumAlive)
+	if err != nil {
+		return ReloadResponse{}, wrapError(CodeDatabase, err)
+	}
+	utils.SetPasselConfig(&config)
+	r.modTime = info.ModTime()
+	log.WithFields(log.Fields{"package": "webServer", "function": "Reload", "passel": config.Passel, "added": added, "archived": archived}).Info("Reloaded passel config")
+	return ReloadResponse{Passel: config.Passel, Added: append([]string{}, added...), Archived: append([]string{}, archived...)}, nil
+}
+
+// ReloadIfChanged - reloads the passel config file if it has been modified since the last reload
+func (r *Reloader) ReloadIfChanged() (bool, error) {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false, wrapError(CodeConfig, err)
+	}
+	r.mutex.Lock()
+	changed := !info.ModTime().Equal(r.modTime)
+	r.mutex.Unlock()
+	if !changed {
+		return false, nil
+	}
+	_, err = r.Reload()
+	return err == nil, err
+}
+
+// Watch - reloads the passel config file whenever it changes until stop is closed
+func (r *Reloader) Watch(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := r.ReloadIfChanged(); err != nil {
+				log.WithFields(log.Fields{"package": "webServer", "function": "Watch"}).Warnf("Keeping the current passel config: %s", err)
+			}
+		}
+	}
+}
+
+// Reload - Reload passel membership and credentials from the passel config file
+func (c *Controller) Reload(w http.ResponseWriter, r *http.Request) {
+	if !c.authorize(w, r, checkAuth) {
+		return
+	}
+	if c.Reloader == nil {
+		writeError(w, newAPIError(CodeReloadDisabled, "PASSEL_CONFIG_FILE is not configured"))
+		return
+	}
+	response, err := c.Reloader.Reload()
+	if standardError(err, w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "Reload"}).Debug(err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,207 @@
+package webServer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/FidelityInternational/possum/tracing"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader - the header a request ID is accepted from, returned in and sent to peers on
+const RequestIDHeader = "X-Request-ID"
+
+// request IDs from clients are only accepted if they cannot be used to forge log lines
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
+
+// requestID - returns the ID of the request, or "" outside RequestMiddleware
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLog - a logger whose lines carry the ID and trace ID of the request
+func requestLog(r *http.Request) *log.Entry {
+	entry := log.WithField("request_id", requestID(r))
+	if span := tracing.FromContext(r.Context()); span != nil {
+		entry = entry.WithField("trace_id", span.Context().TraceID)
+	}
+	return entry
+}
+
+// responseLog - a logger whose lines carry the ID of the request being responded to
+func responseLog(w http.ResponseWriter) *log.Entry {
+	return log.WithField("request_id", w.Header().Get(RequestIDHeader))
+}
+
+// accessLogEnabled - true if ACCESS_LOG asks for a line to be logged for every request
+func accessLogEnabled() bool {
+	return os.Getenv("ACCESS_LOG") == "true"
+}
+
+// ConfigureLogging - switches to JSON log lines if LOG_FORMAT is "json"
+func ConfigureLogging() {
+	if os.Getenv("LOG_FORMAT") == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+}
+
+// accessLogWriter - passes a response through while keeping its status and size
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (aw *accessLogWriter) WriteHeader(status int) {
+	aw.status = status
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *accessLogWriter) Write(data []byte) (int, error) {
+	size, err := aw.ResponseWriter.Write(data)
+	aw.size += size
+	return size, err
+}
+
+// routeTemplate - the route that matched the request, or its path if none did
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+// RequestMiddleware - gives every request an ID, taken from X-Request-ID if the
+// client sent a valid one, returns it in the X-Request-ID response header,
+// traces the request as a child of any traceparent it carries and logs the
+// request if ACCESS_LOG is set
+func RequestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		route := routeTemplate(r)
+		ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), fmt.Sprintf("%s %s", r.Method, route), tracing.KindServer)
+		defer span.End()
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("request_id", id)
+		r = r.WithContext(context.WithValue(ctx, requestIDKey{}, id))
+		aw := &accessLogWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(aw, r)
+		span.SetAttribute("http.status_code", aw.status)
+		if aw.status >= 500 {
+			span.RecordError(fmt.Errorf("%d %s", aw.status, http.StatusText(aw.status)))
+		}
+		if !accessLogEnabled() {
+			return
+		}
+		requestLog(r).WithFields(log.Fields{
+			"package":     "webServer",
+			"function":    "RequestMiddleware",
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"route":       route,
+			"status":      aw.status,
+			"bytes":       aw.size,
+			"duration_ms": time.Since(start).Milliseconds(),
+			"remote":      r.RemoteAddr,
+		}).Info("Handled request")
+	})
+}
+
+// peerTransport - sends the request ID and trace context on every peer call,
+// tracing and logging the calls
+type peerTransport struct {
+	base http.RoundTripper
+	id   string
+	ctx  context.Context
+}
+
+func (t peerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracing.Start(t.ctx, fmt.Sprintf("%s %s", req.Method, req.URL.Path), tracing.KindClient)
+	defer span.End()
+	req = req.Clone(req.Context())
+	req.Header.Set(RequestIDHeader, t.id)
+	tracing.Inject(ctx, req.Header)
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", req.URL.String())
+	span.SetAttribute("request_id", t.id)
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	fields := log.Fields{"package": "webServer", "function": "RoundTrip", "request_id": t.id, "method": req.Method, "url": req.URL.String(), "duration_ms": time.Since(start).Milliseconds()}
+	if err != nil {
+		span.RecordError(err)
+		log.WithFields(fields).Debugf("Peer call failed: %s", err)
+		return nil, err
+	}
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.RecordError(fmt.Errorf("%s", resp.Status))
+	}
+	fields["status"] = resp.StatusCode
+	log.WithFields(fields).Debug("Called peer")
+	return resp, nil
+}
+
+// forRequest - returns a copy of the controller whose peer calls carry the ID
+// and trace context of the request, and whose store calls are traced
+func (c *Controller) forRequest(r *http.Request) *Controller {
+	id := requestID(r)
+	if id == "" {
+		return c
+	}
+	controller := *c
+	controller.ctx = r.Context()
+	if c.HTTPClient != nil {
+		base := c.HTTPClient.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		client := *c.HTTPClient
+		client.Transport = peerTransport{base: base, id: id, ctx: r.Context()}
+		controller.HTTPClient = &client
+	}
+	return &controller
+}
+
+// storeSpan - starts a span for a call to the store made while handling a
+// request, or returns nil if the controller is not handling one
+func (c *Controller) storeSpan(operation string) *tracing.Span {
+	if c.ctx == nil {
+		return nil
+	}
+	_, span := tracing.Start(c.ctx, "store "+operation, tracing.KindInternal)
+	span.SetAttribute("db.system", "mysql")
+	span.SetAttribute("db.operation", operation)
+	return span
+}
+
+// endStoreSpan - ends a span started by storeSpan, recording the error of the call
+func endStoreSpan(span *tracing.Span, err error) {
+	span.RecordError(err)
+	span.End()
+}
@@ -2,7 +2,8 @@ package webServer
 
 import (
 	"database/sql"
-
+	"net/http"
+	"os"
 	"time"
 
 	"github.com/FidelityInternational/possum/utils"
@@ -30,8 +31,8 @@ type DBConn func(driverName string, connectionString string) (*sql.DB, error)
 // ControllerCreator - controller creation function
 type ControllerCreator func(db *sql.DB) *Controller
 
-// CreateServer - creates a server
-func CreateServer(dbConnFunc DBConn, controllerCreator ControllerCreator) (*Server, error) {
+// OpenDB - opens the state database described by the "possum-db" service
+func OpenDB(dbConnFunc DBConn) (*sql.DB, error) {
 	dbConnectionString, err = utils.GetDBConnectionDetails()
 	if err != nil {
 		return nil, err
@@ -39,15 +40,42 @@ func CreateServer(dbConnFunc DBConn, controllerCreator ControllerCreator) (*Serv
 
 	db, err = dbConnFunc("mysql", dbConnectionString)
 	if err != nil {
-		log.WithFields(log.Fields{"package": "webServer", "function": "CreateServer"}).Debugf("Can't open DB connection: %s", err)
+		log.WithFields(log.Fields{"package": "webServer", "function": "OpenDB"}).Debugf("Can't open DB connection: %s", err)
+		return nil, err
+	}
+	return db, nil
+}
+
+// CreateServer - creates a server
+func CreateServer(dbConnFunc DBConn, controllerCreator ControllerCreator) (*Server, error) {
+	// a passel config file is checked when it is loaded
+	if os.Getenv("PASSEL_CONFIG_FILE") == "" {
+		if err := checkApprovalConfig(nil); err != nil {
+			log.WithFields(log.Fields{"package": "webServer", "function": "CreateServer"}).Debugf("Can't require approval: %s", err)
+			return nil, err
+		}
+	}
+
+	db, err = OpenDB(dbConnFunc)
+	if err != nil {
 		return nil, err
 	}
 
-	err = utils.SetupStateDB(db)
+	_, err = utils.Migrate(db)
 	if err != nil {
-		log.WithFields(log.Fields{"package": "webServer", "function": "CreateServer"}).Debugf("Can't set up state DB: %s", err)
+		log.WithFields(log.Fields{"package": "webServer", "function": "CreateServer"}).Debugf("Can't migrate state DB: %s", err)
 		return nil, err
 	}
+
+	// a passel config file or discovery sets the passel once the server is created, the
+	// passel of the "possum" service would bring back possums they have archived
+	if os.Getenv("PASSEL_CONFIG_FILE") == "" && os.Getenv("PASSEL_DISCOVERY") == "" {
+		err = utils.SetupStateDB(db)
+		if err != nil {
+			log.WithFields(log.Fields{"package": "webServer", "function": "CreateServer"}).Debugf("Can't set up state DB: %s", err)
+			return nil, err
+		}
+	}
 	db.SetConnMaxLifetime(3 * time.Minute)
 	db.SetMaxOpenConns(10)
 	db.SetMaxIdleConns(10)
@@ -68,6 +96,50 @@ func (s *Server) Start() *mux.Router {
 	router.HandleFunc("/v1/passel_state_consistency", s.Controller.GetPasselStateConsistency).Methods("GET")
 	router.HandleFunc("/v1/state", s.Controller.SetState).Methods("POST")
 	router.HandleFunc("/v1/passel_state", s.Controller.SetPasselState).Methods("POST")
+	router.HandleFunc("/v1/services/{service}/state", s.Controller.GetServiceState).Methods("GET")
+	router.HandleFunc("/v1/services/{service}/passel_state", s.Controller.GetPasselServiceState).Methods("GET")
+	router.HandleFunc("/v1/services/{service}/state", s.Controller.SetServiceState).Methods("POST")
+	router.HandleFunc("/v1/services/{service}/passel_state", s.Controller.SetPasselServiceState).Methods("POST")
+	router.HandleFunc("/v1/proposals", s.Controller.GetProposals).Methods("GET")
+	router.HandleFunc("/v1/proposals/{id}", s.Controller.GetProposal).Methods("GET")
+	router.HandleFunc("/v1/proposals/{id}", s.Controller.PutProposal).Methods("PUT")
+	router.HandleFunc("/v1/proposals/{id}/approve", s.Controller.ApproveProposal).Methods("POST")
+	router.HandleFunc("/v1/alertmanager", s.Controller.ReceiveAlerts).Methods("POST")
+	router.HandleFunc("/v1/members", s.Controller.GetMembers).Methods("GET")
+	router.HandleFunc("/v1/members", s.Controller.RegisterMember).Methods("POST")
+	router.HandleFunc("/v1/reload", s.Controller.Reload).Methods("POST")
+	router.HandleFunc("/v1/state_changes", s.Controller.GetStateChanges).Methods("GET")
+	router.HandleFunc("/v1/export", s.Controller.ExportState).Methods("GET")
+	router.HandleFunc("/v1/import", s.Controller.ImportState).Methods("POST")
+	router.HandleFunc("/v1/probe_status", s.Controller.GetProbeStatus).Methods("GET")
+	router.HandleFunc("/v1/openapi.json", s.Controller.GetOpenAPI).Methods("GET")
+	router.HandleFunc("/v1/ready", s.Controller.GetReady).Methods("GET")
+	router.HandleFunc("/v1/diagnostics", s.Controller.GetDiagnostics).Methods("GET")
+	router.HandleFunc("/metrics", s.Controller.GetMetrics).Methods("GET")
+	router.HandleFunc("/dashboard", s.Controller.GetDashboard).Methods("GET")
+	cors := CORSMiddleware(LoadCORSConfig())
+	router.Use(RequestMiddleware)
+	router.Use(cors)
+	// mux does not run the middlewares for requests that match no route, which
+	// includes every OPTIONS request
+	router.NotFoundHandler = RequestMiddleware(cors(http.HandlerFunc(notFound)))
+	router.MethodNotAllowedHandler = RequestMiddleware(cors(http.HandlerFunc(methodNotAllowed)))
 
 	return router
 }
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		preflight(w, r)
+		return
+	}
+	writeError(w, newAPIError(CodeNotFound, "%s is not a possum endpoint", r.URL.Path))
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		preflight(w, r)
+		return
+	}
+	writeError(w, newAPIError(CodeMethodNotAllowed, "%s is not allowed on %s", r.Method, r.URL.Path))
+}
@@ -1,6 +1,8 @@
 package webServer_test
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 
@@ -66,6 +68,23 @@ func setupMultiple(mockEndpoints []MockRoute) *httptest.Server {
 	return newServer
 }
 
+// setupFakePossum - a possum serving passelState, which POST /v1/state
+// updates, recording each POSTed body in posted
+func setupFakePossum(passelState map[string]string, posted *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			data, _ := ioutil.ReadAll(r.Body)
+			*posted = append(*posted, string(data))
+			var desired map[string]string
+			json.Unmarshal(data, &desired)
+			for possum, state := range desired {
+				passelState[possum] = state
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]map[string]string{"possum_states": passelState})
+	}))
+}
+
 func teardown(server *httptest.Server) {
 	server.Close()
 }
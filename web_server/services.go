@@ -0,0 +1,184 @@
+package webServer
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/FidelityInternational/possum/utils"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+var serviceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// ServiceStateResponse - the body of a successful GET /v1/services/{service}/state
+type ServiceStateResponse struct {
+	Service string `json:"service"`
+	// State is dead if either the service or the possum it runs on is dead
+	State        string `json:"state"`
+	ServiceState string `json:"service_state"`
+	PossumState  string `json:"possum_state"`
+	// Stale is true when the states were served from the cache because the database is unavailable
+	Stale bool `json:"stale,omitempty"`
+}
+
+// configuredServices - the named services of every possum, from the comma or space separated
+// POSSUM_SERVICES. Names that are not lower case letters, digits, '-' and '_' are ignored.
+func configuredServices() []string {
+	var services []string
+	for _, service := range strings.FieldsFunc(os.Getenv("POSSUM_SERVICES"), func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !serviceNamePattern.MatchString(service) {
+			log.WithFields(log.Fields{"package": "webServer", "function": "configuredServices", "service": service}).Warn("Ignoring service with an invalid name")
+			continue
+		}
+		services = append(services, service)
+	}
+	return services
+}
+
+// requestService - the service named in the path of the request, which must be configured
+func requestService(r *http.Request) (string, error) {
+	service := mux.Vars(r)["service"]
+	for _, configured := range configuredServices() {
+		if configured == service {
+			return service, nil
+		}
+	}
+	return "", newAPIError(CodeServiceNotFound, "Service %s is not configured", service)
+}
+
+// statePath - the path of a state endpoint, "state" or "passel_state", of the possum itself
+// when service is empty, otherwise of the service
+func statePath(service string, endpoint string) string {
+	if service == "" {
+		return "/v1/" + endpoint
+	}
+	return fmt.Sprintf("/v1/services/%s/%s", service, endpoint)
+}
+
+// isServiceAliveSomewhere - true if, after the desired service states are applied, at least one
+// possum that is alive still has the service alive
+func isServiceAliveSomewhere(desiredServiceStates map[string]string, serviceStates map[string]string, passelStates map[string]string) bool {
+	for possum, state := range updateStateToDesired(desiredServiceStates, serviceStates) {
+		if state == "alive" && passelStates[possum] == "alive" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkServicesStayAlive - refuses a change that would leave a configured service, alive on
+// some possum now, alive on none, because the possums it runs on or the service itself are
+// killed. desiredServiceStates are the desired states of the possums by service, and the
+// current service states are read with readServiceStates.
+func checkServicesStayAlive(desiredPasselState map[string]string, passelState map[string]string, desiredServiceStates map[string]map[string]string, readServiceStates utils.ServiceStateReader) error {
+	afterPasselState := updateStateToDesired(desiredPasselState, passelState)
+	for _, service := range configuredServices() {
+		serviceStates, err := readServiceStates(service)
+		if err != nil {
+			return wrapError(CodeDatabase, err)
+		}
+		if isServiceAliveSomewhere(nil, serviceStates, passelState) && !isServiceAliveSomewhere(desiredServiceStates[service], serviceStates, afterPasselState) {
+			return newAPIError(CodeWouldKillAll, "Would have killed %s on every possum", service)
+		}
+	}
+	return nil
+}
+
+// serviceStateReader - reads service states of the passel from the database, outside of any write
+func (c *Controller) serviceStateReader(passel []string) utils.ServiceStateReader {
+	return func(service string) (map[string]string, error) {
+		span := c.storeSpan("GetPasselServiceState")
+		serviceStates, err := utils.GetPasselServiceState(c.DB, passel, service)
+		endStoreSpan(span, err)
+		return serviceStates, err
+	}
+}
+
+// GetServiceState - Get the health of a service of this possum
+func (c *Controller) GetServiceState(w http.ResponseWriter, r *http.Request) {
+	c = c.forRequest(r)
+	w.Header().Set("Content-Type", "application/json")
+	service, err := requestService(r)
+	if standardError(err, w) {
+		return
+	}
+	possum, _, err := findMyPossum()
+	if standardError(err, w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetServiceState"}).Debugf("Can't find my possum: %s", err.Error())
+		return
+	}
+	possumState, cachedAt, err := c.readState(possum, readerState)
+	if standardError(wrapError(CodeDatabase, err), w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetServiceState"}).Debugf("%v", err)
+		return
+	}
+	serviceState, serviceCachedAt, err := c.readServiceState(possum, service, readerServiceState)
+	if standardError(wrapError(CodeDatabase, err), w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetServiceState", "service": service}).Debugf("%v", err)
+		return
+	}
+	response := ServiceStateResponse{Service: service, State: "alive", ServiceState: serviceState, PossumState: possumState, Stale: !cachedAt.IsZero() || !serviceCachedAt.IsZero()}
+	if serviceState != "alive" || possumState != "alive" {
+		response.State = "dead"
+	}
+	if response.Stale {
+		setStaleWarning(w)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// GetPasselServiceState - Get the state of a service of every possum in the passel
+func (c *Controller) GetPasselServiceState(w http.ResponseWriter, r *http.Request) {
+	c = c.forRequest(r)
+	w.Header().Set("Content-Type", "application/json")
+	service, err := requestService(r)
+	if standardError(err, w) {
+		return
+	}
+	passel, err := getPassel()
+	if standardError(err, w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetPasselServiceState"}).Debugf("Can't get passel: %s", err.Error())
+		return
+	}
+	serviceStates, cachedAt, err := c.readPasselServiceState(passel, service, readerPasselServiceState)
+	if standardError(wrapError(CodeDatabase, err), w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "GetPasselServiceState", "service": service}).Debug(err.Error())
+		return
+	}
+	if !cachedAt.IsZero() {
+		setStaleWarning(w)
+		writeJSON(w, http.StatusOK, PossumStates{PossumStates: serviceStates, Service: service, Stale: true, CachedAt: &cachedAt})
+		return
+	}
+	writeJSON(w, http.StatusOK, PossumStates{PossumStates: serviceStates, Service: service})
+}
+
+// SetServiceState - set the state of a service of the possums in this possum's database
+func (c *Controller) SetServiceState(w http.ResponseWriter, r *http.Request) {
+	if !c.authorize(w, r, checkAuth) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	service, err := requestService(r)
+	if standardError(err, w) {
+		return
+	}
+	c.setState(w, r, service)
+}
+
+// SetPasselServiceState - Set the state of a service of the entire passel
+func (c *Controller) SetPasselServiceState(w http.ResponseWriter, r *http.Request) {
+	if !c.authorize(w, r, checkAuth) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	service, err := requestService(r)
+	if standardError(err, w) {
+		return
+	}
+	c.setPasselStates(w, r, service)
+}
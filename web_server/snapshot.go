@@ -0,0 +1,251 @@
+package webServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/FidelityInternational/possum/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// ImportRequest - the body of POST /v1/import
+type ImportRequest struct {
+	Snapshot utils.Snapshot `json:"snapshot"`
+	DryRun   bool           `json:"dry_run,omitempty"`
+	// Force skips the check that the snapshot matches the state of the other possums
+	Force bool `json:"force,omitempty"`
+}
+
+// ImportResponse - the result of importing a snapshot, or of a dry run of the import
+type ImportResponse struct {
+	DryRun          bool              `json:"dry_run,omitempty"`
+	Possum          string            `json:"possum"`
+	Changed         []string          `json:"changed"`
+	HistoryImported int               `json:"history_imported"`
+	PossumStates    map[string]string `json:"possum_states"`
+	// ServicesChanged are the possums whose service states the import changed, by service
+	ServicesChanged map[string][]string `json:"services_changed,omitempty"`
+	// Passel and PasselStates are the other possums the snapshot was checked against, and their states
+	Passel       []string            `json:"passel,omitempty"`
+	PasselStates []map[string]string `json:"passel_states,omitempty"`
+}
+
+// snapshotKey - the key snapshots are signed with, SNAPSHOT_SIGNING_KEY or else the
+// password possums use with each other, so any possum in the passel can verify them
+func snapshotKey() ([]byte, error) {
+	if key := os.Getenv("SNAPSHOT_SIGNING_KEY"); key != "" {
+		return []byte(key), nil
+	}
+	password, err := utils.GetPassword()
+	if err != nil {
+		return nil, wrapError(CodeConfig, err)
+	}
+	if password == "" {
+		return nil, newAPIError(CodeConfig, "SNAPSHOT_SIGNING_KEY or the possum service password must be set to sign snapshots")
+	}
+	return []byte(password), nil
+}
+
+// ExportState - Export the state and state history of this possum as a signed snapshot
+func (c *Controller) ExportState(w http.ResponseWriter, r *http.Request) {
+	if !c.authorize(w, r, checkAuth) {
+		return
+	}
+	c = c.forRequest(r)
+	key, err := snapshotKey()
+	if standardError(err, w) {
+		return
+	}
+	span := c.storeSpan("ExportSnapshot")
+	snapshot, err := utils.ExportSnapshot(c.DB)
+	endStoreSpan(span, err)
+	if standardError(wrapError(CodeDatabase, err), w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "ExportState"}).Debug(err.Error())
+		return
+	}
+	if possum, _, err := findMyPossum(); err == nil {
+		snapshot.Possum = possum
+	}
+	snapshot, err = snapshot.Sign(key)
+	if standardError(err, w) {
+		return
+	}
+	requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "ExportState", "actor": requestActor(r, checkPeerSignature(r)), "states": len(snapshot.States), "history": len(snapshot.History)}).Info("Exported a snapshot")
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+// ImportState - Import a signed snapshot into this possum, once it has been checked
+// against the passel and against the state of the other possums
+func (c *Controller) ImportState(w http.ResponseWriter, r *http.Request) {
+	if !c.authorize(w, r, checkAuth) {
+		return
+	}
+	c = c.forRequest(r)
+	// possums never import into each other, so only the emergency credentials skip approval
+	if approvalRequired() && !checkEmergencyAuth(r) {
+		writeError(w, newAPIError(CodeApprovalRequired, "Imports need the emergency credentials when changes need approval"))
+		return
+	}
+	signed := checkPeerSignature(r)
+	data, err := ioutil.ReadAll(r.Body)
+	if standardError(wrapError(CodeInvalidRequest, err), w) {
+		return
+	}
+	if standardError(validateRequestBody(data, "ImportRequest"), w) {
+		return
+	}
+	var request ImportRequest
+	if standardError(wrapError(CodeInvalidRequest, json.Unmarshal(data, &request)), w) {
+		return
+	}
+	snapshot := request.Snapshot
+	if standardError(checkSnapshot(snapshot), w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "ImportState"}).Warn("Rejected a snapshot")
+		return
+	}
+	possum, passel, err := findMyPossum()
+	if standardError(err, w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "ImportState"}).Debugf("Can't find my possum: %s", err.Error())
+		return
+	}
+	states, found, unknown := desiredPossumInPassel(snapshot.States, passel)
+	if !found {
+		customError(w, CodePossumNotInPassel, fmt.Sprintf("Possum %s in the snapshot is not part of my passel", unknown))
+		return
+	}
+	snapshot.States = states
+	configured := make(map[string]bool)
+	for _, service := range configuredServices() {
+		configured[service] = true
+	}
+	for service, serviceStates := range snapshot.ServiceStates {
+		if !configured[service] {
+			requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "ImportState", "service": service}).Warn("Not importing the states of a service that is not configured")
+			delete(snapshot.ServiceStates, service)
+			continue
+		}
+		serviceStates, found, unknown := desiredPossumInPassel(serviceStates, passel)
+		if !found {
+			customError(w, CodePossumNotInPassel, fmt.Sprintf("Possum %s in the snapshot is not part of my passel", unknown))
+			return
+		}
+		snapshot.ServiceStates[service] = serviceStates
+	}
+
+	var peers []string
+	for _, peer := range passel {
+		if peer != possum {
+			peers = append(peers, peer)
+		}
+	}
+	var reachable quorumStates
+	if len(peers) > 0 {
+		reachable, err = gatherQuorumStates(c.HTTPClient, peers, "")
+		if standardError(err, w) {
+			requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "ImportState"}).Debug(err.Error())
+			return
+		}
+		if !request.Force {
+			if !statesAgree(reachable.PasselStates) {
+				stateInconsistentError(w, reachable.Passel, reachable.PasselStates, false, "The other possums do not agree on the passel state")
+				return
+			}
+			if !snapshotMatches(snapshot.States, reachable.PasselStates[0]) {
+				stateInconsistentError(w, reachable.Passel, reachable.PasselStates, false, "The snapshot does not match the passel state of the other possums")
+				return
+			}
+		}
+	}
+
+	emergency, reason := emergencyRequest(r)
+	actor := requestActor(r, signed)
+	validate := func(passelState map[string]string, serviceStates utils.ServiceStateReader) (string, error) {
+		if !isAtLeastOnePossumAlive(snapshot.States, passelState) {
+			return "", newAPIError(CodeWouldKillAll, "Would have killed all possums")
+		}
+		if err := checkServicesStayAlive(snapshot.States, passelState, snapshot.ServiceStates, serviceStates); err != nil {
+			return "", err
+		}
+		if !changesState(snapshot.States, passelState) {
+			return "", nil
+		}
+		return checkFreeze(emergency, reason, checkEmergencyAuth(r), actor)
+	}
+	response := ImportResponse{Possum: possum, Changed: []string{}, Passel: reachable.Passel, PasselStates: reachable.PasselStates}
+
+	if request.DryRun {
+		span := c.storeSpan("GetPasselState")
+		passelState, err := utils.GetPasselState(c.DB, passel)
+		endStoreSpan(span, err)
+		if standardError(wrapError(CodeDatabase, err), w) {
+			return
+		}
+		if _, err := validate(passelState, c.serviceStateReader(passel)); standardError(err, w) {
+			return
+		}
+		for _, changed := range sortedKeys(snapshot.States) {
+			if passelState[changed] != snapshot.States[changed] {
+				response.Changed = append(response.Changed, changed)
+			}
+		}
+		response.DryRun = true
+		response.PossumStates = updateStateToDesired(snapshot.States, passelState)
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	span := c.storeSpan("ImportSnapshot")
+	result, err := utils.ImportSnapshot(c.DB, passel, snapshot, actor, validate)
+	endStoreSpan(span, err)
+	if standardError(wrapError(CodeDatabase, err), w) {
+		requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "ImportState"}).Debug(err.Error())
+		return
+	}
+	span = c.storeSpan("GetPasselState")
+	afterImportPasselState, err := utils.GetPasselState(c.DB, passel)
+	endStoreSpan(span, err)
+	if standardError(wrapError(CodeDatabase, err), w) {
+		return
+	}
+	if c.StateCache != nil {
+		c.StateCache.update("", afterImportPasselState, time.Now().UTC())
+	}
+	requestLog(r).WithFields(log.Fields{"package": "webServer", "function": "ImportState", "actor": actor, "exported_from": snapshot.Possum, "exported_at": snapshot.ExportedAt, "changed": result.Changed, "history_imported": result.HistoryImported}).Info("Imported a snapshot")
+	response.Changed = result.Changed
+	response.HistoryImported = result.HistoryImported
+	response.ServicesChanged = result.ServicesChanged
+	response.PossumStates = afterImportPasselState
+	writeJSON(w, http.StatusAccepted, response)
+}
+
+// checkSnapshot - checks a snapshot is in a format and from a schema this possum understands, and that its signature is valid
+func checkSnapshot(snapshot utils.Snapshot) error {
+	if snapshot.FormatVersion != utils.SnapshotFormat {
+		return newAPIError(CodeSnapshotInvalid, "Snapshot format %d is not supported, only %d is", snapshot.FormatVersion, utils.SnapshotFormat)
+	}
+	if snapshot.SchemaVersion > utils.LatestSchemaVersion() {
+		return newAPIError(CodeSnapshotInvalid, "Snapshot is from schema version %d, newer than this possum understands", snapshot.SchemaVersion)
+	}
+	key, err := snapshotKey()
+	if err != nil {
+		return err
+	}
+	if !snapshot.Verify(key) {
+		return newAPIError(CodeSnapshotInvalid, "Snapshot signature is invalid")
+	}
+	return nil
+}
+
+// snapshotMatches - true if every state in the snapshot is the state the other possums agree on
+func snapshotMatches(snapshotStates map[string]string, agreedState map[string]string) bool {
+	for possum, state := range snapshotStates {
+		if agreedState[possum] != state {
+			return false
+		}
+	}
+	return true
+}
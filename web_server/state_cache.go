@@ -0,0 +1,307 @@
+package webServer
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/FidelityInternational/possum/utils"
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultStateCacheMaxAgeSeconds = 300
+	// an unchanged cache is written to disk at most this often, the time it
+	// was read is then at most this far behind, which only makes it look older
+	stateCachePersistInterval = 10 * time.Second
+)
+
+// Readers of the state that can be answered from the cache, reported in metrics
+const (
+	readerState       = "state"
+	readerPasselState = "passel_state"
+	readerAgentCheck  = "agent_check"
+	readerDNS         = "dns"
+	// the service state readers
+	readerServiceState       = "service_state"
+	readerPasselServiceState = "passel_service_state"
+)
+
+// StateCache - the last passel state, and service states of the passel, successfully read
+// from the database, used to answer reads while the database is unavailable
+type StateCache struct {
+	mutex sync.Mutex
+	// states are the states of each possum by service, "" for the states of the possums themselves
+	states map[string]map[string]string
+	// readAts is when each state was last read, reads can refresh only some possums
+	readAts map[string]map[string]time.Time
+	// readAt is when any state was last read
+	readAt time.Time
+	// path is the file the cache is kept in across restarts, "" to keep it in memory only
+	path        string
+	persistedAt time.Time
+	served      map[string]int
+}
+
+// stateCacheFile - the on-disk copy of the cache
+type stateCacheFile struct {
+	PossumStates   map[string]string               `json:"possum_states"`
+	ReadAt         time.Time                       `json:"read_at"`
+	ReadAts        map[string]time.Time            `json:"read_ats,omitempty"`
+	ServiceStates  map[string]map[string]string    `json:"service_states,omitempty"`
+	ServiceReadAts map[string]map[string]time.Time `json:"service_read_ats,omitempty"`
+}
+
+// NewStateCache - creates a state cache, loading it from path if it is set and exists
+func NewStateCache(path string) *StateCache {
+	cache := &StateCache{
+		states:  make(map[string]map[string]string),
+		readAts: make(map[string]map[string]time.Time),
+		path:    path,
+		served:  make(map[string]int),
+	}
+	if path == "" {
+		return cache
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithFields(log.Fields{"package": "webServer", "function": "NewStateCache", "path": path}).Warnf("Can't read state cache: %s", err)
+		}
+		return cache
+	}
+	var file stateCacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		log.WithFields(log.Fields{"package": "webServer", "function": "NewStateCache", "path": path}).Warnf("Can't parse state cache: %s", err)
+		return cache
+	}
+	if file.PossumStates != nil {
+		cache.readAt = file.ReadAt
+		cache.load("", file.PossumStates, file.ReadAts, file.ReadAt)
+		for service, states := range file.ServiceStates {
+			cache.load(service, states, file.ServiceReadAts[service], file.ReadAt)
+		}
+	}
+	return cache
+}
+
+// load - loads the states of a service from the cache file, caches written before
+// states were timed by possum were all read at readAt
+func (cache *StateCache) load(service string, states map[string]string, readAts map[string]time.Time, readAt time.Time) {
+	cache.states[service] = states
+	cache.readAts[service] = make(map[string]time.Time, len(states))
+	for possum := range states {
+		possumReadAt, found := readAts[possum]
+		if !found {
+			possumReadAt = readAt
+		}
+		cache.readAts[service][possum] = possumReadAt
+	}
+}
+
+// stateCacheMaxAge - how old the cache can be and still be served, from STATE_CACHE_MAX_AGE_SECONDS
+func stateCacheMaxAge() time.Duration {
+	return time.Duration(envInt("STATE_CACHE_MAX_AGE_SECONDS", defaultStateCacheMaxAgeSeconds)) * time.Second
+}
+
+// update - records states read from the database, of a service of each possum when service
+// is not empty, only the possums read are refreshed
+func (cache *StateCache) update(service string, states map[string]string, now time.Time) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.states[service] == nil {
+		cache.states[service] = make(map[string]string)
+		cache.readAts[service] = make(map[string]time.Time)
+	}
+	changed := false
+	for possum, state := range states {
+		if cache.states[service][possum] != state {
+			cache.states[service][possum] = state
+			changed = true
+		}
+		cache.readAts[service][possum] = now
+	}
+	cache.readAt = now
+	if cache.path == "" || (!changed && now.Sub(cache.persistedAt) < stateCachePersistInterval) {
+		return
+	}
+	cache.persistedAt = now
+	file := stateCacheFile{PossumStates: cache.states[""], ReadAt: now, ReadAts: cache.readAts[""]}
+	if file.PossumStates == nil {
+		file.PossumStates = make(map[string]string)
+	}
+	for service, states := range cache.states {
+		if service == "" {
+			continue
+		}
+		if file.ServiceStates == nil {
+			file.ServiceStates = make(map[string]map[string]string)
+			file.ServiceReadAts = make(map[string]map[string]time.Time)
+		}
+		file.ServiceStates[service] = states
+		file.ServiceReadAts[service] = cache.readAts[service]
+	}
+	data, _ := json.Marshal(file)
+	// write then rename, so a crash never leaves half a cache behind
+	tmp, err := ioutil.TempFile(filepath.Dir(cache.path), ".possum-state-cache")
+	if err == nil {
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), cache.path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"package": "webServer", "function": "update", "path": cache.path}).Warnf("Can't write state cache: %s", err)
+	}
+}
+
+// lookup - returns the cached states of the passel, or of a service of each possum when
+// service is not empty, and when the oldest of them was read, if every possum is cached
+// and read within the staleness budget
+func (cache *StateCache) lookup(service string, passel []string, reader string, now time.Time) (map[string]string, time.Time, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	maxAge := stateCacheMaxAge()
+	states := make(map[string]string)
+	var oldest time.Time
+	for _, possum := range passel {
+		state, found := cache.states[service][possum]
+		readAt := cache.readAts[service][possum]
+		if !found || readAt.IsZero() || now.Sub(readAt) > maxAge {
+			return nil, time.Time{}, false
+		}
+		if oldest.IsZero() || readAt.Before(oldest) {
+			oldest = readAt
+		}
+		states[possum] = state
+	}
+	if oldest.IsZero() {
+		return nil, time.Time{}, false
+	}
+	cache.served[reader]++
+	return states, oldest, true
+}
+
+// setStaleWarning - marks a response as served from the cache
+func setStaleWarning(w http.ResponseWriter) {
+	w.Header().Set("Warning", `110 possum "Response is Stale"`)
+}
+
+// readPasselState - reads the state of the passel from the database, falling
+// back to the cache if the database cannot be read. cachedAt is zero unless
+// the states came from the cache.
+func (c *Controller) readPasselState(passel []string, reader string) (map[string]string, time.Time, error) {
+	span := c.storeSpan("GetPasselState")
+	states, err := utils.GetPasselState(c.DB, passel)
+	endStoreSpan(span, err)
+	return c.cachedRead("", passel, reader, states, err)
+}
+
+// readPasselServiceState - reads the state of a service of every possum in the passel,
+// falling back to the cache like readPasselState
+func (c *Controller) readPasselServiceState(passel []string, service string, reader string) (map[string]string, time.Time, error) {
+	span := c.storeSpan("GetPasselServiceState")
+	states, err := utils.GetPasselServiceState(c.DB, passel, service)
+	endStoreSpan(span, err)
+	return c.cachedRead(service, passel, reader, states, err)
+}
+
+// mysqlConnectivityErrors - server errors that mean the database can't take queries,
+// rather than that the query was wrong
+var mysqlConnectivityErrors = map[uint16]bool{
+	1040: true, // ER_CON_COUNT_ERROR, too many connections
+	1053: true, // ER_SERVER_SHUTDOWN
+	1203: true, // ER_TOO_MANY_USER_CONNECTIONS
+	1927: true, // ER_CONNECTION_KILLED
+}
+
+// isConnectivityError - true if err means the database could not be reached, the only
+// errors the cache answers for; any other error would be returned again by the database
+func isConnectivityError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) {
+		return true
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlConnectivityErrors[mysqlErr.Number]
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// cachedRead - caches states read from the database, or answers from the cache if the
+// database could not be reached; any other err is returned unchanged
+func (c *Controller) cachedRead(service string, passel []string, reader string, states map[string]string, err error) (map[string]string, time.Time, error) {
+	if c.StateCache == nil {
+		return states, time.Time{}, err
+	}
+	now := time.Now().UTC()
+	if err == nil {
+		c.StateCache.update(service, states, now)
+		return states, time.Time{}, nil
+	}
+	if !isConnectivityError(err) {
+		return nil, time.Time{}, err
+	}
+	cached, cachedAt, found := c.StateCache.lookup(service, passel, reader, now)
+	if !found {
+		return nil, time.Time{}, err
+	}
+	log.WithFields(log.Fields{"package": "webServer", "function": "cachedRead", "reader": reader, "service": service, "cached_at": cachedAt}).Warnf("Serving cached state, can't read the database: %s", err)
+	return cached, cachedAt, nil
+}
+
+// readState - reads the state of a possum, falling back to the cache like readPasselState
+func (c *Controller) readState(possum string, reader string) (string, time.Time, error) {
+	states, cachedAt, err := c.readPasselState([]string{possum}, reader)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return states[possum], cachedAt, nil
+}
+
+// readServiceState - reads the state of a service of a possum, falling back to the cache like readPasselState
+func (c *Controller) readServiceState(possum string, service string, reader string) (string, time.Time, error) {
+	span := c.storeSpan("GetServiceState")
+	state, err := utils.GetServiceState(c.DB, possum, service)
+	endStoreSpan(span, err)
+	states, cachedAt, err := c.cachedRead(service, []string{possum}, reader, map[string]string{possum: state}, err)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return states[possum], cachedAt, nil
+}
+
+// CachedPasselState - reads the state of the passel for the DNS server, falling back to the cache
+func (c *Controller) CachedPasselState(passel []string) (map[string]string, error) {
+	states, _, err := c.readPasselState(passel, readerDNS)
+	return states, err
+}
+
+// metrics - the reads served from the cache by reader, and the age of the cache
+func (cache *StateCache) metrics(now time.Time) (map[string]int, float64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	served := make(map[string]int, len(cache.served))
+	for reader, count := range cache.served {
+		served[reader] = count
+	}
+	if cache.readAt.IsZero() {
+		return served, 0
+	}
+	return served, now.Sub(cache.readAt).Seconds()
+}
@@ -2,19 +2,33 @@ package webServer_test
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/FidelityInternational/possum/tracing"
+	"github.com/FidelityInternational/possum/utils"
 	webs "github.com/FidelityInternational/possum/web_server"
 	"github.com/gorilla/mux"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	log "github.com/sirupsen/logrus"
 )
 
 var (
@@ -22,6 +36,40 @@ var (
 	fakeServer2 *httptest.Server
 )
 
+// errConnectionRefused - a database that cannot be reached, the only read error the state cache answers for
+var errConnectionRefused = &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}
+
+// withRequestID - adds the request ID a response was given to the error body expected of it
+func withRequestID(recorder *httptest.ResponseRecorder, body string) string {
+	codeField := regexp.MustCompile(`"code":"[A-Z_]+"`)
+	location := codeField.FindStringIndex(body)
+	return body[:location[1]] + fmt.Sprintf(`,"request_id":"%s"`, recorder.Header().Get("X-Request-ID")) + body[location[1]:]
+}
+
+// unreachableMembership - the membership section of a consistency check whose possums do not serve /v1/members
+func unreachableMembership(possums ...string) string {
+	sorted, _ := json.Marshal(sortedStrings(possums))
+	return fmt.Sprintf(`"membership":{"consistent":false,"members":%s,"self_in_passel":false,"passel_members":{},"unreachable":%s}`, sorted, sorted)
+}
+
+func sortedStrings(values []string) []string {
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+type recordingExporter struct {
+	mutex sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (e *recordingExporter) Export(spans []tracing.SpanData) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
 func Router(controller *webs.Controller) *mux.Router {
 	server := &webs.Server{Controller: controller}
 	r := server.Start()
@@ -39,27 +87,43 @@ func mockFailedStateDBConn(driverName string, connectionString string) (*sql.DB,
 		fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
 		os.Exit(1)
 	}
+	mock.ExpectQuery("SELECT GET_LOCK").WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_version").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COALESCE").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(0))
 	mock.ExpectExec("CREATE TABLE IF NOT EXISTS state.").WillReturnError(fmt.Errorf("An error has occurred: %s", "Database Create Error"))
+	mock.ExpectQuery("SELECT RELEASE_LOCK").WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
 	return db, err
 }
 
+func expectMigrations(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT GET_LOCK").WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_version").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COALESCE").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(0))
+	for _, migration := range utils.Migrations {
+		for _, statement := range migration.Statements {
+			if statement.Applied != "" {
+				mock.ExpectQuery("information_schema").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			}
+			mock.ExpectExec(".*").WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectExec("INSERT INTO schema_version").WithArgs(migration.Version, migration.Description, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectQuery("SELECT RELEASE_LOCK").WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+}
+
 func mockDBConn(driverName string, connectionString string) (*sql.DB, error) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		fmt.Printf("\nan error '%s' was not expected when opening a stub database connection\n", err)
 		os.Exit(1)
 	}
-	mRows := sqlmock.NewRows([]string{"possum", "state"}).
-		AddRow("mother", "alive")
-	fRows := sqlmock.NewRows([]string{"possum", "state"}).
-		AddRow("father", "alive")
-	jRows := sqlmock.NewRows([]string{"possum", "state"}).
-		AddRow("joey", "alive")
-
-	mock.ExpectExec("CREATE TABLE IF NOT EXISTS state.*").WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WillReturnRows(mRows)
-	mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WillReturnRows(fRows)
-	mock.ExpectQuery("SELECT (.+) FROM state WHERE possum=").WillReturnRows(jRows)
+	rows := sqlmock.NewRows([]string{"possum", "state", "version", "updated_at", "updated_by"}).
+		AddRow("mother", "alive", 0, nil, "").
+		AddRow("father", "alive", 0, nil, "").
+		AddRow("joey", "alive", 0, nil, "")
+
+	expectMigrations(mock)
+	mock.ExpectPrepare("SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnRows(rows)
 	return db, err
 }
 
@@ -130,19 +194,69 @@ var _ = Describe("Server", func() {
 			})
 
 			Context("and fetching the connection string does not raise an error", func() {
-				Context("and SetupStateDB does not raise an error", func() {
+				Context("and migrating and SetupStateDB do not raise an error", func() {
 					It("creates a Server object", func() {
 						server, err := webs.CreateServer(mockDBConn, mockCreateController)
 						Ω(err).Should(BeNil())
 						Ω(server).To(BeAssignableToTypeOf(&webs.Server{}))
 					})
 				})
-				Context("and SetupStateDB raises an error", func() {
+				Context("and migrating raises an error", func() {
 					It("returns an error", func() {
 						_, err := webs.CreateServer(mockFailedStateDBConn, mockCreateController)
 						Ω(err).Should(MatchError("An error has occurred: Database Create Error"))
 					})
 				})
+				for _, env := range []string{"PASSEL_CONFIG_FILE", "PASSEL_DISCOVERY"} {
+					env := env
+					Context(fmt.Sprintf("and %s will set the passel", env), func() {
+						BeforeEach(func() {
+							os.Setenv(env, "set")
+						})
+
+						AfterEach(func() {
+							os.Unsetenv(env)
+						})
+
+						It("does not insert the possums of the possum service", func() {
+							migratedDBConn := func(driverName string, connectionString string) (*sql.DB, error) {
+								db, mock, err := sqlmock.New()
+								expectMigrations(mock)
+								return db, err
+							}
+							server, err := webs.CreateServer(migratedDBConn, mockCreateController)
+							Ω(err).Should(BeNil())
+							Ω(server).To(BeAssignableToTypeOf(&webs.Server{}))
+						})
+					})
+				}
+
+				Context("and approval is required", func() {
+					BeforeEach(func() {
+						os.Setenv("REQUIRE_APPROVAL", "true")
+					})
+
+					AfterEach(func() {
+						os.Unsetenv("REQUIRE_APPROVAL")
+					})
+
+					It("refuses to start without a peer secret", func() {
+						_, err := webs.CreateServer(mockDBConn, mockCreateController)
+						Ω(err).Should(MatchError("REQUIRE_APPROVAL needs a peer_secret to sign the writes possums make to each other"))
+					})
+
+					Context("and a peer secret", func() {
+						BeforeEach(func() {
+							vcapServicesJSON = strings.Replace(vcapServicesJSON, `"passel": [`, `"peer_secret": "peer-secret", "passel": [`, 1)
+						})
+
+						It("creates a Server object", func() {
+							server, err := webs.CreateServer(mockDBConn, mockCreateController)
+							Ω(err).Should(BeNil())
+							Ω(server).To(BeAssignableToTypeOf(&webs.Server{}))
+						})
+					})
+				})
 			})
 
 			Context("When possum-db service is not set", func() {
@@ -215,7 +329,7 @@ var _ = Describe("Controller", func() {
 		Context("when getting application uris raises an error", func() {
 			It("returns an error 500", func() {
 				Ω(mockRecorder.Code).Should(Equal(500))
-				Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "unexpected end of JSON input"}`))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"unexpected end of JSON input","code":"CONFIG_ERROR"}`)))
 			})
 		})
 
@@ -231,7 +345,7 @@ var _ = Describe("Controller", func() {
 
 				It("returns an error", func() {
 					Ω(mockRecorder.Code).Should(Equal(410))
-					Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "No uris were configured"}`))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"No uris were configured","code":"NO_URIS_CONFIGURED"}`)))
 				})
 			})
 
@@ -250,7 +364,7 @@ var _ = Describe("Controller", func() {
 
 					It("returns an error 500", func() {
 						Ω(mockRecorder.Code).Should(Equal(500))
-						Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "no service with name possum"}`))
+						Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"no service with name possum","code":"CONFIG_ERROR"}`)))
 					})
 				})
 
@@ -282,7 +396,7 @@ var _ = Describe("Controller", func() {
 
 						It("returns an error", func() {
 							Ω(mockRecorder.Code).Should(Equal(410))
-							Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "Passel had 0 members"}`))
+							Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Passel had 0 members","code":"PASSEL_EMPTY"}`)))
 						})
 					})
 
@@ -318,7 +432,7 @@ var _ = Describe("Controller", func() {
 
 							It("returns an error", func() {
 								Ω(mockRecorder.Code).Should(Equal(410))
-								Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "Could not match any possum in db"}`))
+								Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Could not match any possum in db","code":"POSSUM_NOT_MATCHED"}`)))
 							})
 
 							Context("and there is a matching possum and application_uri", func() {
@@ -354,26 +468,26 @@ var _ = Describe("Controller", func() {
 									BeforeEach(func() {
 										rows := sqlmock.NewRows([]string{"possum", "state"})
 
-										mock.ExpectQuery("^SELECT (.+) FROM state WHERE possum=").WillReturnRows(rows)
+										mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnRows(rows)
 									})
 
 									It("returns an error", func() {
 										Ω(mockRecorder.Code).Should(Equal(500))
-										Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "Could not find possum https://possum.example1.domain.com in db"}`))
+										Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Could not find possum https://possum.example1.domain.com in db","code":"DATABASE_ERROR"}`)))
 									})
 								})
 
 								Context("and state can be found in db", func() {
 									BeforeEach(func() {
 										rows := sqlmock.NewRows([]string{"possum", "state"}).
-											AddRow("possum.example1.domain.com", "alive")
+											AddRow("https://possum.example1.domain.com", "alive")
 
-										mock.ExpectQuery("^SELECT (.+) FROM state WHERE possum=").WillReturnRows(rows)
+										mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnRows(rows)
 									})
 
 									It("returns the state", func() {
 										Ω(mockRecorder.Code).Should(Equal(200))
-										Ω(mockRecorder.Body.String()).Should(Equal(`{"state": "alive"}`))
+										Ω(mockRecorder.Body.String()).Should(Equal(`{"state":"alive"}`))
 										Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
 										Ω(mockRecorder.Header().Get("Access-Control-Allow-Origin")).Should(Equal("*"))
 									})
@@ -411,7 +525,7 @@ var _ = Describe("Controller", func() {
 
 			It("returns an error 500", func() {
 				Ω(mockRecorder.Code).Should(Equal(500))
-				Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "no service with name possum"}`))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"no service with name possum","code":"CONFIG_ERROR"}`)))
 			})
 		})
 
@@ -436,8 +550,8 @@ var _ = Describe("Controller", func() {
 				})
 
 				It("returns an error", func() {
-					Ω(mockRecorder.Code).Should(Equal(500))
-					Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "Passel had 0 members"}`))
+					Ω(mockRecorder.Code).Should(Equal(410))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Passel had 0 members","code":"PASSEL_EMPTY"}`)))
 				})
 			})
 
@@ -468,34 +582,28 @@ var _ = Describe("Controller", func() {
 					BeforeEach(func() {
 						mRows := sqlmock.NewRows([]string{"possum", "state"})
 
-						mock.ExpectQuery("^SELECT (.+) FROM state WHERE possum=").WithArgs("mother").WillReturnRows(mRows)
+						mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WithArgs("mother", "father", "joey").WillReturnRows(mRows)
 					})
 
 					It("returns an error", func() {
 						Ω(mockRecorder.Code).Should(Equal(500))
-						Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "Could not find possum mother in db"}`))
+						Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Could not find possum mother in db","code":"DATABASE_ERROR"}`)))
 					})
 				})
 
 				Context("and the states can be fetched from the db", func() {
 					BeforeEach(func() {
-						mRows := sqlmock.NewRows([]string{"possum", "state"}).
-							AddRow("mother", "alive")
-
-						fRows := sqlmock.NewRows([]string{"possum", "state"}).
-							AddRow("father", "alive")
-
-						jRows := sqlmock.NewRows([]string{"possum", "state"}).
+						rows := sqlmock.NewRows([]string{"possum", "state"}).
+							AddRow("mother", "alive").
+							AddRow("father", "alive").
 							AddRow("joey", "dead")
 
-						mock.ExpectQuery("^SELECT (.+) FROM state WHERE possum=").WithArgs("mother").WillReturnRows(mRows)
-						mock.ExpectQuery("^SELECT (.+) FROM state WHERE possum=").WithArgs("father").WillReturnRows(fRows)
-						mock.ExpectQuery("^SELECT (.+) FROM state WHERE possum=").WithArgs("joey").WillReturnRows(jRows)
+						mock.ExpectPrepare(`^SELECT possum, state FROM state WHERE possum IN \(\?, \?, \?\)$`).ExpectQuery().WithArgs("mother", "father", "joey").WillReturnRows(rows)
 					})
 
 					It("returns the state", func() {
 						Ω(mockRecorder.Code).Should(Equal(200))
-						Ω(mockRecorder.Body.String()).Should(Equal(`{"possum_states": {"father":"alive","joey":"dead","mother":"alive"}}`))
+						Ω(mockRecorder.Body.String()).Should(Equal(`{"possum_states":{"father":"alive","joey":"dead","mother":"alive"}}`))
 						Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
 						Ω(mockRecorder.Header().Get("Access-Control-Allow-Origin")).Should(Equal("*"))
 					})
@@ -529,7 +637,7 @@ var _ = Describe("Controller", func() {
 
 			It("returns an error 500", func() {
 				Ω(mockRecorder.Code).Should(Equal(500))
-				Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "no service with name possum"}`))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"no service with name possum","code":"CONFIG_ERROR"}`)))
 			})
 		})
 
@@ -554,8 +662,8 @@ var _ = Describe("Controller", func() {
 				})
 
 				It("returns an error", func() {
-					Ω(mockRecorder.Code).Should(Equal(500))
-					Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "Passel had 0 members"}`))
+					Ω(mockRecorder.Code).Should(Equal(410))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Passel had 0 members","code":"PASSEL_EMPTY"}`)))
 				})
 			})
 
@@ -591,8 +699,8 @@ var _ = Describe("Controller", func() {
 						})
 
 						It("returns an error", func() {
-							Ω(mockRecorder.Code).Should(Equal(500))
-							Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "I am an error"}`))
+							Ω(mockRecorder.Code).Should(Equal(502))
+							Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"I am an error","code":"PEER_ERROR"}`)))
 						})
 					})
 				})
@@ -627,8 +735,8 @@ var _ = Describe("Controller", func() {
 					})
 
 					It("returns an error", func() {
-						Ω(mockRecorder.Code).Should(Equal(500))
-						Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "unexpected end of JSON input"}`))
+						Ω(mockRecorder.Code).Should(Equal(502))
+						Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"unexpected end of JSON input","code":"PEER_INVALID_RESPONSE"}`)))
 					})
 				})
 
@@ -654,12 +762,42 @@ var _ = Describe("Controller", func() {
 					})
 
 					It("returns an error", func() {
-						Ω(mockRecorder.Code).Should(Equal(500))
-						Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "Get joey/v1/passel_state: unsupported protocol scheme """}`))
+						Ω(mockRecorder.Code).Should(Equal(502))
+						Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"PEER_UNREACHABLE"`))
+						Ω(mockRecorder.Body.String()).Should(ContainSubstring("unsupported protocol scheme"))
 					})
 				})
 			})
 
+			Context("and one possum of three does not answer", func() {
+				const down = "http://127.0.0.1:1"
+
+				BeforeEach(func() {
+					fakeServer1 = setup(MockRoute{"GET", "/v1/passel_state", `{"possum_states": {"father":"alive","joey":"dead","mother":"alive"}}`, "", 0})
+					fakeServer2 = setup(MockRoute{"GET", "/v1/passel_state", `{"possum_states": {"father":"alive","joey":"dead","mother":"alive"}}`, "", 0})
+					os.Setenv("VCAP_APPLICATION", "{}")
+					os.Setenv("VCAP_SERVICES", fmt.Sprintf(`{"user-provided": [{"credentials": {"passel": ["%s", "%s", "%s"]}, "label": "user-provided", "name": "possum"}]}`, fakeServer1.URL, fakeServer2.URL, down))
+					mock.ExpectPrepare("SELECT possum, state FROM state WHERE possum NOT IN").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}))
+				})
+
+				AfterEach(func() {
+					teardown(fakeServer1)
+					teardown(fakeServer2)
+				})
+
+				It("returns the states of the possums that answered and the possums that did not", func() {
+					Ω(mockRecorder.Code).Should(Equal(409))
+					var response webs.PasselStatesResponse
+					Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &response)).Should(Succeed())
+					Ω(response.Consistent).Should(BeFalse())
+					Ω(response.Code).Should(Equal(webs.CodeStateInconsistent))
+					Ω(response.Error).Should(Equal(fmt.Sprintf("Possums %s did not answer", down)))
+					Ω(response.Passel).Should(Equal([]string{fakeServer1.URL, fakeServer2.URL}))
+					Ω(response.Missed).Should(Equal([]string{down}))
+					Ω(response.PasselStates).Should(HaveLen(2))
+				})
+			})
+
 			Context("and getting passel states can be fetched from all possums", func() {
 				Context("and state is inconsistent", func() {
 					BeforeEach(func() {
@@ -683,6 +821,7 @@ var _ = Describe("Controller", func() {
 }`, fakeServer1.URL, fakeServer2.URL)
 						os.Setenv("VCAP_APPLICATION", "{}")
 						os.Setenv("VCAP_SERVICES", vcapServicesJSON)
+						mock.ExpectPrepare("SELECT possum, state FROM state WHERE possum NOT IN").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}))
 					})
 
 					AfterEach(func() {
@@ -691,8 +830,8 @@ var _ = Describe("Controller", func() {
 					})
 
 					It("returns an error and useful messages", func() {
-						Ω(mockRecorder.Code).Should(Equal(500))
-						Ω(mockRecorder.Body.String()).Should(Equal(`{"consistent": false, "error": "State was inconsistent", "passel_states": [{"father":"alive","joey":"dead","mother":"alive"},{"father":"dead","joey":"dead","mother":"alive"}]}`))
+						Ω(mockRecorder.Code).Should(Equal(409))
+						Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, fmt.Sprintf(`{"consistent":false,"error":"State was inconsistent","code":"STATE_INCONSISTENT","passel":["%s","%s"],"passel_states":[{"father":"alive","joey":"dead","mother":"alive"},{"father":"dead","joey":"dead","mother":"alive"}],%s}`, fakeServer1.URL, fakeServer2.URL, unreachableMembership(fakeServer1.URL, fakeServer2.URL)))))
 					})
 				})
 
@@ -718,6 +857,7 @@ var _ = Describe("Controller", func() {
 }`, fakeServer1.URL, fakeServer2.URL)
 						os.Setenv("VCAP_APPLICATION", "{}")
 						os.Setenv("VCAP_SERVICES", vcapServicesJSON)
+						mock.ExpectPrepare("SELECT possum, state FROM state WHERE possum NOT IN").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}))
 					})
 
 					AfterEach(func() {
@@ -727,7 +867,7 @@ var _ = Describe("Controller", func() {
 
 					It("returns consistent true", func() {
 						Ω(mockRecorder.Code).Should(Equal(200))
-						Ω(mockRecorder.Body.String()).Should(Equal(`{"consistent": true, "passel_states": [{"father":"alive","joey":"dead","mother":"alive"},{"father":"alive","joey":"dead","mother":"alive"}]}`))
+						Ω(mockRecorder.Body.String()).Should(Equal(fmt.Sprintf(`{"consistent":true,"passel":["%s","%s"],"passel_states":[{"father":"alive","joey":"dead","mother":"alive"},{"father":"alive","joey":"dead","mother":"alive"}],%s}`, fakeServer1.URL, fakeServer2.URL, unreachableMembership(fakeServer1.URL, fakeServer2.URL))))
 						Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
 						Ω(mockRecorder.Header().Get("Access-Control-Allow-Origin")).Should(Equal("*"))
 					})
@@ -773,7 +913,9 @@ var _ = Describe("Controller", func() {
 
 				It("return an authentication error", func() {
 					Ω(mockRecorder.Code).Should(Equal(401))
-					Ω(mockRecorder.Body.String()).Should(Equal(`401 Unauthorized`))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Unauthorized","code":"UNAUTHORIZED"}`)))
+					Ω(mockRecorder.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="possum"`))
+					Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
 				})
 			})
 
@@ -805,7 +947,9 @@ var _ = Describe("Controller", func() {
 
 				It("return an authentication error", func() {
 					Ω(mockRecorder.Code).Should(Equal(401))
-					Ω(mockRecorder.Body.String()).Should(Equal(`401 Unauthorized`))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Unauthorized","code":"UNAUTHORIZED"}`)))
+					Ω(mockRecorder.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="possum"`))
+					Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
 				})
 			})
 
@@ -838,7 +982,9 @@ var _ = Describe("Controller", func() {
 
 				It("return an authentication error", func() {
 					Ω(mockRecorder.Code).Should(Equal(401))
-					Ω(mockRecorder.Body.String()).Should(Equal(`401 Unauthorized`))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Unauthorized","code":"UNAUTHORIZED"}`)))
+					Ω(mockRecorder.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="possum"`))
+					Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
 				})
 			})
 
@@ -871,7 +1017,9 @@ var _ = Describe("Controller", func() {
 
 				It("return an authentication error", func() {
 					Ω(mockRecorder.Code).Should(Equal(401))
-					Ω(mockRecorder.Body.String()).Should(Equal(`401 Unauthorized`))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Unauthorized","code":"UNAUTHORIZED"}`)))
+					Ω(mockRecorder.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="possum"`))
+					Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
 				})
 			})
 
@@ -904,7 +1052,9 @@ var _ = Describe("Controller", func() {
 
 				It("return an authentication error", func() {
 					Ω(mockRecorder.Code).Should(Equal(401))
-					Ω(mockRecorder.Body.String()).Should(Equal(`401 Unauthorized`))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Unauthorized","code":"UNAUTHORIZED"}`)))
+					Ω(mockRecorder.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="possum"`))
+					Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
 				})
 			})
 
@@ -937,7 +1087,9 @@ var _ = Describe("Controller", func() {
 
 				It("return an authentication error", func() {
 					Ω(mockRecorder.Code).Should(Equal(401))
-					Ω(mockRecorder.Body.String()).Should(Equal(`401 Unauthorized`))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Unauthorized","code":"UNAUTHORIZED"}`)))
+					Ω(mockRecorder.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="possum"`))
+					Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
 				})
 			})
 		})
@@ -979,7 +1131,7 @@ var _ = Describe("Controller", func() {
 
 					It("returns an error", func() {
 						Ω(mockRecorder.Code).Should(Equal(410))
-						Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "No uris were configured"}`))
+						Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"No uris were configured","code":"NO_URIS_CONFIGURED"}`)))
 					})
 				})
 
@@ -1015,7 +1167,7 @@ var _ = Describe("Controller", func() {
 
 						It("returns an error 500", func() {
 							Ω(mockRecorder.Code).Should(Equal(500))
-							Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "possum was not a string"}`))
+							Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"possum was not a string","code":"CONFIG_ERROR"}`)))
 						})
 					})
 
@@ -1049,7 +1201,7 @@ var _ = Describe("Controller", func() {
 
 							It("returns an error", func() {
 								Ω(mockRecorder.Code).Should(Equal(410))
-								Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "Passel had 0 members"}`))
+								Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Passel had 0 members","code":"PASSEL_EMPTY"}`)))
 							})
 						})
 
@@ -1087,29 +1239,26 @@ var _ = Describe("Controller", func() {
 
 								It("returns an error", func() {
 									Ω(mockRecorder.Code).Should(Equal(410))
-									Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "Could not match any possum in db"}`))
+									Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Could not match any possum in db","code":"POSSUM_NOT_MATCHED"}`)))
 								})
 
 								Context("and there is a matching possum and application_uri", func() {
-									Context("and passel state cannot be fetched", func() {
-										BeforeEach(func() {
-											fakeServer1 = setup(MockRoute{"GET", "/v1/passel_state", `{"error": "This is an error"}`, "", 0})
-											requestBody = bytes.NewReader([]byte(`{}`))
-											applicationURISplit := strings.Split(fakeServer1.URL, "http://")
-											applicationURI := applicationURISplit[1]
-											vcapApplicationJSON := fmt.Sprintf(`{
+									BeforeEach(func() {
+										vcapApplicationJSON := `{
   "application_uris": [
-    "%s"
+    "joey.example.com"
   ]
-}`, applicationURI)
-											vcapServicesJSON := fmt.Sprintf(`{
+}`
+										vcapServicesJSON := `{
 "user-provided": [
  {
   "credentials": {
     "username": "admin",
     "password": "admin",
     "passel": [
-      "%s"
+      "http://joey.example.com",
+      "father",
+      "mother"
     ]
   },
   "label": "user-provided",
@@ -1118,376 +1267,231 @@ var _ = Describe("Controller", func() {
   "tags": []
  }
 ]
-}`, fakeServer1.URL)
-											os.Setenv("VCAP_APPLICATION", vcapApplicationJSON)
-											os.Setenv("VCAP_SERVICES", vcapServicesJSON)
+}`
+										os.Setenv("VCAP_APPLICATION", vcapApplicationJSON)
+										os.Setenv("VCAP_SERVICES", vcapServicesJSON)
+										requestBody = bytes.NewReader([]byte(`{"father":"dead"}`))
+									})
+
+									lockedRows := func() *sqlmock.Rows {
+										return sqlmock.NewRows([]string{"possum", "state"}).
+											AddRow("father", "alive").
+											AddRow("http://joey.example.com", "alive").
+											AddRow("mother", "dead")
+									}
+
+									expectCommittedStates := func(father string) {
+										mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WithArgs("http://joey.example.com", "father", "mother").
+											WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow("http://joey.example.com", "alive").AddRow("father", father).AddRow("mother", "dead"))
+									}
+
+									Context("and getting desired state raises an error", func() {
+										BeforeEach(func() {
+											requestBody = bytes.NewReader([]byte(`{[notjson}`))
 										})
 
-										AfterEach(func() {
-											teardown(fakeServer1)
+										It("returns an error", func() {
+											Ω(mockRecorder.Code).Should(Equal(400))
+											Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"invalid character '[' looking for beginning of object key string","code":"INVALID_REQUEST"}`)))
+										})
+									})
+
+									Context("and the desired possum is not in the passel", func() {
+										BeforeEach(func() {
+											requestBody = bytes.NewReader([]byte(`{"doesnotexist":"dead"}`))
+										})
+
+										It("returns an error", func() {
+											Ω(mockRecorder.Code).Should(Equal(400))
+											Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Possum doesnotexist is not part of my passel","code":"POSSUM_NOT_IN_PASSEL"}`)))
+										})
+									})
+
+									Context("and the passel state cannot be locked", func() {
+										BeforeEach(func() {
+											mock.ExpectBegin()
+											mock.ExpectQuery(`^SELECT possum, state FROM state WHERE possum IN \(\?, \?, \?\) ORDER BY possum FOR UPDATE$`).
+												WithArgs("father", "http://joey.example.com", "mother").
+												WillReturnError(fmt.Errorf("An error has occurred: %s", "SELECT error"))
+											mock.ExpectRollback()
 										})
 
 										It("returns an error", func() {
 											Ω(mockRecorder.Code).Should(Equal(500))
-											Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "This is an error"}`))
+											Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"An error has occurred: SELECT error","code":"DATABASE_ERROR"}`)))
+											Ω(mock.ExpectationsWereMet()).Should(Succeed())
 										})
 									})
 
-									Context("and passel state can be fetched", func() {
-										Context("and getting desired state raises an error", func() {
-											BeforeEach(func() {
-												fakeServer1 = setupMultiple([]MockRoute{
-													{"GET", "/v1/passel_state", `{"possum_states": {"father":"alive","joey":"dead","mother":"alive"}}`, "", 0},
-												})
-												applicationURISplit := strings.Split(fakeServer1.URL, "http://")
-												applicationURI := applicationURISplit[1]
-												vcapApplicationJSON := fmt.Sprintf(`{
-  "application_uris": [
-    "%s"
-  ]
-}`, applicationURI)
-												vcapServicesJSON := fmt.Sprintf(`{
-"user-provided": [
- {
-  "credentials": {
-    "username": "admin",
-    "password": "admin",
-    "passel": [
-      "%s"
-    ]
-  },
-  "label": "user-provided",
-  "name": "possum",
-  "syslog_drain_url": "",
-  "tags": []
- }
-]
-}`, fakeServer1.URL)
-												os.Setenv("VCAP_APPLICATION", vcapApplicationJSON)
-												os.Setenv("VCAP_SERVICES", vcapServicesJSON)
-												requestBody = bytes.NewReader([]byte(`{[notjson}`))
-											})
+									Context("and a possum of the passel is not in the db", func() {
+										BeforeEach(func() {
+											mock.ExpectBegin()
+											mock.ExpectQuery("^SELECT possum, state FROM state WHERE possum IN").
+												WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow("father", "alive").AddRow("http://joey.example.com", "alive"))
+											mock.ExpectRollback()
+										})
+
+										It("returns an error", func() {
+											Ω(mockRecorder.Code).Should(Equal(500))
+											Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Could not find possum mother in db","code":"DATABASE_ERROR"}`)))
+											Ω(mock.ExpectationsWereMet()).Should(Succeed())
+										})
+									})
+
+									Context("and the desired state would kill all possums", func() {
+										BeforeEach(func() {
+											requestBody = bytes.NewReader([]byte(`{"father":"dead","http://joey.example.com":"dead"}`))
+											mock.ExpectBegin()
+											mock.ExpectQuery("^SELECT possum, state FROM state WHERE possum IN").WillReturnRows(lockedRows())
+											mock.ExpectRollback()
+										})
+
+										It("returns an error without writing anything", func() {
+											Ω(mockRecorder.Code).Should(Equal(409))
+											Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Would have killed all possums","code":"WOULD_KILL_ALL"}`)))
+											Ω(mock.ExpectationsWereMet()).Should(Succeed())
+										})
+									})
+
+									Context("and the states cannot be written to the db", func() {
+										BeforeEach(func() {
+											mock.ExpectBegin()
+											mock.ExpectQuery("^SELECT possum, state FROM state WHERE possum IN").WillReturnRows(lockedRows())
+											mock.ExpectExec("UPDATE state.*").WithArgs("dead", sqlmock.AnyArg(), "admin", "father").WillReturnError(fmt.Errorf("An error has occurred: %s", "UPDATE error"))
+											mock.ExpectRollback()
+										})
+
+										It("rolls back and returns an error", func() {
+											Ω(mockRecorder.Code).Should(Equal(500))
+											Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"An error has occurred: UPDATE error","code":"DATABASE_ERROR"}`)))
+											Ω(mock.ExpectationsWereMet()).Should(Succeed())
+										})
+									})
+
+									Context("and the state change cannot be recorded", func() {
+										BeforeEach(func() {
+											mock.ExpectBegin()
+											mock.ExpectQuery("^SELECT possum, state FROM state WHERE possum IN").WillReturnRows(lockedRows())
+											mock.ExpectExec("UPDATE state.*").WithArgs("dead", sqlmock.AnyArg(), "admin", "father").WillReturnResult(sqlmock.NewResult(1, 1))
+											mock.ExpectExec("INSERT INTO state_history.*").WillReturnError(fmt.Errorf("An error has occurred: %s", "INSERT error"))
+											mock.ExpectRollback()
+										})
+
+										It("rolls back the state change and returns an error", func() {
+											Ω(mockRecorder.Code).Should(Equal(500))
+											Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"An error has occurred: INSERT error","code":"DATABASE_ERROR"}`)))
+											Ω(mock.ExpectationsWereMet()).Should(Succeed())
+										})
+									})
+
+									Context("and the states can be written to the db", func() {
+										BeforeEach(func() {
+											mock.ExpectBegin()
+											mock.ExpectQuery("^SELECT possum, state FROM state WHERE possum IN").WillReturnRows(lockedRows())
+											mock.ExpectExec("UPDATE state.*").WithArgs("dead", sqlmock.AnyArg(), "admin", "father").WillReturnResult(sqlmock.NewResult(1, 1))
+											mock.ExpectExec("INSERT INTO state_history.*").WithArgs("father", "dead", sqlmock.AnyArg(), "admin", false, "").WillReturnResult(sqlmock.NewResult(1, 1))
+										})
 
-											AfterEach(func() {
-												teardown(fakeServer1)
+										Context("and the transaction cannot be committed", func() {
+											BeforeEach(func() {
+												mock.ExpectCommit().WillReturnError(fmt.Errorf("An error has occurred: %s", "COMMIT error"))
 											})
 
 											It("returns an error", func() {
 												Ω(mockRecorder.Code).Should(Equal(500))
-												Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "invalid character '[' looking for beginning of object key string"}`))
+												Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"An error has occurred: COMMIT error","code":"DATABASE_ERROR"}`)))
 											})
 										})
 
-										Context("and getting desired state is successful", func() {
-											Context("and the desired state would kill all possums", func() {
-												BeforeEach(func() {
-													fakeServer1 = setupMultiple([]MockRoute{
-														{"GET", "/v1/passel_state", `{"possum_states": {}}`, "", 0},
-													})
-													requestBody = bytes.NewReader([]byte(fmt.Sprintf(`{"%s":"dead"}`, fakeServer1.URL)))
-													applicationURISplit := strings.Split(fakeServer1.URL, "http://")
-													applicationURI := applicationURISplit[1]
-													vcapApplicationJSON := fmt.Sprintf(`{
-  "application_uris": [
-    "%s"
-  ]
-}`, applicationURI)
-													vcapServicesJSON := fmt.Sprintf(`{
-"user-provided": [
- {
-  "credentials": {
-    "username": "admin",
-    "password": "admin",
-    "passel": [
-      "%s"
-    ]
-  },
-  "label": "user-provided",
-  "name": "possum",
-  "syslog_drain_url": "",
-  "tags": []
- }
-]
-}`, fakeServer1.URL)
-													os.Setenv("VCAP_APPLICATION", vcapApplicationJSON)
-													os.Setenv("VCAP_SERVICES", vcapServicesJSON)
-												})
+										Context("and the transaction is committed", func() {
+											BeforeEach(func() {
+												mock.ExpectCommit()
+											})
 
-												AfterEach(func() {
-													teardown(fakeServer1)
+											Context("and the committed states cannot be read", func() {
+												BeforeEach(func() {
+													mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnError(fmt.Errorf("An error has occurred: %s", "SELECT error"))
 												})
 
 												It("returns an error", func() {
 													Ω(mockRecorder.Code).Should(Equal(500))
-													Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "Would have killed all possums"}`))
+													Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"An error has occurred: SELECT error","code":"DATABASE_ERROR"}`)))
 												})
 											})
 
-											Context("and the desired possum is not in the passel", func() {
+											Context("and the committed states do not match the expected states", func() {
 												BeforeEach(func() {
-													requestBody = bytes.NewReader([]byte(`{"doesnotexist":"dead"}`))
-													vcapApplicationJSON := fmt.Sprintf(`{
-  "application_uris": [
-    "%s"
-  ]
-}`, "joey.example.com")
-													vcapServicesJSON := fmt.Sprintf(`{
-"user-provided": [
- {
-  "credentials": {
-    "username": "admin",
-    "password": "admin",
-    "passel": [
-      "%s"
-    ]
-  },
-  "label": "user-provided",
-  "name": "possum",
-  "syslog_drain_url": "",
-  "tags": []
- }
-]
-}`, "http://joey.example.com")
-													os.Setenv("VCAP_APPLICATION", vcapApplicationJSON)
-													os.Setenv("VCAP_SERVICES", vcapServicesJSON)
+													expectCommittedStates("alive")
 												})
 
 												It("returns an error", func() {
 													Ω(mockRecorder.Code).Should(Equal(500))
-													Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "Possum doesnotexist is not part of my passel"}`))
+													Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"State should have been: {\"father\":\"dead\",\"http://joey.example.com\":\"alive\",\"mother\":\"dead\"} but was {\"father\":\"alive\",\"http://joey.example.com\":\"alive\",\"mother\":\"dead\"}","code":"STATE_MISMATCH"}`)))
 												})
 											})
 
-											Context("and all desired possums are in the passel", func() {
-												Context("and the desired state would leave at least one possum alive", func() {
-													Context("and the states cannot be written to the db", func() {
-														BeforeEach(func() {
-															fakeServer1 = setupMultiple([]MockRoute{
-																{"GET", "/v1/passel_state", `{"possum_states": {"father":"alive","joey":"dead","mother":"alive"}}`, "", 0},
-															})
-															requestBody = bytes.NewReader([]byte(fmt.Sprintf(`{"%s":"dead"}`, fakeServer1.URL)))
-															applicationURISplit := strings.Split(fakeServer1.URL, "http://")
-															applicationURI := applicationURISplit[1]
-															vcapApplicationJSON := fmt.Sprintf(`{
-  "application_uris": [
-    "%s"
-  ]
-}`, applicationURI)
-															vcapServicesJSON := fmt.Sprintf(`{
-"user-provided": [
- {
-  "credentials": {
-    "username": "admin",
-    "password": "admin",
-    "passel": [
-      "%s"
-    ]
-  },
-  "label": "user-provided",
-  "name": "possum",
-  "syslog_drain_url": "",
-  "tags": []
- }
-]
-}`, fakeServer1.URL)
-															os.Setenv("VCAP_APPLICATION", vcapApplicationJSON)
-															os.Setenv("VCAP_SERVICES", vcapServicesJSON)
-															mock.ExpectExec("UPDATE state.*").WillReturnError(fmt.Errorf("An error has occurred: %s", "UPDATE error"))
+											Context("and the committed states match the expected states", func() {
+												BeforeEach(func() {
+													expectCommittedStates("dead")
+												})
 
-														})
+												It("returns a http 202 and the configured states", func() {
+													Ω(mockRecorder.Code).Should(Equal(202))
+													Ω(mockRecorder.Body.String()).Should(Equal(`{"possum_states":{"father":"dead","http://joey.example.com":"alive","mother":"dead"}}`))
+													Ω(mock.ExpectationsWereMet()).Should(Succeed())
+												})
+											})
+										})
+									})
 
-														AfterEach(func() {
-															teardown(fakeServer1)
-														})
+									Context("and the desired state is already the state", func() {
+										BeforeEach(func() {
+											requestBody = bytes.NewReader([]byte(`{"father":"alive"}`))
+											mock.ExpectBegin()
+											mock.ExpectQuery("^SELECT possum, state FROM state WHERE possum IN").WillReturnRows(lockedRows())
+											mock.ExpectCommit()
+											expectCommittedStates("alive")
+										})
 
-														It("returns an error", func() {
-															Ω(mockRecorder.Code).Should(Equal(500))
-															Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "An error has occurred: UPDATE error"}`))
-														})
-													})
+										It("writes nothing and returns a http 202", func() {
+											Ω(mockRecorder.Code).Should(Equal(202))
+											Ω(mockRecorder.Body.String()).Should(Equal(`{"possum_states":{"father":"alive","http://joey.example.com":"alive","mother":"dead"}}`))
+											Ω(mock.ExpectationsWereMet()).Should(Succeed())
+										})
+									})
+								})
+							})
+						})
+					})
+				})
+			})
+		})
+	})
 
-													Context("and the states can be written to the db", func() {
-														BeforeEach(func() {
-															mock.ExpectExec("UPDATE state.*").WillReturnResult(sqlmock.NewResult(1, 1))
-															mock.ExpectExec("UPDATE state.*").WillReturnResult(sqlmock.NewResult(1, 1))
-															mock.ExpectExec("UPDATE state.*").WillReturnResult(sqlmock.NewResult(1, 1))
-														})
+	Describe("#SetPasselState", func() {
+		var (
+			controller   *webs.Controller
+			req          *http.Request
+			mockRecorder *httptest.ResponseRecorder
+			requestBody  io.Reader
+		)
+		Context("when not authenticated", func() {
+			Context("as a password was not configured", func() {
+				JustBeforeEach(func() {
+					req, _ = http.NewRequest("POST", "http://example.com/v1/passel_state", requestBody)
+					req.SetBasicAuth("admin", "admin")
+					Router(controller).ServeHTTP(mockRecorder, req)
+				})
 
-														Context("and getting the after write states raises an error", func() {
-															BeforeEach(func() {
-																fakeServer1 = setupMultiple([]MockRoute{
-																	{"GET", "/v1/passel_state", `{"possum_states": {"father":"alive","joey":"dead","mother":"alive"}}`, "", 0},
-																	{"GET", "/v1/passel_state", "", `{"possum_states": her":"dead","joey":"alive","mother":"dead"}}`, 1},
-																})
-																requestBody = bytes.NewReader([]byte(fmt.Sprintf(`{"%s":"dead"}`, fakeServer1.URL)))
-																applicationURISplit := strings.Split(fakeServer1.URL, "http://")
-																applicationURI := applicationURISplit[1]
-																vcapApplicationJSON := fmt.Sprintf(`{
-  "application_uris": [
-    "%s"
-  ]
-}`, applicationURI)
-																vcapServicesJSON := fmt.Sprintf(`{
+				BeforeEach(func() {
+					controller = webs.CreateController(db)
+					mockRecorder = httptest.NewRecorder()
+					os.Setenv("VCAP_APPLICATION", "{}")
+					os.Setenv("VCAP_SERVICES", `{
 "user-provided": [
  {
   "credentials": {
-    "username": "admin",
-    "password": "admin",
-    "passel": [
-      "%s"
-    ]
-  },
-  "label": "user-provided",
-  "name": "possum",
-  "syslog_drain_url": "",
-  "tags": []
- }
-]
-}`, fakeServer1.URL)
-																os.Setenv("VCAP_APPLICATION", vcapApplicationJSON)
-																os.Setenv("VCAP_SERVICES", vcapServicesJSON)
-															})
-
-															AfterEach(func() {
-																teardown(fakeServer1)
-															})
-
-															It("returns an error", func() {
-																Ω(mockRecorder.Code).Should(Equal(500))
-																Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "invalid character 'h' looking for beginning of value"}`))
-															})
-														})
-
-														Context("and the after write states can be fetched", func() {
-															Context("and the after state does not match the expected after state", func() {
-																BeforeEach(func() {
-																	fakeServer1 = setupMultiple([]MockRoute{
-																		{"GET", "/v1/passel_state", `{"possum_states": {"father":"alive","joey":"dead","mother":"alive"}}`, "", 0},
-																		{"GET", "/v1/passel_state", "", `{"possum_states": {"father":"alive","joey":"dead","mother":"alive"}}`, 1},
-																	})
-																	requestBody = bytes.NewReader([]byte(fmt.Sprintf(`{"%s":"dead"}`, fakeServer1.URL)))
-																	applicationURISplit := strings.Split(fakeServer1.URL, "http://")
-																	applicationURI := applicationURISplit[1]
-																	vcapApplicationJSON := fmt.Sprintf(`{
-  "application_uris": [
-    "%s"
-  ]
-}`, applicationURI)
-																	vcapServicesJSON := fmt.Sprintf(`{
-"user-provided": [
- {
-  "credentials": {
-    "username": "admin",
-    "password": "admin",
-    "passel": [
-      "%s"
-    ]
-  },
-  "label": "user-provided",
-  "name": "possum",
-  "syslog_drain_url": "",
-  "tags": []
- }
-]
-}`, fakeServer1.URL)
-																	os.Setenv("VCAP_APPLICATION", vcapApplicationJSON)
-																	os.Setenv("VCAP_SERVICES", vcapServicesJSON)
-																})
-
-																AfterEach(func() {
-																	teardown(fakeServer1)
-																})
-
-																It("returns an error", func() {
-																	Ω(mockRecorder.Code).Should(Equal(500))
-																	Ω(mockRecorder.Body.String()).Should(Equal(fmt.Sprintf(`{"error": "State should have been: {"father":"alive","%s":"dead","joey":"dead","mother":"alive"} but was {"father":"alive","joey":"dead","mother":"alive"}"}`, fakeServer1.URL)))
-																})
-															})
-
-															Context("and the after state matches the expected after state", func() {
-																BeforeEach(func() {
-																	fakeServer1 = setupMultiple([]MockRoute{
-																		{"GET", "/v1/passel_state", `{"possum_states": {"father":"alive","joey":"dead","mother":"alive"}}`, "", 0},
-																		{"GET", "/v1/passel_state", "", `{"possum_states": {"father":"dead","joey":"dead","mother":"alive"}}`, 1},
-																	})
-																	requestBody = bytes.NewReader([]byte(fmt.Sprintf(`{"%s":"dead"}`, "father")))
-																	applicationURISplit := strings.Split(fakeServer1.URL, "http://")
-																	applicationURI := applicationURISplit[1]
-																	vcapApplicationJSON := fmt.Sprintf(`{
-  "application_uris": [
-    "%s"
-  ]
-}`, applicationURI)
-																	vcapServicesJSON := fmt.Sprintf(`{
-"user-provided": [
- {
-  "credentials": {
-    "username": "admin",
-    "password": "admin",
-    "passel": [
-      "%s",
-      "father"
-    ]
-  },
-  "label": "user-provided",
-  "name": "possum",
-  "syslog_drain_url": "",
-  "tags": []
- }
-]
-}`, fakeServer1.URL)
-																	os.Setenv("VCAP_APPLICATION", vcapApplicationJSON)
-																	os.Setenv("VCAP_SERVICES", vcapServicesJSON)
-																})
-
-																AfterEach(func() {
-																	teardown(fakeServer1)
-																})
-
-																It("returns a http 202 and the configured states", func() {
-																	Ω(mockRecorder.Code).Should(Equal(202))
-																	Ω(mockRecorder.Body.String()).Should(Equal(`{"possum_states": {"father":"dead","joey":"dead","mother":"alive"}}`))
-																})
-															})
-														})
-													})
-												})
-											})
-										})
-									})
-								})
-							})
-						})
-					})
-				})
-			})
-		})
-	})
-
-	Describe("#SetPasselState", func() {
-		var (
-			controller   *webs.Controller
-			req          *http.Request
-			mockRecorder *httptest.ResponseRecorder
-			requestBody  io.Reader
-		)
-		Context("when not authenticated", func() {
-			Context("as a password was not configured", func() {
-				JustBeforeEach(func() {
-					req, _ = http.NewRequest("POST", "http://example.com/v1/passel_state", requestBody)
-					req.SetBasicAuth("admin", "admin")
-					Router(controller).ServeHTTP(mockRecorder, req)
-				})
-
-				BeforeEach(func() {
-					controller = webs.CreateController(db)
-					mockRecorder = httptest.NewRecorder()
-					os.Setenv("VCAP_APPLICATION", "{}")
-					os.Setenv("VCAP_SERVICES", `{
-"user-provided": [
- {
-  "credentials": {
-    "username": "admin"
+    "username": "admin"
   },
   "label": "user-provided",
   "name": "possum",
@@ -1500,7 +1504,9 @@ var _ = Describe("Controller", func() {
 
 				It("return an authentication error", func() {
 					Ω(mockRecorder.Code).Should(Equal(401))
-					Ω(mockRecorder.Body.String()).Should(Equal(`401 Unauthorized`))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Unauthorized","code":"UNAUTHORIZED"}`)))
+					Ω(mockRecorder.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="possum"`))
+					Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
 				})
 			})
 
@@ -1532,7 +1538,9 @@ var _ = Describe("Controller", func() {
 
 				It("return an authentication error", func() {
 					Ω(mockRecorder.Code).Should(Equal(401))
-					Ω(mockRecorder.Body.String()).Should(Equal(`401 Unauthorized`))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Unauthorized","code":"UNAUTHORIZED"}`)))
+					Ω(mockRecorder.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="possum"`))
+					Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
 				})
 			})
 
@@ -1565,7 +1573,9 @@ var _ = Describe("Controller", func() {
 
 				It("return an authentication error", func() {
 					Ω(mockRecorder.Code).Should(Equal(401))
-					Ω(mockRecorder.Body.String()).Should(Equal(`401 Unauthorized`))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Unauthorized","code":"UNAUTHORIZED"}`)))
+					Ω(mockRecorder.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="possum"`))
+					Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
 				})
 			})
 
@@ -1598,7 +1608,9 @@ var _ = Describe("Controller", func() {
 
 				It("return an authentication error", func() {
 					Ω(mockRecorder.Code).Should(Equal(401))
-					Ω(mockRecorder.Body.String()).Should(Equal(`401 Unauthorized`))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Unauthorized","code":"UNAUTHORIZED"}`)))
+					Ω(mockRecorder.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="possum"`))
+					Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
 				})
 			})
 
@@ -1631,7 +1643,9 @@ var _ = Describe("Controller", func() {
 
 				It("return an authentication error", func() {
 					Ω(mockRecorder.Code).Should(Equal(401))
-					Ω(mockRecorder.Body.String()).Should(Equal(`401 Unauthorized`))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Unauthorized","code":"UNAUTHORIZED"}`)))
+					Ω(mockRecorder.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="possum"`))
+					Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
 				})
 			})
 
@@ -1664,7 +1678,9 @@ var _ = Describe("Controller", func() {
 
 				It("return an authentication error", func() {
 					Ω(mockRecorder.Code).Should(Equal(401))
-					Ω(mockRecorder.Body.String()).Should(Equal(`401 Unauthorized`))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Unauthorized","code":"UNAUTHORIZED"}`)))
+					Ω(mockRecorder.Header().Get("WWW-Authenticate")).Should(Equal(`Basic realm="possum"`))
+					Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
 				})
 			})
 		})
@@ -1713,7 +1729,7 @@ var _ = Describe("Controller", func() {
 
 				It("returns an error 500", func() {
 					Ω(mockRecorder.Code).Should(Equal(500))
-					Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "possum was not a string"}`))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"possum was not a string","code":"CONFIG_ERROR"}`)))
 				})
 			})
 
@@ -1747,8 +1763,96 @@ var _ = Describe("Controller", func() {
 				})
 
 				It("returns an error", func() {
-					Ω(mockRecorder.Code).Should(Equal(500))
-					Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "invalid character '[' looking for beginning of object key string"}`))
+					Ω(mockRecorder.Code).Should(Equal(400))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"invalid character '[' looking for beginning of object key string","code":"INVALID_REQUEST"}`)))
+				})
+			})
+
+			Context("and the desired state contains an unknown state", func() {
+				BeforeEach(func() {
+					requestBody = bytes.NewReader([]byte(`{"possum_states":{"http://joey": "undead"}}`))
+					vcapServicesJSON := `{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "admin",
+    "password": "admin",
+    "passel": [
+      "http://joey"
+    ]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`
+					os.Setenv("VCAP_APPLICATION", "{}")
+					os.Setenv("VCAP_SERVICES", vcapServicesJSON)
+				})
+
+				It("returns a bad request error", func() {
+					Ω(mockRecorder.Code).Should(Equal(400))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Request body is invalid: body.possum_states.http://joey should be one of [alive dead] not undead","code":"INVALID_REQUEST"}`)))
+				})
+			})
+
+			Context("and the desired state contains an unknown field", func() {
+				BeforeEach(func() {
+					requestBody = bytes.NewReader([]byte(`{"possum_states":{"http://joey": "alive"}, "forced": true}`))
+					os.Setenv("VCAP_APPLICATION", "{}")
+					os.Setenv("VCAP_SERVICES", `{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "admin",
+    "password": "admin",
+    "passel": [
+      "http://joey"
+    ]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`)
+				})
+
+				It("returns a bad request error", func() {
+					Ω(mockRecorder.Code).Should(Equal(400))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Request body is invalid: body.forced is not a known field","code":"INVALID_REQUEST"}`)))
+				})
+			})
+
+			Context("and the desired state has the wrong type", func() {
+				BeforeEach(func() {
+					requestBody = bytes.NewReader([]byte(`{"possum_states":{"http://joey": "alive"}, "force": "yes"}`))
+					os.Setenv("VCAP_APPLICATION", "{}")
+					os.Setenv("VCAP_SERVICES", `{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "admin",
+    "password": "admin",
+    "passel": [
+      "http://joey"
+    ]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`)
+				})
+
+				It("returns a bad request error", func() {
+					Ω(mockRecorder.Code).Should(Equal(400))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Request body is invalid: body.force should be a boolean","code":"INVALID_REQUEST"}`)))
 				})
 			})
 
@@ -1795,8 +1899,8 @@ var _ = Describe("Controller", func() {
 							})
 
 							It("returns an error and useful messages", func() {
-								Ω(mockRecorder.Code).Should(Equal(500))
-								Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "Would have killed all possums"}`))
+								Ω(mockRecorder.Code).Should(Equal(409))
+								Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Would have killed all possums","code":"WOULD_KILL_ALL"}`)))
 							})
 						})
 
@@ -1848,8 +1952,8 @@ var _ = Describe("Controller", func() {
 									})
 
 									It("returns an error", func() {
-										Ω(mockRecorder.Code).Should(Equal(500))
-										Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "invalid character ']' looking for beginning of object key string"}`))
+										Ω(mockRecorder.Code).Should(Equal(502))
+										Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"invalid character ']' looking for beginning of object key string","code":"PEER_INVALID_RESPONSE"}`)))
 									})
 								})
 
@@ -1899,8 +2003,8 @@ var _ = Describe("Controller", func() {
 									})
 
 									It("returns an error", func() {
-										Ω(mockRecorder.Code).Should(Equal(500))
-										Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "this is an error"}`))
+										Ω(mockRecorder.Code).Should(Equal(502))
+										Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"this is an error","code":"PEER_ERROR"}`)))
 									})
 								})
 							})
@@ -1952,8 +2056,8 @@ var _ = Describe("Controller", func() {
 									})
 
 									It("returns an error", func() {
-										Ω(mockRecorder.Code).Should(Equal(500))
-										Ω(mockRecorder.Body.String()).Should(Equal(`{"consistent": false, "error": "State was inconsistent after update", "passel_states": [{"father":"alive","joey":"alive","mother":"alive"},{"father":"dead","joey":"alive","mother":"alive"}]}`))
+										Ω(mockRecorder.Code).Should(Equal(409))
+										Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, fmt.Sprintf(`{"consistent":false,"error":"State was inconsistent after update","code":"STATE_INCONSISTENT","passel":["%s","%s"],"passel_states":[{"father":"alive","joey":"alive","mother":"alive"},{"father":"dead","joey":"alive","mother":"alive"}]}`, fakeServer1.URL, fakeServer2.URL))))
 									})
 								})
 
@@ -2004,7 +2108,7 @@ var _ = Describe("Controller", func() {
 
 									It("returns a http 202 and consistent state", func() {
 										Ω(mockRecorder.Code).Should(Equal(202))
-										Ω(mockRecorder.Body.String()).Should(Equal(`{"consistent": true, "passel_states": [{"father":"alive","joey":"alive","mother":"alive"},{"father":"alive","joey":"alive","mother":"alive"}]}`))
+										Ω(mockRecorder.Body.String()).Should(Equal(fmt.Sprintf(`{"consistent":true,"passel":["%s","%s"],"passel_states":[{"father":"alive","joey":"alive","mother":"alive"},{"father":"alive","joey":"alive","mother":"alive"}]}`, fakeServer1.URL, fakeServer2.URL)))
 									})
 								})
 							})
@@ -2050,8 +2154,8 @@ var _ = Describe("Controller", func() {
 								})
 
 								It("returns an error", func() {
-									Ω(mockRecorder.Code).Should(Equal(500))
-									Ω(mockRecorder.Body.String()).Should(MatchRegexp(`{"error": "Get http://.+/v1/passel_state: dial tcp .+: connect: connection refused"}`))
+									Ω(mockRecorder.Code).Should(Equal(502))
+									Ω(mockRecorder.Body.String()).Should(MatchRegexp(`{"error":"Get \\"?http://.+/v1/passel_state\\"?: dial tcp .+: connect: connection refused","code":"PEER_UNREACHABLE","request_id":"[0-9a-f]{32}"}`))
 								})
 							})
 
@@ -2095,8 +2199,8 @@ var _ = Describe("Controller", func() {
 								})
 
 								It("returns an error", func() {
-									Ω(mockRecorder.Code).Should(Equal(500))
-									Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "I am an error"}`))
+									Ω(mockRecorder.Code).Should(Equal(502))
+									Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"I am an error","code":"PEER_ERROR"}`)))
 								})
 							})
 						})
@@ -2141,8 +2245,8 @@ var _ = Describe("Controller", func() {
 							})
 
 							It("returns an error", func() {
-								Ω(mockRecorder.Code).Should(Equal(500))
-								Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "unexpected end of JSON input"}`))
+								Ω(mockRecorder.Code).Should(Equal(502))
+								Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"unexpected end of JSON input","code":"PEER_INVALID_RESPONSE"}`)))
 							})
 						})
 
@@ -2178,8 +2282,9 @@ var _ = Describe("Controller", func() {
 							})
 
 							It("returns an error", func() {
-								Ω(mockRecorder.Code).Should(Equal(500))
-								Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "Get joey/v1/passel_state: unsupported protocol scheme """}`))
+								Ω(mockRecorder.Code).Should(Equal(502))
+								Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"PEER_UNREACHABLE"`))
+								Ω(mockRecorder.Body.String()).Should(ContainSubstring("unsupported protocol scheme"))
 							})
 						})
 					})
@@ -2225,8 +2330,8 @@ var _ = Describe("Controller", func() {
 							})
 
 							It("returns an error and useful messages", func() {
-								Ω(mockRecorder.Code).Should(Equal(500))
-								Ω(mockRecorder.Body.String()).Should(Equal(`{"consistent": false, "error": "State was inconsistent before update", "passel_states": [{"father":"alive","joey":"dead","mother":"alive"},{"father":"dead","joey":"dead","mother":"alive"}]}`))
+								Ω(mockRecorder.Code).Should(Equal(409))
+								Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, fmt.Sprintf(`{"consistent":false,"error":"State was inconsistent before update","code":"STATE_INCONSISTENT","passel":["%s","%s"],"passel_states":[{"father":"alive","joey":"dead","mother":"alive"},{"father":"dead","joey":"dead","mother":"alive"}]}`, fakeServer1.URL, fakeServer2.URL))))
 							})
 						})
 
@@ -2271,12 +2376,50 @@ var _ = Describe("Controller", func() {
 								})
 
 								It("returns an error and useful messages", func() {
-									Ω(mockRecorder.Code).Should(Equal(500))
-									Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "Would have killed all possums"}`))
+									Ω(mockRecorder.Code).Should(Equal(409))
+									Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Would have killed all possums","code":"WOULD_KILL_ALL"}`)))
 								})
 							})
 
 							Context("and the state would have left at least one possum alive", func() {
+								Context("and dry run is set", func() {
+									BeforeEach(func() {
+										fakeServer1 = setup(MockRoute{"GET", "/v1/passel_state", `{"possum_states": {"father":"alive","joey":"dead","mother":"alive"}}`, "", 0})
+										fakeServer2 = setup(MockRoute{"GET", "/v1/passel_state", `{"possum_states": {"father":"alive","joey":"dead","mother":"alive"}}`, "", 0})
+										vcapServicesJSON := fmt.Sprintf(`{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "admin",
+    "password": "admin",
+    "passel": [
+      "%s",
+      "%s"
+    ]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`, fakeServer1.URL, fakeServer2.URL)
+										os.Setenv("VCAP_APPLICATION", "{}")
+										os.Setenv("VCAP_SERVICES", vcapServicesJSON)
+										requestBody = bytes.NewReader([]byte(`{"possum_states":{"father": "dead", "joey": "alive"}, "dry_run": true}`))
+									})
+
+									AfterEach(func() {
+										teardown(fakeServer1)
+										teardown(fakeServer2)
+									})
+
+									It("returns the proposed state without updating any possum", func() {
+										Ω(mockRecorder.Code).Should(Equal(200))
+										Ω(mockRecorder.Body.String()).Should(Equal(fmt.Sprintf(`{"consistent":true,"dry_run":true,"passel":["%s","%s"],"passel_states":[{"father":"alive","joey":"dead","mother":"alive"},{"father":"alive","joey":"dead","mother":"alive"}],"proposed_state":{"father":"dead","joey":"alive","mother":"alive"}}`, fakeServer1.URL, fakeServer2.URL)))
+									})
+								})
+
 								Context("and set states returns an error", func() {
 									Context("due to invalid json", func() {
 										BeforeEach(func() {
@@ -2324,8 +2467,8 @@ var _ = Describe("Controller", func() {
 										})
 
 										It("returns an error", func() {
-											Ω(mockRecorder.Code).Should(Equal(500))
-											Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "invalid character ']' looking for beginning of object key string"}`))
+											Ω(mockRecorder.Code).Should(Equal(502))
+											Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"invalid character ']' looking for beginning of object key string","code":"PEER_INVALID_RESPONSE"}`)))
 										})
 									})
 
@@ -2375,8 +2518,8 @@ var _ = Describe("Controller", func() {
 										})
 
 										It("returns an error", func() {
-											Ω(mockRecorder.Code).Should(Equal(500))
-											Ω(mockRecorder.Body.String()).Should(Equal(`{"error": "this is an error"}`))
+											Ω(mockRecorder.Code).Should(Equal(502))
+											Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"this is an error","code":"PEER_ERROR"}`)))
 										})
 									})
 								})
@@ -2428,8 +2571,8 @@ var _ = Describe("Controller", func() {
 										})
 
 										It("returns an error", func() {
-											Ω(mockRecorder.Code).Should(Equal(500))
-											Ω(mockRecorder.Body.String()).Should(Equal(`{"consistent": false, "error": "State was inconsistent after update", "passel_states": [{"father":"alive","joey":"alive","mother":"alive"},{"father":"dead","joey":"alive","mother":"alive"}]}`))
+											Ω(mockRecorder.Code).Should(Equal(409))
+											Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, fmt.Sprintf(`{"consistent":false,"error":"State was inconsistent after update","code":"STATE_INCONSISTENT","passel":["%s","%s"],"passel_states":[{"father":"alive","joey":"alive","mother":"alive"},{"father":"dead","joey":"alive","mother":"alive"}]}`, fakeServer1.URL, fakeServer2.URL))))
 										})
 									})
 
@@ -2480,7 +2623,7 @@ var _ = Describe("Controller", func() {
 
 										It("returns a http 202 and consistent state", func() {
 											Ω(mockRecorder.Code).Should(Equal(202))
-											Ω(mockRecorder.Body.String()).Should(Equal(`{"consistent": true, "passel_states": [{"father":"alive","joey":"alive","mother":"alive"},{"father":"alive","joey":"alive","mother":"alive"}]}`))
+											Ω(mockRecorder.Body.String()).Should(Equal(fmt.Sprintf(`{"consistent":true,"passel":["%s","%s"],"passel_states":[{"father":"alive","joey":"alive","mother":"alive"},{"father":"alive","joey":"alive","mother":"alive"}]}`, fakeServer1.URL, fakeServer2.URL)))
 										})
 									})
 								})
@@ -2491,4 +2634,4130 @@ var _ = Describe("Controller", func() {
 			})
 		})
 	})
+
+	Describe("#GetOpenAPI", func() {
+		var (
+			controller   *webs.Controller
+			req          *http.Request
+			mockRecorder *httptest.ResponseRecorder
+			spec         map[string]interface{}
+		)
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			mockRecorder = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "http://example.com/v1/openapi.json", nil)
+			Router(controller).ServeHTTP(mockRecorder, req)
+			Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &spec)).Should(Succeed())
+		})
+
+		It("returns an OpenAPI 3 document", func() {
+			Ω(mockRecorder.Code).Should(Equal(200))
+			Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Ω(spec["openapi"]).Should(HavePrefix("3."))
+		})
+
+		It("describes every route registered by the server", func() {
+			paths := spec["paths"].(map[string]interface{})
+			err := Router(controller).Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+				path, err := route.GetPathTemplate()
+				Ω(err).Should(BeNil())
+				methods, err := route.GetMethods()
+				Ω(err).Should(BeNil())
+				Ω(paths).Should(HaveKey(path))
+				for _, method := range methods {
+					Ω(paths[path]).Should(HaveKey(strings.ToLower(method)), fmt.Sprintf("%s %s", method, path))
+				}
+				return nil
+			})
+			Ω(err).Should(BeNil())
+		})
+	})
+
+	Describe("#GetStateChanges", func() {
+		var (
+			controller   *webs.Controller
+			req          *http.Request
+			mockRecorder *httptest.ResponseRecorder
+		)
+
+		JustBeforeEach(func() {
+			req, _ = http.NewRequest("GET", "http://example.com/v1/state_changes", nil)
+			Router(controller).ServeHTTP(mockRecorder, req)
+		})
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			mockRecorder = httptest.NewRecorder()
+			vcapServicesJSON := `{
+"user-provided": [
+ {
+  "credentials": {
+    "passel": [
+      "mother",
+      "joey"
+    ]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`
+			os.Setenv("VCAP_APPLICATION", "{}")
+			os.Setenv("VCAP_SERVICES", vcapServicesJSON)
+		})
+
+		Context("when the state history can be read", func() {
+			BeforeEach(func() {
+				changedAt := time.Date(2019, 6, 1, 12, 30, 0, 0, time.UTC)
+				mRows := sqlmock.NewRows([]string{"possum", "state", "changed_at", "changed_by", "emergency", "reason"}).
+					AddRow("mother", "dead", changedAt, "admin", false, "")
+
+				mock.ExpectPrepare("^SELECT (.+) FROM state_history h JOIN").ExpectQuery().WithArgs("mother", "joey").WillReturnRows(mRows)
+			})
+
+			It("returns the last change of each possum that has changed", func() {
+				Ω(mockRecorder.Code).Should(Equal(200))
+				Ω(mockRecorder.Body.String()).Should(Equal(`{"state_changes":{"mother":{"possum":"mother","state":"dead","changed_at":"2019-06-01T12:30:00Z","changed_by":"admin"}}}`))
+			})
+		})
+
+		Context("when the state history cannot be read", func() {
+			BeforeEach(func() {
+				mock.ExpectPrepare("^SELECT (.+) FROM state_history h JOIN").ExpectQuery().WillReturnError(fmt.Errorf("An error has occurred: %s", "SELECT error"))
+			})
+
+			It("returns an error", func() {
+				Ω(mockRecorder.Code).Should(Equal(500))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"An error has occurred: SELECT error","code":"DATABASE_ERROR"}`)))
+			})
+		})
+	})
+
+	Describe("#GetDashboard", func() {
+		It("returns the dashboard page", func() {
+			mockRecorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://example.com/dashboard", nil)
+			Router(webs.CreateController(db)).ServeHTTP(mockRecorder, req)
+			Ω(mockRecorder.Code).Should(Equal(200))
+			Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("text/html; charset=utf-8"))
+			Ω(mockRecorder.Body.String()).Should(ContainSubstring("<title>possum dashboard</title>"))
+			Ω(mockRecorder.Body.String()).Should(ContainSubstring("/v1/passel_state_consistency"))
+			// possums that do not answer are drawn from the missed list instead of hiding the table
+			Ω(mockRecorder.Body.String()).Should(ContainSubstring("consistency.missed"))
+		})
+	})
+
+	Describe("unknown routes", func() {
+		var mockRecorder *httptest.ResponseRecorder
+
+		serve := func(method string, path string) {
+			req, _ := http.NewRequest(method, "http://example.com"+path, nil)
+			req.Header.Set("Origin", "https://app.example.com")
+			Router(webs.CreateController(db)).ServeHTTP(mockRecorder, req)
+		}
+
+		BeforeEach(func() {
+			mockRecorder = httptest.NewRecorder()
+		})
+
+		It("returns a JSON not found error through the middlewares", func() {
+			serve("GET", "/v1/nothing")
+			Ω(mockRecorder.Code).Should(Equal(404))
+			Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Ω(mockRecorder.Header().Get("X-Request-ID")).ShouldNot(BeEmpty())
+			Ω(mockRecorder.Header().Get("Access-Control-Allow-Origin")).Should(Equal("*"))
+			Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"/v1/nothing is not a possum endpoint","code":"NOT_FOUND"}`)))
+		})
+
+		It("returns a JSON method not allowed error through the middlewares", func() {
+			serve("DELETE", "/v1/state")
+			Ω(mockRecorder.Code).Should(Equal(405))
+			Ω(mockRecorder.Header().Get("Content-Type")).Should(Equal("application/json"))
+			Ω(mockRecorder.Header().Get("X-Request-ID")).ShouldNot(BeEmpty())
+			Ω(mockRecorder.Header().Get("Access-Control-Allow-Origin")).Should(Equal("*"))
+			Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"DELETE is not allowed on /v1/state","code":"METHOD_NOT_ALLOWED"}`)))
+		})
+
+		It("answers OPTIONS requests on any path", func() {
+			serve("OPTIONS", "/v1/nothing")
+			Ω(mockRecorder.Code).Should(Equal(204))
+			Ω(mockRecorder.Header().Get("Access-Control-Allow-Origin")).Should(Equal("*"))
+		})
+	})
+
+	Describe("CORS", func() {
+		var (
+			controller   *webs.Controller
+			req          *http.Request
+			mockRecorder *httptest.ResponseRecorder
+			method       string
+			origin       string
+		)
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			mockRecorder = httptest.NewRecorder()
+			method = "GET"
+			origin = "https://app.example.com"
+			os.Setenv("VCAP_APPLICATION", "{}")
+			os.Setenv("VCAP_SERVICES", "{}")
+		})
+
+		JustBeforeEach(func() {
+			req, _ = http.NewRequest(method, "http://example.com/v1/passel_state", nil)
+			if origin != "" {
+				req.Header.Set("Origin", origin)
+			}
+			if method == "OPTIONS" {
+				req.Header.Set("Access-Control-Request-Method", "POST")
+			}
+			Router(controller).ServeHTTP(mockRecorder, req)
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("CORS_ALLOWED")
+			os.Unsetenv("CORS_ALLOW_CREDENTIALS")
+		})
+
+		Context("when CORS_ALLOWED is not set", func() {
+			It("allows any origin", func() {
+				Ω(mockRecorder.Header().Get("Access-Control-Allow-Origin")).Should(Equal("*"))
+			})
+
+			Context("and credentials are allowed", func() {
+				BeforeEach(func() {
+					os.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+				})
+
+				It("allows any origin without credentials", func() {
+					Ω(mockRecorder.Header().Get("Access-Control-Allow-Origin")).Should(Equal("*"))
+					Ω(mockRecorder.Header().Get("Access-Control-Allow-Credentials")).Should(BeEmpty())
+					Ω(mockRecorder.Header().Get("Vary")).Should(BeEmpty())
+				})
+
+				Context("and a preflight request is made", func() {
+					BeforeEach(func() {
+						method = "OPTIONS"
+					})
+
+					It("answers the preflight without credentials", func() {
+						Ω(mockRecorder.Code).Should(Equal(204))
+						Ω(mockRecorder.Header().Get("Access-Control-Allow-Origin")).Should(Equal("*"))
+						Ω(mockRecorder.Header().Get("Access-Control-Allow-Credentials")).Should(BeEmpty())
+					})
+				})
+			})
+		})
+
+		Context("when CORS_ALLOWED lists origins", func() {
+			BeforeEach(func() {
+				os.Setenv("CORS_ALLOWED", "https://other.example.com, https://*.example.com")
+			})
+
+			Context("and the origin matches a wildcard pattern", func() {
+				It("echoes the origin", func() {
+					Ω(mockRecorder.Header().Get("Access-Control-Allow-Origin")).Should(Equal("https://app.example.com"))
+					Ω(mockRecorder.Header().Get("Vary")).Should(Equal("Origin"))
+				})
+			})
+
+			Context("and the origin matches exactly", func() {
+				BeforeEach(func() {
+					origin = "https://other.example.com"
+				})
+
+				It("echoes the origin", func() {
+					Ω(mockRecorder.Header().Get("Access-Control-Allow-Origin")).Should(Equal("https://other.example.com"))
+				})
+
+				Context("and credentials are allowed", func() {
+					BeforeEach(func() {
+						os.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+					})
+
+					It("echoes the origin with credentials", func() {
+						Ω(mockRecorder.Header().Get("Access-Control-Allow-Origin")).Should(Equal("https://other.example.com"))
+						Ω(mockRecorder.Header().Get("Access-Control-Allow-Credentials")).Should(Equal("true"))
+						Ω(mockRecorder.Header().Get("Vary")).Should(Equal("Origin"))
+					})
+				})
+			})
+
+			Context("and the origin does not match", func() {
+				BeforeEach(func() {
+					origin = "https://example.com.evil.org"
+				})
+
+				It("does not allow the origin", func() {
+					Ω(mockRecorder.Header().Get("Access-Control-Allow-Origin")).Should(BeEmpty())
+				})
+			})
+
+			Context("and a preflight request is made", func() {
+				BeforeEach(func() {
+					method = "OPTIONS"
+				})
+
+				It("answers the preflight", func() {
+					Ω(mockRecorder.Code).Should(Equal(204))
+					Ω(mockRecorder.Header().Get("Access-Control-Allow-Origin")).Should(Equal("https://app.example.com"))
+					Ω(mockRecorder.Header().Get("Access-Control-Allow-Methods")).Should(Equal("GET, POST, OPTIONS"))
+					Ω(mockRecorder.Header().Get("Access-Control-Allow-Headers")).Should(Equal("Authorization, Content-Type"))
+					Ω(mockRecorder.Header().Get("Access-Control-Max-Age")).Should(Equal("600"))
+				})
+
+				Context("from an origin that is not allowed", func() {
+					BeforeEach(func() {
+						origin = "https://evil.org"
+					})
+
+					It("rejects the preflight", func() {
+						Ω(mockRecorder.Code).Should(Equal(403))
+						Ω(mockRecorder.Header().Get("Access-Control-Allow-Origin")).Should(BeEmpty())
+					})
+				})
+			})
+		})
+	})
+
+	Describe("#ServeAgentCheck", func() {
+		var (
+			controller *webs.Controller
+			listener   net.Listener
+			config     webs.AgentCheckConfig
+		)
+
+		probe := func() string {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			Ω(err).Should(BeNil())
+			defer conn.Close()
+			reply, _ := ioutil.ReadAll(conn)
+			return string(reply)
+		}
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			config = webs.AgentCheckConfig{AliveResponse: "up 100%", DeadResponse: "drain", ErrorResponse: "fail"}
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Ω(err).Should(BeNil())
+			os.Setenv("VCAP_APPLICATION", `{"application_uris": ["possum.example1.domain.com"]}`)
+			os.Setenv("VCAP_SERVICES", `{
+"user-provided": [
+ {
+  "credentials": {
+    "passel": [
+      "https://possum.example1.domain.com",
+      "https://possum.example2.domain.com"
+    ]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`)
+		})
+
+		JustBeforeEach(func() {
+			go controller.ServeAgentCheck(listener, config)
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		Context("when this possum is alive", func() {
+			BeforeEach(func() {
+				rows := sqlmock.NewRows([]string{"possum", "state"}).AddRow("https://possum.example1.domain.com", "alive")
+				mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WithArgs("https://possum.example1.domain.com").WillReturnRows(rows)
+			})
+
+			It("replies with the alive response", func() {
+				Ω(probe()).Should(Equal("up 100%\n"))
+			})
+		})
+
+		Context("when this possum is dead", func() {
+			BeforeEach(func() {
+				rows := sqlmock.NewRows([]string{"possum", "state"}).AddRow("https://possum.example1.domain.com", "dead")
+				mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WithArgs("https://possum.example1.domain.com").WillReturnRows(rows)
+			})
+
+			It("replies with the dead response", func() {
+				Ω(probe()).Should(Equal("drain\n"))
+			})
+		})
+
+		Context("when the state cannot be read", func() {
+			BeforeEach(func() {
+				mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnError(fmt.Errorf("An error has occurred: %s", "SELECT error"))
+			})
+
+			It("replies with the error response", func() {
+				Ω(probe()).Should(Equal("fail\n"))
+			})
+
+			Context("and no error response is configured", func() {
+				BeforeEach(func() {
+					config.ErrorResponse = ""
+				})
+
+				It("closes the connection without replying", func() {
+					Ω(probe()).Should(BeEmpty())
+				})
+			})
+		})
+	})
+
+	Describe("#LoadAgentCheckConfig", func() {
+		AfterEach(func() {
+			os.Unsetenv("AGENT_CHECK_DEAD_RESPONSE")
+		})
+
+		It("defaults to up and down", func() {
+			config, err := webs.LoadAgentCheckConfig()
+			Ω(err).Should(BeNil())
+			Ω(config).Should(Equal(webs.AgentCheckConfig{AliveResponse: "up", DeadResponse: "down"}))
+		})
+
+		Context("when a response is a weight percentage", func() {
+			BeforeEach(func() {
+				os.Setenv("AGENT_CHECK_DEAD_RESPONSE", "0%")
+			})
+
+			It("accepts it", func() {
+				config, err := webs.LoadAgentCheckConfig()
+				Ω(err).Should(BeNil())
+				Ω(config.DeadResponse).Should(Equal("0%"))
+			})
+		})
+
+		Context("when a response is not understood by HAProxy", func() {
+			BeforeEach(func() {
+				os.Setenv("AGENT_CHECK_DEAD_RESPONSE", "dead")
+			})
+
+			It("returns an error", func() {
+				_, err := webs.LoadAgentCheckConfig()
+				Ω(err).Should(MatchError(`AGENT_CHECK_DEAD_RESPONSE is invalid: "dead" is not an agent-check keyword or weight percentage`))
+			})
+		})
+	})
+
+	Describe("#LoadProbeConfig", func() {
+		It("applies defaults", func() {
+			config, err := webs.LoadProbeConfig([]byte(`{"foundations": {"father": {"cf_api": "https://api.sys.example.com"}}}`))
+			Ω(err).Should(BeNil())
+			Ω(config.IntervalSeconds).Should(Equal(30))
+			Ω(config.TimeoutSeconds).Should(Equal(5))
+			Ω(config.FailureThreshold).Should(Equal(3))
+			Ω(config.MinAlive).Should(Equal(1))
+			Ω(config.AutoApply).Should(BeFalse())
+		})
+
+		It("rejects invalid JSON", func() {
+			_, err := webs.LoadProbeConfig([]byte(`{`))
+			Ω(err).ShouldNot(BeNil())
+		})
+
+		It("rejects a config without foundations", func() {
+			_, err := webs.LoadProbeConfig([]byte(`{}`))
+			Ω(err).Should(MatchError("no foundations were configured"))
+		})
+
+		It("rejects a foundation with nothing to probe", func() {
+			_, err := webs.LoadProbeConfig([]byte(`{"foundations": {"father": {}}}`))
+			Ω(err).Should(MatchError("father has nothing to probe"))
+		})
+
+		It("rejects a target that is not an http URL", func() {
+			_, err := webs.LoadProbeConfig([]byte(`{"foundations": {"father": {"uaa": "login.sys.example.com"}}}`))
+			Ω(err).Should(MatchError(`father: "login.sys.example.com" is not an http or https URL`))
+		})
+
+		It("rejects negative settings", func() {
+			_, err := webs.LoadProbeConfig([]byte(`{"min_alive": -1, "foundations": {"father": {"uaa": "https://login.sys.example.com"}}}`))
+			Ω(err).Should(MatchError("interval_seconds, timeout_seconds, failure_threshold and min_alive cannot be negative"))
+		})
+
+		It("rejects applying changes automatically when approval is required", func() {
+			os.Setenv("REQUIRE_APPROVAL", "true")
+			defer os.Unsetenv("REQUIRE_APPROVAL")
+			_, err := webs.LoadProbeConfig([]byte(`{"auto_apply": true, "foundations": {"father": {"uaa": "https://login.sys.example.com"}}}`))
+			Ω(err).Should(MatchError("auto_apply cannot be used with REQUIRE_APPROVAL, changes need a second person"))
+		})
+	})
+
+	Describe("#Prober", func() {
+		var (
+			controller    *webs.Controller
+			prober        *webs.Prober
+			config        webs.ProbeConfig
+			cfAPI         *httptest.Server
+			failing       map[string]bool
+			applicationIn *httptest.Server
+		)
+
+		BeforeEach(func() {
+			failing = make(map[string]bool)
+			cfAPI = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if failing[r.URL.Path] {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				fmt.Fprint(w, "{}")
+			}))
+			fakeServer1 = setupMultiple([]MockRoute{
+				{"GET", "/v1/passel_state", `{"possum_states": {"father":"alive","mother":"alive"}}`, `{"possum_states": {"father":"alive","mother":"alive"}}`, 0},
+				{"POST", "/v1/state", `{"possum_states": {"father":"dead","mother":"alive"}}`, "", 0},
+			})
+			fakeServer2 = setupMultiple([]MockRoute{
+				{"GET", "/v1/passel_state", `{"possum_states": {"father":"alive","mother":"alive"}}`, `{"possum_states": {"father":"alive","mother":"alive"}}`, 0},
+				{"POST", "/v1/state", `{"possum_states": {"father":"dead","mother":"alive"}}`, "", 0},
+			})
+			applicationIn = fakeServer1
+			config = webs.ProbeConfig{
+				TimeoutSeconds:   1,
+				FailureThreshold: 2,
+				MinAlive:         1,
+				Foundations: map[string]webs.ProbeTargets{
+					"father": {CFAPI: cfAPI.URL, UAA: cfAPI.URL + "/uaa", Canary: cfAPI.URL + "/canary/father"},
+					"mother": {Canary: cfAPI.URL + "/canary/mother"},
+				},
+			}
+			controller = webs.CreateController(db)
+		})
+
+		JustBeforeEach(func() {
+			os.Setenv("VCAP_SERVICES", fmt.Sprintf(`{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "admin",
+    "password": "admin",
+    "passel": [
+      "%s",
+      "%s"
+    ]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`, fakeServer1.URL, fakeServer2.URL))
+			os.Setenv("VCAP_APPLICATION", fmt.Sprintf(`{"application_uris": ["%s"]}`, strings.TrimPrefix(applicationIn.URL, "http://")))
+			prober = webs.NewProber(controller, config)
+		})
+
+		AfterEach(func() {
+			cfAPI.Close()
+			teardown(fakeServer1)
+			teardown(fakeServer2)
+		})
+
+		Context("when every foundation is healthy", func() {
+			It("proposes nothing", func() {
+				Ω(prober.ProbeOnce()).Should(BeNil())
+				status := prober.Status()
+				Ω(status.Foundations["father"].Healthy).Should(BeTrue())
+				Ω(status.Foundations["mother"].Healthy).Should(BeTrue())
+				Ω(status.ProposedState).Should(BeNil())
+				Ω(status.LastAction).Should(BeEmpty())
+			})
+		})
+
+		Context("when the CF API only serves /v3", func() {
+			BeforeEach(func() {
+				failing["/v2/info"] = true
+			})
+
+			It("treats the CF API as reachable", func() {
+				Ω(prober.ProbeOnce()).Should(BeNil())
+				Ω(prober.Status().Foundations["father"].Healthy).Should(BeTrue())
+			})
+		})
+
+		Context("when a foundation fails", func() {
+			BeforeEach(func() {
+				failing["/uaa/healthz"] = true
+			})
+
+			Context("fewer times than the failure threshold", func() {
+				It("records the failure but proposes nothing", func() {
+					Ω(prober.ProbeOnce()).Should(BeNil())
+					status := prober.Status()
+					Ω(status.Foundations["father"].Healthy).Should(BeFalse())
+					Ω(status.Foundations["father"].ConsecutiveFailures).Should(Equal(1))
+					Ω(status.Foundations["father"].LastError).Should(Equal(fmt.Sprintf("uaa: %s/uaa/healthz returned 503", cfAPI.URL)))
+					Ω(status.ProposedState).Should(BeNil())
+				})
+			})
+
+			Context("as many times as the failure threshold", func() {
+				It("proposes killing its possum", func() {
+					Ω(prober.ProbeOnce()).Should(BeNil())
+					Ω(prober.ProbeOnce()).Should(BeNil())
+					status := prober.Status()
+					Ω(status.ProposedState).Should(Equal(map[string]string{"father": "dead"}))
+					Ω(status.LastAction).Should(Equal("Proposed killing father"))
+				})
+
+				Context("and then recovers", func() {
+					It("withdraws the proposal", func() {
+						Ω(prober.ProbeOnce()).Should(BeNil())
+						Ω(prober.ProbeOnce()).Should(BeNil())
+						failing["/uaa/healthz"] = false
+						Ω(prober.ProbeOnce()).Should(BeNil())
+						status := prober.Status()
+						Ω(status.Foundations["father"].ConsecutiveFailures).Should(Equal(0))
+						Ω(status.ProposedState).Should(BeNil())
+					})
+				})
+
+				Context("and changes are applied automatically", func() {
+					BeforeEach(func() {
+						config.AutoApply = true
+					})
+
+					It("kills its possum on every possum in the passel", func() {
+						Ω(prober.ProbeOnce()).Should(BeNil())
+						Ω(prober.ProbeOnce()).Should(BeNil())
+						status := prober.Status()
+						Ω(status.ProposedState).Should(BeNil())
+						Ω(status.LastAction).Should(Equal("Killed father"))
+					})
+
+					Context("and approval is required", func() {
+						BeforeEach(func() {
+							os.Setenv("REQUIRE_APPROVAL", "true")
+						})
+
+						AfterEach(func() {
+							os.Unsetenv("REQUIRE_APPROVAL")
+						})
+
+						It("leaves the change for someone to propose", func() {
+							Ω(prober.ProbeOnce()).Should(BeNil())
+							Ω(prober.ProbeOnce()).Should(BeNil())
+							status := prober.Status()
+							Ω(status.ProposedState).Should(Equal(map[string]string{"father": "dead"}))
+							Ω(status.LastAction).Should(Equal("Left killing father, changes need approval, propose them with POST /v1/passel_state"))
+						})
+					})
+
+					Context("and another possum is responsible for applying it", func() {
+						BeforeEach(func() {
+							applicationIn = fakeServer2
+						})
+
+						It("leaves the change to that possum", func() {
+							Ω(prober.ProbeOnce()).Should(BeNil())
+							Ω(prober.ProbeOnce()).Should(BeNil())
+							status := prober.Status()
+							Ω(status.ProposedState).Should(Equal(map[string]string{"father": "dead"}))
+							Ω(status.LastAction).Should(Equal(fmt.Sprintf("Left killing father to %s", fakeServer1.URL)))
+						})
+					})
+				})
+			})
+		})
+
+		Context("when every foundation fails", func() {
+			BeforeEach(func() {
+				failing["/canary/father"] = true
+				failing["/canary/mother"] = true
+				config.AutoApply = true
+			})
+
+			It("refuses to kill every possum", func() {
+				Ω(prober.ProbeOnce()).Should(BeNil())
+				err := prober.ProbeOnce()
+				Ω(err).Should(MatchError("Killing father, mother would leave fewer than 1 possums alive"))
+				status := prober.Status()
+				Ω(status.ProposedState).Should(BeNil())
+				Ω(status.LastAction).Should(Equal("Killing father, mother would leave fewer than 1 possums alive"))
+			})
+		})
+	})
+
+	Describe("#GetProbeStatus", func() {
+		var (
+			controller   *webs.Controller
+			mockRecorder *httptest.ResponseRecorder
+		)
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			mockRecorder = httptest.NewRecorder()
+		})
+
+		JustBeforeEach(func() {
+			req, _ := http.NewRequest("GET", "http://example.com/v1/probe_status", nil)
+			Router(controller).ServeHTTP(mockRecorder, req)
+		})
+
+		Context("when probing is not configured", func() {
+			It("returns a http 404", func() {
+				Ω(mockRecorder.Code).Should(Equal(404))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Foundation probing is not configured","code":"PROBE_DISABLED"}`)))
+			})
+		})
+
+		Context("when probing is configured", func() {
+			BeforeEach(func() {
+				controller.Prober = webs.NewProber(controller, webs.ProbeConfig{
+					AutoApply:   true,
+					Foundations: map[string]webs.ProbeTargets{"father": {Canary: "http://canary.example.com"}},
+				})
+			})
+
+			It("returns the probe status", func() {
+				Ω(mockRecorder.Code).Should(Equal(200))
+				Ω(mockRecorder.Body.String()).Should(Equal(`{"auto_apply":true,"foundations":{}}`))
+			})
+		})
+	})
+
+	Describe("#ReceiveAlerts", func() {
+		var (
+			controller   *webs.Controller
+			mockRecorder *httptest.ResponseRecorder
+			requestBody  string
+			password     string
+			passelState  map[string]string
+			posted       []string
+		)
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			mockRecorder = httptest.NewRecorder()
+			password = "admin"
+			posted = nil
+			passelState = make(map[string]string)
+			fakeServer1 = setupFakePossum(passelState, &posted)
+			fakeServer2 = setupFakePossum(passelState, &posted)
+			passelState[fakeServer1.URL] = "alive"
+			passelState[fakeServer2.URL] = "alive"
+			os.Setenv("VCAP_APPLICATION", "{}")
+			os.Setenv("VCAP_SERVICES", fmt.Sprintf(`{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "admin",
+    "password": "admin",
+    "passel": [
+      "%s",
+      "%s"
+    ]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`, fakeServer1.URL, fakeServer2.URL))
+			os.Setenv("ALERTMANAGER_RULES", fmt.Sprintf(`[
+  {"match": {"alertname": "FoundationDown", "foundation": "one"}, "possum": "%s"},
+  {"match": {"alertname": "FoundationDown", "foundation": "two"}, "possum": "%s"}
+]`, fakeServer1.URL, fakeServer2.URL))
+			requestBody = `{"version": "4", "status": "firing", "receiver": "possum", "alerts": [{"status": "firing", "labels": {"alertname": "FoundationDown", "foundation": "one", "severity": "critical"}}]}`
+		})
+
+		JustBeforeEach(func() {
+			req, _ := http.NewRequest("POST", "http://example.com/v1/alertmanager", strings.NewReader(requestBody))
+			req.SetBasicAuth("admin", password)
+			Router(controller).ServeHTTP(mockRecorder, req)
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("ALERTMANAGER_RULES")
+			teardown(fakeServer1)
+			teardown(fakeServer2)
+		})
+
+		Context("when not authenticated", func() {
+			BeforeEach(func() {
+				password = "wrong"
+			})
+
+			It("returns an authentication error", func() {
+				Ω(mockRecorder.Code).Should(Equal(401))
+				Ω(posted).Should(BeEmpty())
+			})
+		})
+
+		Context("when no rules are configured", func() {
+			BeforeEach(func() {
+				os.Unsetenv("ALERTMANAGER_RULES")
+			})
+
+			It("returns a http 404", func() {
+				Ω(mockRecorder.Code).Should(Equal(404))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Alertmanager rules are not configured","code":"ALERTMANAGER_DISABLED"}`)))
+			})
+		})
+
+		Context("when a rule has no match labels", func() {
+			BeforeEach(func() {
+				os.Setenv("ALERTMANAGER_RULES", `[{"possum": "https://possum.example.com"}]`)
+			})
+
+			It("returns a config error", func() {
+				Ω(mockRecorder.Code).Should(Equal(500))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"ALERTMANAGER_RULES is invalid: rule 0 needs match labels and a possum","code":"CONFIG_ERROR"}`)))
+			})
+		})
+
+		Context("when the payload is not an Alertmanager webhook", func() {
+			BeforeEach(func() {
+				requestBody = `{"alerts": [{"status": "pending", "labels": {}}]}`
+			})
+
+			It("returns a http 400", func() {
+				Ω(mockRecorder.Code).Should(Equal(400))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Request body is invalid: body.alerts[0].status should be one of [firing resolved] not pending","code":"INVALID_REQUEST"}`)))
+			})
+		})
+
+		Context("when no rule matches an alert", func() {
+			BeforeEach(func() {
+				requestBody = `{"alerts": [{"status": "firing", "labels": {"alertname": "DiskFull", "foundation": "one"}}]}`
+			})
+
+			It("changes nothing", func() {
+				Ω(mockRecorder.Code).Should(Equal(200))
+				Ω(mockRecorder.Body.String()).Should(Equal(`{"possum_states":{}}`))
+				Ω(posted).Should(BeEmpty())
+			})
+		})
+
+		Context("when a rule maps to a possum outside the passel", func() {
+			BeforeEach(func() {
+				os.Setenv("ALERTMANAGER_RULES", `[{"match": {"foundation": "one"}, "possum": "https://possum.example.com"}]`)
+			})
+
+			It("returns a http 400", func() {
+				Ω(mockRecorder.Code).Should(Equal(400))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Possum https://possum.example.com is not part of my passel","code":"POSSUM_NOT_IN_PASSEL"}`)))
+			})
+		})
+
+		Context("when an alert fires", func() {
+			It("kills the matching possum on every possum in the passel", func() {
+				Ω(mockRecorder.Code).Should(Equal(202))
+				Ω(posted).Should(Equal([]string{
+					fmt.Sprintf(`{"%s":"dead"}`, fakeServer1.URL),
+					fmt.Sprintf(`{"%s":"dead"}`, fakeServer1.URL),
+				}))
+				Ω(passelState[fakeServer1.URL]).Should(Equal("dead"))
+			})
+		})
+
+		Context("when an alert resolves", func() {
+			BeforeEach(func() {
+				passelState[fakeServer1.URL] = "dead"
+				requestBody = `{"alerts": [{"status": "resolved", "labels": {"alertname": "FoundationDown", "foundation": "one"}}]}`
+			})
+
+			It("revives the matching possum", func() {
+				Ω(mockRecorder.Code).Should(Equal(202))
+				Ω(passelState[fakeServer1.URL]).Should(Equal("alive"))
+			})
+
+			Context("while another alert for the same possum is firing", func() {
+				BeforeEach(func() {
+					requestBody = `{"alerts": [
+  {"status": "resolved", "labels": {"alertname": "FoundationDown", "foundation": "one", "instance": "a"}},
+  {"status": "firing", "labels": {"alertname": "FoundationDown", "foundation": "one", "instance": "b"}}
+]}`
+				})
+
+				It("keeps the possum dead", func() {
+					Ω(mockRecorder.Code).Should(Equal(202))
+					Ω(passelState[fakeServer1.URL]).Should(Equal("dead"))
+				})
+			})
+
+			Context("while another alert group for the same possum is firing", func() {
+				webhook := func(body string) *httptest.ResponseRecorder {
+					recorder := httptest.NewRecorder()
+					req, _ := http.NewRequest("POST", "http://example.com/v1/alertmanager", strings.NewReader(body))
+					req.SetBasicAuth("admin", "admin")
+					Router(controller).ServeHTTP(recorder, req)
+					return recorder
+				}
+
+				BeforeEach(func() {
+					Ω(webhook(`{"alerts": [{"status": "firing", "labels": {"alertname": "FoundationDown", "foundation": "one", "instance": "a"}}]}`).Code).Should(Equal(202))
+					Ω(webhook(`{"alerts": [{"status": "firing", "labels": {"alertname": "FoundationDown", "foundation": "one", "instance": "b"}}]}`).Code).Should(Equal(202))
+					requestBody = `{"alerts": [{"status": "resolved", "labels": {"alertname": "FoundationDown", "foundation": "one", "instance": "a"}}]}`
+				})
+
+				It("keeps the possum dead", func() {
+					Ω(mockRecorder.Code).Should(Equal(202))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(fmt.Sprintf(`"%s":"dead"`, fakeServer1.URL)))
+					Ω(passelState[fakeServer1.URL]).Should(Equal("dead"))
+				})
+
+				It("revives the possum once that group resolves too", func() {
+					Ω(webhook(`{"alerts": [{"status": "resolved", "labels": {"alertname": "FoundationDown", "foundation": "one", "instance": "b"}}]}`).Code).Should(Equal(202))
+					Ω(passelState[fakeServer1.URL]).Should(Equal("alive"))
+				})
+			})
+		})
+
+		Context("when alerts fire for every possum", func() {
+			BeforeEach(func() {
+				requestBody = `{"alerts": [
+  {"status": "firing", "labels": {"alertname": "FoundationDown", "foundation": "one"}},
+  {"status": "firing", "labels": {"alertname": "FoundationDown", "foundation": "two"}}
+]}`
+			})
+
+			It("refuses to kill every possum", func() {
+				Ω(mockRecorder.Code).Should(Equal(409))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Would have killed all possums","code":"WOULD_KILL_ALL"}`)))
+				Ω(posted).Should(BeEmpty())
+			})
+		})
+
+		Context("when approval is required", func() {
+			BeforeEach(func() {
+				os.Setenv("REQUIRE_APPROVAL", "true")
+				mock.ExpectExec("REPLACE INTO proposals").
+					WithArgs(sqlmock.AnyArg(), fmt.Sprintf(`{"%s":"dead"}`, fakeServer1.URL), false, false, "", "admin", sqlmock.AnyArg(), sqlmock.AnyArg(), "pending", "", nil, "", "").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			})
+
+			AfterEach(func() {
+				os.Unsetenv("REQUIRE_APPROVAL")
+			})
+
+			It("proposes the change instead of applying it", func() {
+				Ω(mockRecorder.Code).Should(Equal(202))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"status":"pending"`))
+				Ω(posted).Should(BeEmpty())
+				Ω(passelState[fakeServer1.URL]).Should(Equal("alive"))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+		})
+	})
+
+	Describe("quorum writes", func() {
+		var (
+			controller *webs.Controller
+			possums    []*httptest.Server
+			states     []map[string]string
+			posted     []string
+			passel     []string
+		)
+
+		setPassel := func(members []*httptest.Server) {
+			passel = nil
+			for _, possum := range members {
+				passel = append(passel, possum.URL)
+			}
+			os.Setenv("VCAP_APPLICATION", "{}")
+			os.Setenv("VCAP_SERVICES", fmt.Sprintf(`{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "admin",
+    "password": "admin",
+    "passel": ["%s"]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`, strings.Join(passel, `", "`)))
+		}
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			posted = nil
+			states = make([]map[string]string, 3)
+			possums = make([]*httptest.Server, 3)
+			for i := range possums {
+				states[i] = make(map[string]string)
+				possums[i] = setupFakePossum(states[i], &posted)
+			}
+			for i := range states {
+				for _, possum := range possums {
+					states[i][possum.URL] = "alive"
+				}
+			}
+			setPassel(possums)
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("PASSEL_QUORUM")
+			for _, possum := range possums {
+				possum.Close()
+			}
+		})
+
+		Describe("#SetPasselState", func() {
+			var mockRecorder *httptest.ResponseRecorder
+
+			JustBeforeEach(func() {
+				mockRecorder = httptest.NewRecorder()
+				req, _ := http.NewRequest("POST", "http://example.com/v1/passel_state", strings.NewReader(fmt.Sprintf(`{"possum_states": {"%s": "dead"}}`, possums[0].URL)))
+				req.SetBasicAuth("admin", "admin")
+				Router(controller).ServeHTTP(mockRecorder, req)
+			})
+
+			Context("when a minority of possums are unreachable", func() {
+				BeforeEach(func() {
+					possums[2].Close()
+					mock.ExpectExec("REPLACE INTO missed_writes").
+						WithArgs(possums[2].URL, "", fmt.Sprintf(`{"%s":"dead"}`, possums[0].URL), sqlmock.AnyArg(), "admin").
+						WillReturnResult(sqlmock.NewResult(1, 1))
+				})
+
+				It("writes to the quorum and records the missed possum", func() {
+					Ω(mockRecorder.Code).Should(Equal(202))
+					var response webs.PasselStatesResponse
+					Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &response)).Should(Succeed())
+					Ω(response.Consistent).Should(BeTrue())
+					Ω(response.Passel).Should(Equal([]string{possums[0].URL, possums[1].URL}))
+					Ω(response.Missed).Should(Equal([]string{possums[2].URL}))
+					Ω(posted).Should(HaveLen(2))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+
+				Context("and the quorum is the whole passel", func() {
+					BeforeEach(func() {
+						os.Setenv("PASSEL_QUORUM", "3")
+					})
+
+					It("does not write to any possum", func() {
+						Ω(mockRecorder.Code).Should(Equal(502))
+						Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"PEER_UNREACHABLE"`))
+						Ω(posted).Should(BeEmpty())
+					})
+				})
+			})
+
+			Context("when a possum answers from its cache", func() {
+				BeforeEach(func() {
+					possums[2].Close()
+					possums[2] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						if r.Method == "POST" {
+							posted = append(posted, "stale")
+						}
+						json.NewEncoder(w).Encode(webs.PossumStates{PossumStates: states[2], Stale: true})
+					}))
+					setPassel(possums)
+					mock.ExpectExec("REPLACE INTO missed_writes").
+						WithArgs(possums[2].URL, "", fmt.Sprintf(`{"%s":"dead"}`, possums[0].URL), sqlmock.AnyArg(), "admin").
+						WillReturnResult(sqlmock.NewResult(1, 1))
+				})
+
+				It("treats it as unreachable", func() {
+					Ω(mockRecorder.Code).Should(Equal(202))
+					var response webs.PasselStatesResponse
+					Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &response)).Should(Succeed())
+					Ω(response.Passel).Should(Equal([]string{possums[0].URL, possums[1].URL}))
+					Ω(response.Missed).Should(Equal([]string{possums[2].URL}))
+					Ω(posted).ShouldNot(ContainElement("stale"))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+
+			Context("when a majority of possums are unreachable", func() {
+				BeforeEach(func() {
+					possums[1].Close()
+					possums[2].Close()
+				})
+
+				It("does not write to any possum", func() {
+					Ω(mockRecorder.Code).Should(Equal(502))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"PEER_UNREACHABLE"`))
+					Ω(posted).Should(BeEmpty())
+				})
+			})
+
+			Context("when the write fails to reach a quorum after some possums were written", func() {
+				BeforeEach(func() {
+					for i := 1; i < 3; i++ {
+						state := states[i]
+						possums[i].Close()
+						possums[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+							if r.Method == "POST" {
+								w.WriteHeader(http.StatusInternalServerError)
+								fmt.Fprint(w, `{"error":"database is read only"}`)
+								return
+							}
+							json.NewEncoder(w).Encode(map[string]map[string]string{"possum_states": state})
+						}))
+					}
+					setPassel(possums)
+				})
+
+				It("rolls back the possums that were written", func() {
+					Ω(mockRecorder.Code).Should(Equal(502))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"PEER_ERROR"`))
+					Ω(posted).Should(Equal([]string{
+						fmt.Sprintf(`{"%s":"dead"}`, possums[0].URL),
+						fmt.Sprintf(`{"%s":"alive"}`, possums[0].URL),
+					}))
+					Ω(states[0][possums[0].URL]).Should(Equal("alive"))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+
+			Context("when the reachable possums disagree", func() {
+				BeforeEach(func() {
+					possums[2].Close()
+					states[1][possums[1].URL] = "dead"
+				})
+
+				It("returns the inconsistent states", func() {
+					Ω(mockRecorder.Code).Should(Equal(409))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"STATE_INCONSISTENT"`))
+					Ω(posted).Should(BeEmpty())
+				})
+			})
+		})
+
+		Describe("#CatchUpMissedWrites", func() {
+			expectMissedWrite := func(possum string) {
+				mock.ExpectQuery("SELECT (.+) FROM missed_writes").WillReturnRows(sqlmock.NewRows([]string{"possum", "service", "passel_state", "missed_at", "changed_by"}).
+					AddRow(possum, "", `{}`, time.Now(), "admin"))
+			}
+
+			BeforeEach(func() {
+				states[0][possums[0].URL] = "dead"
+				states[1][possums[0].URL] = "dead"
+			})
+
+			Context("when the possum has returned", func() {
+				BeforeEach(func() {
+					expectMissedWrite(possums[2].URL)
+					mock.ExpectExec("DELETE FROM missed_writes WHERE possum=").WithArgs(possums[2].URL, "").WillReturnResult(sqlmock.NewResult(1, 1))
+				})
+
+				It("writes the state the rest of the passel agrees on", func() {
+					Ω(controller.CatchUpMissedWrites()).Should(Succeed())
+					Ω(states[2]).Should(Equal(states[0]))
+					Ω(posted).Should(HaveLen(1))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+
+				Context("and has already caught up", func() {
+					BeforeEach(func() {
+						states[2][possums[0].URL] = "dead"
+					})
+
+					It("clears the missed write without writing", func() {
+						Ω(controller.CatchUpMissedWrites()).Should(Succeed())
+						Ω(posted).Should(BeEmpty())
+						Ω(mock.ExpectationsWereMet()).Should(Succeed())
+					})
+				})
+			})
+
+			Context("when the missed write names the possum differently from the passel", func() {
+				BeforeEach(func() {
+					expectMissedWrite(strings.ToUpper(possums[2].URL) + "/")
+					mock.ExpectExec("DELETE FROM missed_writes WHERE possum=").WithArgs(strings.ToUpper(possums[2].URL)+"/", "").WillReturnResult(sqlmock.NewResult(1, 1))
+				})
+
+				It("catches up the possum without asking it to agree with itself", func() {
+					Ω(controller.CatchUpMissedWrites()).Should(Succeed())
+					Ω(states[2]).Should(Equal(states[0]))
+					Ω(posted).Should(HaveLen(1))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+
+			Context("when the possum is still unreachable", func() {
+				BeforeEach(func() {
+					expectMissedWrite(possums[2].URL)
+					possums[2].Close()
+				})
+
+				It("keeps the missed write", func() {
+					Ω(controller.CatchUpMissedWrites()).Should(Succeed())
+					Ω(posted).Should(BeEmpty())
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+
+			Context("when the rest of the passel disagrees", func() {
+				BeforeEach(func() {
+					expectMissedWrite(possums[2].URL)
+					states[1][possums[0].URL] = "alive"
+				})
+
+				It("keeps the missed write", func() {
+					Ω(controller.CatchUpMissedWrites()).Should(Succeed())
+					Ω(posted).Should(BeEmpty())
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+
+			Context("when the possum has left the passel", func() {
+				BeforeEach(func() {
+					expectMissedWrite(possums[2].URL)
+					setPassel(possums[:2])
+					mock.ExpectExec("DELETE FROM missed_writes WHERE possum=").WillReturnResult(sqlmock.NewResult(1, 1))
+				})
+
+				It("clears the missed write", func() {
+					Ω(controller.CatchUpMissedWrites()).Should(Succeed())
+					Ω(posted).Should(BeEmpty())
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+		})
+	})
+
+	Describe("#Reload", func() {
+		var (
+			controller   *webs.Controller
+			mockRecorder *httptest.ResponseRecorder
+			dir          string
+			path         string
+		)
+
+		writeConfig := func(config string) {
+			Ω(ioutil.WriteFile(path, []byte(config), 0600)).Should(Succeed())
+		}
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			mockRecorder = httptest.NewRecorder()
+			dir, err = ioutil.TempDir("", "possum")
+			Ω(err).Should(BeNil())
+			path = dir + "/passel.json"
+			os.Setenv("VCAP_APPLICATION", "{}")
+			os.Setenv("VCAP_SERVICES", `{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "admin",
+    "password": "admin",
+    "passel": ["https://possum.example1.domain.com"]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`)
+		})
+
+		JustBeforeEach(func() {
+			req, _ := http.NewRequest("POST", "http://example.com/v1/reload", nil)
+			req.SetBasicAuth("admin", "admin")
+			Router(controller).ServeHTTP(mockRecorder, req)
+		})
+
+		AfterEach(func() {
+			utils.SetPasselConfig(nil)
+			os.RemoveAll(dir)
+		})
+
+		Context("when no passel config file is configured", func() {
+			It("returns a http 404", func() {
+				Ω(mockRecorder.Code).Should(Equal(404))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"PASSEL_CONFIG_FILE is not configured","code":"RELOAD_DISABLED"}`)))
+			})
+		})
+
+		Context("when a passel config file is configured", func() {
+			BeforeEach(func() {
+				controller.Reloader = webs.NewReloader(db, path)
+			})
+
+			Context("and it is valid", func() {
+				BeforeEach(func() {
+					writeConfig(`{"passel": ["https://possum.example1.domain.com", "https://possum.example3.domain.com"], "username": "new", "password": "secret", "initial_state": "dead"}`)
+					rows := sqlmock.NewRows([]string{"possum", "state"}).
+						AddRow("https://possum.example1.domain.com", "alive").
+						AddRow("https://possum.example2.domain.com", "alive")
+					mock.ExpectBegin()
+					mock.ExpectQuery("SELECT possum, state FROM state").WillReturnRows(rows)
+					mock.ExpectQuery("SELECT state FROM state_archive").WithArgs("https://possum.example3.domain.com").WillReturnRows(sqlmock.NewRows([]string{"state"}))
+					mock.ExpectExec(`INSERT INTO state \(possum, state\) VALUES`).WithArgs("https://possum.example3.domain.com", "dead").WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectQuery("SELECT service, state FROM service_state_archive").WithArgs("https://possum.example3.domain.com").WillReturnRows(sqlmock.NewRows([]string{"service", "state"}))
+					mock.ExpectExec("INSERT INTO state_archive").WithArgs("https://possum.example2.domain.com", "alive", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("DELETE FROM state WHERE possum=").WithArgs("https://possum.example2.domain.com").WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("INSERT INTO service_state_archive").WithArgs(sqlmock.AnyArg(), "https://possum.example2.domain.com").WillReturnResult(sqlmock.NewResult(0, 0))
+					mock.ExpectExec("DELETE FROM service_state WHERE possum=").WithArgs("https://possum.example2.domain.com").WillReturnResult(sqlmock.NewResult(0, 0))
+					mock.ExpectCommit()
+				})
+
+				It("swaps in the new passel and credentials", func() {
+					Ω(mockRecorder.Code).Should(Equal(200))
+					Ω(mockRecorder.Body.String()).Should(Equal(`{"passel":["https://possum.example1.domain.com","https://possum.example3.domain.com"],"added":["https://possum.example3.domain.com"],"archived":["https://possum.example2.domain.com"]}`))
+					Ω(utils.GetPassel()).Should(Equal([]string{"https://possum.example1.domain.com", "https://possum.example3.domain.com"}))
+					Ω(utils.GetUsername()).Should(Equal("new"))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+
+				It("does not reload again until the file changes", func() {
+					changed, err := controller.Reloader.ReloadIfChanged()
+					Ω(err).Should(BeNil())
+					Ω(changed).Should(BeFalse())
+				})
+			})
+
+			Context("and it is invalid", func() {
+				BeforeEach(func() {
+					writeConfig(`{"passel": ["possum.example1.domain.com"]}`)
+				})
+
+				It("keeps the current passel", func() {
+					Ω(mockRecorder.Code).Should(Equal(500))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, fmt.Sprintf(`{"error":"%s is invalid: possum \"possum.example1.domain.com\" is not an http or https URL","code":"CONFIG_ERROR"}`, path))))
+					Ω(utils.GetPassel()).Should(Equal([]string{"https://possum.example1.domain.com"}))
+				})
+			})
+
+			Context("and it would leave no possum alive", func() {
+				BeforeEach(func() {
+					writeConfig(`{"passel": ["https://possum.example1.domain.com", "https://possum.example3.domain.com"], "initial_state": "dead"}`)
+					mock.ExpectBegin()
+					mock.ExpectQuery("SELECT possum, state FROM state").WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow("https://possum.example1.domain.com", "dead"))
+					mock.ExpectQuery("SELECT state FROM state_archive").WithArgs("https://possum.example3.domain.com").WillReturnRows(sqlmock.NewRows([]string{"state"}))
+					mock.ExpectExec(`INSERT INTO state \(possum, state\) VALUES`).WithArgs("https://possum.example3.domain.com", "dead").WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectQuery("SELECT service, state FROM service_state_archive").WithArgs("https://possum.example3.domain.com").WillReturnRows(sqlmock.NewRows([]string{"service", "state"}))
+					mock.ExpectRollback()
+				})
+
+				It("keeps the current passel", func() {
+					Ω(mockRecorder.Code).Should(Equal(409))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Would have left no possum alive in the passel","code":"WOULD_KILL_ALL"}`)))
+					Ω(utils.GetPassel()).Should(Equal([]string{"https://possum.example1.domain.com"}))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+
+			Context("and approval is required but there is no peer secret", func() {
+				BeforeEach(func() {
+					os.Setenv("REQUIRE_APPROVAL", "true")
+					writeConfig(`{"passel": ["https://possum.example1.domain.com", "https://possum.example3.domain.com"]}`)
+				})
+
+				AfterEach(func() {
+					os.Unsetenv("REQUIRE_APPROVAL")
+				})
+
+				It("keeps the current passel", func() {
+					Ω(mockRecorder.Code).Should(Equal(500))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, fmt.Sprintf(`{"error":"%s is invalid: REQUIRE_APPROVAL needs a peer_secret to sign the writes possums make to each other","code":"CONFIG_ERROR"}`, path))))
+					Ω(utils.GetPassel()).Should(Equal([]string{"https://possum.example1.domain.com"}))
+				})
+			})
+
+			Context("and the state table cannot be synced", func() {
+				BeforeEach(func() {
+					writeConfig(`{"passel": ["https://possum.example3.domain.com"]}`)
+					mock.ExpectBegin()
+					mock.ExpectQuery("SELECT possum, state FROM state").WillReturnError(fmt.Errorf("An error has occurred: %s", "SELECT error"))
+				})
+
+				It("keeps the current passel", func() {
+					Ω(mockRecorder.Code).Should(Equal(500))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"An error has occurred: SELECT error","code":"DATABASE_ERROR"}`)))
+					Ω(utils.GetPassel()).Should(Equal([]string{"https://possum.example1.domain.com"}))
+				})
+			})
+		})
+	})
+
+	Describe("freeze windows", func() {
+		var (
+			controller   *webs.Controller
+			mockRecorder *httptest.ResponseRecorder
+			possums      []*httptest.Server
+			states       []map[string]string
+			posted       []*http.Request
+			username     string
+			body         string
+		)
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			mockRecorder = httptest.NewRecorder()
+			username = "admin"
+			posted = nil
+			states = make([]map[string]string, 2)
+			possums = make([]*httptest.Server, 2)
+			for i := range possums {
+				state := make(map[string]string)
+				states[i] = state
+				possums[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.Method == "POST" {
+						posted = append(posted, r)
+						var desired map[string]string
+						json.NewDecoder(r.Body).Decode(&desired)
+						for possum, desiredState := range desired {
+							state[possum] = desiredState
+						}
+					}
+					json.NewEncoder(w).Encode(map[string]map[string]string{"possum_states": state})
+				}))
+			}
+			for i := range states {
+				for _, possum := range possums {
+					states[i][possum.URL] = "alive"
+				}
+			}
+			os.Setenv("VCAP_APPLICATION", fmt.Sprintf(`{"application_uris": ["%s"]}`, strings.TrimPrefix(possums[0].URL, "http://")))
+			os.Setenv("VCAP_SERVICES", fmt.Sprintf(`{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "admin",
+    "password": "admin",
+    "emergency_username": "oncall",
+    "emergency_password": "oncall",
+    "peer_secret": "peer-secret",
+    "passel": ["%s", "%s"]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`, possums[0].URL, possums[1].URL))
+			os.Setenv("FREEZE_WINDOWS", `[{"name": "trading hours", "start": "2000-01-01T00:00", "end": "2100-01-01T00:00", "timezone": "Europe/London"}]`)
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("FREEZE_WINDOWS")
+			for _, possum := range possums {
+				possum.Close()
+			}
+		})
+
+		Describe("#SetPasselState", func() {
+			BeforeEach(func() {
+				body = fmt.Sprintf(`{"possum_states": {"%s": "dead"}}`, possums[1].URL)
+			})
+
+			JustBeforeEach(func() {
+				req, _ := http.NewRequest("POST", "http://example.com/v1/passel_state", strings.NewReader(body))
+				req.SetBasicAuth(username, username)
+				Router(controller).ServeHTTP(mockRecorder, req)
+			})
+
+			Context("when a freeze window is active", func() {
+				It("rejects the change", func() {
+					Ω(mockRecorder.Code).Should(Equal(423))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Changes are frozen by trading hours until 2100-01-01T00:00:00Z","code":"CHANGE_FROZEN"}`)))
+					Ω(posted).Should(BeEmpty())
+				})
+
+				Context("and the change would not change any state", func() {
+					BeforeEach(func() {
+						body = fmt.Sprintf(`{"possum_states": {"%s": "alive"}}`, possums[1].URL)
+					})
+
+					It("is accepted", func() {
+						Ω(mockRecorder.Code).Should(Equal(202))
+					})
+				})
+
+				Context("and the change is an emergency change without a reason", func() {
+					BeforeEach(func() {
+						username = "oncall"
+						body = fmt.Sprintf(`{"possum_states": {"%s": "dead"}, "emergency": true}`, possums[1].URL)
+					})
+
+					It("rejects the change", func() {
+						Ω(mockRecorder.Code).Should(Equal(400))
+						Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"An emergency change needs a reason","code":"INVALID_REQUEST"}`)))
+						Ω(posted).Should(BeEmpty())
+					})
+				})
+
+				Context("and the change is an emergency change made without the emergency credentials", func() {
+					BeforeEach(func() {
+						body = fmt.Sprintf(`{"possum_states": {"%s": "dead"}, "emergency": true, "reason": "datacentre fire"}`, possums[1].URL)
+					})
+
+					It("rejects the change", func() {
+						Ω(mockRecorder.Code).Should(Equal(403))
+						Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Emergency changes need the emergency credentials","code":"EMERGENCY_ROLE_REQUIRED"}`)))
+						Ω(posted).Should(BeEmpty())
+					})
+				})
+
+				Context("and the change is an emergency change made with the emergency credentials", func() {
+					BeforeEach(func() {
+						username = "oncall"
+						body = fmt.Sprintf(`{"possum_states": {"%s": "dead"}, "emergency": true, "reason": "datacentre fire"}`, possums[1].URL)
+					})
+
+					It("forwards the emergency change to every possum", func() {
+						Ω(mockRecorder.Code).Should(Equal(202))
+						Ω(posted).Should(HaveLen(2))
+						for _, req := range posted {
+							postedUsername, _, _ := req.BasicAuth()
+							Ω(postedUsername).Should(Equal("oncall"))
+							Ω(req.Header.Get("X-Possum-Emergency")).Should(Equal("true"))
+							Ω(req.Header.Get("X-Possum-Emergency-Reason")).Should(Equal("datacentre fire"))
+						}
+					})
+				})
+			})
+
+			Context("when a recurring freeze window is active", func() {
+				BeforeEach(func() {
+					os.Setenv("FREEZE_WINDOWS", `[{"cron": "* * * * *", "duration_minutes": 1, "timezone": "America/New_York"}]`)
+				})
+
+				It("rejects the change", func() {
+					Ω(mockRecorder.Code).Should(Equal(423))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`Changes are frozen by freeze window 0 until`))
+				})
+			})
+
+			Context("when no freeze window is active", func() {
+				BeforeEach(func() {
+					os.Setenv("FREEZE_WINDOWS", `[{"start": "2000-01-01T00:00", "end": "2000-01-02T00:00"}, {"cron": "0 0 1 1 *", "duration_minutes": 1}]`)
+				})
+
+				It("applies the change", func() {
+					Ω(mockRecorder.Code).Should(Equal(202))
+					Ω(posted).Should(HaveLen(2))
+				})
+			})
+
+			Context("when the freeze windows are invalid", func() {
+				BeforeEach(func() {
+					os.Setenv("FREEZE_WINDOWS", `[{"cron": "61 * * * *", "duration_minutes": 60}]`)
+				})
+
+				It("returns a config error", func() {
+					Ω(mockRecorder.Code).Should(Equal(500))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"FREEZE_WINDOWS is invalid: window 0: cron field \"61\" should be between 0 and 59","code":"CONFIG_ERROR"}`)))
+				})
+			})
+		})
+
+		Describe("#SetState", func() {
+			var (
+				emergencyReason string
+				actor           string
+				secret          string
+			)
+
+			BeforeEach(func() {
+				emergencyReason = ""
+				actor = ""
+				secret = ""
+				mock.ExpectBegin()
+				mock.ExpectQuery("^SELECT possum, state FROM state WHERE possum IN").
+					WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possums[0].URL, "alive").AddRow(possums[1].URL, "alive"))
+			})
+
+			JustBeforeEach(func() {
+				body := fmt.Sprintf(`{"%s": "dead"}`, possums[1].URL)
+				req, _ := http.NewRequest("POST", "http://example.com/v1/state", strings.NewReader(body))
+				req.SetBasicAuth(username, username)
+				if emergencyReason != "" {
+					req.Header.Set("X-Possum-Emergency", "true")
+					req.Header.Set("X-Possum-Emergency-Reason", emergencyReason)
+				}
+				if actor != "" {
+					req.Header.Set("X-Possum-Actor", actor)
+				}
+				if secret != "" {
+					timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+					mac := hmac.New(sha256.New, []byte(secret))
+					fmt.Fprintf(mac, "POST\n/v1/state\n%s\n%s\n%s", timestamp, actor, body)
+					req.Header.Set("X-Possum-Peer-Time", timestamp)
+					req.Header.Set("X-Possum-Peer-Signature", hex.EncodeToString(mac.Sum(nil)))
+				}
+				Router(controller).ServeHTTP(mockRecorder, req)
+			})
+
+			It("rejects the change", func() {
+				Ω(mockRecorder.Code).Should(Equal(423))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"CHANGE_FROZEN"`))
+			})
+
+			Context("when the change is a catch-up write", func() {
+				BeforeEach(func() {
+					actor = "catch-up"
+				})
+
+				It("rejects it unless it is signed with the peer secret", func() {
+					Ω(mockRecorder.Code).Should(Equal(423))
+				})
+
+				Context("signed with the peer secret", func() {
+					BeforeEach(func() {
+						secret = "peer-secret"
+						mock.ExpectExec("UPDATE state").WillReturnResult(sqlmock.NewResult(1, 1))
+						mock.ExpectExec("INSERT INTO state_history").WithArgs(possums[1].URL, "dead", sqlmock.AnyArg(), "catch-up", false, "").
+							WillReturnResult(sqlmock.NewResult(1, 1))
+						mock.ExpectCommit()
+						mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possums[0].URL, "alive").AddRow(possums[1].URL, "dead"))
+					})
+
+					It("applies it, since it replays a change that was already allowed", func() {
+						Ω(mockRecorder.Code).Should(Equal(202))
+						Ω(mock.ExpectationsWereMet()).Should(Succeed())
+					})
+				})
+			})
+
+			Context("when the change is an emergency change made with the emergency credentials", func() {
+				BeforeEach(func() {
+					username = "oncall"
+					emergencyReason = "datacentre fire"
+					mock.ExpectExec("UPDATE state").WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("INSERT INTO state_history").WithArgs(possums[1].URL, "dead", sqlmock.AnyArg(), "oncall", true, "datacentre fire").
+						WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectCommit()
+					mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possums[0].URL, "alive").AddRow(possums[1].URL, "dead"))
+				})
+
+				It("records the emergency change in the state history", func() {
+					Ω(mockRecorder.Code).Should(Equal(202))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+
+				Context("and names another actor without a peer signature", func() {
+					BeforeEach(func() {
+						actor = "mallory"
+					})
+
+					It("records the authenticated username", func() {
+						Ω(mockRecorder.Code).Should(Equal(202))
+						Ω(mock.ExpectationsWereMet()).Should(Succeed())
+					})
+				})
+			})
+		})
+	})
+
+	Describe("proposals", func() {
+		type peerRequest struct {
+			method, path, username, actor, body, signature string
+		}
+
+		var (
+			controller   *webs.Controller
+			mockRecorder *httptest.ResponseRecorder
+			possums      []*httptest.Server
+			requests     []peerRequest
+			proposedAt   time.Time
+			columns      []string
+		)
+
+		proposalRow := func(proposedBy string, expiresAt time.Time, status string) *sqlmock.Rows {
+			return sqlmock.NewRows(columns).AddRow("abc", fmt.Sprintf(`{"%s":"dead"}`, possums[1].URL), false, false, "", proposedBy, proposedAt, expiresAt, status, "", nil, nil, "")
+		}
+
+		serve := func(method string, path string, username string, body string) {
+			req, _ := http.NewRequest(method, "http://example.com"+path, strings.NewReader(body))
+			req.SetBasicAuth(username, username+"-password")
+			Router(controller).ServeHTTP(mockRecorder, req)
+		}
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			mockRecorder = httptest.NewRecorder()
+			requests = nil
+			proposedAt = time.Now().UTC().Add(-time.Minute)
+			columns = []string{"id", "possum_states", "force_update", "emergency", "reason", "proposed_by", "proposed_at", "expires_at", "status", "decided_by", "decided_at", "error", "service"}
+			possums = make([]*httptest.Server, 2)
+			states := make([]map[string]string, 2)
+			for i := range possums {
+				state := make(map[string]string)
+				states[i] = state
+				possums[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					data, _ := ioutil.ReadAll(r.Body)
+					username, _, _ := r.BasicAuth()
+					if r.Method != "GET" {
+						requests = append(requests, peerRequest{r.Method, r.URL.Path, username, r.Header.Get("X-Possum-Actor"), string(data), r.Header.Get("X-Possum-Peer-Signature")})
+					}
+					if r.Method == "POST" {
+						var desired map[string]string
+						json.Unmarshal(data, &desired)
+						for possum, desiredState := range desired {
+							state[possum] = desiredState
+						}
+					}
+					json.NewEncoder(w).Encode(map[string]map[string]string{"possum_states": state})
+				}))
+			}
+			for _, state := range states {
+				for _, possum := range possums {
+					state[possum.URL] = "alive"
+				}
+			}
+			os.Setenv("VCAP_APPLICATION", "{}")
+			os.Setenv("VCAP_SERVICES", fmt.Sprintf(`{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "admin",
+    "password": "admin-password",
+    "peer_secret": "peer-secret",
+    "emergency_username": "oncall",
+    "emergency_password": "oncall-password",
+    "users": {"alice": "alice-password", "bob": "bob-password"},
+    "passel": ["%s", "%s"]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`, possums[0].URL, possums[1].URL))
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("REQUIRE_APPROVAL")
+			for _, possum := range possums {
+				possum.Close()
+			}
+		})
+
+		Describe("#SetPasselState", func() {
+			Context("when the change is proposed", func() {
+				BeforeEach(func() {
+					mock.ExpectExec("REPLACE INTO proposals").
+						WithArgs(sqlmock.AnyArg(), fmt.Sprintf(`{"%s":"dead"}`, possums[1].URL), false, false, "", "alice", sqlmock.AnyArg(), sqlmock.AnyArg(), "pending", "", nil, "", "").
+						WillReturnResult(sqlmock.NewResult(1, 1))
+					serve("POST", "/v1/passel_state", "alice", fmt.Sprintf(`{"possum_states": {"%s": "dead"}, "propose": true}`, possums[1].URL))
+				})
+
+				It("stores a pending proposal on every possum without changing any state", func() {
+					Ω(mockRecorder.Code).Should(Equal(202))
+					var proposal utils.Proposal
+					Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &proposal)).Should(Succeed())
+					Ω(proposal.ID).ShouldNot(BeEmpty())
+					Ω(proposal.ProposedBy).Should(Equal("alice"))
+					Ω(proposal.Status).Should(Equal("pending"))
+					Ω(proposal.ExpiresAt.Sub(proposal.ProposedAt)).Should(Equal(15 * time.Minute))
+					Ω(requests).Should(HaveLen(2))
+					for _, request := range requests {
+						Ω(request.method).Should(Equal("PUT"))
+						Ω(request.path).Should(Equal("/v1/proposals/" + proposal.ID))
+						Ω(request.username).Should(Equal("admin"))
+					}
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+
+			Context("when the change is proposed with the emergency credentials", func() {
+				It("rejects the proposal", func() {
+					serve("POST", "/v1/passel_state", "oncall", fmt.Sprintf(`{"possum_states": {"%s": "dead"}, "propose": true}`, possums[1].URL))
+					Ω(mockRecorder.Code).Should(Equal(403))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"The emergency credentials bypass approval, apply the change without proposing it","code":"APPROVAL_FORBIDDEN"}`)))
+					Ω(requests).Should(BeEmpty())
+				})
+			})
+
+			Context("when approval is required", func() {
+				BeforeEach(func() {
+					os.Setenv("REQUIRE_APPROVAL", "true")
+				})
+
+				It("proposes the change", func() {
+					mock.ExpectExec("REPLACE INTO proposals").WillReturnResult(sqlmock.NewResult(1, 1))
+					serve("POST", "/v1/passel_state", "alice", fmt.Sprintf(`{"possum_states": {"%s": "dead"}}`, possums[1].URL))
+					Ω(mockRecorder.Code).Should(Equal(202))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"status":"pending"`))
+				})
+
+				It("applies changes made with the emergency credentials without a proposal", func() {
+					serve("POST", "/v1/passel_state", "oncall", fmt.Sprintf(`{"possum_states": {"%s": "dead"}, "emergency": true, "reason": "outage"}`, possums[1].URL))
+					Ω(mockRecorder.Code).Should(Equal(202))
+					Ω(requests).Should(HaveLen(2))
+					for _, request := range requests {
+						Ω(request.method).Should(Equal("POST"))
+						Ω(request.path).Should(Equal("/v1/state"))
+					}
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+
+				It("still allows dry runs", func() {
+					serve("POST", "/v1/passel_state", "alice", fmt.Sprintf(`{"possum_states": {"%s": "dead"}, "dry_run": true}`, possums[1].URL))
+					Ω(mockRecorder.Code).Should(Equal(200))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"dry_run":true`))
+				})
+
+				It("rejects changes made to a single possum by users", func() {
+					serve("POST", "/v1/state", "alice", fmt.Sprintf(`{"%s": "dead"}`, possums[1].URL))
+					Ω(mockRecorder.Code).Should(Equal(403))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Changes need approval, propose them with POST /v1/passel_state","code":"APPROVAL_REQUIRED"}`)))
+				})
+
+				It("rejects changes made to a single possum with the credentials possums share", func() {
+					serve("POST", "/v1/state", "admin", fmt.Sprintf(`{"%s": "dead"}`, possums[1].URL))
+					Ω(mockRecorder.Code).Should(Equal(403))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"APPROVAL_REQUIRED"`))
+				})
+
+				Context("when the change is signed with the peer secret", func() {
+					var signedAt int64
+
+					signedServe := func(secret string, body string) {
+						timestamp := strconv.FormatInt(signedAt, 10)
+						mac := hmac.New(sha256.New, []byte(secret))
+						fmt.Fprintf(mac, "POST\n/v1/state\n%s\nalice, approved by bob\n%s", timestamp, body)
+						req, _ := http.NewRequest("POST", "http://example.com/v1/state", strings.NewReader(body))
+						req.SetBasicAuth("admin", "admin-password")
+						req.Header.Set("X-Possum-Actor", "alice, approved by bob")
+						req.Header.Set("X-Possum-Peer-Time", timestamp)
+						req.Header.Set("X-Possum-Peer-Signature", hex.EncodeToString(mac.Sum(nil)))
+						Router(controller).ServeHTTP(mockRecorder, req)
+					}
+
+					BeforeEach(func() {
+						signedAt = time.Now().Unix()
+						os.Setenv("VCAP_APPLICATION", fmt.Sprintf(`{"application_uris": ["%s"]}`, strings.TrimPrefix(possums[0].URL, "http://")))
+					})
+
+					It("applies the change", func() {
+						mock.ExpectBegin()
+						mock.ExpectQuery("^SELECT possum, state FROM state WHERE possum IN").
+							WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possums[0].URL, "alive").AddRow(possums[1].URL, "alive"))
+						mock.ExpectExec("UPDATE state").WillReturnResult(sqlmock.NewResult(1, 1))
+						mock.ExpectExec("INSERT INTO state_history").WillReturnResult(sqlmock.NewResult(1, 1))
+						mock.ExpectCommit()
+						mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().
+							WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possums[0].URL, "alive").AddRow(possums[1].URL, "dead"))
+						signedServe("peer-secret", fmt.Sprintf(`{"%s": "dead"}`, possums[1].URL))
+						Ω(mockRecorder.Code).Should(Equal(202))
+						Ω(mock.ExpectationsWereMet()).Should(Succeed())
+					})
+
+					It("rejects changes signed with another secret", func() {
+						signedServe("guessed-secret", fmt.Sprintf(`{"%s": "dead"}`, possums[1].URL))
+						Ω(mockRecorder.Code).Should(Equal(403))
+						Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"APPROVAL_REQUIRED"`))
+					})
+
+					It("rejects changes signed too long ago", func() {
+						signedAt = time.Now().Add(-time.Hour).Unix()
+						signedServe("peer-secret", fmt.Sprintf(`{"%s": "dead"}`, possums[1].URL))
+						Ω(mockRecorder.Code).Should(Equal(403))
+					})
+				})
+			})
+		})
+
+		Describe("#ApproveProposal", func() {
+			Context("when approved by someone else", func() {
+				BeforeEach(func() {
+					mock.ExpectQuery("SELECT (.+) FROM proposals WHERE id=").WithArgs("abc").WillReturnRows(proposalRow("alice", proposedAt.Add(15*time.Minute), "pending"))
+					mock.ExpectExec("UPDATE proposals SET status=").WithArgs("approved", "bob", sqlmock.AnyArg(), "abc", "pending", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectExec("REPLACE INTO proposals").
+						WithArgs("abc", sqlmock.AnyArg(), false, false, "", "alice", sqlmock.AnyArg(), sqlmock.AnyArg(), "executed", "bob", sqlmock.AnyArg(), "", "").
+						WillReturnResult(sqlmock.NewResult(1, 1))
+					serve("POST", "/v1/proposals/abc/approve", "bob", "")
+				})
+
+				It("applies the change to every possum and records who proposed and approved it", func() {
+					Ω(mockRecorder.Code).Should(Equal(202))
+					var posts []peerRequest
+					for _, request := range requests {
+						if request.method == "POST" {
+							posts = append(posts, request)
+						}
+					}
+					Ω(posts).Should(HaveLen(2))
+					for _, post := range posts {
+						Ω(post.actor).Should(Equal("alice, approved by bob"))
+						Ω(post.signature).ShouldNot(BeEmpty())
+					}
+					Ω(requests[len(requests)-1].body).Should(ContainSubstring(`"status":"executed"`))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+
+			Context("when the claim does not reach a majority of the passel", func() {
+				It("releases the claim on every possum without applying the change", func() {
+					possums[1].Close()
+					mock.ExpectQuery("SELECT (.+) FROM proposals WHERE id=").WithArgs("abc").WillReturnRows(proposalRow("alice", proposedAt.Add(15*time.Minute), "pending"))
+					mock.ExpectExec("UPDATE proposals SET status=").WithArgs("approved", "bob", sqlmock.AnyArg(), "abc", "pending", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectExec("UPDATE proposals SET status=(.+), decided_by='', decided_at=NULL").WithArgs("pending", "abc", "approved", "bob").WillReturnResult(sqlmock.NewResult(0, 1))
+					serve("POST", "/v1/proposals/abc/approve", "bob", "")
+					Ω(mockRecorder.Code).Should(Equal(409))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"PROPOSAL_CONFLICT"`))
+					Ω(requests).Should(HaveLen(2))
+					for _, request := range requests {
+						Ω(request.method).Should(Equal("PUT"))
+					}
+					Ω(requests[1].body).Should(ContainSubstring(`"status":"pending"`))
+					Ω(requests[1].body).Should(ContainSubstring(`"decided_by":"bob"`))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+
+			Context("when approved by the proposer", func() {
+				It("rejects the approval", func() {
+					mock.ExpectQuery("SELECT (.+) FROM proposals WHERE id=").WillReturnRows(proposalRow("alice", proposedAt.Add(15*time.Minute), "pending"))
+					serve("POST", "/v1/proposals/abc/approve", "alice", "")
+					Ω(mockRecorder.Code).Should(Equal(403))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Proposal abc must be approved by someone other than alice","code":"APPROVAL_FORBIDDEN"}`)))
+					Ω(requests).Should(BeEmpty())
+				})
+			})
+
+			Context("when approved with the credentials possums share", func() {
+				It("rejects the approval", func() {
+					mock.ExpectQuery("SELECT (.+) FROM proposals WHERE id=").WillReturnRows(proposalRow("alice", proposedAt.Add(15*time.Minute), "pending"))
+					serve("POST", "/v1/proposals/abc/approve", "admin", "")
+					Ω(mockRecorder.Code).Should(Equal(403))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Proposals must be approved by a named user","code":"APPROVAL_FORBIDDEN"}`)))
+				})
+			})
+
+			Context("when approved with the emergency credentials", func() {
+				It("rejects the approval", func() {
+					mock.ExpectQuery("SELECT (.+) FROM proposals WHERE id=").WillReturnRows(proposalRow("alice", proposedAt.Add(15*time.Minute), "pending"))
+					serve("POST", "/v1/proposals/abc/approve", "oncall", "")
+					Ω(mockRecorder.Code).Should(Equal(403))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Proposals must be approved by a named user","code":"APPROVAL_FORBIDDEN"}`)))
+					Ω(requests).Should(BeEmpty())
+				})
+			})
+
+			Context("when the proposal has expired", func() {
+				It("rejects the approval", func() {
+					mock.ExpectQuery("SELECT (.+) FROM proposals WHERE id=").WillReturnRows(proposalRow("alice", proposedAt.Add(time.Second), "pending"))
+					serve("POST", "/v1/proposals/abc/approve", "bob", "")
+					Ω(mockRecorder.Code).Should(Equal(410))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"PROPOSAL_EXPIRED"`))
+				})
+			})
+
+			Context("when the proposal has already been approved", func() {
+				It("rejects the approval", func() {
+					mock.ExpectQuery("SELECT (.+) FROM proposals WHERE id=").WillReturnRows(proposalRow("alice", proposedAt.Add(15*time.Minute), "executed"))
+					mock.ExpectExec("UPDATE proposals SET status=").WillReturnResult(sqlmock.NewResult(0, 0))
+					serve("POST", "/v1/proposals/abc/approve", "bob", "")
+					Ω(mockRecorder.Code).Should(Equal(409))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Proposal abc is executed","code":"PROPOSAL_NOT_PENDING"}`)))
+				})
+			})
+
+			Context("when the proposal does not exist", func() {
+				It("returns a http 404", func() {
+					mock.ExpectQuery("SELECT (.+) FROM proposals WHERE id=").WillReturnRows(sqlmock.NewRows(columns))
+					serve("POST", "/v1/proposals/abc/approve", "bob", "")
+					Ω(mockRecorder.Code).Should(Equal(404))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Could not find proposal abc","code":"PROPOSAL_NOT_FOUND"}`)))
+				})
+			})
+		})
+
+		Describe("#PutProposal", func() {
+			var body string
+
+			BeforeEach(func() {
+				body = fmt.Sprintf(`{"id": "abc", "possum_states": {"%s": "dead"}, "proposed_by": "alice", "proposed_at": "2019-06-01T12:30:00Z", "expires_at": "2019-06-01T12:45:00Z", "status": "pending"}`, possums[1].URL)
+			})
+
+			It("stores the proposal", func() {
+				mock.ExpectQuery("SELECT (.+) FROM proposals WHERE id=").WithArgs("abc").WillReturnRows(sqlmock.NewRows(columns))
+				mock.ExpectExec("REPLACE INTO proposals").WithArgs("abc", sqlmock.AnyArg(), false, false, "", "alice", sqlmock.AnyArg(), sqlmock.AnyArg(), "pending", "", nil, "", "").WillReturnResult(sqlmock.NewResult(1, 1))
+				serve("PUT", "/v1/proposals/abc", "admin", body)
+				Ω(mockRecorder.Code).Should(Equal(200))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+
+			It("rejects a new proposal that is not pending", func() {
+				mock.ExpectQuery("SELECT (.+) FROM proposals WHERE id=").WithArgs("abc").WillReturnRows(sqlmock.NewRows(columns))
+				serve("PUT", "/v1/proposals/abc", "admin", strings.Replace(body, `"status": "pending"`, `"status": "approved", "decided_by": "bob"`, 1))
+				Ω(mockRecorder.Code).Should(Equal(409))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"PROPOSAL_CONFLICT"`))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+
+			Context("when the proposal is stored", func() {
+				var expiresAt time.Time
+
+				stored := func(status string, decidedBy string, possumStates string) string {
+					return fmt.Sprintf(`{"id": "abc", "possum_states": %s, "proposed_by": "alice", "proposed_at": "%s", "expires_at": "%s", "status": "%s", "decided_by": "%s"}`,
+						possumStates, proposedAt.Format(time.RFC3339Nano), expiresAt.Format(time.RFC3339Nano), status, decidedBy)
+				}
+
+				BeforeEach(func() {
+					expiresAt = proposedAt.Add(15 * time.Minute)
+					mock.ExpectQuery("SELECT (.+) FROM proposals WHERE id=").WithArgs("abc").WillReturnRows(proposalRow("alice", expiresAt, "pending"))
+				})
+
+				It("claims the proposal for the approver", func() {
+					mock.ExpectExec("UPDATE proposals SET status=").WithArgs("approved", "bob", sqlmock.AnyArg(), "abc", "pending", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+					serve("PUT", "/v1/proposals/abc", "admin", stored("approved", "bob", fmt.Sprintf(`{"%s": "dead"}`, possums[1].URL)))
+					Ω(mockRecorder.Code).Should(Equal(200))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+
+				It("rejects the claim when someone else claimed it first", func() {
+					mock.ExpectExec("UPDATE proposals SET status=").WillReturnResult(sqlmock.NewResult(0, 0))
+					serve("PUT", "/v1/proposals/abc", "admin", stored("approved", "bob", fmt.Sprintf(`{"%s": "dead"}`, possums[1].URL)))
+					Ω(mockRecorder.Code).Should(Equal(409))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"PROPOSAL_NOT_PENDING"`))
+				})
+
+				It("does not take the release of a claim it does not hold", func() {
+					serve("PUT", "/v1/proposals/abc", "admin", stored("pending", "bob", fmt.Sprintf(`{"%s": "dead"}`, possums[1].URL)))
+					Ω(mockRecorder.Code).Should(Equal(409))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+
+				It("rejects approvals by the proposer", func() {
+					serve("PUT", "/v1/proposals/abc", "admin", stored("approved", "alice", fmt.Sprintf(`{"%s": "dead"}`, possums[1].URL)))
+					Ω(mockRecorder.Code).Should(Equal(409))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+
+				It("rejects a proposal that changes the proposed states", func() {
+					serve("PUT", "/v1/proposals/abc", "admin", stored("approved", "bob", fmt.Sprintf(`{"%s": "dead"}`, possums[0].URL)))
+					Ω(mockRecorder.Code).Should(Equal(409))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Proposal abc does not match the proposal stored here","code":"PROPOSAL_CONFLICT"}`)))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+
+			Context("when the proposal is claimed", func() {
+				var release string
+
+				BeforeEach(func() {
+					expiresAt := proposedAt.Add(15 * time.Minute)
+					mock.ExpectQuery("SELECT (.+) FROM proposals WHERE id=").WithArgs("abc").WillReturnRows(sqlmock.NewRows(columns).
+						AddRow("abc", fmt.Sprintf(`{"%s":"dead"}`, possums[1].URL), false, false, "", "alice", proposedAt, expiresAt, "approved", "bob", proposedAt, nil, ""))
+					release = fmt.Sprintf(`{"id": "abc", "possum_states": {"%s": "dead"}, "proposed_by": "alice", "proposed_at": "%s", "expires_at": "%s", "status": "pending", "decided_by": "%%s"}`,
+						possums[1].URL, proposedAt.Format(time.RFC3339Nano), expiresAt.Format(time.RFC3339Nano))
+				})
+
+				It("releases the claim for the approver who made it", func() {
+					mock.ExpectExec("UPDATE proposals SET status=(.+), decided_by='', decided_at=NULL").WithArgs("pending", "abc", "approved", "bob").WillReturnResult(sqlmock.NewResult(0, 1))
+					serve("PUT", "/v1/proposals/abc", "admin", fmt.Sprintf(release, "bob"))
+					Ω(mockRecorder.Code).Should(Equal(200))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+
+				It("does not release the claim for anyone else", func() {
+					serve("PUT", "/v1/proposals/abc", "admin", fmt.Sprintf(release, "carol"))
+					Ω(mockRecorder.Code).Should(Equal(409))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"PROPOSAL_CONFLICT"`))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+
+			It("rejects a proposal moving on from executed", func() {
+				mock.ExpectQuery("SELECT (.+) FROM proposals WHERE id=").WithArgs("abc").WillReturnRows(proposalRow("alice", proposedAt.Add(15*time.Minute), "executed"))
+				serve("PUT", "/v1/proposals/abc", "admin", fmt.Sprintf(`{"id": "abc", "possum_states": {"%s": "dead"}, "proposed_by": "alice", "proposed_at": "%s", "expires_at": "%s", "status": "failed", "decided_by": "bob"}`,
+					possums[1].URL, proposedAt.Format(time.RFC3339Nano), proposedAt.Add(15*time.Minute).Format(time.RFC3339Nano)))
+				Ω(mockRecorder.Code).Should(Equal(409))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+
+			It("only accepts signed proposals when approval is required", func() {
+				os.Setenv("REQUIRE_APPROVAL", "true")
+				serve("PUT", "/v1/proposals/abc", "admin", body)
+				Ω(mockRecorder.Code).Should(Equal(403))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"APPROVAL_REQUIRED"`))
+			})
+
+			It("only accepts proposals from possums", func() {
+				serve("PUT", "/v1/proposals/abc", "alice", body)
+				Ω(mockRecorder.Code).Should(Equal(401))
+			})
+
+			It("rejects a proposal that does not match the path", func() {
+				serve("PUT", "/v1/proposals/def", "admin", body)
+				Ω(mockRecorder.Code).Should(Equal(400))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Proposal abc does not match the path","code":"INVALID_REQUEST"}`)))
+			})
+		})
+
+		Describe("#GetProposals", func() {
+			It("reports pending proposals past their expiry as expired", func() {
+				mock.ExpectQuery("SELECT (.+) FROM proposals ORDER BY proposed_at DESC").WillReturnRows(proposalRow("alice", proposedAt.Add(time.Second), "pending"))
+				serve("GET", "/v1/proposals", "alice", "")
+				Ω(mockRecorder.Code).Should(Equal(200))
+				var response webs.ProposalsResponse
+				Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &response)).Should(Succeed())
+				Ω(response.Proposals).Should(HaveLen(1))
+				Ω(response.Proposals[0].Status).Should(Equal("expired"))
+			})
+		})
+	})
+
+	Describe("brute-force protection", func() {
+		var controller *webs.Controller
+
+		reload := func(remoteAddr string, username string, password string, forwardedFor string) *httptest.ResponseRecorder {
+			mockRecorder := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "http://example.com/v1/reload", nil)
+			req.RemoteAddr = remoteAddr
+			if username != "" {
+				req.SetBasicAuth(username, password)
+			}
+			if forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", forwardedFor)
+			}
+			Router(controller).ServeHTTP(mockRecorder, req)
+			return mockRecorder
+		}
+
+		signedReload := func(remoteAddr string, secret string) *httptest.ResponseRecorder {
+			mockRecorder := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "http://example.com/v1/reload", nil)
+			req.RemoteAddr = remoteAddr
+			req.SetBasicAuth("admin", "admin")
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			mac := hmac.New(sha256.New, []byte(secret))
+			fmt.Fprintf(mac, "POST\n/v1/reload\n%s\n\n", timestamp)
+			req.Header.Set("X-Possum-Peer-Time", timestamp)
+			req.Header.Set("X-Possum-Peer-Signature", hex.EncodeToString(mac.Sum(nil)))
+			Router(controller).ServeHTTP(mockRecorder, req)
+			return mockRecorder
+		}
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			os.Setenv("VCAP_APPLICATION", "{}")
+			os.Setenv("VCAP_SERVICES", `{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "admin",
+    "password": "admin",
+    "peer_secret": "peer-secret",
+    "users": {"alice": "alice"}
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`)
+			os.Setenv("AUTH_LOCKOUT_THRESHOLD", "3")
+			os.Setenv("AUTH_LOCKOUT_BASE_SECONDS", "60")
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("AUTH_LOCKOUT_THRESHOLD")
+			os.Unsetenv("AUTH_LOCKOUT_BASE_SECONDS")
+			os.Unsetenv("WRITE_ALLOWED_CIDRS")
+			os.Unsetenv("TRUSTED_PROXY_CIDRS")
+		})
+
+		Context("when a source keeps guessing", func() {
+			BeforeEach(func() {
+				for i := 0; i < 3; i++ {
+					Ω(reload("192.0.2.1:1234", "guess", fmt.Sprintf("guess-%d", i), "").Code).Should(Equal(401))
+				}
+			})
+
+			It("locks the source out, even with the right credentials", func() {
+				mockRecorder := reload("192.0.2.1:1234", "admin", "admin", "")
+				Ω(mockRecorder.Code).Should(Equal(429))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"AUTH_LOCKED_OUT"`))
+				Ω(mockRecorder.Header().Get("Retry-After")).Should(Equal("60"))
+			})
+
+			It("does not lock the username out at other sources", func() {
+				Ω(reload("192.0.2.2:1234", "guess", "guess", "").Code).Should(Equal(401))
+			})
+
+			It("does not lock out other sources and usernames", func() {
+				Ω(reload("192.0.2.2:1234", "admin", "admin", "").Code).Should(Equal(404))
+			})
+
+			It("reports the rejections and lockouts as metrics", func() {
+				reload("192.0.2.1:1234", "admin", "admin", "")
+				mockRecorder := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "http://example.com/metrics", nil)
+				Router(controller).ServeHTTP(mockRecorder, req)
+				Ω(mockRecorder.Code).Should(Equal(200))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring(`possum_auth_rejections_total{reason="bad_credentials"} 3`))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring(`possum_auth_rejections_total{reason="locked_out"} 1`))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring("possum_auth_lockouts_total 2"))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring("possum_auth_locked_out 2"))
+			})
+		})
+
+		Context("when a source keeps guessing the password of the peer username", func() {
+			BeforeEach(func() {
+				for i := 0; i < 3; i++ {
+					Ω(reload("192.0.2.1:1234", "admin", fmt.Sprintf("guess-%d", i), "").Code).Should(Equal(401))
+				}
+			})
+
+			It("locks the source out", func() {
+				Ω(reload("192.0.2.1:1234", "admin", "admin", "").Code).Should(Equal(429))
+			})
+
+			It("does not lock the peer username out at other sources", func() {
+				Ω(reload("192.0.2.2:1234", "admin", "admin", "").Code).Should(Equal(404))
+			})
+
+			It("still accepts writes signed with the peer secret", func() {
+				Ω(signedReload("192.0.2.1:1234", "peer-secret").Code).Should(Equal(404))
+				Ω(signedReload("192.0.2.2:1234", "peer-secret").Code).Should(Equal(404))
+			})
+
+			It("does not clear the lockout after a signed write", func() {
+				signedReload("192.0.2.1:1234", "peer-secret")
+				Ω(reload("192.0.2.1:1234", "admin", "admin", "").Code).Should(Equal(429))
+			})
+
+			It("rejects writes signed with another secret", func() {
+				Ω(signedReload("192.0.2.1:1234", "guessed-secret").Code).Should(Equal(429))
+			})
+		})
+
+		It("forgets failed attempts after a success", func() {
+			reload("192.0.2.1:1234", "alice", "guess", "")
+			reload("192.0.2.1:1234", "alice", "guess", "")
+			Ω(reload("192.0.2.1:1234", "alice", "alice", "").Code).Should(Equal(404))
+			reload("192.0.2.1:1234", "alice", "guess", "")
+			reload("192.0.2.1:1234", "alice", "guess", "")
+			Ω(reload("192.0.2.1:1234", "alice", "alice", "").Code).Should(Equal(404))
+		})
+
+		Context("when a shared source keeps guessing at one username", func() {
+			BeforeEach(func() {
+				Ω(reload("192.0.2.1:1234", "guess", "guess-0", "").Code).Should(Equal(401))
+				Ω(reload("192.0.2.1:1234", "guess", "guess-1", "").Code).Should(Equal(401))
+				Ω(reload("192.0.2.1:1234", "alice", "alice", "").Code).Should(Equal(404))
+				Ω(reload("192.0.2.1:1234", "guess", "guess-2", "").Code).Should(Equal(401))
+			})
+
+			It("locks the username out at the source after other users succeed", func() {
+				Ω(reload("192.0.2.1:1234", "guess", "guess-3", "").Code).Should(Equal(429))
+			})
+
+			It("does not lock out the other users of the source", func() {
+				Ω(reload("192.0.2.1:1234", "alice", "alice", "").Code).Should(Equal(404))
+			})
+		})
+
+		It("does not count requests without credentials", func() {
+			for i := 0; i < 3; i++ {
+				Ω(reload("192.0.2.1:1234", "", "", "").Code).Should(Equal(401))
+			}
+			Ω(reload("192.0.2.1:1234", "admin", "admin", "").Code).Should(Equal(404))
+		})
+
+		Context("when WRITE_ALLOWED_CIDRS is set", func() {
+			BeforeEach(func() {
+				os.Setenv("WRITE_ALLOWED_CIDRS", "10.0.0.0/8, 192.0.2.7")
+			})
+
+			It("allows writes from the allowed sources", func() {
+				Ω(reload("10.1.2.3:1234", "admin", "admin", "").Code).Should(Equal(404))
+				Ω(reload("192.0.2.7:1234", "admin", "admin", "").Code).Should(Equal(404))
+			})
+
+			It("rejects writes from other sources", func() {
+				mockRecorder := reload("192.0.2.1:1234", "admin", "admin", "")
+				Ω(mockRecorder.Code).Should(Equal(403))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Writes are not allowed from 192.0.2.1","code":"SOURCE_NOT_ALLOWED"}`)))
+			})
+
+			It("ignores X-Forwarded-For from untrusted proxies", func() {
+				Ω(reload("192.0.2.1:1234", "admin", "admin", "10.1.2.3").Code).Should(Equal(403))
+			})
+
+			Context("and the request comes through a trusted proxy", func() {
+				BeforeEach(func() {
+					os.Setenv("TRUSTED_PROXY_CIDRS", "192.0.2.0/28")
+				})
+
+				It("uses the last address added before the trusted proxies", func() {
+					Ω(reload("192.0.2.1:1234", "admin", "admin", "10.1.2.3, 192.0.2.2").Code).Should(Equal(404))
+					Ω(reload("192.0.2.1:1234", "admin", "admin", "10.1.2.3, 198.51.100.1").Code).Should(Equal(403))
+				})
+			})
+
+			Context("and it is invalid", func() {
+				BeforeEach(func() {
+					os.Setenv("WRITE_ALLOWED_CIDRS", "10.0.0.0/99")
+				})
+
+				It("rejects every write", func() {
+					mockRecorder := reload("10.1.2.3:1234", "admin", "admin", "")
+					Ω(mockRecorder.Code).Should(Equal(500))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"CONFIG_ERROR"`))
+				})
+			})
+		})
+	})
+
+	Describe("state cache", func() {
+		var (
+			controller *webs.Controller
+			cacheDir   string
+		)
+
+		get := func(path string) *httptest.ResponseRecorder {
+			mockRecorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+			Router(controller).ServeHTTP(mockRecorder, req)
+			return mockRecorder
+		}
+
+		expectStates := func(states ...string) {
+			rows := sqlmock.NewRows([]string{"possum", "state"})
+			for i, possum := range []string{"https://possum.example1.domain.com", "father"} {
+				rows.AddRow(possum, states[i])
+			}
+			mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().
+				WithArgs("https://possum.example1.domain.com", "father").
+				WillReturnRows(rows)
+		}
+
+		BeforeEach(func() {
+			var err error
+			cacheDir, err = ioutil.TempDir("", "possum-state-cache")
+			Ω(err).Should(BeNil())
+			os.Setenv("STATE_CACHE_FILE", cacheDir+"/cache.json")
+			os.Setenv("VCAP_APPLICATION", `{"application_uris": ["possum.example1.domain.com"]}`)
+			os.Setenv("VCAP_SERVICES", `{
+"user-provided": [
+ {
+  "credentials": {
+    "passel": ["https://possum.example1.domain.com", "father"]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`)
+			controller = webs.CreateController(db)
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("STATE_CACHE_FILE")
+			os.Unsetenv("STATE_CACHE_MAX_AGE_SECONDS")
+			os.RemoveAll(cacheDir)
+		})
+
+		Context("when the database becomes unavailable after a successful read", func() {
+			BeforeEach(func() {
+				expectStates("alive", "dead")
+				Ω(get("/v1/passel_state").Code).Should(Equal(200))
+				mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnError(errConnectionRefused)
+			})
+
+			It("serves the state of the possum from the cache, marked as stale", func() {
+				mockRecorder := get("/v1/state")
+				Ω(mockRecorder.Code).Should(Equal(200))
+				var response webs.StateResponse
+				Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &response)).Should(Succeed())
+				Ω(response.State).Should(Equal("alive"))
+				Ω(response.Stale).Should(BeTrue())
+				Ω(response.CachedAt).ShouldNot(BeNil())
+				Ω(mockRecorder.Header().Get("Warning")).Should(ContainSubstring("Response is Stale"))
+			})
+
+			It("counts the reads served from the cache", func() {
+				get("/v1/state")
+				mockRecorder := get("/metrics")
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring(`possum_state_cache_served_total{reader="state"} 1`))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring(`possum_state_cache_served_total{reader="passel_state"} 0`))
+			})
+
+			It("keeps the cache on disk for the next instance", func() {
+				controller = webs.CreateController(db)
+				Ω(get("/v1/state").Code).Should(Equal(200))
+			})
+
+			Context("and the cache is older than the staleness budget", func() {
+				BeforeEach(func() {
+					os.Setenv("STATE_CACHE_FILE", cacheDir+"/old.json")
+					Ω(ioutil.WriteFile(cacheDir+"/old.json", []byte(`{"possum_states": {"https://possum.example1.domain.com": "alive"}, "read_at": "2020-01-01T00:00:00Z"}`), 0600)).Should(Succeed())
+					controller = webs.CreateController(db)
+				})
+
+				It("returns the database error", func() {
+					mockRecorder := get("/v1/state")
+					Ω(mockRecorder.Code).Should(Equal(500))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"dial tcp: connection refused","code":"DATABASE_ERROR"}`)))
+				})
+			})
+		})
+
+		Context("when the database becomes unavailable after the passel state was read", func() {
+			BeforeEach(func() {
+				expectStates("alive", "dead")
+				Ω(get("/v1/passel_state").Code).Should(Equal(200))
+				// the statement was prepared by the first read
+				mock.ExpectQuery("^SELECT (.+) FROM state WHERE possum IN").WillReturnError(errConnectionRefused)
+			})
+
+			It("serves the passel state from the cache, marked as stale", func() {
+				mockRecorder := get("/v1/passel_state")
+				Ω(mockRecorder.Code).Should(Equal(200))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"possum_states":{"father":"dead","https://possum.example1.domain.com":"alive"},"stale":true,"cached_at":`))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+		})
+
+		Context("when a read fails for a reason other than reaching the database", func() {
+			BeforeEach(func() {
+				expectStates("alive", "dead")
+				Ω(get("/v1/passel_state").Code).Should(Equal(200))
+				mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnError(sql.ErrNoRows)
+			})
+
+			It("returns the error rather than the cached state", func() {
+				mockRecorder := get("/v1/state")
+				Ω(mockRecorder.Code).Should(Equal(500))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"sql: no rows in result set","code":"DATABASE_ERROR"}`)))
+				Ω(mockRecorder.Header().Get("Warning")).Should(BeEmpty())
+			})
+		})
+
+		Context("when only some possums were read since the staleness budget ran out", func() {
+			BeforeEach(func() {
+				Ω(ioutil.WriteFile(cacheDir+"/cache.json", []byte(`{"possum_states": {"https://possum.example1.domain.com": "alive", "father": "alive"}, "read_at": "2020-01-01T00:00:00Z"}`), 0600)).Should(Succeed())
+				controller = webs.CreateController(db)
+				mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().
+					WithArgs("https://possum.example1.domain.com").
+					WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow("https://possum.example1.domain.com", "alive"))
+				Ω(get("/v1/state").Code).Should(Equal(200))
+				mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnError(errConnectionRefused)
+			})
+
+			It("does not serve the possums that were not read from the cache", func() {
+				mockRecorder := get("/v1/passel_state")
+				Ω(mockRecorder.Code).Should(Equal(500))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"DATABASE_ERROR"`))
+			})
+		})
+
+		Context("when the database is available", func() {
+			It("does not mark the state as stale", func() {
+				expectStates("alive", "dead")
+				mockRecorder := get("/v1/passel_state")
+				Ω(mockRecorder.Code).Should(Equal(200))
+				Ω(mockRecorder.Body.String()).Should(Equal(`{"possum_states":{"father":"dead","https://possum.example1.domain.com":"alive"}}`))
+				Ω(mockRecorder.Header().Get("Warning")).Should(BeEmpty())
+			})
+		})
+
+		Context("when nothing has been cached", func() {
+			It("returns the database error", func() {
+				mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnError(errConnectionRefused)
+				Ω(get("/v1/state").Code).Should(Equal(500))
+			})
+		})
+	})
+
+	Describe("request IDs", func() {
+		var (
+			controller   *webs.Controller
+			mockRecorder *httptest.ResponseRecorder
+			req          *http.Request
+		)
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			mockRecorder = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "http://example.com/v1/state", nil)
+		})
+
+		Context("when the client does not send a request ID", func() {
+			It("gives the request one and returns it with the error", func() {
+				Router(controller).ServeHTTP(mockRecorder, req)
+				Ω(mockRecorder.Header().Get("X-Request-ID")).Should(MatchRegexp(`^[0-9a-f]{32}$`))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring(fmt.Sprintf(`"request_id":"%s"`, mockRecorder.Header().Get("X-Request-ID"))))
+			})
+		})
+
+		Context("when the client sends a request ID", func() {
+			It("uses it", func() {
+				req.Header.Set("X-Request-ID", "change-1234")
+				Router(controller).ServeHTTP(mockRecorder, req)
+				Ω(mockRecorder.Header().Get("X-Request-ID")).Should(Equal("change-1234"))
+			})
+
+			It("replaces it if it could forge log lines", func() {
+				req.Header.Set("X-Request-ID", "change\nlevel=error")
+				Router(controller).ServeHTTP(mockRecorder, req)
+				Ω(mockRecorder.Header().Get("X-Request-ID")).Should(MatchRegexp(`^[0-9a-f]{32}$`))
+			})
+		})
+
+		Context("when the request calls other possums", func() {
+			var (
+				possums    []*httptest.Server
+				requestIDs []string
+			)
+
+			BeforeEach(func() {
+				requestIDs = nil
+				possums = make([]*httptest.Server, 2)
+				for i := range possums {
+					possums[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						requestIDs = append(requestIDs, r.Header.Get("X-Request-ID"))
+						w.Write([]byte(`{"possum_states": {"joey": "alive"}}`))
+					}))
+				}
+				os.Setenv("VCAP_SERVICES", fmt.Sprintf(`{
+"user-provided": [
+ {
+  "credentials": {
+    "passel": ["%s", "%s"]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`, possums[0].URL, possums[1].URL))
+				os.Setenv("VCAP_APPLICATION", "{}")
+				req, _ = http.NewRequest("GET", "http://example.com/v1/passel_state_consistency", nil)
+				req.Header.Set("X-Request-ID", "change-1234")
+			})
+
+			AfterEach(func() {
+				for _, possum := range possums {
+					possum.Close()
+				}
+			})
+
+			It("sends the request ID to every possum", func() {
+				Router(controller).ServeHTTP(mockRecorder, req)
+				Ω(mockRecorder.Code).Should(Equal(200))
+				Ω(requestIDs).Should(Equal([]string{"change-1234", "change-1234", "change-1234", "change-1234"}))
+			})
+		})
+
+		Context("when ACCESS_LOG is true", func() {
+			var logs *bytes.Buffer
+
+			BeforeEach(func() {
+				logs = &bytes.Buffer{}
+				log.SetOutput(logs)
+				os.Setenv("ACCESS_LOG", "true")
+			})
+
+			AfterEach(func() {
+				log.SetOutput(os.Stderr)
+				os.Unsetenv("ACCESS_LOG")
+			})
+
+			It("logs every request with its request ID", func() {
+				req.Header.Set("X-Request-ID", "change-1234")
+				Router(controller).ServeHTTP(mockRecorder, req)
+				Ω(logs.String()).Should(ContainSubstring(`msg="Handled request"`))
+				Ω(logs.String()).Should(ContainSubstring("request_id=change-1234"))
+				Ω(logs.String()).Should(ContainSubstring("route=/v1/state"))
+				Ω(logs.String()).Should(ContainSubstring("status=500"))
+			})
+		})
+	})
+
+	Describe("tracing", func() {
+		var (
+			controller   *webs.Controller
+			mockRecorder *httptest.ResponseRecorder
+			req          *http.Request
+			exporter     *recordingExporter
+			tracer       *tracing.Tracer
+		)
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			mockRecorder = httptest.NewRecorder()
+			exporter = &recordingExporter{}
+			tracer = tracing.NewTracer("possum", exporter)
+			tracing.SetTracer(tracer)
+		})
+
+		AfterEach(func() {
+			tracing.SetTracer(nil)
+		})
+
+		Context("when the request calls other possums", func() {
+			var (
+				possums      []*httptest.Server
+				traceParents []string
+			)
+
+			BeforeEach(func() {
+				traceParents = nil
+				possums = make([]*httptest.Server, 2)
+				for i := range possums {
+					possums[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						traceParents = append(traceParents, r.Header.Get("traceparent"))
+						w.Write([]byte(`{"possum_states": {"joey": "alive"}}`))
+					}))
+				}
+				os.Setenv("VCAP_SERVICES", fmt.Sprintf(`{
+"user-provided": [
+ {
+  "credentials": {
+    "passel": ["%s", "%s"]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`, possums[0].URL, possums[1].URL))
+				os.Setenv("VCAP_APPLICATION", "{}")
+				req, _ = http.NewRequest("GET", "http://example.com/v1/passel_state_consistency", nil)
+				req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+			})
+
+			AfterEach(func() {
+				for _, possum := range possums {
+					possum.Close()
+				}
+			})
+
+			It("continues the trace on every possum with a span per call", func() {
+				Router(controller).ServeHTTP(mockRecorder, req)
+				Ω(mockRecorder.Code).Should(Equal(200))
+				Ω(tracer.Flush()).Should(Succeed())
+				Ω(exporter.spans).Should(HaveLen(6))
+				server := exporter.spans[5]
+				Ω(server.Name).Should(Equal("GET /v1/passel_state_consistency"))
+				Ω(server.Kind).Should(Equal(tracing.KindServer))
+				Ω(server.TraceID).Should(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+				Ω(server.ParentSpanID).Should(Equal("00f067aa0ba902b7"))
+				Ω(server.Attributes["http.status_code"]).Should(Equal(200))
+				Ω(server.Attributes["request_id"]).Should(Equal(mockRecorder.Header().Get("X-Request-ID")))
+				for i, client := range exporter.spans[:2] {
+					Ω(client.Name).Should(Equal("GET /v1/passel_state"))
+					Ω(client.Kind).Should(Equal(tracing.KindClient))
+					Ω(client.ParentSpanID).Should(Equal(server.SpanID))
+					Ω(client.Attributes["http.url"]).Should(Equal(possums[i].URL + "/v1/passel_state"))
+					Ω(traceParents[i]).Should(Equal(fmt.Sprintf("00-4bf92f3577b34da6a3ce929d0e0e4736-%s-01", client.SpanID)))
+				}
+				for i, client := range exporter.spans[2:4] {
+					Ω(client.Name).Should(Equal("GET /v1/members"))
+					Ω(client.ParentSpanID).Should(Equal(server.SpanID))
+					Ω(traceParents[i+2]).Should(Equal(fmt.Sprintf("00-4bf92f3577b34da6a3ce929d0e0e4736-%s-01", client.SpanID)))
+				}
+				Ω(exporter.spans[4].Name).Should(Equal("store GetOrphanedStates"))
+			})
+		})
+
+		Context("when the request reads the store", func() {
+			var mock sqlmock.Sqlmock
+
+			BeforeEach(func() {
+				var mockDB *sql.DB
+				mockDB, mock, _ = sqlmock.New()
+				controller = webs.CreateController(mockDB)
+				controller.StateCache = nil
+				os.Setenv("VCAP_SERVICES", `{
+"user-provided": [
+ {
+  "credentials": {
+    "passel": ["http://possum1.example.com"]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`)
+				os.Setenv("VCAP_APPLICATION", "{}")
+				mock.ExpectPrepare("SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnError(fmt.Errorf("connection refused"))
+				req, _ = http.NewRequest("GET", "http://example.com/v1/passel_state", nil)
+			})
+
+			It("traces the store call as a child of the request", func() {
+				Router(controller).ServeHTTP(mockRecorder, req)
+				Ω(mockRecorder.Code).Should(Equal(500))
+				Ω(tracer.Flush()).Should(Succeed())
+				Ω(exporter.spans).Should(HaveLen(2))
+				store, server := exporter.spans[0], exporter.spans[1]
+				Ω(store.Name).Should(Equal("store GetPasselState"))
+				Ω(store.TraceID).Should(Equal(server.TraceID))
+				Ω(store.ParentSpanID).Should(Equal(server.SpanID))
+				Ω(store.Attributes["db.system"]).Should(Equal("mysql"))
+				Ω(store.Error).Should(ContainSubstring("connection refused"))
+				Ω(server.ParentSpanID).Should(BeEmpty())
+				Ω(server.Error).Should(Equal("500 Internal Server Error"))
+			})
+		})
+	})
+
+	Describe("readiness and diagnostics", func() {
+		var (
+			controller   *webs.Controller
+			mockRecorder *httptest.ResponseRecorder
+			req          *http.Request
+			possums      []*httptest.Server
+		)
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			mockRecorder = httptest.NewRecorder()
+			possums = make([]*httptest.Server, 2)
+			for i := range possums {
+				ready := i == 0
+				possums[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == "/v1/ready" && !ready {
+						w.WriteHeader(503)
+					}
+					w.Write([]byte(`{"possum_states": {"joey": "alive"}}`))
+				}))
+			}
+			os.Setenv("VCAP_APPLICATION", fmt.Sprintf(`{"application_uris": ["%s"]}`, strings.TrimPrefix(possums[0].URL, "http://")))
+			os.Setenv("VCAP_SERVICES", fmt.Sprintf(`{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "admin",
+    "password": "admin",
+    "passel": ["%s", "%s", "http://127.0.0.1:1"]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`, possums[0].URL, possums[1].URL))
+		})
+
+		AfterEach(func() {
+			for _, possum := range possums {
+				possum.Close()
+			}
+		})
+
+		Describe("#GetReady", func() {
+			BeforeEach(func() {
+				req, _ = http.NewRequest("GET", "http://example.com/v1/ready", nil)
+			})
+
+			Context("when the database, passel config and possum are all fine", func() {
+				It("returns 200", func() {
+					Router(controller).ServeHTTP(mockRecorder, req)
+					Ω(mockRecorder.Code).Should(Equal(200))
+					Ω(mockRecorder.Body.String()).Should(MatchJSON(fmt.Sprintf(`{"ready":true,"checks":{"database":{"ok":true},"passel_config":{"ok":true},"possum":{"ok":true,"possum":"%s"}}}`, possums[0].URL)))
+				})
+			})
+
+			Context("when the database cannot be reached", func() {
+				BeforeEach(func() {
+					unreachableDB, _ := sql.Open("mysql", "possum:possum@tcp(127.0.0.1:1)/possum")
+					controller = webs.CreateController(unreachableDB)
+				})
+
+				It("returns 503 with the failing check", func() {
+					Router(controller).ServeHTTP(mockRecorder, req)
+					Ω(mockRecorder.Code).Should(Equal(503))
+					var response webs.ReadyResponse
+					Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &response)).Should(Succeed())
+					Ω(response.Ready).Should(BeFalse())
+					Ω(response.Checks["database"].OK).Should(BeFalse())
+					Ω(response.Checks["database"].Error).Should(ContainSubstring("connection refused"))
+					Ω(response.Checks["passel_config"].OK).Should(BeTrue())
+				})
+			})
+
+			Context("when this instance is not in the passel", func() {
+				BeforeEach(func() {
+					os.Setenv("VCAP_APPLICATION", `{"application_uris": ["possum.example.com"]}`)
+				})
+
+				It("returns 503 with the failing check", func() {
+					Router(controller).ServeHTTP(mockRecorder, req)
+					Ω(mockRecorder.Code).Should(Equal(503))
+					Ω(mockRecorder.Body.String()).Should(MatchJSON(`{"ready":false,"checks":{"database":{"ok":true},"passel_config":{"ok":true},"possum":{"ok":false,"error":"Could not match any possum in db"}}}`))
+				})
+			})
+		})
+
+		Describe("#GetDiagnostics", func() {
+			BeforeEach(func() {
+				req, _ = http.NewRequest("GET", "http://example.com/v1/diagnostics", nil)
+			})
+
+			Context("without credentials", func() {
+				It("returns 401", func() {
+					Router(controller).ServeHTTP(mockRecorder, req)
+					Ω(mockRecorder.Code).Should(Equal(401))
+				})
+			})
+
+			Context("with credentials", func() {
+				BeforeEach(func() {
+					req.SetBasicAuth("admin", "admin")
+				})
+
+				It("returns the configuration and view of the passel", func() {
+					Router(controller).ServeHTTP(mockRecorder, req)
+					Ω(mockRecorder.Code).Should(Equal(200))
+					var response webs.DiagnosticsResponse
+					Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &response)).Should(Succeed())
+					Ω(response.Version).Should(Equal("dev"))
+					Ω(response.ConfigSource).Should(Equal("VCAP_SERVICES"))
+					Ω(response.Possum).Should(Equal(possums[0].URL))
+					Ω(response.DBDriver).Should(Equal("mysql"))
+					Ω(response.Peers).Should(HaveLen(3))
+					Ω(response.Peers[0].Reachable).Should(BeTrue())
+					Ω(response.Peers[0].Ready).Should(BeTrue())
+					Ω(response.Peers[1].Reachable).Should(BeTrue())
+					Ω(response.Peers[1].Ready).Should(BeFalse())
+					Ω(response.Peers[1].StatusCode).Should(Equal(503))
+					Ω(response.Peers[2].Reachable).Should(BeFalse())
+					Ω(response.Peers[2].Error).Should(ContainSubstring("connection refused"))
+					Ω(response.LastConsistentAt).Should(BeNil())
+					Ω(response.SecondsSinceLastConsistency).Should(BeNil())
+				})
+
+				It("returns when the passel was last consistent", func() {
+					os.Setenv("VCAP_SERVICES", fmt.Sprintf(`{"user-provided": [{"credentials": {"username": "admin", "password": "admin", "passel": ["%s", "%s"]}, "label": "user-provided", "name": "possum"}]}`, possums[0].URL, possums[1].URL))
+					consistencyReq, _ := http.NewRequest("GET", "http://example.com/v1/passel_state_consistency", nil)
+					consistencyRecorder := httptest.NewRecorder()
+					Router(controller).ServeHTTP(consistencyRecorder, consistencyReq)
+					Ω(consistencyRecorder.Code).Should(Equal(200))
+
+					Router(controller).ServeHTTP(mockRecorder, req)
+					var response webs.DiagnosticsResponse
+					Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &response)).Should(Succeed())
+					Ω(response.LastConsistentAt).ShouldNot(BeNil())
+					Ω(*response.LastConsistentAt).Should(BeTemporally("~", time.Now(), 5*time.Second))
+					Ω(*response.SecondsSinceLastConsistency).Should(BeNumerically("<", 5))
+				})
+			})
+		})
+	})
+
+	Describe("peer discovery", func() {
+		const self = "https://possum-self.example.com"
+		var (
+			controller   *webs.Controller
+			mockDB       *sql.DB
+			mock         sqlmock.Sqlmock
+			mockRecorder *httptest.ResponseRecorder
+		)
+
+		BeforeEach(func() {
+			mockDB, mock, _ = sqlmock.New()
+			controller = webs.CreateController(mockDB)
+			mockRecorder = httptest.NewRecorder()
+			os.Setenv("VCAP_APPLICATION", `{"application_uris": ["possum-self.example.com"]}`)
+			os.Setenv("VCAP_SERVICES", `{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "admin",
+    "password": "admin",
+    "passel": ["https://possum-self.example.com"],
+    "peer_secret": "peer-secret"
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`)
+		})
+
+		AfterEach(func() {
+			utils.SetPasselConfig(nil)
+		})
+
+		Describe("#LoadDiscoveryConfig", func() {
+			It("fills in the defaults and takes self from the application uris", func() {
+				config, err := webs.LoadDiscoveryConfig([]byte(`{"mode": "seeds", "seeds": ["https://possum-seed.example.com"]}`))
+				Ω(err).Should(BeNil())
+				Ω(config.Self).Should(Equal(self))
+				Ω(config.IntervalSeconds).Should(Equal(30))
+				Ω(config.MissedRounds).Should(Equal(10))
+				Ω(config.InitialState).Should(Equal("alive"))
+			})
+
+			It("rejects an unknown mode", func() {
+				_, err := webs.LoadDiscoveryConfig([]byte(`{"mode": "gossip"}`))
+				Ω(err).Should(MatchError(`mode should have been "seeds" or "dns" not "gossip"`))
+			})
+
+			It("rejects seeds mode without seeds", func() {
+				_, err := webs.LoadDiscoveryConfig([]byte(`{"mode": "seeds"}`))
+				Ω(err).Should(MatchError("no seeds were configured"))
+			})
+
+			It("rejects a seed that is not a URL", func() {
+				_, err := webs.LoadDiscoveryConfig([]byte(`{"mode": "seeds", "seeds": ["possum-seed.example.com"]}`))
+				Ω(err).Should(MatchError(`possum "possum-seed.example.com" is not an http or https URL`))
+			})
+
+			It("rejects seeds mode without a peer secret to sign registrations", func() {
+				os.Setenv("VCAP_SERVICES", `{"user-provided": [{"credentials": {"username": "admin", "password": "admin", "passel": ["https://possum-self.example.com"]}, "label": "user-provided", "name": "possum"}]}`)
+				_, err := webs.LoadDiscoveryConfig([]byte(`{"mode": "seeds", "seeds": ["https://possum-seed.example.com"]}`))
+				Ω(err).Should(MatchError("seeds mode needs a peer_secret to sign registrations"))
+			})
+
+			It("rejects dns mode without an SRV name", func() {
+				_, err := webs.LoadDiscoveryConfig([]byte(`{"mode": "dns"}`))
+				Ω(err).Should(MatchError("no srv_name was configured"))
+			})
+		})
+
+		Context("when discovering through seeds", func() {
+			var (
+				seed, other   *httptest.Server
+				registrations []string
+				seedMembers   []string
+				discoverer    *webs.Discoverer
+				// peers are the seed and other possum, in the sorted order of the passel
+				peers []string
+			)
+
+			peer := func() *httptest.Server {
+				return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					var request webs.RegisterMemberRequest
+					json.NewDecoder(r.Body).Decode(&request)
+					username, password, _ := r.BasicAuth()
+					if r.Method == "POST" && r.Header.Get("X-Possum-Peer-Signature") == "" {
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					registrations = append(registrations, fmt.Sprintf("%s %s %s:%s", r.Method, request.Possum, username, password))
+					json.NewEncoder(w).Encode(webs.MembersResponse{Discovery: "seeds", Members: seedMembers})
+				}))
+			}
+
+			BeforeEach(func() {
+				registrations = nil
+				seed = peer()
+				other = peer()
+				seedMembers = []string{seed.URL, other.URL, self}
+				peers = []string{seed.URL, other.URL}
+				sort.Strings(peers)
+				config, err := webs.LoadDiscoveryConfig([]byte(fmt.Sprintf(`{"mode": "seeds", "seeds": ["%s"], "missed_rounds": 2}`, seed.URL)))
+				Ω(err).Should(BeNil())
+				discoverer = webs.NewDiscoverer(mockDB, config)
+				controller.Discoverer = discoverer
+
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT possum, state FROM state").WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(self, "alive"))
+				mock.ExpectQuery("SELECT state FROM state_archive").WithArgs(peers[0]).WillReturnRows(sqlmock.NewRows([]string{"state"}))
+				mock.ExpectExec(`INSERT INTO state \(possum, state\) VALUES`).WithArgs(peers[0], "alive").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery("SELECT service, state FROM service_state_archive").WithArgs(peers[0]).WillReturnRows(sqlmock.NewRows([]string{"service", "state"}))
+				mock.ExpectQuery("SELECT state FROM state_archive").WithArgs(peers[1]).WillReturnRows(sqlmock.NewRows([]string{"state"}))
+				mock.ExpectExec(`INSERT INTO state \(possum, state\) VALUES`).WithArgs(peers[1], "alive").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery("SELECT service, state FROM service_state_archive").WithArgs(peers[1]).WillReturnRows(sqlmock.NewRows([]string{"service", "state"}))
+				mock.ExpectCommit()
+				mock.ExpectExec("INSERT INTO membership_changes").WithArgs(peers[0], "joined", "seeds", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO membership_changes").WithArgs(peers[1], "joined", "seeds", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+				Ω(discoverer.Discover()).Should(Succeed())
+			})
+
+			AfterEach(func() {
+				seed.Close()
+				other.Close()
+			})
+
+			It("registers with the seed and swaps in the passel it learns", func() {
+				Ω(registrations).Should(Equal([]string{fmt.Sprintf("POST %s admin:admin", self)}))
+				passel, err := utils.GetPassel()
+				Ω(err).Should(BeNil())
+				Ω(passel).Should(Equal([]string{peers[0], peers[1], self}))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+
+			It("registers with the possums it learned of in the next round", func() {
+				Ω(discoverer.Discover()).Should(Succeed())
+				Ω(registrations).Should(HaveLen(3))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+
+			It("returns the members and that every possum agrees on them", func() {
+				mock.ExpectQuery("SELECT possum, event, source, changed_at FROM membership_changes").WithArgs(20).
+					WillReturnRows(sqlmock.NewRows([]string{"possum", "event", "source", "changed_at"}).AddRow(other.URL, "joined", "seeds", time.Now()))
+				req, _ := http.NewRequest("GET", "http://example.com/v1/members", nil)
+				Router(controller).ServeHTTP(mockRecorder, req)
+				Ω(mockRecorder.Code).Should(Equal(200))
+				var response webs.MembersResponse
+				Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &response)).Should(Succeed())
+				Ω(response.Discovery).Should(Equal("seeds"))
+				Ω(response.Members).Should(Equal([]string{peers[0], peers[1], self}))
+				Ω(*response.Consistent).Should(BeTrue())
+				Ω(response.Changes).Should(HaveLen(1))
+				Ω(response.Changes[0].Event).Should(Equal("joined"))
+			})
+
+			Context("when a possum stops answering", func() {
+				BeforeEach(func() {
+					other.Close()
+				})
+
+				It("keeps it until it has missed too many rounds, then records it leaving", func() {
+					Ω(discoverer.Discover()).Should(Succeed())
+					passel, _ := utils.GetPassel()
+					Ω(passel).Should(ContainElement(other.URL))
+
+					mock.ExpectBegin()
+					mock.ExpectQuery("SELECT possum, state FROM state").WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).
+						AddRow(peers[0], "alive").AddRow(peers[1], "alive").AddRow(self, "alive"))
+					mock.ExpectExec("INSERT INTO state_archive").WithArgs(other.URL, "alive", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("DELETE FROM state WHERE possum=").WithArgs(other.URL).WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("INSERT INTO service_state_archive").WithArgs(sqlmock.AnyArg(), other.URL).WillReturnResult(sqlmock.NewResult(0, 0))
+					mock.ExpectExec("DELETE FROM service_state WHERE possum=").WithArgs(other.URL).WillReturnResult(sqlmock.NewResult(0, 0))
+					mock.ExpectCommit()
+					mock.ExpectExec("INSERT INTO membership_changes").WithArgs(other.URL, "left", "seeds", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+					Ω(discoverer.Discover()).Should(Succeed())
+					passel, _ = utils.GetPassel()
+					Ω(passel).Should(Equal([]string{seed.URL, self}))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+
+					mock.ExpectQuery("SELECT possum, event, source, changed_at FROM membership_changes").WillReturnError(fmt.Errorf("table is locked"))
+					req, _ := http.NewRequest("GET", "http://example.com/v1/members", nil)
+					Router(controller).ServeHTTP(mockRecorder, req)
+					var response webs.MembersResponse
+					Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &response)).Should(Succeed())
+					Ω(*response.Consistent).Should(BeFalse())
+					Ω(response.Disagreeing).Should(Equal([]string{seed.URL}))
+					Ω(response.Unreachable).Should(Equal([]string{other.URL}))
+				})
+			})
+
+			Describe("#RegisterMember", func() {
+				var newPossum *httptest.Server
+
+				register := func(body string, username string, password string, secret string) {
+					req, _ := http.NewRequest("POST", "http://example.com/v1/members", strings.NewReader(body))
+					req.SetBasicAuth(username, password)
+					if secret != "" {
+						timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+						mac := hmac.New(sha256.New, []byte(secret))
+						fmt.Fprintf(mac, "POST\n/v1/members\n%s\n\n%s", timestamp, body)
+						req.Header.Set("X-Possum-Peer-Time", timestamp)
+						req.Header.Set("X-Possum-Peer-Signature", hex.EncodeToString(mac.Sum(nil)))
+					}
+					Router(controller).ServeHTTP(mockRecorder, req)
+				}
+
+				BeforeEach(func() {
+					newPossum = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						json.NewEncoder(w).Encode(webs.MembersResponse{Discovery: "seeds", Members: seedMembers})
+					}))
+				})
+
+				AfterEach(func() {
+					newPossum.Close()
+				})
+
+				It("adds the possum and returns every possum known", func() {
+					register(fmt.Sprintf(`{"possum": "%s"}`, newPossum.URL), "admin", "admin", "peer-secret")
+					Ω(mockRecorder.Code).Should(Equal(200))
+					var response webs.MembersResponse
+					Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &response)).Should(Succeed())
+					Ω(response.Members).Should(Equal(sortedStrings([]string{peers[0], peers[1], newPossum.URL, self})))
+				})
+
+				It("rejects a possum that does not answer /v1/members", func() {
+					newPossum.Close()
+					register(fmt.Sprintf(`{"possum": "%s"}`, newPossum.URL), "admin", "admin", "peer-secret")
+					Ω(mockRecorder.Code).Should(Equal(400))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"INVALID_REQUEST"`))
+					Ω(discoverer.Discover()).Should(Succeed())
+					passel, _ := utils.GetPassel()
+					Ω(passel).ShouldNot(ContainElement(newPossum.URL))
+				})
+
+				It("rejects a registration that is not signed with the peer secret", func() {
+					register(fmt.Sprintf(`{"possum": "%s"}`, newPossum.URL), "admin", "admin", "")
+					Ω(mockRecorder.Code).Should(Equal(401))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"UNAUTHORIZED"`))
+				})
+
+				It("rejects a registration signed with another secret", func() {
+					register(fmt.Sprintf(`{"possum": "%s"}`, newPossum.URL), "admin", "admin", "guessed-secret")
+					Ω(mockRecorder.Code).Should(Equal(401))
+				})
+
+				It("rejects a possum that is not a URL", func() {
+					register(`{"possum": "possum-new.example.com"}`, "admin", "admin", "peer-secret")
+					Ω(mockRecorder.Code).Should(Equal(400))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"possum \"possum-new.example.com\" is not an http or https URL","code":"INVALID_REQUEST"}`)))
+				})
+
+				It("rejects credentials other than the peer credentials", func() {
+					register(fmt.Sprintf(`{"possum": "%s"}`, newPossum.URL), "admin", "wrong", "peer-secret")
+					Ω(mockRecorder.Code).Should(Equal(401))
+				})
+			})
+		})
+
+		Context("when discovering through DNS", func() {
+			var possums []*httptest.Server
+
+			BeforeEach(func() {
+				possums = make([]*httptest.Server, 2)
+				var records []*net.SRV
+				for i := range possums {
+					possums[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						json.NewEncoder(w).Encode(webs.MembersResponse{Discovery: "dns", Members: []string{possums[0].URL, possums[1].URL, self}})
+					}))
+					address := possums[i].Listener.Addr().(*net.TCPAddr)
+					records = append(records, &net.SRV{Target: "127.0.0.1.", Port: uint16(address.Port)})
+				}
+				config, err := webs.LoadDiscoveryConfig([]byte(`{"mode": "dns", "srv_name": "_possum._tcp.example.com", "scheme": "http"}`))
+				Ω(err).Should(BeNil())
+				config.Self = self
+				discoverer := webs.NewDiscoverer(mockDB, config)
+				discoverer.LookupSRV = func(service string, proto string, name string) (string, []*net.SRV, error) {
+					Ω(name).Should(Equal("_possum._tcp.example.com"))
+					return "", records, nil
+				}
+				controller.Discoverer = discoverer
+
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT possum, state FROM state").WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).
+					AddRow(possums[0].URL, "alive").AddRow(possums[1].URL, "dead").AddRow(self, "alive"))
+				mock.ExpectCommit()
+				Ω(discoverer.Discover()).Should(Succeed())
+			})
+
+			AfterEach(func() {
+				for _, possum := range possums {
+					possum.Close()
+				}
+			})
+
+			It("takes the passel from the SRV records", func() {
+				passel, err := utils.GetPassel()
+				Ω(err).Should(BeNil())
+				Ω(passel).Should(ConsistOf(possums[0].URL, possums[1].URL, self))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+
+			It("does not accept registrations", func() {
+				req, _ := http.NewRequest("POST", "http://example.com/v1/members", strings.NewReader(`{"possum": "https://possum-new.example.com"}`))
+				req.SetBasicAuth("admin", "admin")
+				Router(controller).ServeHTTP(mockRecorder, req)
+				Ω(mockRecorder.Code).Should(Equal(404))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Seed discovery is not configured","code":"DISCOVERY_DISABLED"}`)))
+			})
+		})
+
+		Context("when a possum that was killed rejoins", func() {
+			var rejoining *httptest.Server
+
+			BeforeEach(func() {
+				rejoining = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					json.NewEncoder(w).Encode(webs.MembersResponse{Discovery: "dns", Members: []string{rejoining.URL, self}})
+				}))
+				address := rejoining.Listener.Addr().(*net.TCPAddr)
+				config, err := webs.LoadDiscoveryConfig([]byte(`{"mode": "dns", "srv_name": "_possum._tcp.example.com", "scheme": "http"}`))
+				Ω(err).Should(BeNil())
+				config.Self = self
+				discoverer := webs.NewDiscoverer(mockDB, config)
+				discoverer.LookupSRV = func(service string, proto string, name string) (string, []*net.SRV, error) {
+					return "", []*net.SRV{{Target: "127.0.0.1.", Port: uint16(address.Port)}}, nil
+				}
+				controller.Discoverer = discoverer
+
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT possum, state FROM state").WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(self, "dead"))
+				mock.ExpectQuery("SELECT state FROM state_archive").WithArgs(rejoining.URL).WillReturnRows(sqlmock.NewRows([]string{"state"}).AddRow("dead"))
+				mock.ExpectExec(`INSERT INTO state \(possum, state\) VALUES`).WithArgs(rejoining.URL, "dead").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery("SELECT service, state FROM service_state_archive").WithArgs(rejoining.URL).WillReturnRows(sqlmock.NewRows([]string{"service", "state"}))
+				mock.ExpectRollback()
+			})
+
+			AfterEach(func() {
+				rejoining.Close()
+			})
+
+			It("keeps it dead and refuses a passel with no possum alive", func() {
+				err := controller.Discoverer.Discover()
+				Ω(err).Should(MatchError("Would have left no possum alive in the passel"))
+				passel, _ := utils.GetPassel()
+				Ω(passel).Should(Equal([]string{self}))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+		})
+
+		Context("when discovery is not configured", func() {
+			It("returns the static passel", func() {
+				req, _ := http.NewRequest("GET", "http://example.com/v1/members", nil)
+				Router(controller).ServeHTTP(mockRecorder, req)
+				Ω(mockRecorder.Code).Should(Equal(200))
+				Ω(mockRecorder.Body.String()).Should(MatchJSON(`{"discovery":"static","members":["https://possum-self.example.com"],"self":"https://possum-self.example.com"}`))
+			})
+		})
+	})
+
+	Describe("exporting and importing state", func() {
+		var (
+			controller   *webs.Controller
+			mockRecorder *httptest.ResponseRecorder
+			possums      []*httptest.Server
+			sorted       []string
+			peerState    map[string]string
+			exportedAt   time.Time
+		)
+
+		serve := func(method string, path string, username string, password string, body string) {
+			req, _ := http.NewRequest(method, "http://example.com"+path, strings.NewReader(body))
+			req.SetBasicAuth(username, password)
+			Router(controller).ServeHTTP(mockRecorder, req)
+		}
+
+		signed := func(states map[string]string, key string) string {
+			snapshot, err := utils.Snapshot{
+				FormatVersion: utils.SnapshotFormat,
+				SchemaVersion: utils.LatestSchemaVersion(),
+				ExportedAt:    exportedAt,
+				States:        states,
+				History:       []utils.StateChange{{Possum: possums[1].URL, State: "dead", ChangedAt: exportedAt, ChangedBy: "alice"}},
+			}.Sign([]byte(key))
+			Ω(err).Should(BeNil())
+			data, err := json.Marshal(snapshot)
+			Ω(err).Should(BeNil())
+			return string(data)
+		}
+
+		expectLock := func(states ...string) {
+			rows := sqlmock.NewRows([]string{"possum", "state"})
+			for i, possum := range sorted {
+				rows.AddRow(possum, states[i])
+			}
+			mock.ExpectBegin()
+			mock.ExpectQuery("SELECT possum, state FROM state WHERE possum IN").WithArgs(sorted[0], sorted[1]).WillReturnRows(rows)
+		}
+
+		expectReadBack := func(states ...string) {
+			mock.ExpectPrepare("SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WithArgs(possums[0].URL, possums[1].URL).
+				WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possums[0].URL, states[0]).AddRow(possums[1].URL, states[1]))
+		}
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			controller.StateCache = nil
+			mockRecorder = httptest.NewRecorder()
+			exportedAt = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+			possums = make([]*httptest.Server, 2)
+			for i := range possums {
+				possums[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					json.NewEncoder(w).Encode(map[string]map[string]string{"possum_states": peerState})
+				}))
+			}
+			sorted = []string{possums[0].URL, possums[1].URL}
+			sort.Strings(sorted)
+			peerState = map[string]string{possums[0].URL: "alive", possums[1].URL: "dead"}
+			os.Setenv("VCAP_APPLICATION", fmt.Sprintf(`{"application_uris": ["%s"]}`, strings.TrimPrefix(possums[0].URL, "http://")))
+			os.Setenv("VCAP_SERVICES", fmt.Sprintf(`{
+"user-provided": [
+ {
+  "credentials": {
+    "username": "admin",
+    "password": "admin-password",
+    "users": {"alice": "alice-password"},
+    "passel": ["%s", "%s"]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`, possums[0].URL, possums[1].URL))
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("SNAPSHOT_SIGNING_KEY")
+			os.Unsetenv("REQUIRE_APPROVAL")
+			for _, possum := range possums {
+				possum.Close()
+			}
+		})
+
+		Describe("#ExportState", func() {
+			It("needs credentials", func() {
+				serve("GET", "/v1/export", "", "", "")
+				Ω(mockRecorder.Code).Should(Equal(401))
+			})
+
+			It("returns a snapshot signed with the password possums share", func() {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT COALESCE").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(7))
+				mock.ExpectQuery("SELECT possum, state FROM state ORDER BY possum").
+					WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possums[0].URL, "alive").AddRow(possums[1].URL, "dead"))
+				mock.ExpectQuery("SELECT possum, service, state FROM service_state").
+					WillReturnRows(sqlmock.NewRows([]string{"possum", "service", "state"}).AddRow(possums[1].URL, "payments", "dead"))
+				mock.ExpectQuery("SELECT (.+) FROM state_history ORDER BY id").
+					WillReturnRows(sqlmock.NewRows([]string{"possum", "state", "changed_at", "changed_by", "emergency", "reason"}).AddRow(possums[1].URL, "dead", exportedAt, "alice", false, ""))
+				mock.ExpectRollback()
+				serve("GET", "/v1/export", "alice", "alice-password", "")
+
+				Ω(mockRecorder.Code).Should(Equal(200))
+				var snapshot utils.Snapshot
+				Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &snapshot)).Should(Succeed())
+				Ω(snapshot.Possum).Should(Equal(possums[0].URL))
+				Ω(snapshot.SchemaVersion).Should(Equal(7))
+				Ω(snapshot.States).Should(Equal(map[string]string{possums[0].URL: "alive", possums[1].URL: "dead"}))
+				Ω(snapshot.ServiceStates).Should(Equal(map[string]map[string]string{"payments": {possums[1].URL: "dead"}}))
+				Ω(snapshot.History).Should(HaveLen(1))
+				Ω(snapshot.Verify([]byte("admin-password"))).Should(BeTrue())
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+
+			It("signs with SNAPSHOT_SIGNING_KEY when it is set", func() {
+				os.Setenv("SNAPSHOT_SIGNING_KEY", "signing-key")
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT COALESCE").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(7))
+				mock.ExpectQuery("SELECT possum, state FROM state ORDER BY possum").WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}))
+				mock.ExpectQuery("SELECT possum, service, state FROM service_state").WillReturnRows(sqlmock.NewRows([]string{"possum", "service", "state"}))
+				mock.ExpectQuery("SELECT (.+) FROM state_history ORDER BY id").WillReturnRows(sqlmock.NewRows([]string{"possum", "state", "changed_at", "changed_by", "emergency", "reason"}))
+				mock.ExpectRollback()
+				serve("GET", "/v1/export", "alice", "alice-password", "")
+
+				Ω(mockRecorder.Code).Should(Equal(200))
+				var snapshot utils.Snapshot
+				Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &snapshot)).Should(Succeed())
+				Ω(snapshot.Verify([]byte("signing-key"))).Should(BeTrue())
+			})
+		})
+
+		Describe("#ImportState", func() {
+			It("needs credentials", func() {
+				serve("POST", "/v1/import", "", "", "{}")
+				Ω(mockRecorder.Code).Should(Equal(401))
+			})
+
+			It("rejects a snapshot with a bad signature", func() {
+				serve("POST", "/v1/import", "alice", "alice-password", fmt.Sprintf(`{"snapshot": %s}`, signed(peerState, "wrong-key")))
+				Ω(mockRecorder.Code).Should(Equal(400))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Snapshot signature is invalid","code":"SNAPSHOT_INVALID"}`)))
+			})
+
+			It("rejects a snapshot from a newer schema", func() {
+				snapshot, _ := utils.Snapshot{FormatVersion: utils.SnapshotFormat, SchemaVersion: utils.LatestSchemaVersion() + 1, States: peerState, History: []utils.StateChange{}}.Sign([]byte("admin-password"))
+				data, _ := json.Marshal(snapshot)
+				serve("POST", "/v1/import", "alice", "alice-password", fmt.Sprintf(`{"snapshot": %s}`, data))
+				Ω(mockRecorder.Code).Should(Equal(400))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"SNAPSHOT_INVALID"`))
+			})
+
+			It("rejects a snapshot with a possum that is not in the passel", func() {
+				serve("POST", "/v1/import", "alice", "alice-password", fmt.Sprintf(`{"snapshot": %s}`, signed(map[string]string{"http://possum.example.com": "alive"}, "admin-password")))
+				Ω(mockRecorder.Code).Should(Equal(400))
+				Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Possum http://possum.example.com in the snapshot is not part of my passel","code":"POSSUM_NOT_IN_PASSEL"}`)))
+			})
+
+			Context("when the snapshot does not match the other possums", func() {
+				BeforeEach(func() {
+					peerState = map[string]string{possums[0].URL: "alive", possums[1].URL: "alive"}
+				})
+
+				It("does not import it", func() {
+					serve("POST", "/v1/import", "alice", "alice-password", fmt.Sprintf(`{"snapshot": %s}`, signed(map[string]string{possums[0].URL: "alive", possums[1].URL: "dead"}, "admin-password")))
+					Ω(mockRecorder.Code).Should(Equal(409))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"error":"The snapshot does not match the passel state of the other possums","code":"STATE_INCONSISTENT"`))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+
+				It("imports it when forced", func() {
+					expectLock("alive", "alive")
+					mock.ExpectQuery("SELECT COUNT").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+					mock.ExpectExec("INSERT INTO state_history").WithArgs(possums[1].URL, "dead", exportedAt, "alice", false, "").WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("UPDATE state").WithArgs("dead", sqlmock.AnyArg(), "alice", possums[1].URL).WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("INSERT INTO state_history").WithArgs(possums[1].URL, "dead", sqlmock.AnyArg(), "alice", false, "").WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectCommit()
+					expectReadBack("alive", "dead")
+					serve("POST", "/v1/import", "alice", "alice-password", fmt.Sprintf(`{"snapshot": %s, "force": true}`, signed(map[string]string{possums[0].URL: "alive", possums[1].URL: "dead"}, "admin-password")))
+					Ω(mockRecorder.Code).Should(Equal(202))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+
+			Context("when the snapshot matches the other possums", func() {
+				It("imports the states and history in one transaction", func() {
+					expectLock("alive", "alive")
+					mock.ExpectQuery("SELECT COUNT").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+					mock.ExpectExec("INSERT INTO state_history").WithArgs(possums[1].URL, "dead", exportedAt, "alice", false, "").WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("UPDATE state").WithArgs("dead", sqlmock.AnyArg(), "alice", possums[1].URL).WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectExec("INSERT INTO state_history").WithArgs(possums[1].URL, "dead", sqlmock.AnyArg(), "alice", false, "").WillReturnResult(sqlmock.NewResult(1, 1))
+					mock.ExpectCommit()
+					expectReadBack("alive", "dead")
+					serve("POST", "/v1/import", "alice", "alice-password", fmt.Sprintf(`{"snapshot": %s}`, signed(peerState, "admin-password")))
+
+					Ω(mockRecorder.Code).Should(Equal(202))
+					Ω(mockRecorder.Body.String()).Should(MatchJSON(fmt.Sprintf(`{
+						"possum": "%[1]s",
+						"changed": ["%[2]s"],
+						"history_imported": 1,
+						"possum_states": {"%[1]s": "alive", "%[2]s": "dead"},
+						"passel": ["%[2]s"],
+						"passel_states": [{"%[1]s": "alive", "%[2]s": "dead"}]
+					}`, possums[0].URL, possums[1].URL)))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+
+				It("shows what would change in a dry run without importing anything", func() {
+					expectReadBack("alive", "alive")
+					serve("POST", "/v1/import", "alice", "alice-password", fmt.Sprintf(`{"snapshot": %s, "dry_run": true}`, signed(peerState, "admin-password")))
+
+					Ω(mockRecorder.Code).Should(Equal(200))
+					var response webs.ImportResponse
+					Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &response)).Should(Succeed())
+					Ω(response.DryRun).Should(BeTrue())
+					Ω(response.Changed).Should(Equal([]string{possums[1].URL}))
+					Ω(response.PossumStates).Should(Equal(peerState))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+
+				It("does not import a snapshot that would kill every possum", func() {
+					peerState = map[string]string{possums[0].URL: "dead", possums[1].URL: "dead"}
+					expectLock("alive", "alive")
+					mock.ExpectRollback()
+					serve("POST", "/v1/import", "alice", "alice-password", fmt.Sprintf(`{"snapshot": %s}`, signed(peerState, "admin-password")))
+					Ω(mockRecorder.Code).Should(Equal(409))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"WOULD_KILL_ALL"`))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+
+			Context("when approval is required", func() {
+				It("rejects imports made by users", func() {
+					os.Setenv("REQUIRE_APPROVAL", "true")
+					serve("POST", "/v1/import", "alice", "alice-password", fmt.Sprintf(`{"snapshot": %s}`, signed(peerState, "admin-password")))
+					Ω(mockRecorder.Code).Should(Equal(403))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"APPROVAL_REQUIRED"`))
+				})
+			})
+		})
+	})
+
+	Describe("reading the passel state with its metadata", func() {
+		var (
+			controller   *webs.Controller
+			mockRecorder *httptest.ResponseRecorder
+		)
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			mockRecorder = httptest.NewRecorder()
+			os.Setenv("VCAP_APPLICATION", "{}")
+			os.Setenv("VCAP_SERVICES", `{
+"user-provided": [
+ {
+  "credentials": {
+    "passel": ["mother", "joey"]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`)
+		})
+
+		JustBeforeEach(func() {
+			req, _ := http.NewRequest("GET", "http://example.com/v1/passel_state?metadata=true", nil)
+			Router(controller).ServeHTTP(mockRecorder, req)
+		})
+
+		Context("when the states can be read", func() {
+			BeforeEach(func() {
+				updatedAt := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+				mock.ExpectPrepare(`^SELECT possum, state, version, updated_at, updated_by FROM state WHERE possum IN \(\?, \?\)$`).ExpectQuery().WithArgs("mother", "joey").
+					WillReturnRows(sqlmock.NewRows([]string{"possum", "state", "version", "updated_at", "updated_by"}).
+						AddRow("joey", "dead", 3, updatedAt, "alice").
+						AddRow("mother", "alive", 0, nil, ""))
+			})
+
+			It("returns the version and last update of each state", func() {
+				Ω(mockRecorder.Code).Should(Equal(200))
+				Ω(mockRecorder.Body.String()).Should(MatchJSON(`{
+					"possum_states": {"joey": "dead", "mother": "alive"},
+					"metadata": {
+						"joey": {"state": "dead", "version": 3, "updated_at": "2019-05-01T12:00:00Z", "updated_by": "alice"},
+						"mother": {"state": "alive", "version": 0}
+					}
+				}`))
+				Ω(mock.ExpectationsWereMet()).Should(Succeed())
+			})
+		})
+
+		Context("when the states cannot be read", func() {
+			BeforeEach(func() {
+				mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().WillReturnError(fmt.Errorf("connection refused"))
+			})
+
+			It("returns an error rather than cached states", func() {
+				Ω(mockRecorder.Code).Should(Equal(500))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"DATABASE_ERROR"`))
+			})
+		})
+	})
+
+	Describe("checking passel membership", func() {
+		var (
+			controller   *webs.Controller
+			mockRecorder *httptest.ResponseRecorder
+			possums      []*httptest.Server
+			members      [][]string
+			selves       []string
+			passel       []string
+		)
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			mockRecorder = httptest.NewRecorder()
+			possums = make([]*httptest.Server, 2)
+			members = make([][]string, 2)
+			selves = make([]string, 2)
+			for i := range possums {
+				i := i
+				possums[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == "/v1/members" {
+						if members[i] == nil {
+							w.WriteHeader(http.StatusNotFound)
+							return
+						}
+						json.NewEncoder(w).Encode(webs.MembersResponse{Discovery: "static", Members: members[i], Self: selves[i]})
+						return
+					}
+					w.Write([]byte(`{"possum_states": {"joey": "alive"}}`))
+				}))
+			}
+			passel = []string{possums[0].URL, possums[1].URL}
+			members[0], members[1] = passel, passel
+			selves[0], selves[1] = possums[0].URL, possums[1].URL
+			os.Setenv("VCAP_APPLICATION", fmt.Sprintf(`{"application_uris": ["%s"]}`, strings.TrimPrefix(possums[0].URL, "http://")))
+			os.Setenv("VCAP_SERVICES", fmt.Sprintf(`{
+"user-provided": [
+ {
+  "credentials": {
+    "passel": ["%s", "%s"]
+  },
+  "label": "user-provided",
+  "name": "possum",
+  "syslog_drain_url": "",
+  "tags": []
+ }
+]
+}`, possums[0].URL, possums[1].URL))
+		})
+
+		AfterEach(func() {
+			for _, possum := range possums {
+				possum.Close()
+			}
+		})
+
+		check := func() webs.MembershipConsistency {
+			req, _ := http.NewRequest("GET", "http://example.com/v1/passel_state_consistency", nil)
+			Router(controller).ServeHTTP(mockRecorder, req)
+			Ω(mockRecorder.Code).Should(Equal(200))
+			var response webs.PasselStatesResponse
+			Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &response)).Should(Succeed())
+			Ω(response.Membership).ShouldNot(BeNil())
+			return *response.Membership
+		}
+
+		Context("when every possum has the same passel and finds itself in it", func() {
+			BeforeEach(func() {
+				mock.ExpectPrepare(`^SELECT possum, state FROM state WHERE possum NOT IN \(\?, \?\)$`).ExpectQuery().WithArgs(possums[0].URL, possums[1].URL).
+					WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}))
+			})
+
+			It("reports the membership as consistent", func() {
+				membership := check()
+				Ω(membership.Consistent).Should(BeTrue())
+				Ω(membership.SelfInPassel).Should(BeTrue())
+				Ω(membership.Members).Should(Equal(sortedStrings(passel)))
+				Ω(membership.PasselMembers).Should(Equal(map[string][]string{possums[0].URL: sortedStrings(passel), possums[1].URL: sortedStrings(passel)}))
+				Ω(membership.Disagreeing).Should(BeEmpty())
+				Ω(membership.Stranded).Should(BeEmpty())
+				Ω(membership.Orphaned).Should(BeEmpty())
+			})
+		})
+
+		Context("when a possum has a different passel and can not find itself in it", func() {
+			BeforeEach(func() {
+				members[1] = []string{possums[0].URL, "https://possum.example3.domain.com"}
+				selves[1] = ""
+				mock.ExpectPrepare("NOT IN").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}))
+			})
+
+			It("reports it as disagreeing and stranded", func() {
+				membership := check()
+				Ω(membership.Consistent).Should(BeFalse())
+				Ω(membership.Disagreeing).Should(Equal([]string{possums[1].URL}))
+				Ω(membership.Stranded).Should(Equal([]string{possums[1].URL}))
+				Ω(membership.PasselMembers[possums[1].URL]).Should(Equal(sortedStrings(members[1])))
+			})
+		})
+
+		Context("when this possum can not find itself in its passel", func() {
+			BeforeEach(func() {
+				os.Setenv("VCAP_APPLICATION", `{"application_uris": ["possum.example9.domain.com"]}`)
+				mock.ExpectPrepare("NOT IN").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}))
+			})
+
+			It("reports that it is not in its passel", func() {
+				membership := check()
+				Ω(membership.Consistent).Should(BeFalse())
+				Ω(membership.SelfInPassel).Should(BeFalse())
+			})
+		})
+
+		Context("when the state table has rows of possums that are not in the passel", func() {
+			BeforeEach(func() {
+				mock.ExpectPrepare("NOT IN").ExpectQuery().
+					WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow("https://possum.example3.domain.com", "dead"))
+			})
+
+			It("flags them as orphaned", func() {
+				membership := check()
+				Ω(membership.Consistent).Should(BeFalse())
+				Ω(membership.Orphaned).Should(Equal(map[string]string{"https://possum.example3.domain.com": "dead"}))
+			})
+		})
+
+		Context("when a possum does not answer with its members", func() {
+			BeforeEach(func() {
+				members[1] = nil
+				mock.ExpectPrepare("NOT IN").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}))
+			})
+
+			It("reports it as unreachable without failing the check", func() {
+				membership := check()
+				Ω(membership.Consistent).Should(BeFalse())
+				Ω(membership.Unreachable).Should(Equal([]string{possums[1].URL}))
+				Ω(membership.PasselMembers).ShouldNot(HaveKey(possums[1].URL))
+			})
+		})
+	})
+
+	Describe("matching this possum in its passel", func() {
+		var (
+			controller   *webs.Controller
+			mockRecorder *httptest.ResponseRecorder
+			passel       string
+		)
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			mockRecorder = httptest.NewRecorder()
+			passel = `["HTTPS://Possum.Example1.Domain.com.:443/", "https://possum.example2.domain.com:8443", "https://possum.example3.domain.com/east/"]`
+		})
+
+		JustBeforeEach(func() {
+			os.Setenv("VCAP_SERVICES", `{"user-provided": [{"credentials": {"passel": `+passel+`}, "label": "user-provided", "name": "possum"}]}`)
+			req, _ := http.NewRequest("GET", "http://example.com/v1/state", nil)
+			Router(controller).ServeHTTP(mockRecorder, req)
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("POSSUM_SELF")
+			os.Unsetenv("GLOBAL_DOMAIN")
+		})
+
+		expectState := func(possum string) {
+			mock.ExpectPrepare("^SELECT (.+) FROM state WHERE possum IN").ExpectQuery().
+				WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possum, "alive"))
+		}
+
+		Context("when the route and the passel entry differ in case, trailing dot, slash and default port", func() {
+			BeforeEach(func() {
+				os.Setenv("VCAP_APPLICATION", `{"application_uris": ["possum.example1.domain.com"]}`)
+				expectState("HTTPS://Possum.Example1.Domain.com.:443/")
+			})
+
+			It("matches the passel entry", func() {
+				Ω(mockRecorder.Code).Should(Equal(200))
+				Ω(mockRecorder.Body.String()).Should(Equal(`{"state":"alive"}`))
+			})
+		})
+
+		Context("when the passel entry has a port that is not the default", func() {
+			Context("and the route has the same port", func() {
+				BeforeEach(func() {
+					os.Setenv("VCAP_APPLICATION", `{"application_uris": ["possum.example2.domain.com:8443"]}`)
+					expectState("https://possum.example2.domain.com:8443")
+				})
+
+				It("matches the passel entry", func() {
+					Ω(mockRecorder.Code).Should(Equal(200))
+				})
+			})
+
+			Context("and the route has no port", func() {
+				BeforeEach(func() {
+					os.Setenv("VCAP_APPLICATION", `{"application_uris": ["possum.example2.domain.com"]}`)
+				})
+
+				It("does not match", func() {
+					Ω(mockRecorder.Code).Should(Equal(410))
+					Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"POSSUM_NOT_MATCHED"`))
+				})
+			})
+		})
+
+		Context("when the route has a path", func() {
+			Context("and the path is the path of the passel entry", func() {
+				BeforeEach(func() {
+					os.Setenv("VCAP_APPLICATION", `{"application_uris": ["possum.example3.domain.com/east"]}`)
+					expectState("https://possum.example3.domain.com/east/")
+				})
+
+				It("matches the passel entry", func() {
+					Ω(mockRecorder.Code).Should(Equal(200))
+				})
+			})
+
+			Context("and the path is another path on the host", func() {
+				BeforeEach(func() {
+					os.Setenv("VCAP_APPLICATION", `{"application_uris": ["possum.example3.domain.com/west"]}`)
+				})
+
+				It("does not match", func() {
+					Ω(mockRecorder.Code).Should(Equal(410))
+				})
+			})
+		})
+
+		Context("when the routes match more than one possum", func() {
+			BeforeEach(func() {
+				os.Setenv("VCAP_APPLICATION", `{"application_uris": ["possum.example1.domain.com", "possum.example2.domain.com:8443"]}`)
+			})
+
+			It("returns an error asking for POSSUM_SELF", func() {
+				Ω(mockRecorder.Code).Should(Equal(410))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring("set POSSUM_SELF"))
+			})
+
+			Context("and POSSUM_SELF is set", func() {
+				BeforeEach(func() {
+					os.Setenv("POSSUM_SELF", "https://possum.example2.domain.com:8443/")
+					expectState("https://possum.example2.domain.com:8443")
+				})
+
+				It("uses the passel entry of POSSUM_SELF", func() {
+					Ω(mockRecorder.Code).Should(Equal(200))
+				})
+			})
+		})
+
+		Context("when POSSUM_SELF is not in the passel", func() {
+			BeforeEach(func() {
+				os.Setenv("VCAP_APPLICATION", `{"application_uris": ["possum.example1.domain.com"]}`)
+				os.Setenv("POSSUM_SELF", "https://possum.example9.domain.com")
+			})
+
+			It("returns an error", func() {
+				Ω(mockRecorder.Code).Should(Equal(410))
+				Ω(mockRecorder.Body.String()).Should(ContainSubstring("POSSUM_SELF https://possum.example9.domain.com is not in the passel"))
+			})
+		})
+
+		Context("when a route is on GLOBAL_DOMAIN", func() {
+			BeforeEach(func() {
+				passel = `["https://possum.global.domain.com", "https://possum.example1.domain.com"]`
+				os.Setenv("VCAP_APPLICATION", `{"application_uris": ["possum.global.domain.com", "possum.example1.domain.com"]}`)
+				os.Setenv("GLOBAL_DOMAIN", "Global.Domain.com.")
+				expectState("https://possum.example1.domain.com")
+			})
+
+			It("is not used to match this possum", func() {
+				Ω(mockRecorder.Code).Should(Equal(200))
+			})
+		})
+	})
+
+	Describe("per-service states", func() {
+		var (
+			controller   *webs.Controller
+			mockRecorder *httptest.ResponseRecorder
+		)
+
+		passelServices := func(passel ...string) string {
+			return fmt.Sprintf(`{"user-provided": [{"credentials": {"username": "admin", "password": "admin", "passel": ["%s"]}, "label": "user-provided", "name": "possum"}]}`, strings.Join(passel, `", "`))
+		}
+
+		serve := func(method string, path string, body string) {
+			req, _ := http.NewRequest(method, "http://example.com"+path, strings.NewReader(body))
+			req.SetBasicAuth("admin", "admin")
+			Router(controller).ServeHTTP(mockRecorder, req)
+		}
+
+		BeforeEach(func() {
+			controller = webs.CreateController(db)
+			mockRecorder = httptest.NewRecorder()
+			os.Setenv("POSSUM_SERVICES", "payments, search")
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("POSSUM_SERVICES")
+			os.Unsetenv("REQUIRE_APPROVAL")
+		})
+
+		Context("on this possum", func() {
+			var (
+				possum1 = "https://possum.example1.domain.com"
+				possum2 = "https://possum.example2.domain.com"
+			)
+
+			BeforeEach(func() {
+				os.Setenv("VCAP_APPLICATION", `{"application_uris": ["possum.example1.domain.com"]}`)
+				os.Setenv("VCAP_SERVICES", passelServices(possum1, possum2))
+			})
+
+			Describe("#GetServiceState", func() {
+				Context("when the service is not configured", func() {
+					It("returns an error 404", func() {
+						serve("GET", "/v1/services/ledger/state", "")
+						Ω(mockRecorder.Code).Should(Equal(404))
+						Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Service ledger is not configured","code":"SERVICE_NOT_FOUND"}`)))
+					})
+				})
+
+				Context("when the service has never been changed", func() {
+					It("follows the state of the possum", func() {
+						mock.ExpectPrepare("^SELECT possum, state FROM state WHERE possum IN").ExpectQuery().
+							WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possum1, "alive"))
+						mock.ExpectPrepare("^SELECT state FROM service_state WHERE possum=(.+) AND service=").ExpectQuery().
+							WithArgs(possum1, "payments").WillReturnRows(sqlmock.NewRows([]string{"state"}))
+						serve("GET", "/v1/services/payments/state", "")
+						Ω(mockRecorder.Code).Should(Equal(200))
+						Ω(mockRecorder.Body.String()).Should(Equal(`{"service":"payments","state":"alive","service_state":"alive","possum_state":"alive"}`))
+					})
+				})
+
+				Context("when the service is dead", func() {
+					It("returns dead while the possum is alive", func() {
+						mock.ExpectPrepare("^SELECT possum, state FROM state WHERE possum IN").ExpectQuery().
+							WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possum1, "alive"))
+						mock.ExpectPrepare("^SELECT state FROM service_state").ExpectQuery().
+							WillReturnRows(sqlmock.NewRows([]string{"state"}).AddRow("dead"))
+						serve("GET", "/v1/services/payments/state", "")
+						Ω(mockRecorder.Code).Should(Equal(200))
+						Ω(mockRecorder.Body.String()).Should(Equal(`{"service":"payments","state":"dead","service_state":"dead","possum_state":"alive"}`))
+					})
+				})
+
+				Context("when the possum is dead", func() {
+					It("returns dead for every service", func() {
+						mock.ExpectPrepare("^SELECT possum, state FROM state WHERE possum IN").ExpectQuery().
+							WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possum1, "dead"))
+						mock.ExpectPrepare("^SELECT state FROM service_state").ExpectQuery().
+							WillReturnRows(sqlmock.NewRows([]string{"state"}).AddRow("alive"))
+						serve("GET", "/v1/services/search/state", "")
+						Ω(mockRecorder.Code).Should(Equal(200))
+						Ω(mockRecorder.Body.String()).Should(Equal(`{"service":"search","state":"dead","service_state":"alive","possum_state":"dead"}`))
+					})
+				})
+
+				Context("when the database becomes unavailable after a successful read", func() {
+					It("serves the service state from the cache, marked as stale", func() {
+						mock.ExpectPrepare("^SELECT possum, state FROM state WHERE possum IN").ExpectQuery().
+							WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possum1, "alive"))
+						mock.ExpectPrepare("^SELECT state FROM service_state").ExpectQuery().
+							WillReturnRows(sqlmock.NewRows([]string{"state"}).AddRow("dead"))
+						serve("GET", "/v1/services/payments/state", "")
+						Ω(mockRecorder.Code).Should(Equal(200))
+
+						mock.ExpectQuery("^SELECT possum, state FROM state WHERE possum IN").WillReturnError(errConnectionRefused)
+						mock.ExpectQuery("^SELECT state FROM service_state").WillReturnError(errConnectionRefused)
+						mockRecorder = httptest.NewRecorder()
+						serve("GET", "/v1/services/payments/state", "")
+						Ω(mockRecorder.Code).Should(Equal(200))
+						Ω(mockRecorder.Body.String()).Should(Equal(`{"service":"payments","state":"dead","service_state":"dead","possum_state":"alive","stale":true}`))
+						Ω(mockRecorder.Header().Get("Warning")).Should(ContainSubstring("Response is Stale"))
+						Ω(mock.ExpectationsWereMet()).Should(Succeed())
+					})
+				})
+			})
+
+			Describe("#GetPasselServiceState", func() {
+				It("returns the state of the service of every possum", func() {
+					mock.ExpectPrepare(`^SELECT possum, state FROM service_state WHERE service=\? AND possum IN \(\?, \?\)$`).ExpectQuery().
+						WithArgs("payments", possum1, possum2).
+						WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possum2, "dead"))
+					serve("GET", "/v1/services/payments/passel_state", "")
+					Ω(mockRecorder.Code).Should(Equal(200))
+					Ω(mockRecorder.Body.String()).Should(Equal(fmt.Sprintf(`{"possum_states":{"%s":"alive","%s":"dead"},"service":"payments"}`, possum1, possum2)))
+				})
+			})
+
+			Describe("#SetServiceState", func() {
+				lockedStates := func(state1 string, state2 string) {
+					mock.ExpectBegin()
+					mock.ExpectQuery("^SELECT possum, state FROM state WHERE possum IN (.+) FOR UPDATE$").
+						WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possum1, state1).AddRow(possum2, state2))
+				}
+
+				Context("when the service is not configured", func() {
+					It("returns an error 404 without writing anything", func() {
+						serve("POST", "/v1/services/ledger/state", fmt.Sprintf(`{"%s":"dead"}`, possum2))
+						Ω(mockRecorder.Code).Should(Equal(404))
+						Ω(mock.ExpectationsWereMet()).Should(Succeed())
+					})
+				})
+
+				Context("when the service stays alive on another possum", func() {
+					BeforeEach(func() {
+						lockedStates("alive", "alive")
+						mock.ExpectQuery(`^SELECT possum, state FROM service_state WHERE service=\? AND possum IN \(\?, \?\) FOR UPDATE$`).
+							WithArgs("payments", possum1, possum2).WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}))
+						mock.ExpectExec("^INSERT INTO service_state (.+) ON DUPLICATE KEY UPDATE").
+							WithArgs(possum2, "payments", "dead", sqlmock.AnyArg(), "admin").WillReturnResult(sqlmock.NewResult(1, 1))
+						mock.ExpectExec("^INSERT INTO service_state_history").
+							WithArgs(possum2, "payments", "dead", sqlmock.AnyArg(), "admin", false, "").WillReturnResult(sqlmock.NewResult(1, 1))
+						mock.ExpectCommit()
+						mock.ExpectPrepare("^SELECT possum, state FROM service_state WHERE service=").ExpectQuery().
+							WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possum2, "dead"))
+					})
+
+					It("writes the state of the service only", func() {
+						serve("POST", "/v1/services/payments/state", fmt.Sprintf(`{"%s":"dead"}`, possum2))
+						Ω(mockRecorder.Code).Should(Equal(202))
+						Ω(mockRecorder.Body.String()).Should(Equal(fmt.Sprintf(`{"possum_states":{"%s":"alive","%s":"dead"},"service":"payments"}`, possum1, possum2)))
+						Ω(mock.ExpectationsWereMet()).Should(Succeed())
+					})
+				})
+
+				Context("when the service is already dead on every other possum", func() {
+					BeforeEach(func() {
+						lockedStates("alive", "alive")
+						mock.ExpectQuery("^SELECT possum, state FROM service_state").
+							WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possum1, "dead"))
+						mock.ExpectRollback()
+					})
+
+					It("refuses to kill the service everywhere", func() {
+						serve("POST", "/v1/services/payments/state", fmt.Sprintf(`{"%s":"dead"}`, possum2))
+						Ω(mockRecorder.Code).Should(Equal(409))
+						Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Would have killed payments on every possum","code":"WOULD_KILL_ALL"}`)))
+						Ω(mock.ExpectationsWereMet()).Should(Succeed())
+					})
+				})
+
+				Context("when every other possum is dead", func() {
+					BeforeEach(func() {
+						lockedStates("dead", "alive")
+						mock.ExpectQuery("^SELECT possum, state FROM service_state").
+							WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}))
+						mock.ExpectRollback()
+					})
+
+					It("refuses to kill the only running copy of the service", func() {
+						serve("POST", "/v1/services/payments/state", fmt.Sprintf(`{"%s":"dead"}`, possum2))
+						Ω(mockRecorder.Code).Should(Equal(409))
+						Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"code":"WOULD_KILL_ALL"`))
+						Ω(mock.ExpectationsWereMet()).Should(Succeed())
+					})
+				})
+			})
+
+			Describe("#SetState", func() {
+				Context("when killing a possum would leave a service alive on no possum", func() {
+					It("refuses to kill the possum", func() {
+						mock.ExpectBegin()
+						mock.ExpectQuery("^SELECT possum, state FROM state WHERE possum IN (.+) FOR UPDATE$").
+							WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possum1, "alive").AddRow(possum2, "alive"))
+						// read through the write's transaction, not on a second connection
+						mock.ExpectQuery(`^SELECT possum, state FROM service_state WHERE service=\? AND possum IN (.+) FOR UPDATE$`).
+							WithArgs("payments", possum1, possum2).WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possum1, "dead"))
+						mock.ExpectRollback()
+						serve("POST", "/v1/state", fmt.Sprintf(`{"%s":"dead"}`, possum2))
+						Ω(mockRecorder.Code).Should(Equal(409))
+						Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Would have killed payments on every possum","code":"WOULD_KILL_ALL"}`)))
+						Ω(mock.ExpectationsWereMet()).Should(Succeed())
+					})
+				})
+			})
+		})
+
+		Describe("across the passel", func() {
+			var (
+				possums  []*httptest.Server
+				states   []map[string]string
+				requests []string
+			)
+
+			servicePossum := func(serviceStates map[string]string) *httptest.Server {
+				return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					requests = append(requests, r.Method+" "+r.URL.Path)
+					switch {
+					case r.Method == "GET" && r.URL.Path == "/v1/passel_state":
+						possumStates := make(map[string]string)
+						for _, possum := range possums {
+							possumStates[possum.URL] = "alive"
+						}
+						json.NewEncoder(w).Encode(webs.PossumStates{PossumStates: possumStates})
+						return
+					case r.Method == "GET" && r.URL.Path == "/v1/services/payments/passel_state":
+					case r.Method == "POST" && r.URL.Path == "/v1/services/payments/state":
+						var desired map[string]string
+						json.NewDecoder(r.Body).Decode(&desired)
+						for possum, state := range desired {
+							serviceStates[possum] = state
+						}
+					default:
+						http.NotFound(w, r)
+						return
+					}
+					json.NewEncoder(w).Encode(webs.PossumStates{PossumStates: serviceStates, Service: "payments"})
+				}))
+			}
+
+			BeforeEach(func() {
+				requests = nil
+				possums = make([]*httptest.Server, 3)
+				states = make([]map[string]string, 3)
+				for i := range possums {
+					states[i] = make(map[string]string)
+					possums[i] = servicePossum(states[i])
+				}
+				for i := range states {
+					for _, possum := range possums {
+						states[i][possum.URL] = "alive"
+					}
+				}
+				os.Setenv("VCAP_APPLICATION", "{}")
+				os.Setenv("VCAP_SERVICES", passelServices(possums[0].URL, possums[1].URL, possums[2].URL))
+			})
+
+			AfterEach(func() {
+				for _, possum := range possums {
+					possum.Close()
+				}
+			})
+
+			localStates := func(states ...string) {
+				rows := sqlmock.NewRows([]string{"possum", "state"})
+				for i, state := range states {
+					rows.AddRow(possums[i].URL, state)
+				}
+				mock.ExpectPrepare("^SELECT possum, state FROM state WHERE possum IN").ExpectQuery().WillReturnRows(rows)
+			}
+
+			Describe("#SetPasselState", func() {
+				It("refuses to kill the only possum a service is alive on", func() {
+					mock.ExpectPrepare("^SELECT possum, state FROM service_state WHERE service=").ExpectQuery().
+						WithArgs("payments", possums[0].URL, possums[1].URL, possums[2].URL).
+						WillReturnRows(sqlmock.NewRows([]string{"possum", "state"}).AddRow(possums[1].URL, "dead").AddRow(possums[2].URL, "dead"))
+					serve("POST", "/v1/passel_state", fmt.Sprintf(`{"possum_states": {"%s": "dead"}}`, possums[0].URL))
+					Ω(mockRecorder.Code).Should(Equal(409))
+					Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Would have killed payments on every possum","code":"WOULD_KILL_ALL"}`)))
+					Ω(requests).ShouldNot(ContainElement("POST /v1/state"))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+
+			Describe("#SetPasselServiceState", func() {
+				Context("when the service stays alive somewhere", func() {
+					BeforeEach(func() {
+						localStates("alive", "alive", "alive")
+					})
+
+					It("writes the service state to every possum", func() {
+						serve("POST", "/v1/services/payments/passel_state", fmt.Sprintf(`{"possum_states": {"%s": "dead"}}`, possums[0].URL))
+						Ω(mockRecorder.Code).Should(Equal(202))
+						var response webs.PasselStatesResponse
+						Ω(json.Unmarshal(mockRecorder.Body.Bytes(), &response)).Should(Succeed())
+						Ω(response.Service).Should(Equal("payments"))
+						for i := range states {
+							Ω(states[i][possums[0].URL]).Should(Equal("dead"))
+						}
+						Ω(requests).Should(ContainElement("POST /v1/services/payments/state"))
+						Ω(requests).ShouldNot(ContainElement("POST /v1/state"))
+					})
+				})
+
+				Context("when the only possums with the service alive are dead", func() {
+					BeforeEach(func() {
+						for i := range states {
+							states[i][possums[1].URL] = "dead"
+							states[i][possums[2].URL] = "dead"
+						}
+						localStates("alive", "alive", "alive")
+					})
+
+					It("refuses to kill the service everywhere", func() {
+						serve("POST", "/v1/services/payments/passel_state", fmt.Sprintf(`{"possum_states": {"%s": "dead"}}`, possums[0].URL))
+						Ω(mockRecorder.Code).Should(Equal(409))
+						Ω(mockRecorder.Body.String()).Should(Equal(withRequestID(mockRecorder, `{"error":"Would have killed payments on every possum","code":"WOULD_KILL_ALL"}`)))
+						Ω(requests).ShouldNot(ContainElement("POST /v1/services/payments/state"))
+					})
+				})
+
+				Context("when the possums the service is alive on are dead", func() {
+					BeforeEach(func() {
+						localStates("alive", "dead", "dead")
+					})
+
+					It("refuses to kill the service on the only possum that is alive", func() {
+						serve("POST", "/v1/services/payments/passel_state", fmt.Sprintf(`{"possum_states": {"%s": "dead"}}`, possums[0].URL))
+						Ω(mockRecorder.Code).Should(Equal(409))
+						Ω(requests).ShouldNot(ContainElement("POST /v1/services/payments/state"))
+					})
+				})
+
+				Context("when approval is required", func() {
+					BeforeEach(func() {
+						os.Setenv("REQUIRE_APPROVAL", "true")
+						mock.ExpectExec("REPLACE INTO proposals").
+							WithArgs(sqlmock.AnyArg(), fmt.Sprintf(`{"%s":"dead"}`, possums[0].URL), false, false, "", "admin", sqlmock.AnyArg(), sqlmock.AnyArg(), "pending", "", nil, "", "payments").
+							WillReturnResult(sqlmock.NewResult(1, 1))
+					})
+
+					It("proposes the change to the service", func() {
+						serve("POST", "/v1/services/payments/passel_state", fmt.Sprintf(`{"possum_states": {"%s": "dead"}}`, possums[0].URL))
+						Ω(mockRecorder.Code).Should(Equal(202))
+						Ω(mockRecorder.Body.String()).Should(ContainSubstring(`"service":"payments"`))
+						Ω(mock.ExpectationsWereMet()).Should(Succeed())
+					})
+				})
+			})
+
+			Describe("#CatchUpMissedWrites", func() {
+				BeforeEach(func() {
+					for i := range states[:2] {
+						states[i][possums[0].URL] = "dead"
+					}
+					mock.ExpectQuery("SELECT (.+) FROM missed_writes").
+						WillReturnRows(sqlmock.NewRows([]string{"possum", "service", "passel_state", "missed_at", "changed_by"}).
+							AddRow(possums[2].URL, "payments", `{}`, time.Now(), "admin"))
+					mock.ExpectExec("DELETE FROM missed_writes WHERE possum=(.+) AND service=").WithArgs(possums[2].URL, "payments").WillReturnResult(sqlmock.NewResult(1, 1))
+				})
+
+				It("catches up the state of the service", func() {
+					Ω(controller.CatchUpMissedWrites()).Should(Succeed())
+					Ω(states[2][possums[0].URL]).Should(Equal("dead"))
+					Ω(mock.ExpectationsWereMet()).Should(Succeed())
+				})
+			})
+		})
+	})
 })